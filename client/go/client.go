@@ -8,6 +8,7 @@ package basenine
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -28,6 +29,13 @@ type Metadata struct {
 	NoMoreData         bool   `json:"noMoreData"`
 }
 
+// Acknowledgement is the reply of an inserted record in acknowledged insert mode.
+type Acknowledgement struct {
+	Id       string `json:"id,omitempty"`
+	Filtered bool   `json:"filtered,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
 // Commands refers to TCP connection modes.
 const (
 	CMD_INSERT           string = "/insert"
@@ -41,6 +49,21 @@ const (
 	CMD_METADATA         string = "/metadata"
 	CMD_FLUSH            string = "/flush"
 	CMD_RESET            string = "/reset"
+	CMD_RETENTION        string = "/retention"
+	CMD_INSERT_ACK       string = "/insert-ack"
+	CMD_INSERT_BATCH     string = "/insert-batch"
+	CMD_INDEX            string = "/index"
+	CMD_SNAPSHOT         string = "/snapshot"
+	CMD_EXPORT           string = "/export"
+)
+
+// The maximum number of records in a batch that the server accepts.
+const MAX_BATCH_SIZE int = 100000
+
+// Flags that can follow a command, separated by a space.
+const (
+	FLAG_ARCHIVED string = "archived"
+	FLAG_GZIP     string = "gzip"
 )
 
 // Closing indicators
@@ -52,9 +75,18 @@ const (
 // Software name
 const SoftwareName = "Basenine"
 
+// The default duration that an acknowledgement is waited for.
+const DEFAULT_ACK_TIMEOUT time.Duration = 3 * time.Second
+
 // Connection is the struct that holds the TCP connection reference.
+// reader buffers the acknowledgements in acknowledged and batched insert modes.
+//
+// AckTimeout is the duration that an acknowledgement is waited for. Zero means DEFAULT_ACK_TIMEOUT,
+// while a negative value doesn't set a read deadline, such that the deadline that's set on the connection applies.
 type Connection struct {
 	net.Conn
+	AckTimeout time.Duration
+	reader     *bufio.Reader
 }
 
 // NewConnection establishes a new connection with the server in the address host:port.
@@ -63,7 +95,7 @@ func NewConnection(host string, port string) (connection *Connection, err error)
 	dest := host + ":" + port
 	var conn net.Conn
 	conn, err = net.Dial("tcp", dest)
-	connection = &Connection{conn}
+	connection = &Connection{Conn: conn}
 	return
 }
 
@@ -89,6 +121,198 @@ func (c *Connection) InsertMode() (err error) {
 	return
 }
 
+// InsertAckMode turns the connection's mode into acknowledged INSERT mode.
+// Records must be inserted through InsertAck in this mode.
+func (c *Connection) InsertAckMode() (err error) {
+	err = c.SendText(CMD_INSERT_ACK)
+	return
+}
+
+// InsertAck inserts a single record in acknowledged INSERT mode and waits for its acknowledgement.
+// Returns the ID that's assigned to the record. filtered is true if the record is filtered out
+// by the insertion filter. A record that cannot be inserted is returned as an error.
+// The acknowledgement is waited for up to AckTimeout.
+func (c *Connection) InsertAck(data []byte) (id string, filtered bool, err error) {
+	// The message is built into a new slice such that the caller's backing array is not written.
+	msg := make([]byte, 0, len(data)+1)
+	msg = append(msg, data...)
+	err = c.Send(append(msg, '\n'))
+	if err != nil {
+		return
+	}
+
+	var ack Acknowledgement
+	ack, err = c.readAck()
+	if err != nil {
+		return
+	}
+
+	if ack.Error != "" {
+		err = errors.New(ack.Error)
+		return
+	}
+
+	id = ack.Id
+	filtered = ack.Filtered
+	return
+}
+
+// readAck reads the next acknowledgement from the server.
+func (c *Connection) readAck() (ack Acknowledgement, err error) {
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c)
+	}
+
+	timeout := c.AckTimeout
+	if timeout == 0 {
+		timeout = DEFAULT_ACK_TIMEOUT
+	}
+	if timeout > 0 {
+		err = c.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil {
+			return
+		}
+	}
+
+	var line string
+	line, err = c.reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	line = strings.TrimSuffix(line, "\n")
+
+	if line == CloseConnection {
+		err = errors.New("Server is leaving.")
+		return
+	}
+
+	// The server replies with a plain text error if it cannot read the records at all.
+	err = json.Unmarshal([]byte(line), &ack)
+	if err != nil {
+		err = errors.New(line)
+	}
+	return
+}
+
+// InsertBatchMode turns the connection's mode into batched INSERT mode.
+// Records must be inserted through a BatchWriter in this mode.
+func (c *Connection) InsertBatchMode() (err error) {
+	err = c.SendText(CMD_INSERT_BATCH)
+	return
+}
+
+// BatchWriter buffers the records and sends them to the server in batches
+// through a connection in batched INSERT mode. It's safe for concurrent use.
+// acks are the acknowledgements of the records in the last batch.
+type BatchWriter struct {
+	sync.Mutex
+	c       *Connection
+	size    int
+	records [][]byte
+	acks    []Acknowledgement
+}
+
+// NewBatchWriter elevates the connection into batched INSERT mode and returns
+// a BatchWriter that sends a batch once size number of records are buffered.
+func NewBatchWriter(c *Connection, size int) (w *BatchWriter, err error) {
+	if size <= 0 || size > MAX_BATCH_SIZE {
+		err = fmt.Errorf("Invalid batch size: %d (must be between 1 and %d)", size, MAX_BATCH_SIZE)
+		return
+	}
+
+	err = c.InsertBatchMode()
+	if err != nil {
+		return
+	}
+
+	w = &BatchWriter{
+		c:    c,
+		size: size,
+	}
+	return
+}
+
+// Write buffers a single record. The buffered records are sent if the batch is full
+// and their acknowledgements are waited for.
+// The record is copied, so the caller can reuse data once Write returns.
+func (w *BatchWriter) Write(data []byte) (err error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.records = append(w.records, append([]byte(nil), data...))
+	if len(w.records) >= w.size {
+		err = w.flush()
+	}
+	return
+}
+
+// Flush sends the buffered records to the server, even if the batch is not full.
+// The records that cannot be sent are kept in the buffer to be sent by the next Write or Flush.
+func (w *BatchWriter) Flush() (err error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.flush()
+}
+
+// Acks returns the acknowledgements of the records in the last batch that's sent, in the same order as they're written.
+// They contain the IDs that are assigned to the records.
+func (w *BatchWriter) Acks() (acks []Acknowledgement) {
+	w.Lock()
+	defer w.Unlock()
+	return w.acks
+}
+
+// Close flushes the buffered records and closes the connection.
+func (w *BatchWriter) Close() (err error) {
+	err = w.Flush()
+	w.c.Close()
+	return
+}
+
+// flush sends the buffered records in batches of up to size records. The records of a batch are
+// removed from the buffer only once the batch is sent, such that a failed send can be retried.
+func (w *BatchWriter) flush() (err error) {
+	for len(w.records) > 0 {
+		n := len(w.records)
+		if n > w.size {
+			n = w.size
+		}
+
+		// The batch header, which is the number of records, is followed by the records line by line.
+		buf := []byte(fmt.Sprintf("%d\n", n))
+		for _, record := range w.records[:n] {
+			buf = append(buf, record...)
+			buf = append(buf, '\n')
+		}
+
+		err = w.c.Send(buf)
+		if err != nil {
+			return
+		}
+		w.records = w.records[n:]
+
+		// The server acknowledges each record of the batch in order once the batch is inserted.
+		// The first record that cannot be inserted is returned as an error.
+		acks := make([]Acknowledgement, n)
+		for i := range acks {
+			acks[i], err = w.c.readAck()
+			if err != nil {
+				return
+			}
+		}
+		w.acks = acks
+
+		for _, ack := range acks {
+			if ack.Error != "" {
+				err = errors.New(ack.Error)
+				return
+			}
+		}
+	}
+	w.records = nil
+	return
+}
+
 // Query is the method that user should use to stream the records from the database.
 // It takes the filtering language (query) as the first parameter and
 // a []byte channel which the records will be streamed into as the second parameter.
@@ -122,6 +346,16 @@ func (c *Connection) Query(leftOff string, query string, data chan []byte, meta
 // Single returns a single record from the database server specified by the host:port pair
 // and by given ID.
 func Single(host string, port string, id string, query string) (data []byte, err error) {
+	return single(host, port, id, query, CMD_SINGLE)
+}
+
+// SingleArchived is same as Single but it also looks up the records that are archived
+// by the database server in archive mode.
+func SingleArchived(host string, port string, id string, query string) (data []byte, err error) {
+	return single(host, port, id, query, fmt.Sprintf("%s %s", CMD_SINGLE, FLAG_ARCHIVED))
+}
+
+func single(host string, port string, id string, query string, command string) (data []byte, err error) {
 	query = escapeLineFeed(query)
 
 	var c *Connection
@@ -136,7 +370,7 @@ func Single(host string, port string, id string, query string) (data []byte, err
 	go readConnection(&wg, c, ret, nil, false, nil)
 	wg.Add(1)
 
-	err = c.SendText(CMD_SINGLE)
+	err = c.SendText(command)
 	if err != nil {
 		c.Close()
 		return
@@ -162,6 +396,16 @@ func Single(host string, port string, id string, query string) (data []byte, err
 // Fetch returns limit number of records by querying on either positive(future) or negative(past) direction
 // that starts from leftOff.
 func Fetch(host string, port string, leftOff string, direction int, query string, limit int, timeout time.Duration) (data [][]byte, firstMeta []byte, lastMeta []byte, err error) {
+	return fetch(host, port, leftOff, direction, query, limit, timeout, CMD_FETCH)
+}
+
+// FetchArchived is same as Fetch but it also fetches the records that are archived
+// by the database server in archive mode.
+func FetchArchived(host string, port string, leftOff string, direction int, query string, limit int, timeout time.Duration) (data [][]byte, firstMeta []byte, lastMeta []byte, err error) {
+	return fetch(host, port, leftOff, direction, query, limit, timeout, fmt.Sprintf("%s %s", CMD_FETCH, FLAG_ARCHIVED))
+}
+
+func fetch(host string, port string, leftOff string, direction int, query string, limit int, timeout time.Duration, command string) (data [][]byte, firstMeta []byte, lastMeta []byte, err error) {
 	query = escapeLineFeed(query)
 
 	var c *Connection
@@ -178,7 +422,7 @@ func Fetch(host string, port string, leftOff string, direction int, query string
 	go readConnection(&wg, c, dataChan, metaChan, true, closeChan)
 	wg.Add(1)
 
-	err = c.SendText(CMD_FETCH)
+	err = c.SendText(command)
 	if err != nil {
 		c.Close()
 		return
@@ -393,6 +637,159 @@ func Limit(host string, port string, limit int64) (err error) {
 	return
 }
 
+// Retention sets the duration that the records are kept in the database like 24 * time.Hour.
+// Such that the records are kept for a duration that ranges between the retention (soft-limit)
+// and one and a half times the retention (hard-limit). 0 disables the time-based retention.
+func Retention(host string, port string, retention time.Duration) (err error) {
+	var c *Connection
+	c, err = NewConnection(host, port)
+	if err != nil {
+		return
+	}
+
+	ret := make(chan []byte)
+
+	var wg sync.WaitGroup
+	go readConnection(&wg, c, ret, nil, false, nil)
+	wg.Add(1)
+
+	err = c.SendText(CMD_RETENTION)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	err = c.SendText(retention.String())
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	data := <-ret
+	text := string(data)
+	if text != "OK" {
+		err = errors.New(text)
+	}
+	c.Close()
+	return
+}
+
+// Index declares a secondary index on the given field path like `request.path`
+// to speed up the queries that compare that field against a literal.
+func Index(host string, port string, path string) (err error) {
+	var c *Connection
+	c, err = NewConnection(host, port)
+	if err != nil {
+		return
+	}
+
+	ret := make(chan []byte)
+
+	var wg sync.WaitGroup
+	go readConnection(&wg, c, ret, nil, false, nil)
+	wg.Add(1)
+
+	err = c.SendText(CMD_INDEX)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	err = c.SendText(path)
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	data := <-ret
+	text := string(data)
+	if text != "OK" {
+		err = errors.New(text)
+	}
+	c.Close()
+	return
+}
+
+// Snapshot writes a consistent snapshot of the database into a tar archive at the given path.
+// The path is on the server's filesystem, relative to its export directory.
+func Snapshot(host string, port string, path string) (err error) {
+	var c *Connection
+	c, err = NewConnection(host, port)
+	if err != nil {
+		return
+	}
+
+	ret := make(chan []byte)
+
+	var wg sync.WaitGroup
+	go readConnection(&wg, c, ret, nil, false, nil)
+	wg.Add(1)
+
+	err = c.SendText(fmt.Sprintf("%s %s", CMD_SNAPSHOT, path))
+	if err != nil {
+		c.Close()
+		return
+	}
+
+	data := <-ret
+	text := string(data)
+	if text != "OK" {
+		err = errors.New(text)
+	}
+	c.Close()
+	return
+}
+
+// Export writes the records in the ID range [from, to] that pass the query into an NDJSON file
+// at the given path, which is gzip-compressed if compress is true. The path is on the server's filesystem,
+// relative to its export directory.
+// An empty ID leaves that end of the range open. The progress is sent into meta if it's not nil.
+func Export(host string, port string, path string, compress bool, from string, to string, query string, meta chan []byte) (err error) {
+	query = escapeLineFeed(query)
+
+	var c *Connection
+	c, err = NewConnection(host, port)
+	if err != nil {
+		return
+	}
+
+	ret := make(chan []byte)
+	metaChan := make(chan []byte)
+
+	var wg sync.WaitGroup
+	go readConnection(&wg, c, ret, metaChan, false, nil)
+	wg.Add(1)
+
+	command := fmt.Sprintf("%s %s", CMD_EXPORT, path)
+	if compress {
+		command = fmt.Sprintf("%s %s %s", CMD_EXPORT, FLAG_GZIP, path)
+	}
+
+	for _, text := range []string{command, from, to, query} {
+		err = c.SendText(text)
+		if err != nil {
+			c.Close()
+			return
+		}
+	}
+
+	for {
+		select {
+		case b := <-metaChan:
+			if meta != nil {
+				meta <- b
+			}
+		case data := <-ret:
+			text := string(data)
+			if text != "OK" {
+				err = errors.New(text)
+			}
+			c.Close()
+			return
+		}
+	}
+}
+
 // Flush removes all the records in the database.
 func Flush(host string, port string) (err error) {
 	var c *Connection
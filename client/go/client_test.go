@@ -1,8 +1,12 @@
 package basenine
 
 import (
+	"bufio"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"sync"
 	"testing"
@@ -38,6 +42,21 @@ func TestLimit(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestRetention(t *testing.T) {
+	err := Retention(HOST, PORT, 24*time.Hour)
+	assert.Nil(t, err)
+}
+
+func TestIndex(t *testing.T) {
+	err := Index(HOST, PORT, "brand.name")
+	assert.Nil(t, err)
+}
+
+func TestSnapshot(t *testing.T) {
+	err := Snapshot(HOST, PORT, fmt.Sprintf("%s/basenine_snapshot.tar", os.TempDir()))
+	assert.Nil(t, err)
+}
+
 func TestMacro(t *testing.T) {
 	err := Macro(HOST, PORT, "chevy", `brand.name == "Chevrolet"`)
 	assert.Nil(t, err)
@@ -71,6 +90,32 @@ func TestSingle(t *testing.T) {
 	assert.JSONEq(t, expected, string(data))
 }
 
+func TestExport(t *testing.T) {
+	path := fmt.Sprintf("%s/basenine_export.ndjson.gz", os.TempDir())
+	defer os.Remove(path)
+
+	from := fmt.Sprintf("%024d", 100)
+	to := fmt.Sprintf("%024d", 199)
+	err := Export(HOST, PORT, path, true, from, to, `brand.name == "Chevrolet"`, nil)
+	assert.Nil(t, err)
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+
+	var records []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		records = append(records, scanner.Text())
+	}
+	assert.Len(t, records, 100)
+
+	expected := fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":"%s"}`, from, REDACTED)
+	assert.JSONEq(t, expected, records[0])
+}
+
 func TestValidate(t *testing.T) {
 	err := Validate(HOST, PORT, `brand.name == "Chevrolet"`)
 	assert.Nil(t, err)
@@ -166,6 +211,183 @@ func TestFetch(t *testing.T) {
 	}
 }
 
+func TestBatchWriter(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	c, err := NewConnection(HOST, PORT)
+	assert.Nil(t, err)
+
+	w, err := NewBatchWriter(c, 100)
+	assert.Nil(t, err)
+	for index := 0; index < 1050; index++ {
+		err = w.Write([]byte(payload))
+		assert.Nil(t, err)
+	}
+
+	err = w.Close()
+	assert.Nil(t, err)
+	assert.Len(t, w.Acks(), 50)
+}
+
+func TestBatchWriterReusedBuffer(t *testing.T) {
+	server, client := net.Pipe()
+	c := &Connection{Conn: client}
+
+	received := make(chan []string)
+	go func() {
+		var lines []string
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+
+			// Acknowledge the records once the batch is received.
+			if len(lines) == 5 {
+				for index := 0; index < 3; index++ {
+					server.Write([]byte(fmt.Sprintf("{\"id\":\"%024d\"}\n", index)))
+				}
+			}
+		}
+		received <- lines
+	}()
+
+	w, err := NewBatchWriter(c, 3)
+	assert.Nil(t, err)
+
+	// A capture agent reads every record into the same buffer.
+	buf := make([]byte, 64)
+	for index := 0; index < 3; index++ {
+		n := copy(buf, fmt.Sprintf(`{"index":%d}`, index))
+		err = w.Write(buf[:n])
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, []Acknowledgement{{Id: fmt.Sprintf("%024d", 0)}, {Id: fmt.Sprintf("%024d", 1)}, {Id: fmt.Sprintf("%024d", 2)}}, w.Acks())
+
+	err = w.Close()
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{CMD_INSERT_BATCH, "3", `{"index":0}`, `{"index":1}`, `{"index":2}`}, <-received)
+}
+
+// failingConn fails the given number of writes before writing into the underlying connection.
+type failingConn struct {
+	net.Conn
+	failures int
+}
+
+func (c *failingConn) Write(b []byte) (n int, err error) {
+	if c.failures > 0 {
+		c.failures--
+		err = errors.New("write failed")
+		return
+	}
+	return c.Conn.Write(b)
+}
+
+func TestBatchWriterFailedSend(t *testing.T) {
+	server, client := net.Pipe()
+	conn := &failingConn{Conn: client}
+	c := &Connection{Conn: conn}
+
+	received := make(chan []string)
+	go func() {
+		var lines []string
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+
+			// Acknowledge the records once the batch is received.
+			if len(lines) == 4 {
+				for index := 0; index < 2; index++ {
+					server.Write([]byte(fmt.Sprintf("{\"id\":\"%024d\"}\n", index)))
+				}
+			}
+		}
+		received <- lines
+	}()
+
+	w, err := NewBatchWriter(c, 2)
+	assert.Nil(t, err)
+
+	err = w.Write([]byte(`{"index":0}`))
+	assert.Nil(t, err)
+
+	// The records are kept in the buffer if the batch cannot be sent.
+	conn.failures = 1
+	err = w.Write([]byte(`{"index":1}`))
+	assert.NotNil(t, err)
+
+	err = w.Flush()
+	assert.Nil(t, err)
+	assert.Len(t, w.Acks(), 2)
+
+	err = w.Close()
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{CMD_INSERT_BATCH, "2", `{"index":0}`, `{"index":1}`}, <-received)
+}
+
+func TestInsertAck(t *testing.T) {
+	c, err := NewConnection(HOST, PORT)
+	assert.Nil(t, err)
+
+	err = c.InsertAckMode()
+	assert.Nil(t, err)
+
+	id, filtered, err := c.InsertAck([]byte(`{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`))
+	assert.Nil(t, err)
+	assert.False(t, filtered)
+	assert.Len(t, id, 24)
+
+	id, filtered, err = c.InsertAck([]byte(`{"brand":{"name":"Ford"},"model":"Mustang","year":2021}`))
+	assert.Nil(t, err)
+	assert.True(t, filtered)
+	assert.Empty(t, id)
+
+	_, _, err = c.InsertAck([]byte(`{"brand":`))
+	assert.NotNil(t, err)
+
+	c.Close()
+}
+
+func TestInsertAckSharedBuffer(t *testing.T) {
+	server, client := net.Pipe()
+	c := &Connection{Conn: client}
+
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			server.Write([]byte(fmt.Sprintf("{\"id\":\"%024d\"}\n", 0)))
+		}
+	}()
+
+	// The record is a slice of a larger buffer that holds the next record right after it.
+	buf := []byte(`{"index":0}{"index":1}`)
+	_, _, err := c.InsertAck(buf[:11])
+	assert.Nil(t, err)
+	assert.Equal(t, `{"index":0}{"index":1}`, string(buf))
+
+	c.Close()
+}
+
+func TestInsertAckTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	c := &Connection{Conn: client, AckTimeout: 50 * time.Millisecond}
+
+	// The server reads the record but never acknowledges it.
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+		}
+	}()
+
+	_, _, err := c.InsertAck([]byte(`{"index":0}`))
+	assert.True(t, os.IsTimeout(err))
+
+	c.Close()
+	server.Close()
+}
+
 func TestFlush(t *testing.T) {
 	err := Flush(HOST, PORT)
 	assert.Nil(t, err)
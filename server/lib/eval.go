@@ -536,6 +536,27 @@ func redact(args ...interface{}) (interface{}, interface{}) {
 	return obj, true
 }
 
+// search looks for all of the words in the term within the value, like `response.body.search("error")`.
+// If the optional second argument is true, the number of occurrences of the words is set
+// into the SEARCH_SCORE_FIELD field of the record for ranking.
+func search(args ...interface{}) (interface{}, interface{}) {
+	if len(args) < 3 {
+		return args[0], false
+	}
+
+	score := searchScore(SearchTokens(args[1]), Tokenize(stringOperand(args[2])))
+	if score == 0 {
+		return args[0], false
+	}
+
+	if len(args) > 3 && boolOperand(args[3]) {
+		if obj, ok := args[0].(map[string]interface{}); ok {
+			obj[SEARCH_SCORE_FIELD] = score
+		}
+	}
+	return args[0], true
+}
+
 func timeHelper(args ...interface{}) (interface{}, interface{}) {
 	timestamp := args[2].(time.Time).UnixNano() / int64(time.Millisecond)
 	return args[0], timestamp
@@ -551,6 +572,7 @@ var helpers = map[string]interface{}{
 	"json":       _json,
 	"xml":        xml,
 	"redact":     redact,
+	"search":     search,
 	"now":        timeHelper,
 	"seconds":    timeHelper,
 	"minutes":    timeHelper,
@@ -621,6 +643,14 @@ func evalPrimary(pri *Primary, obj interface{}) (v interface{}, newObj interface
 				// evaluated to false.
 				collapse = true
 				return
+			} else if *pri.Helper == "search" && len(*pri.JsonPath) == 0 {
+				// A search without a path like `search("x")` refers to the whole record.
+				v = obj
+			} else if *pri.Helper == "search" {
+				// A search on a missing path doesn't match, just like the full-text index
+				// that doesn't post the records without the path.
+				v = false
+				return
 			} else {
 				v = false
 			}
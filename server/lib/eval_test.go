@@ -128,6 +128,15 @@ var data = []struct {
 	{`redact("..surname") and id == 114906`, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`, false, 0, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`},
 	{`redact("model", "..name") and id == 114906`, `{"id":114905,"model":["Aamaro", "Bamaro", "Camaro"],"brand":{"name":"Chevrolet"},"year":2021}`, false, 0, fmt.Sprintf(`{"id":114905,"model":"%s","brand":{"name":"%s"},"year":2021}`, REDACTED, REDACTED)},
 	{`redact("model", "..name") and id == 114906`, `{"id":114905,"model":"Camaro","brand":{"name":["Ahevrolet", "Bhevrolet", "Chevrolet"]},"year":2021}`, false, 0, fmt.Sprintf(`{"id":114905,"model":"%s","brand":{"name":"%s"},"year":2021}`, REDACTED, REDACTED)},
+	{`brand.name.search("chevrolet")`, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`, true, 0, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`},
+	{`brand.search("chevrolet ford")`, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`, false, 0, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`},
+	{`search("camaro 2021")`, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`, true, 0, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`},
+	{`response.body.search("false")`, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`, false, 0, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`},
+	{`body.search("not found", true)`, `{"id":114905,"body":"{\"error\":\"Not Found\",\"detail\":\"not found\"}"}`, true, 0, `{"id":114905,"body":"{\"error\":\"Not Found\",\"detail\":\"not found\"}","_score":4}`},
+	{`startsWith("{")`, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`, false, 0, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`},
+	{`contains("Camaro")`, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`, false, 0, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`},
+	{`!contains("Camaro")`, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`, true, 0, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`},
+	{`json().model == "Camaro"`, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`, false, 0, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`},
 	{`redact("id", "brand.name") and id == 114905`, `{"id":114905,"model":"Camaro","brand":{"name":"Chevrolet"},"year":2021}`, false, 0, fmt.Sprintf(`{"id":"%s","model":"Camaro","brand":{"name":"%s"},"year":2021}`, REDACTED, REDACTED)},
 	{`request.path.* == "v1"`, `{"request":{"path":["api","v1","example"]}}`, true, 0, `{"request":{"path":["api","v1","example"]}}`},
 	{`request.path.* == "v2"`, `{"request":{"path":["api","v1","example"]}}`, false, 0, `{"request":{"path":["api","v1","example"]}}`},
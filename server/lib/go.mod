@@ -6,9 +6,11 @@ require (
 	github.com/alecthomas/participle/v2 v2.0.0-alpha7
 	github.com/clbanning/mxj/v2 v2.5.5
 	github.com/dlclark/regexp2 v1.4.0
-	github.com/fsnotify/fsnotify v1.5.1
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.15.9
 	github.com/ohler55/ojg v1.14.0
 	github.com/stretchr/testify v1.7.0
+	go.etcd.io/bbolt v1.3.6
 )
 
 require (
@@ -5,6 +5,7 @@
 package basenine
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
@@ -30,6 +31,28 @@ func SendClose(conn net.Conn) {
 	SendMsg(conn, CloseConnection)
 }
 
+// SendAck sends the acknowledgement of an inserted record based on the return values of InsertData.
+func SendAck(conn net.Conn, insertedId interface{}, insertErr error) (err error) {
+	var ack Acknowledgement
+	switch {
+	case insertErr != nil:
+		ack.Error = insertErr.Error()
+	case insertedId == nil:
+		ack.Filtered = true
+	default:
+		ack.Id = fmt.Sprintf("%v", insertedId)
+	}
+
+	var b []byte
+	b, err = json.Marshal(ack)
+	if err != nil {
+		return
+	}
+
+	_, err = conn.Write(append(b, '\n'))
+	return
+}
+
 func SendMsg(conn net.Conn, msg string) {
 	conn.Write([]byte(fmt.Sprintf("%s\n", msg)))
 }
@@ -26,6 +26,23 @@ func TestSendX(t *testing.T) {
 	client.Close()
 }
 
+func TestSendAck(t *testing.T) {
+	server, client := net.Pipe()
+
+	go func() {
+		SendAck(server, IndexToID(42), nil)
+		SendAck(server, nil, nil)
+		SendAck(server, nil, errors.New("example"))
+		server.Close()
+	}()
+
+	b, err := io.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"id\":\"000000000000000000000042\"}\n{\"filtered\":true}\n{\"error\":\"example\"}\n", string(b))
+
+	client.Close()
+}
+
 func TestServerConnCheck(t *testing.T) {
 	server, client := net.Pipe()
 	assert.Nil(t, ConnCheck(client))
@@ -0,0 +1,102 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package basenine
+
+import (
+	"sync"
+	"time"
+)
+
+// Notifier is an in-process broadcaster that wakes up every subscribed
+// stream whenever new records are written.
+//
+// Notifications are coalesced. A subscriber that is busy while several
+// writes happen receives a single wake-up, therefore it must re-read
+// the storage state after each wake-up instead of counting them.
+type Notifier struct {
+	sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+}
+
+// Subscription is a handle returned by Notifier.Subscribe.
+//
+// C receives a value whenever new records are written.
+type Subscription struct {
+	C        chan struct{}
+	notifier *Notifier
+}
+
+// NewNotifier creates a Notifier without any subscriptions.
+func NewNotifier() *Notifier {
+	return &Notifier{
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe registers a new subscription that's notified on every write.
+func (notifier *Notifier) Subscribe() (sub *Subscription) {
+	sub = &Subscription{
+		// Buffer of one is enough since the notifications are coalesced.
+		C:        make(chan struct{}, 1),
+		notifier: notifier,
+	}
+
+	notifier.Lock()
+	notifier.subscriptions[sub] = struct{}{}
+	notifier.Unlock()
+	return
+}
+
+// Unsubscribe removes the subscription from the notifier.
+func (notifier *Notifier) Unsubscribe(sub *Subscription) {
+	notifier.Lock()
+	delete(notifier.subscriptions, sub)
+	notifier.Unlock()
+}
+
+// Publish wakes up all of the subscriptions. It never blocks,
+// a subscriber that already has a pending notification is skipped.
+func (notifier *Notifier) Publish() {
+	notifier.RLock()
+	for sub := range notifier.subscriptions {
+		select {
+		case sub.C <- struct{}{}:
+		default:
+		}
+	}
+	notifier.RUnlock()
+}
+
+// Len returns the number of active subscriptions.
+func (notifier *Notifier) Len() int {
+	notifier.RLock()
+	defer notifier.RUnlock()
+	return len(notifier.subscriptions)
+}
+
+// Wait blocks until a notification arrives or the timeout expires.
+// Returns true if it's woken up by a notification. A zero timeout
+// blocks until a notification arrives.
+func (sub *Subscription) Wait(timeout time.Duration) bool {
+	if timeout == 0 {
+		<-sub.C
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-sub.C:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Close unsubscribes from the notifier.
+func (sub *Subscription) Close() {
+	sub.notifier.Unsubscribe(sub)
+}
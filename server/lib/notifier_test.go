@@ -0,0 +1,41 @@
+package basenine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifierPublishWakesAllSubscriptions(t *testing.T) {
+	notifier := NewNotifier()
+
+	var subs []*Subscription
+	for i := 0; i < 100; i++ {
+		subs = append(subs, notifier.Subscribe())
+	}
+	assert.Equal(t, 100, notifier.Len())
+
+	notifier.Publish()
+
+	for _, sub := range subs {
+		assert.True(t, sub.Wait(100*time.Millisecond))
+		sub.Close()
+	}
+	assert.Equal(t, 0, notifier.Len())
+}
+
+func TestNotifierCoalescing(t *testing.T) {
+	notifier := NewNotifier()
+
+	sub := notifier.Subscribe()
+	defer sub.Close()
+
+	// Publish never blocks even if the subscriber is not reading.
+	for i := 0; i < 1000; i++ {
+		notifier.Publish()
+	}
+
+	assert.True(t, sub.Wait(50*time.Millisecond))
+	assert.False(t, sub.Wait(50*time.Millisecond))
+}
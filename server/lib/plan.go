@@ -0,0 +1,452 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package basenine
+
+import (
+	"errors"
+	"strings"
+
+	jp "github.com/ohler55/ojg/jp"
+)
+
+var ErrInvalidIndexPath = errors.New("Index path must refer to a field like request.path")
+
+// Predicate is a comparison between a field and a literal like `dst.name == "catalogue"`
+// or `timestamp >= hours(-1)` that can be answered through a secondary index or a zone map.
+//
+// Path is the path of the field as it's written in the query.
+//
+// Op is one of `==`, `!=`, `>`, `>=`, `<` and `<=`. The field is always on the left side.
+// It's `search` for the calls of the `search` helper like `response.body.search("error")`.
+//
+// Value is the literal in the form that IndexKey returns. It's the term for the `search` helper.
+//
+// Number is the numeric value of the literal for the `>`, `>=`, `<` and `<=` comparisons.
+// The time helpers like `now()` are converted into milliseconds like the `timestamp` field.
+type Predicate struct {
+	Path   string
+	Op     string
+	Value  string
+	Number float64
+}
+
+// The operators that flips the order of the operands in a comparison.
+// Such that `42 < response.status` is planned as `response.status > 42`.
+var flippedComparisonOperators = map[string]string{
+	">":  "<",
+	">=": "<=",
+	"<":  ">",
+	"<=": ">=",
+}
+
+// Plan is the tree of the predicates in a query that are joined with the logical operators.
+// A leaf has a Predicate, while an inner node has an Op (`and`, `or`) along with Left and Right.
+type Plan struct {
+	Predicate *Predicate
+	Op        string
+	Left      *Plan
+	Right     *Plan
+}
+
+// The helpers that change the record while it's evaluated. Such that the comparisons
+// that follow them don't see the stored values, like `redact("a") and a == "[REDACTED]"`.
+var recordChangingHelpers = []string{
+	"redact",
+}
+
+// BuildPlan extracts the plan of the predicates from the AST. nil means there is no part
+// of the query that can be answered through an index. The plan only narrows down
+// the records, they are still evaluated through Eval(). The queries that call a helper
+// which changes the record are not planned, since the indexes only know the stored values.
+func BuildPlan(expr *Expression) (plan *Plan) {
+	if expr == nil || expr.Logical == nil || changesRecord(expr) {
+		return
+	}
+	return planLogical(expr.Logical)
+}
+
+// changesRecord reports whether the expression calls a helper that changes the record,
+// including a `search` call that sets the score of the record.
+func changesRecord(expr *Expression) bool {
+	if expr == nil {
+		return false
+	}
+	for logic := expr.Logical; logic != nil; logic = logic.Next {
+		for equ := logic.Equality; equ != nil; equ = equ.Next {
+			for comp := equ.Comparison; comp != nil; comp = comp.Next {
+				unar := comp.Unary
+				for unar != nil && unar.Primary == nil {
+					unar = unar.Unary
+				}
+				if unar != nil && primaryChangesRecord(unar.Primary) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// primaryChangesRecord reports whether the Primary or an expression in it calls a helper that changes the record.
+func primaryChangesRecord(pri *Primary) bool {
+	call := pri.CallExpression
+	if pri.Helper != nil {
+		if strContains(recordChangingHelpers, *pri.Helper) {
+			return true
+		}
+		if *pri.Helper == "search" && call != nil && len(call.Parameters) > 1 {
+			return true
+		}
+	}
+
+	if changesRecord(pri.SubExpression) {
+		return true
+	}
+	if call == nil {
+		return false
+	}
+	for _, param := range call.Parameters {
+		if changesRecord(param.Expression) {
+			return true
+		}
+	}
+	return call.SelectExpression != nil && changesRecord(call.SelectExpression.Expression)
+}
+
+// planLogical builds the plan of a logical expression. A part that cannot be planned
+// is dropped from an `and`, while it makes the whole `or` unplannable.
+func planLogical(logic *Logical) (plan *Plan) {
+	left := planEquality(logic.Equality)
+	if logic.Next == nil {
+		return left
+	}
+
+	right := planLogical(logic.Next)
+	switch logic.Op {
+	case "and":
+		if left == nil {
+			return right
+		}
+		if right == nil {
+			return left
+		}
+	case "or":
+		if left == nil || right == nil {
+			return
+		}
+	default:
+		return
+	}
+
+	plan = &Plan{
+		Op:    logic.Op,
+		Left:  left,
+		Right: right,
+	}
+	return
+}
+
+// planEquality builds the plan of an equality expression. Only the comparisons between
+// a field and a literal, in either order, and the parenthesized sub-expressions are planned.
+func planEquality(equ *Equality) (plan *Plan) {
+	if equ.Next == nil {
+		if equ.Comparison != nil && equ.Comparison.Next != nil {
+			return planComparison(equ.Comparison)
+		}
+
+		// `(dst.name == "a" or dst.name == "b")` goes here
+		pri := plainPrimary(equ.Comparison)
+		if pri != nil && pri.SubExpression != nil {
+			plan = BuildPlan(pri.SubExpression)
+		} else if pri != nil && pri.Helper != nil && *pri.Helper == "search" {
+			plan = planSearch(pri)
+		}
+		return
+	}
+
+	// Chained equalities like `a == b == c` are not planned.
+	if equ.Next.Next != nil {
+		return
+	}
+
+	x := plainPrimary(equ.Comparison)
+	y := plainPrimary(equ.Next.Comparison)
+	if x == nil || y == nil {
+		return
+	}
+
+	path, ok := fieldPath(x)
+	value, isLiteral := literalValue(y)
+	if !ok {
+		// `"catalogue" == dst.name` goes here
+		path, ok = fieldPath(y)
+		value, isLiteral = literalValue(x)
+	}
+	if !ok || !isLiteral {
+		return
+	}
+
+	plan = &Plan{
+		Predicate: &Predicate{
+			Path:  path,
+			Op:    equ.Op,
+			Value: value,
+		},
+	}
+	return
+}
+
+// planComparison builds the plan of a comparison expression. Only the comparisons between
+// a field and a number or a time helper like `hours(-1)`, in either order, are planned.
+func planComparison(comp *Comparison) (plan *Plan) {
+	// Chained comparisons like `a < b < c` are not planned.
+	if comp.Next.Next != nil {
+		return
+	}
+
+	x := unaryPrimary(comp.Unary)
+	y := unaryPrimary(comp.Next.Unary)
+	if x == nil || y == nil {
+		return
+	}
+
+	op := comp.Op
+	path, ok := fieldPath(x)
+	number, isNumber := numericValue(y)
+	if !ok {
+		// `42 < response.status` goes here
+		op = flippedComparisonOperators[op]
+		path, ok = fieldPath(y)
+		number, isNumber = numericValue(x)
+	}
+	if !ok || !isNumber || op == "" {
+		return
+	}
+
+	plan = &Plan{
+		Predicate: &Predicate{
+			Path:   path,
+			Op:     op,
+			Value:  IndexKey(number),
+			Number: number,
+		},
+	}
+	return
+}
+
+// planSearch builds the plan of a `search` helper call on a field with a string literal term.
+func planSearch(pri *Primary) (plan *Plan) {
+	call := pri.CallExpression
+	if pri.JsonPath == nil || len(*pri.JsonPath) == 0 || call == nil || call.SelectExpression != nil || len(call.Parameters) < 1 {
+		return
+	}
+
+	expr := call.Parameters[0].Expression
+	if expr == nil || expr.Logical == nil || expr.Logical.Next != nil || expr.Logical.Equality.Next != nil {
+		return
+	}
+	term := plainPrimary(expr.Logical.Equality.Comparison)
+	if term == nil || term.String == nil {
+		return
+	}
+
+	plan = &Plan{
+		Predicate: &Predicate{
+			Path:  pri.JsonPath.String(),
+			Op:    "search",
+			Value: strings.Trim(*term.String, "\""),
+		},
+	}
+	return
+}
+
+// plainPrimary returns the Primary of a comparison that has no operators.
+func plainPrimary(comp *Comparison) *Primary {
+	if comp == nil || comp.Next != nil {
+		return nil
+	}
+	return unaryPrimary(comp.Unary)
+}
+
+// unaryPrimary returns the Primary of a unary expression that has no operators.
+func unaryPrimary(unar *Unary) *Primary {
+	if unar == nil || unar.Unary != nil {
+		return nil
+	}
+	return unar.Primary
+}
+
+// fieldPath returns the path of a Primary that only refers to a field like `request.path`
+// or `request.headers["x"]`. The path is in the form of its JSONPath.
+func fieldPath(pri *Primary) (path string, ok bool) {
+	call := pri.CallExpression
+	if call == nil || call.Identifier == nil || call.Parameters != nil || pri.Helper != nil || pri.JsonPath == nil {
+		return
+	}
+	if sel := call.SelectExpression; sel != nil && (sel.Expression != nil || sel.RecursiveDescent != nil) {
+		return
+	}
+	return pri.JsonPath.String(), true
+}
+
+// literalValue returns the value of a string, number, boolean or nil literal as an index key.
+func literalValue(pri *Primary) (value string, ok bool) {
+	switch {
+	case pri.String != nil:
+		return IndexKey(strings.Trim(*pri.String, "\"")), true
+	case pri.Number != nil:
+		return IndexKey(*pri.Number), true
+	case pri.Bool != nil:
+		return IndexKey(*pri.Bool), true
+	case pri.Nil:
+		return IndexKey(nil), true
+	}
+	return
+}
+
+// numericValue returns the value of a number literal or the value of a time helper like
+// `seconds(-30)` that's evaluated on compile-time, in milliseconds.
+func numericValue(pri *Primary) (number float64, ok bool) {
+	if pri.Number != nil {
+		return *pri.Number, true
+	}
+
+	if pri.Helper == nil || *pri.Helper == "limit" || !strContains(compileTimeEvaluatedHelpers, *pri.Helper) {
+		return
+	}
+	call := pri.CallExpression
+	if call == nil || len(call.Parameters) != 1 || !call.Parameters[0].TimeSet {
+		return
+	}
+	_, v := timeHelper(nil, nil, call.Parameters[0].Time)
+	return float64(v.(int64)), true
+}
+
+// ParseIndexPath parses the path of a field like `request.path` or `request.headers["x"]` to be indexed.
+// Paths with wildcards, recursive descents, sub-selections or helpers are not accepted.
+func ParseIndexPath(text string) (path string, jsonPath jp.Expr, err error) {
+	var expr *Expression
+	expr, err = Parse(strings.TrimSpace(text))
+	if err != nil {
+		return
+	}
+
+	_, err = Precompute(expr)
+	if err != nil {
+		return
+	}
+
+	err = ErrInvalidIndexPath
+	if expr.Logical == nil || expr.Logical.Next != nil || expr.Logical.Equality.Next != nil {
+		return
+	}
+
+	pri := plainPrimary(expr.Logical.Equality.Comparison)
+	if pri == nil || pri.JsonPath == nil {
+		return
+	}
+
+	var ok bool
+	path, ok = fieldPath(pri)
+	if !ok || strings.Contains(path, "*") {
+		return
+	}
+
+	jsonPath = *pri.JsonPath
+	err = nil
+	return
+}
+
+// IndexKey converts a value into the key that's stored in a secondary index.
+// Two values are equal according to the `==` operator if their keys are equal.
+func IndexKey(v interface{}) string {
+	return stringOperand(v)
+}
+
+// IndexKeys returns the keys of the values that the JSONPath refers to in the given
+// JSON object. An array has a key for each of its elements, the same way that the `==`
+// operator compares an array to a literal. ok is false if the JSONPath cannot be found.
+func IndexKeys(obj interface{}, jsonPath jp.Expr) (keys []string, ok bool) {
+	result := jsonPath.Get(obj)
+	if len(result) < 1 {
+		return
+	}
+
+	var v interface{} = result
+	if len(result) == 1 {
+		v = result[0]
+	}
+
+	if elements, isArray := v.([]interface{}); isArray {
+		for _, element := range elements {
+			keys = append(keys, IndexKey(element))
+		}
+	} else {
+		keys = []string{IndexKey(v)}
+	}
+
+	ok = true
+	return
+}
+
+// ZoneValues returns the numeric values that the JSONPath refers to in the given JSON object,
+// the same way that the `>`, `>=`, `<` and `<=` operators convert them. An array has a value for
+// each of its elements. ok is false if the JSONPath cannot be found.
+func ZoneValues(obj interface{}, jsonPath jp.Expr) (values []float64, ok bool) {
+	result := jsonPath.Get(obj)
+	if len(result) < 1 {
+		return
+	}
+
+	var v interface{} = result
+	if len(result) == 1 {
+		v = result[0]
+	}
+
+	if elements, isArray := v.([]interface{}); isArray {
+		for _, element := range elements {
+			values = append(values, float64Operand(element))
+		}
+	} else {
+		values = []float64{float64Operand(v)}
+	}
+
+	ok = true
+	return
+}
+
+// MayMatch tells whether a record might satisfy the `>`, `>=`, `<` or `<=` predicate if the
+// values of its field are in the [min, max] range. It's true for the other operators.
+func (predicate *Predicate) MayMatch(min float64, max float64) bool {
+	switch predicate.Op {
+	case ">":
+		return max > predicate.Number
+	case ">=":
+		return max >= predicate.Number
+	case "<":
+		return min < predicate.Number
+	case "<=":
+		return min <= predicate.Number
+	}
+	return true
+}
+
+// LeafKeys returns the keys of all of the values in the JSON object that are not objects or arrays,
+// the same way that IndexKeys returns them. The keys are not unique.
+func LeafKeys(obj interface{}) (keys []string) {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for _, value := range v {
+			keys = append(keys, LeafKeys(value)...)
+		}
+	case []interface{}:
+		for _, element := range v {
+			keys = append(keys, LeafKeys(element)...)
+		}
+	default:
+		keys = []string{IndexKey(v)}
+	}
+	return
+}
@@ -0,0 +1,157 @@
+package basenine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ohler55/ojg/jp"
+	"github.com/ohler55/ojg/oj"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildPlan(t *testing.T) {
+	tests := []struct {
+		query string
+		plan  *Plan
+	}{
+		{`dst.name == "catalogue"`, &Plan{Predicate: &Predicate{Path: "dst.name", Op: "==", Value: "catalogue"}}},
+		{`200 != response.status`, &Plan{Predicate: &Predicate{Path: "response.status", Op: "!=", Value: "200"}}},
+		{`dst.name == "catalogue" and request.path.startsWith("/api")`, &Plan{Predicate: &Predicate{Path: "dst.name", Op: "==", Value: "catalogue"}}},
+		{`http and (dst.name == "a" or dst.name == "b")`, &Plan{
+			Op:    "or",
+			Left:  &Plan{Predicate: &Predicate{Path: "dst.name", Op: "==", Value: "a"}},
+			Right: &Plan{Predicate: &Predicate{Path: "dst.name", Op: "==", Value: "b"}},
+		}},
+		{`dst.name == "a" or http`, nil},
+		{`!(dst.name == "a")`, nil},
+		{`request.path == r"/api.*"`, nil},
+		{`request.headers["x"] == "y"`, &Plan{Predicate: &Predicate{Path: "request.headers.x", Op: "==", Value: "y"}}},
+		{`request.headers["x"].y == "z"`, nil},
+		{`response.status >= 500`, &Plan{Predicate: &Predicate{Path: "response.status", Op: ">=", Value: "500", Number: 500}}},
+		{`500 > response.status`, &Plan{Predicate: &Predicate{Path: "response.status", Op: "<", Value: "500", Number: 500}}},
+		{`response.status >= -500`, nil},
+		{`0 < a < 2`, nil},
+		{`timestamp > "1"`, nil},
+		{`response.body.search("not found")`, &Plan{Predicate: &Predicate{Path: "response.body", Op: "search", Value: "not found"}}},
+		{`response.body.search("not found", true)`, nil},
+		{`redact("brand.name") and brand.name == "[REDACTED]"`, nil},
+		{`brand.name == "Chevrolet" and (model == "Camaro" or redact("model"))`, nil},
+		{`search("error")`, nil},
+		{`!response.body.search("error")`, nil},
+		{`response.body.search(request.path)`, nil},
+		{``, nil},
+	}
+
+	for _, test := range tests {
+		expr, err := Parse(test.query)
+		assert.Nil(t, err)
+		_, err = Precompute(expr)
+		assert.Nil(t, err)
+
+		assert.Equal(t, test.plan, BuildPlan(expr), test.query)
+	}
+}
+
+func TestBuildPlanTimeHelpers(t *testing.T) {
+	for _, query := range []string{`timestamp > now()`, `timestamp >= seconds(-30)`, `hours(-1) < timestamp`} {
+		expr, err := Parse(query)
+		assert.Nil(t, err)
+		_, err = Precompute(expr)
+		assert.Nil(t, err)
+
+		plan := BuildPlan(expr)
+		assert.NotNil(t, plan, query)
+		assert.Equal(t, "timestamp", plan.Predicate.Path)
+		assert.Contains(t, []string{">", ">="}, plan.Predicate.Op)
+		assert.InDelta(t, float64(time.Now().UnixNano()/int64(time.Millisecond)), plan.Predicate.Number, float64(2*time.Hour/time.Millisecond))
+	}
+}
+
+func TestParseIndexPath(t *testing.T) {
+	path, jsonPath, err := ParseIndexPath("request.path")
+	assert.Nil(t, err)
+	assert.Equal(t, "request.path", path)
+
+	obj, err := oj.ParseString(`{"request":{"path":"/catalogue"}}`)
+	assert.Nil(t, err)
+	keys, ok := IndexKeys(obj, jsonPath)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"/catalogue"}, keys)
+
+	// The path of a selection is in the form of its JSONPath.
+	path, _, err = ParseIndexPath(`request.headers["x-request-id"]`)
+	assert.Nil(t, err)
+	assert.Equal(t, "request.headers['x-request-id']", path)
+
+	for _, text := range []string{"", "request.*", "request.path == 1", `request.headers["x"].y`, `request.headers[*]`, "request.path.startsWith(1)", "r\"x\""} {
+		_, _, err = ParseIndexPath(text)
+		assert.NotNil(t, err, text)
+	}
+}
+
+func TestIndexKeys(t *testing.T) {
+	_, jsonPath, err := ParseIndexPath("tags")
+	assert.Nil(t, err)
+
+	obj, _ := oj.ParseString(`{"tags":["a",42,true,null]}`)
+	keys, ok := IndexKeys(obj, jsonPath)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a", "42", "true", "null"}, keys)
+
+	_, jsonPath, _ = ParseIndexPath("status")
+	keys, ok = IndexKeys(obj, jsonPath)
+	assert.False(t, ok)
+	assert.Empty(t, keys)
+
+	// The keys of the literals match the keys of the values.
+	obj, _ = oj.ParseString(`{"status":200}`)
+	keys, _ = IndexKeys(obj, jsonPath)
+	assert.Equal(t, IndexKey(float64(200)), keys[0])
+}
+
+func TestZoneValues(t *testing.T) {
+	_, jsonPath, err := ParseIndexPath("sizes")
+	assert.Nil(t, err)
+
+	obj, _ := oj.ParseString(`{"sizes":[1,"2.5",true,"x"]}`)
+	values, ok := ZoneValues(obj, jsonPath)
+	assert.True(t, ok)
+	assert.Equal(t, []float64{1, 2.5, 1, 0}, values)
+
+	_, jsonPath, _ = ParseIndexPath("status")
+	_, ok = ZoneValues(obj, jsonPath)
+	assert.False(t, ok)
+
+	predicate := &Predicate{Op: ">=", Number: 10}
+	assert.True(t, predicate.MayMatch(0, 10))
+	assert.False(t, predicate.MayMatch(0, 9))
+	predicate.Op = "<"
+	assert.True(t, predicate.MayMatch(9, 20))
+	assert.False(t, predicate.MayMatch(10, 20))
+}
+
+func TestLeafKeys(t *testing.T) {
+	obj, _ := oj.ParseString(`{"a":{"b":"x","c":[1,true]},"d":null}`)
+	keys := LeafKeys(obj)
+	assert.ElementsMatch(t, []string{"x", "1", "true", "null"}, keys)
+}
+
+func TestSearchTokens(t *testing.T) {
+	assert.Equal(t, []string{"get", "api", "v1", "users"}, Tokenize("GET /api/v1/Users"))
+	assert.Empty(t, Tokenize("!?"))
+
+	// The base64 encoded JSON bodies are decoded.
+	tokens := SearchTokens(`eyJlcnJvciI6Ik5vdCBGb3VuZCJ9`)
+	assert.Contains(t, tokens, "found")
+	assert.Contains(t, tokens, "error")
+
+	obj, _ := oj.ParseString(`{"a":"Hello World","b":[42,true]}`)
+	keys, ok := SearchKeys(obj, jp.MustParseString("a"))
+	assert.True(t, ok)
+	assert.ElementsMatch(t, []string{"hello", "world"}, keys)
+	assert.ElementsMatch(t, []string{"a", "hello", "world", "b", "42", "true"}, SearchTokens(obj))
+
+	assert.Equal(t, int64(3), searchScore(Tokenize("a b a c"), Tokenize("A c")))
+	assert.Equal(t, int64(0), searchScore(Tokenize("a b"), Tokenize("a d")))
+	assert.Equal(t, int64(0), searchScore(Tokenize("a b"), nil))
+}
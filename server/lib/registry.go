@@ -0,0 +1,296 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package basenine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// StorageFactory creates a storage driver with the arguments that are parsed from -storage-args.
+type StorageFactory func(persistent bool, args StorageArgs) (storage Storage, err error)
+
+type StorageArgType int
+
+// The types of the values of the storage arguments.
+//
+// STORAGE_ARG_STRING is a string that's taken as is.
+//
+// STORAGE_ARG_INT is a 64-bit signed integer.
+//
+// STORAGE_ARG_BOOL is a boolean like true or false.
+//
+// STORAGE_ARG_DURATION is a duration like 24h.
+//
+// STORAGE_ARG_LIST is a list of strings that are separated by colons,
+// since commas separate the arguments.
+const (
+	STORAGE_ARG_STRING StorageArgType = iota
+	STORAGE_ARG_INT
+	STORAGE_ARG_BOOL
+	STORAGE_ARG_DURATION
+	STORAGE_ARG_LIST
+)
+
+var storageArgTypeNames = map[StorageArgType]string{
+	STORAGE_ARG_STRING:   "string",
+	STORAGE_ARG_INT:      "int",
+	STORAGE_ARG_BOOL:     "bool",
+	STORAGE_ARG_DURATION: "duration",
+	STORAGE_ARG_LIST:     "list",
+}
+
+// StorageOption declares an argument of a storage driver.
+//
+// Name is the key of the argument in -storage-args.
+//
+// Type is the type that the value is parsed into.
+//
+// Default is the value that's used if the argument is not given. It's only printed.
+//
+// Usage describes the argument.
+//
+// Validate checks the parsed value, which is a string, int64, bool, time.Duration
+// or []string according to Type. It can be nil.
+type StorageOption struct {
+	Name     string
+	Type     StorageArgType
+	Default  string
+	Usage    string
+	Validate func(value interface{}) error
+}
+
+// StorageArgs are the typed values of the arguments of a storage driver.
+// The values of the arguments that are not given are the zero values of their types.
+type StorageArgs struct {
+	driver *storageDriver
+	values map[string]interface{}
+}
+
+// storageDriver is a registered storage driver.
+type storageDriver struct {
+	name    string
+	factory StorageFactory
+	options []StorageOption
+}
+
+// Serves as the registry of the storage drivers.
+var storageDrivers = struct {
+	sync.RWMutex
+	drivers map[string]*storageDriver
+}{drivers: make(map[string]*storageDriver)}
+
+// Errors of the storage driver registry.
+var ErrUnknownStorageDriver = errors.New("Unknown storage driver")
+var ErrUnknownStorageArgument = errors.New("Unknown storage argument")
+
+// RegisterStorage makes a storage driver available through the -storage flag with the given name.
+// The options declare the arguments that the driver accepts through -storage-args.
+// It panics if a driver with the same name is already registered, like database/sql does.
+func RegisterStorage(name string, factory StorageFactory, options ...StorageOption) {
+	storageDrivers.Lock()
+	defer storageDrivers.Unlock()
+
+	if factory == nil {
+		panic("Storage factory is nil: " + name)
+	}
+	if _, ok := storageDrivers.drivers[name]; ok {
+		panic("Storage driver is registered twice: " + name)
+	}
+
+	storageDrivers.drivers[name] = &storageDriver{
+		name:    name,
+		factory: factory,
+		options: options,
+	}
+}
+
+// StorageDrivers returns the names of the registered storage drivers in alphabetical order.
+func StorageDrivers() (names []string) {
+	storageDrivers.RLock()
+	for name := range storageDrivers.drivers {
+		names = append(names, name)
+	}
+	storageDrivers.RUnlock()
+
+	sort.Strings(names)
+	return
+}
+
+// getStorageDriver returns the registered storage driver with the given name.
+func getStorageDriver(name string) (driver *storageDriver, err error) {
+	storageDrivers.RLock()
+	driver, ok := storageDrivers.drivers[name]
+	storageDrivers.RUnlock()
+
+	if !ok {
+		err = fmt.Errorf("%w: %s", ErrUnknownStorageDriver, name)
+	}
+	return
+}
+
+// ParseStorageArgs parses the comma separated key=value pairs given through the -storage-args
+// flag into the typed arguments of the storage driver with the given name.
+func ParseStorageArgs(name string, text string) (args StorageArgs, err error) {
+	driver, err := getStorageDriver(name)
+	if err != nil {
+		return
+	}
+
+	args = StorageArgs{
+		driver: driver,
+		values: make(map[string]interface{}),
+	}
+
+	for _, pair := range strings.Split(text, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("Invalid storage argument: %s", pair)
+			return
+		}
+
+		err = args.Set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// NewStorage creates the storage driver with the given name.
+func NewStorage(name string, persistent bool, args StorageArgs) (storage Storage, err error) {
+	driver, err := getStorageDriver(name)
+	if err != nil {
+		return
+	}
+
+	if args.driver != driver {
+		err = fmt.Errorf("Storage arguments are not parsed for the %s storage driver", name)
+		return
+	}
+
+	return driver.factory(persistent, args)
+}
+
+// PrintStorageDrivers writes the registered storage drivers along with their arguments into w.
+func PrintStorageDrivers(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range StorageDrivers() {
+		driver, _ := getStorageDriver(name)
+		fmt.Fprintf(tw, "%s\n", name)
+		for _, option := range driver.options {
+			usage := option.Usage
+			if option.Default != "" {
+				usage = fmt.Sprintf("%s (default: %s)", usage, option.Default)
+			}
+			fmt.Fprintf(tw, "  %s=<%s>\t%s\n", option.Name, storageArgTypeNames[option.Type], usage)
+		}
+	}
+	tw.Flush()
+}
+
+// Supports tells whether the storage driver accepts the argument with the given key.
+func (args StorageArgs) Supports(key string) bool {
+	return args.option(key) != nil
+}
+
+// Set parses and validates the value of the argument with the given key. It overrides
+// the value that's given through -storage-args, such that the dedicated flags can be applied.
+func (args StorageArgs) Set(key string, text string) (err error) {
+	option := args.option(key)
+	if option == nil {
+		err = fmt.Errorf("%w: %s", ErrUnknownStorageArgument, key)
+		return
+	}
+
+	var value interface{}
+	switch option.Type {
+	case STORAGE_ARG_STRING:
+		value = text
+	case STORAGE_ARG_INT:
+		value, err = strconv.ParseInt(text, 10, 64)
+	case STORAGE_ARG_BOOL:
+		value, err = strconv.ParseBool(text)
+	case STORAGE_ARG_DURATION:
+		value, err = time.ParseDuration(text)
+	case STORAGE_ARG_LIST:
+		value = strings.Split(text, ":")
+	}
+	if err != nil {
+		err = fmt.Errorf("Invalid value of the storage argument %s: %w", key, err)
+		return
+	}
+
+	if option.Validate != nil {
+		err = option.Validate(value)
+		if err != nil {
+			return
+		}
+	}
+
+	args.values[key] = value
+	return
+}
+
+// Has tells whether the argument with the given key is given.
+func (args StorageArgs) Has(key string) bool {
+	_, ok := args.values[key]
+	return ok
+}
+
+// String returns the value of a STORAGE_ARG_STRING argument.
+func (args StorageArgs) String(key string) (value string) {
+	value, _ = args.values[key].(string)
+	return
+}
+
+// Int returns the value of a STORAGE_ARG_INT argument.
+func (args StorageArgs) Int(key string) (value int64) {
+	value, _ = args.values[key].(int64)
+	return
+}
+
+// Bool returns the value of a STORAGE_ARG_BOOL argument.
+func (args StorageArgs) Bool(key string) (value bool) {
+	value, _ = args.values[key].(bool)
+	return
+}
+
+// Duration returns the value of a STORAGE_ARG_DURATION argument.
+func (args StorageArgs) Duration(key string) (value time.Duration) {
+	value, _ = args.values[key].(time.Duration)
+	return
+}
+
+// List returns the value of a STORAGE_ARG_LIST argument.
+func (args StorageArgs) List(key string) (value []string) {
+	value, _ = args.values[key].([]string)
+	return
+}
+
+// option returns the declaration of the argument with the given key or nil if there is none.
+func (args StorageArgs) option(key string) *StorageOption {
+	if args.driver == nil {
+		return nil
+	}
+	for i := range args.driver.options {
+		if args.driver.options[i].Name == key {
+			return &args.driver.options[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package basenine
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errTestStorage = errors.New("Test storage")
+
+func registerTestStorage(name string) {
+	RegisterStorage(name, func(persistent bool, args StorageArgs) (storage Storage, err error) {
+		err = errTestStorage
+		return
+	},
+		StorageOption{Name: "dir", Type: STORAGE_ARG_STRING, Default: ".", Usage: "The directory."},
+		StorageOption{
+			Name:  "size",
+			Type:  STORAGE_ARG_INT,
+			Usage: "The size.",
+			Validate: func(value interface{}) (err error) {
+				if value.(int64) <= 0 {
+					err = errors.New("Size must be positive")
+				}
+				return
+			},
+		},
+		StorageOption{Name: "verbose", Type: STORAGE_ARG_BOOL, Usage: "Verbose."},
+		StorageOption{Name: "retention", Type: STORAGE_ARG_DURATION, Usage: "The retention."},
+		StorageOption{Name: "paths", Type: STORAGE_ARG_LIST, Usage: "The paths."},
+	)
+}
+
+func TestStorageRegistry(t *testing.T) {
+	registerTestStorage("test-registry")
+
+	assert.Contains(t, StorageDrivers(), "test-registry")
+	assert.Panics(t, func() {
+		registerTestStorage("test-registry")
+	})
+
+	args, err := ParseStorageArgs("test-registry", "dir=/tmp, size=42,verbose=true,retention=1h,paths=a.b:c")
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp", args.String("dir"))
+	assert.Equal(t, int64(42), args.Int("size"))
+	assert.True(t, args.Bool("verbose"))
+	assert.Equal(t, time.Hour, args.Duration("retention"))
+	assert.Equal(t, []string{"a.b", "c"}, args.List("paths"))
+
+	// The arguments that are not given have the zero values.
+	args, err = ParseStorageArgs("test-registry", "")
+	assert.Nil(t, err)
+	assert.False(t, args.Has("size"))
+	assert.Equal(t, int64(0), args.Int("size"))
+	assert.Nil(t, args.List("paths"))
+
+	// The dedicated flags override the arguments.
+	assert.True(t, args.Supports("dir"))
+	assert.False(t, args.Supports("sync"))
+	assert.Nil(t, args.Set("dir", "/var/lib/basenine"))
+	assert.Equal(t, "/var/lib/basenine", args.String("dir"))
+
+	_, err = ParseStorageArgs("test-registry", "sync=always")
+	assert.ErrorIs(t, err, ErrUnknownStorageArgument)
+
+	for _, text := range []string{"size", "size=0", "size=big", "verbose=maybe", "retention=1 day"} {
+		_, err = ParseStorageArgs("test-registry", text)
+		assert.NotNil(t, err, text)
+	}
+
+	_, err = ParseStorageArgs("test-unknown", "")
+	assert.ErrorIs(t, err, ErrUnknownStorageDriver)
+
+	_, err = NewStorage("test-registry", false, args)
+	assert.ErrorIs(t, err, errTestStorage)
+
+	// The arguments of another driver are rejected.
+	_, err = NewStorage("test-registry", false, StorageArgs{})
+	assert.NotNil(t, err)
+	assert.NotErrorIs(t, err, errTestStorage)
+}
+
+func TestPrintStorageDrivers(t *testing.T) {
+	registerTestStorage("test-print")
+
+	var buf bytes.Buffer
+	PrintStorageDrivers(&buf)
+
+	assert.Contains(t, buf.String(), "test-print\n")
+	assert.Regexp(t, `  dir=<string> +The directory\. \(default: \.\)\n`, buf.String())
+	assert.Regexp(t, `  paths=<list> +The paths\.\n`, buf.String())
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package basenine
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	jp "github.com/ohler55/ojg/jp"
+	oj "github.com/ohler55/ojg/oj"
+)
+
+// The field that the `search` helper sets to the score of the record if the ranking is enabled.
+const SEARCH_SCORE_FIELD string = "_score"
+
+// Tokenize splits the text into lowercase words that consist of letters and digits.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// SearchTokens returns the tokens of a value that the `search` helper looks for the terms in.
+// An object or an array is tokenized through its keys and values. A string is tokenized along
+// with its base64 decoded form, while a string that contains a JSON document, like the body of
+// a request, is tokenized as a decoded object. The tokens are not unique, such that they can be
+// counted for the ranking.
+func SearchTokens(v interface{}) (tokens []string) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for key, element := range value {
+			tokens = append(tokens, Tokenize(key)...)
+			tokens = append(tokens, SearchTokens(element)...)
+		}
+	case []interface{}:
+		for _, element := range value {
+			tokens = append(tokens, SearchTokens(element)...)
+		}
+	case string:
+		tokens = searchTextTokens(value)
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err == nil && len(decoded) > 0 && utf8.Valid(decoded) {
+			tokens = append(tokens, searchTextTokens(string(decoded))...)
+		}
+	default:
+		tokens = Tokenize(stringOperand(value))
+	}
+	return
+}
+
+// searchTextTokens tokenizes a text. The text is decoded if it's a JSON object or an array.
+func searchTextTokens(text string) []string {
+	trimmed := strings.TrimSpace(text)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		if obj, err := oj.ParseString(trimmed); err == nil {
+			return SearchTokens(obj)
+		}
+	}
+	return Tokenize(text)
+}
+
+// SearchKeys returns the tokens of the values that the JSONPath refers to in the given
+// JSON object, to be stored in a full-text index. ok is false if the JSONPath cannot be found.
+func SearchKeys(obj interface{}, jsonPath jp.Expr) (keys []string, ok bool) {
+	result := jsonPath.Get(obj)
+	if len(result) < 1 {
+		return
+	}
+
+	var v interface{} = result
+	if len(result) == 1 {
+		v = result[0]
+	}
+
+	keys = SearchTokens(v)
+	ok = true
+	return
+}
+
+// searchScore returns the number of occurrences of the terms in the tokens if all of the terms are found.
+// Otherwise it returns 0. A text without any terms doesn't match anything.
+func searchScore(tokens []string, terms []string) (score int64) {
+	if len(terms) == 0 {
+		return
+	}
+
+	counts := make(map[string]int64)
+	for _, token := range tokens {
+		counts[token]++
+	}
+
+	for _, term := range terms {
+		if counts[term] == 0 {
+			return 0
+		}
+		score += counts[term]
+	}
+	return
+}
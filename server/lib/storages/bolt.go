@@ -0,0 +1,1343 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	basenine "github.com/up9inc/basenine/server/lib"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Name of the bolt storage driver in the storage driver registry.
+const BOLT_STORAGE_DRIVER string = "bolt"
+
+// Filename of the bolt database in the data directory.
+const BOLT_STORAGE_DB_FILE string = "basenine.bolt"
+
+// Buckets of the bolt database.
+//
+// boltStorageRecordsBucket maps the IDs of the records, which are zero-padded by IndexToID
+// such that their lexicographical order is their numerical order, to their JSON.
+// The sequence of the bucket is the index of the next record.
+//
+// boltStorageMetaBucket contains the state of the storage under boltStorageMetaKey.
+var boltStorageRecordsBucket = []byte("records")
+var boltStorageMetaBucket = []byte("meta")
+var boltStorageMetaKey = []byte("meta")
+
+// The number of records that are read in a single read-only transaction while streaming
+// and fetching. The transactions are kept short since they block the growth of the file.
+const boltStorageReadBatchSize int = 1024
+
+// The interval that the bolt storage enforces the retention and syncs in interval mode.
+const boltStoragePeriodicInterval time.Duration = 1 * time.Second
+
+// The duration that the bolt storage waits for the lock of the database file.
+const boltStorageOpenTimeout time.Duration = 1 * time.Second
+
+// Error that's returned if the database file contains an unknown state.
+var ErrCorruptedBoltMeta = errors.New("Corrupted bolt storage meta")
+
+func init() {
+	basenine.RegisterStorage(BOLT_STORAGE_DRIVER, newBoltStorageFromArgs,
+		basenine.StorageOption{
+			Name:    "data-dir",
+			Type:    basenine.STORAGE_ARG_STRING,
+			Default: ".",
+			Usage:   "The directory of the " + BOLT_STORAGE_DB_FILE + " database file.",
+		},
+		basenine.StorageOption{
+			Name:  "retention",
+			Type:  basenine.STORAGE_ARG_DURATION,
+			Usage: "The duration that the records are kept in the database. 0 means unlimited time.",
+			Validate: func(value interface{}) (err error) {
+				if value.(time.Duration) < 0 {
+					err = fmt.Errorf("Retention must not be negative: %s", value)
+				}
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:    "sync",
+			Type:    basenine.STORAGE_ARG_STRING,
+			Default: "always",
+			Usage:   "When to fsync the database file: none, interval or always (after every transaction).",
+			Validate: func(value interface{}) (err error) {
+				_, err = parseSyncMode(value.(string))
+				return
+			},
+		},
+	)
+}
+
+// newBoltStorageFromArgs is the factory of the bolt storage driver in the storage driver registry.
+func newBoltStorageFromArgs(persistent bool, args basenine.StorageArgs) (storage basenine.Storage, err error) {
+	return NewBoltStorage(persistent, BoltStorageOptions{
+		DataDir:   args.String("data-dir"),
+		Retention: args.Duration("retention"),
+		Sync:      args.String("sync"),
+	})
+}
+
+// BoltStorageOptions is the set of options that alter the behavior of the bolt storage driver.
+//
+// DataDir is the directory that the database file is stored in.
+// Defaults to the current working directory.
+//
+// Retention is the duration that the records are kept in the database. 0 means unlimited time.
+// It overrides the retention that's stored in the database file.
+//
+// Sync is the name of the durability mode (none, interval or always) that decides
+// when the database file is fsynced. Defaults to always.
+type BoltStorageOptions struct {
+	DataDir   string
+	Retention time.Duration
+	Sync      string
+}
+
+// boltStorage keeps the records in an embedded B+tree key-value store along with its state.
+// Every change is committed in a single transaction together with the state, such that
+// the database file is always consistent and there is no core dump.
+//
+// db is the bolt database.
+//
+// path is the path of the database file.
+//
+// meta is the state of the storage that's committed next to the records.
+//
+// insertionFilterExpr is the parsed version of meta.InsertionFilter
+//
+// removedOffsetsCounter is the index of the oldest record, which is also the number of removed records.
+//
+// nextIndex is the index of the next record that's inserted.
+//
+// notifier broadcasts the insertions to the streams in QUERY mode.
+//
+// options is the set of options that's given on initialization.
+//
+// syncMode is the durability mode that decides when the database file is fsynced.
+//
+// closed is set once the database file is closed.
+type boltStorage struct {
+	sync.RWMutex
+	db                    *bolt.DB
+	path                  string
+	meta                  boltStorageMeta
+	insertionFilterExpr   *basenine.Expression
+	removedOffsetsCounter uint64
+	nextIndex             uint64
+	notifier              *basenine.Notifier
+	options               BoltStorageOptions
+	syncMode              byte
+	closed                bool
+}
+
+// boltStorageMeta is the state of the storage that's stored in the meta bucket.
+//
+// Size is the total size of the records in bytes.
+//
+// Limit is the maximum total size of the records that's set by /limit command. 0 means unlimited size.
+//
+// TruncatedTimestamp is the timestamp of the newest record that's removed upon the limit or the retention.
+type boltStorageMeta struct {
+	Version            string
+	Size               int64
+	Limit              int64
+	Retention          time.Duration
+	TruncatedTimestamp int64
+	Macros             map[string]string
+	InsertionFilter    string
+}
+
+// boltWrite is the state of a read-write transaction.
+// The storage takes first, next and meta over once the transaction is committed.
+type boltWrite struct {
+	tx      *bolt.Tx
+	records *bolt.Bucket
+	meta    boltStorageMeta
+	first   uint64
+	next    uint64
+}
+
+// boltRecord is a record that's copied out of a read-only transaction.
+type boltRecord struct {
+	index uint64
+	data  []byte
+}
+
+// NewBoltStorage creates a bolt storage with the given options.
+// The records in the database file are kept in persistent mode, otherwise they are removed.
+func NewBoltStorage(persistent bool, options BoltStorageOptions) (storage basenine.Storage, err error) {
+	var syncMode byte = NATIVE_STORAGE_SYNC_ALWAYS
+	if options.Sync != "" {
+		syncMode, err = parseSyncMode(options.Sync)
+		if err != nil {
+			return
+		}
+	}
+
+	if options.DataDir == "" {
+		options.DataDir = "."
+	}
+
+	err = os.MkdirAll(options.DataDir, 0755)
+	if err != nil {
+		return
+	}
+
+	store := &boltStorage{
+		path:     filepath.Join(options.DataDir, BOLT_STORAGE_DB_FILE),
+		notifier: basenine.NewNotifier(),
+		options:  options,
+		syncMode: syncMode,
+	}
+
+	err = store.Init(persistent)
+	if err != nil {
+		return
+	}
+
+	storage = store
+	return
+}
+
+// Init opens the database file and restores the state of the storage from it.
+func (storage *boltStorage) Init(persistent bool) (err error) {
+	if !persistent {
+		err = os.Remove(storage.path)
+		if err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	storage.db, err = bolt.Open(storage.path, 0644, &bolt.Options{Timeout: boltStorageOpenTimeout})
+	if err != nil {
+		return
+	}
+	storage.db.NoSync = storage.syncMode != NATIVE_STORAGE_SYNC_ALWAYS
+
+	err = storage.db.Update(func(tx *bolt.Tx) (err error) {
+		_, err = tx.CreateBucketIfNotExists(boltStorageRecordsBucket)
+		if err != nil {
+			return
+		}
+		_, err = tx.CreateBucketIfNotExists(boltStorageMetaBucket)
+		return
+	})
+	if err != nil {
+		storage.db.Close()
+		return
+	}
+
+	err = storage.RestoreCore()
+	if err != nil {
+		storage.db.Close()
+		return
+	}
+
+	go storage.periodicRetention(time.NewTicker(boltStoragePeriodicInterval))
+	return
+}
+
+// DumpCore syncs the database file. The state is already committed along with the records.
+func (storage *boltStorage) DumpCore(silent bool, dontLock bool) (err error) {
+	err = storage.db.Sync()
+	if err == nil && !silent {
+		log.Printf("Synced the database file: %s\n", storage.path)
+	}
+	return
+}
+
+// RestoreCore reads the state of the storage from the database file.
+func (storage *boltStorage) RestoreCore() (err error) {
+	var meta boltStorageMeta
+	var first, next uint64
+	err = storage.db.View(func(tx *bolt.Tx) (err error) {
+		if b := tx.Bucket(boltStorageMetaBucket).Get(boltStorageMetaKey); b != nil {
+			err = json.Unmarshal(b, &meta)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrCorruptedBoltMeta, err)
+			}
+		}
+
+		records := tx.Bucket(boltStorageRecordsBucket)
+		next = records.Sequence()
+		first, err = boltFirstIndex(records)
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	var insertionFilterExpr *basenine.Expression
+	if meta.InsertionFilter != "" {
+		insertionFilterExpr, _, err = storage.PrepareQuery(meta.InsertionFilter, meta.Macros)
+		if err != nil {
+			return
+		}
+	}
+
+	if meta.Macros == nil {
+		meta.Macros = make(map[string]string)
+	}
+	meta.Version = basenine.VERSION
+
+	// The retention that's given on initialization overrides the restored one.
+	if storage.options.Retention > 0 {
+		meta.Retention = storage.options.Retention
+	}
+
+	storage.Lock()
+	storage.meta = meta
+	storage.insertionFilterExpr = insertionFilterExpr
+	storage.removedOffsetsCounter = first
+	storage.nextIndex = next
+	storage.Unlock()
+	return
+}
+
+// boltFirstIndex returns the index of the oldest record in the records bucket,
+// which is the index of the next record if the bucket is empty.
+func boltFirstIndex(records *bolt.Bucket) (first uint64, err error) {
+	first = records.Sequence()
+	if k, _ := records.Cursor().First(); k != nil {
+		first, err = strconv.ParseUint(string(k), 10, 64)
+	}
+	return
+}
+
+// update runs fn in a read-write transaction and commits the state of the storage along with
+// the changes of fn. The storage takes the state over once the transaction is committed.
+// It must be called while the storage is locked.
+func (storage *boltStorage) update(fn func(w *boltWrite) error) (err error) {
+	w := &boltWrite{
+		meta:  storage.meta,
+		first: storage.removedOffsetsCounter,
+		next:  storage.nextIndex,
+	}
+
+	err = storage.db.Update(func(tx *bolt.Tx) (err error) {
+		w.tx = tx
+		w.records = tx.Bucket(boltStorageRecordsBucket)
+
+		err = fn(w)
+		if err != nil {
+			return
+		}
+
+		err = w.records.SetSequence(w.next)
+		if err != nil {
+			return
+		}
+
+		b, err := json.Marshal(w.meta)
+		if err != nil {
+			return
+		}
+		return tx.Bucket(boltStorageMetaBucket).Put(boltStorageMetaKey, b)
+	})
+	if err != nil {
+		return
+	}
+
+	storage.meta = w.meta
+	storage.removedOffsetsCounter = w.first
+	storage.nextIndex = w.next
+	return
+}
+
+// insert sets the "id" field of the decoded record and puts it into the records bucket.
+func (w *boltWrite) insert(d map[string]interface{}) (insertedId interface{}, err error) {
+	// Set "id" field to the index of the record.
+	insertedId = basenine.IndexToID(int(w.next))
+	d["id"] = insertedId
+
+	// Marshal it back.
+	data, _ := json.Marshal(d)
+
+	err = w.records.Put([]byte(insertedId.(string)), data)
+	if err != nil {
+		insertedId = nil
+		return
+	}
+
+	w.next++
+	w.meta.Size += int64(len(data))
+	return
+}
+
+// dropOldest removes the oldest record.
+func (w *boltWrite) dropOldest() (err error) {
+	key := []byte(basenine.IndexToID(int(w.first)))
+	data := w.records.Get(key)
+	if data != nil {
+		w.meta.Size -= int64(len(data))
+		if timestamp, err := recordTimestamp(data); err == nil {
+			w.meta.TruncatedTimestamp = timestamp
+		}
+		err = w.records.Delete(key)
+		if err != nil {
+			return
+		}
+	}
+	w.first++
+	return
+}
+
+// enforceLimit removes the oldest records until the total size fits into the limit.
+// The newest record is always kept, even if it's bigger than the limit.
+func (w *boltWrite) enforceLimit() (err error) {
+	for w.meta.Limit > 0 && w.meta.Size > w.meta.Limit && w.next-w.first > 1 {
+		err = w.dropOldest()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// enforceRetention removes the oldest records that are older than the retention window.
+// The records are removed in the order of insertion. Such that the removal stops at
+// the first record that's in the window or doesn't have a timestamp.
+func (storage *boltStorage) enforceRetention() (err error) {
+	storage.Lock()
+	defer storage.Unlock()
+
+	if storage.meta.Retention == 0 || storage.removedOffsetsCounter == storage.nextIndex {
+		return
+	}
+
+	deadline := time.Now().Add(-storage.meta.Retention).UnixMilli()
+	var expired bool
+	err = storage.db.View(func(tx *bolt.Tx) error {
+		_, data := tx.Bucket(boltStorageRecordsBucket).Cursor().First()
+		timestamp, err := recordTimestamp(data)
+		expired = err == nil && timestamp < deadline
+		return nil
+	})
+	if err != nil || !expired {
+		return
+	}
+
+	return storage.update(func(w *boltWrite) (err error) {
+		c := w.records.Cursor()
+		for k, data := c.First(); k != nil; k, data = c.First() {
+			timestamp, err := recordTimestamp(data)
+			if err != nil || timestamp >= deadline {
+				return nil
+			}
+			err = w.dropOldest()
+			if err != nil {
+				return err
+			}
+		}
+		return
+	})
+}
+
+// periodicRetention is a Goroutine that enforces the retention that's set by /retention command
+// and syncs the database file in interval mode. Triggered every second.
+func (storage *boltStorage) periodicRetention(ticker *time.Ticker) {
+	for {
+		<-ticker.C
+
+		err := storage.enforceRetention()
+		if err != nil && !errors.Is(err, bolt.ErrDatabaseNotOpen) {
+			log.Printf("Retention error: %v\n", err)
+		}
+
+		storage.RLock()
+		closed := storage.closed
+		if !closed && storage.syncMode == NATIVE_STORAGE_SYNC_INTERVAL {
+			err = storage.db.Sync()
+			if err != nil {
+				log.Printf("Sync error: %v\n", err)
+			}
+		}
+		storage.RUnlock()
+
+		if closed {
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// readRecords copies up to n records out of a read-only transaction in ascending order,
+// starting from the record with the given index. In descending order, the records
+// before the given index are read instead.
+func (storage *boltStorage) readRecords(from uint64, n int, reverse bool) (records []boltRecord, err error) {
+	err = storage.db.View(func(tx *bolt.Tx) (err error) {
+		c := tx.Bucket(boltStorageRecordsBucket).Cursor()
+
+		k, v := c.Seek([]byte(basenine.IndexToID(int(from))))
+		if reverse {
+			if k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+
+		for k != nil && len(records) < n {
+			var index uint64
+			index, err = strconv.ParseUint(string(k), 10, 64)
+			if err != nil {
+				return
+			}
+			records = append(records, boltRecord{
+				index: index,
+				data:  append([]byte(nil), v...),
+			})
+
+			if reverse {
+				k, v = c.Prev()
+			} else {
+				k, v = c.Next()
+			}
+		}
+		return
+	})
+	return
+}
+
+// InsertData inserts a record into the database in a single transaction.
+// It unmarshals the given bytes into a map[string]interface{}
+// Then inserts a key named "id" to that map. Which indicates the
+// index of that record.
+func (storage *boltStorage) InsertData(data []byte) (insertedId interface{}, err error) {
+	// Handle the insertion filter if it's not empty
+	storage.RLock()
+	insertionFilter := storage.meta.InsertionFilter
+	insertionFilterExpr := storage.insertionFilterExpr
+	storage.RUnlock()
+
+	d, err := decodeRecord(data, insertionFilter, insertionFilterExpr)
+	if d == nil || err != nil {
+		return
+	}
+
+	storage.Lock()
+	err = storage.update(func(w *boltWrite) (err error) {
+		insertedId, err = w.insert(d)
+		if err != nil {
+			return
+		}
+		return w.enforceLimit()
+	})
+	storage.Unlock()
+	if err != nil {
+		insertedId = nil
+		return
+	}
+
+	// Wake up all of the streams that are waiting for new records.
+	storage.notifier.Publish()
+	return
+}
+
+// InsertBatch inserts the given records into the database in a single transaction.
+// insertedIds contains nil for the records that are filtered out or cannot be decoded.
+func (storage *boltStorage) InsertBatch(batch [][]byte) (insertedIds []interface{}, err error) {
+	storage.RLock()
+	insertionFilter := storage.meta.InsertionFilter
+	insertionFilterExpr := storage.insertionFilterExpr
+	storage.RUnlock()
+
+	decoded := make([]map[string]interface{}, len(batch))
+	for i, data := range batch {
+		var decodeErr error
+		decoded[i], decodeErr = decodeRecord(data, insertionFilter, insertionFilterExpr)
+		if decodeErr != nil {
+			log.Printf("Skipping the record in the batch: %v\n", decodeErr)
+		}
+	}
+
+	insertedIds = make([]interface{}, len(batch))
+
+	storage.Lock()
+	err = storage.update(func(w *boltWrite) (err error) {
+		for i, d := range decoded {
+			if d == nil {
+				continue
+			}
+			insertedIds[i], err = w.insert(d)
+			if err != nil {
+				return
+			}
+		}
+		return w.enforceLimit()
+	})
+	storage.Unlock()
+	if err != nil {
+		// None of the records are inserted since the transaction is rolled back.
+		insertedIds = make([]interface{}, len(batch))
+		return
+	}
+
+	// Wake up all of the streams that are waiting for new records.
+	storage.notifier.Publish()
+	return
+}
+
+// GetMacros returns registered macros in the form a map of strings.
+func (storage *boltStorage) GetMacros() (macros map[string]string, err error) {
+	storage.RLock()
+	macros = storage.meta.Macros
+	storage.RUnlock()
+	return
+}
+
+// PrepareQuery get the query as an argument and handles expansion, parsing and compile-time evaluations.
+func (storage *boltStorage) PrepareQuery(query string, macros map[string]string) (expr *basenine.Expression, prop basenine.Propagate, err error) {
+	// Expand all macros in the query, if there are any.
+	query, err = basenine.ExpandMacros(macros, query)
+	if err != nil {
+		log.Printf("Macro expand error: %v\n", err)
+		return
+	}
+
+	// Parse the query.
+	expr, err = basenine.Parse(query)
+	if err != nil {
+		log.Printf("Syntax error: %v\n", err)
+		return
+	}
+
+	prop, err = basenine.Precompute(expr)
+	if err != nil {
+		log.Printf("Precompute error: %v\n", err)
+		return
+	}
+
+	return
+}
+
+// StreamRecords is an infinite loop that only called in case of QUERY TCP connection mode.
+// It expands marcros, parses the given query, does compile-time evaluations with Precompute() call
+// and filters out the records according to query.
+// It starts from the oldest record in the database.
+func (storage *boltStorage) StreamRecords(conn net.Conn, _leftOff string, query string) (err error) {
+	var macros map[string]string
+	macros, err = storage.GetMacros()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	var expr *basenine.Expression
+	var prop basenine.Propagate
+	expr, prop, err = storage.PrepareQuery(query, macros)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	limit := prop.Limit
+
+	leftOff, err := storage.handleSpecialLeftOff(_leftOff, 1)
+	if err != nil {
+		return
+	}
+
+	// Number of written records to the TCP connection.
+	var numberOfWritten uint64 = 0
+
+	// Number of queried records
+	var queried uint64 = 0
+
+	// Subscribe before reading the records such that a record inserted
+	// in between cannot be missed.
+	sub := storage.notifier.Subscribe()
+	defer sub.Close()
+
+	for {
+		err = basenine.ConnCheck(conn)
+		if err != nil {
+			return
+		}
+
+		var records []boltRecord
+		records, err = storage.readRecords(uint64(leftOff), boltStorageReadBatchSize, false)
+		if err != nil {
+			log.Printf("Read error: %v\n", err)
+			conn.Close()
+			return
+		}
+
+		storage.RLock()
+		totalNumberOfRecords := storage.nextIndex - storage.removedOffsetsCounter
+		truncatedTimestamp := storage.meta.TruncatedTimestamp
+		storage.RUnlock()
+
+		for _, r := range records {
+			// The records that are removed in the meantime are also counted as queried.
+			queried += uint64(int64(r.index) + 1 - leftOff)
+			leftOff = int64(r.index) + 1
+
+			// Evaluate the current record against the given query.
+			truth, record, err := basenine.Eval(expr, string(r.data))
+			if err != nil {
+				log.Printf("Eval error: %v\n", err)
+				continue
+			}
+
+			// Write the record into TCP connection if it passes the query.
+			if truth {
+				_, err := conn.Write([]byte(fmt.Sprintf("%s\n", record)))
+				if err != nil {
+					log.Printf("Write error: %v\n", err)
+					break
+				}
+				numberOfWritten++
+			}
+
+			metadata := &basenine.Metadata{
+				NumberOfWritten:    numberOfWritten,
+				Current:            uint64(queried),
+				Total:              totalNumberOfRecords,
+				LeftOff:            basenine.IndexToID(int(leftOff)),
+				TruncatedTimestamp: truncatedTimestamp,
+			}
+			queried = 0
+
+			metadataMarshaled, _ := json.Marshal(metadata)
+			_, err = conn.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_METADATA, string(metadataMarshaled))))
+			if err != nil {
+				log.Printf("Write error: %v\n", err)
+				break
+			}
+
+			// If the number of written records is greater than or equal to the limit
+			// and if the limit is not zero then stop the stream.
+			if limit != 0 && numberOfWritten >= limit {
+				return nil
+			}
+		}
+
+		// Read the next batch right away if the batch is full.
+		if len(records) == boltStorageReadBatchSize {
+			continue
+		}
+
+		// Block until a record is inserted. Time out periodically
+		// to check whether the connection is closed by the peer or not.
+		sub.Wait(nativeStorageStreamCheckInterval)
+	}
+}
+
+// RetrieveSingle fetches a single record from the database.
+// There are no archived records in the bolt storage, so archived has no effect.
+func (storage *boltStorage) RetrieveSingle(conn net.Conn, index string, query string, archived bool) (err error) {
+	// Convert index value provided as string to integer
+	_index, err := strconv.Atoi(index)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While converting the index to integer: %s\n", err.Error())))
+		return
+	}
+
+	storage.RLock()
+	l := int(storage.nextIndex)
+	storage.RUnlock()
+
+	if _index > l {
+		conn.Write([]byte(fmt.Sprintf("Index out of range: %d\n", _index)))
+		return
+	}
+
+	var records []boltRecord
+	if _index >= 0 {
+		records, err = storage.readRecords(uint64(_index), 1, false)
+	}
+
+	// The record is either removed or not inserted yet.
+	if err != nil || len(records) == 0 || records[0].index != uint64(_index) {
+		conn.Write([]byte(fmt.Sprintf("Record does not exist!\n")))
+		return
+	}
+
+	macros, err := storage.GetMacros()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	// Callling `Eval` for record altering helpers like `redact`
+	expr, _, err := storage.PrepareQuery(query, macros)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	_, record, err := basenine.Eval(expr, string(records[0].data))
+	if err != nil {
+		msg := fmt.Sprintf("Eval error: %v\n", err)
+		log.Println(msg)
+		conn.Write([]byte(msg))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("%s\n", record)))
+	return
+}
+
+// ValidateQuery tries to parse the given query and checks if there are
+// any syntax errors or not.
+func (storage *boltStorage) ValidateQuery(conn net.Conn, query string) (err error) {
+	// Expand all macros in the query, if there are any.
+	macros, _ := storage.GetMacros()
+	query, err = basenine.ExpandMacros(macros, query)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("%s\n", err.Error())))
+	}
+	_, err = basenine.Parse(query)
+
+	if err == nil {
+		basenine.SendOK(conn)
+	} else {
+		conn.Write([]byte(fmt.Sprintf("%s\n", err.Error())))
+	}
+	return
+}
+
+// Fetch fetches records in prefered direction, starting from leftOff up to given limit
+// There are no archived records in the bolt storage, so archived has no effect.
+func (storage *boltStorage) Fetch(conn net.Conn, leftOff string, direction string, query string, limit string, archived bool) (err error) {
+	// Parse the arguments
+	var _leftOff int64
+	_leftOff, err = storage.handleSpecialLeftOff(leftOff, 0)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: Cannot parse leftOff value to int: %s\n", err.Error())))
+		return
+	}
+
+	var _direction int
+	_direction, err = strconv.Atoi(direction)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While converting the direction to integer: %s\n", err.Error())))
+		return
+	}
+
+	var _limit int
+	_limit, err = strconv.Atoi(limit)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While converting the limit to integer: %s\n", err.Error())))
+		return
+	}
+
+	storage.RLock()
+	removedOffsetsCounter := storage.removedOffsetsCounter
+	nextIndex := storage.nextIndex
+	truncatedTimestamp := storage.meta.TruncatedTimestamp
+	storage.RUnlock()
+	totalNumberOfRecords := nextIndex - removedOffsetsCounter
+
+	// Check if the leftOff is in the database.
+	if uint64(_leftOff) > nextIndex {
+		conn.Write([]byte(fmt.Sprintf("Index out of range: %d\n", _leftOff)))
+		return
+	}
+
+	macros, err := storage.GetMacros()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	// `limit`, and `leftOff` helpers are not effective in `FETCH` connection mode
+	var expr *basenine.Expression
+	expr, _, err = storage.PrepareQuery(query, macros)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	err = basenine.ConnCheck(conn)
+	if err != nil {
+		return
+	}
+
+	// The records before the removed ones cannot be fetched.
+	if _leftOff < int64(removedOffsetsCounter) {
+		_leftOff = int64(removedOffsetsCounter)
+	}
+
+	// Number of written records to the TCP connection.
+	var numberOfWritten uint64 = 0
+
+	// Number of queried records
+	var queried uint64 = 0
+
+	reverse := _direction < 0
+	for {
+		var records []boltRecord
+		records, err = storage.readRecords(uint64(_leftOff), boltStorageReadBatchSize, reverse)
+		if err != nil {
+			log.Printf("Read error: %v\n", err)
+			break
+		}
+
+		// The records that are inserted after the fetch is started are not fetched.
+		if !reverse {
+			for i, r := range records {
+				if r.index >= nextIndex {
+					records = records[:i]
+					break
+				}
+			}
+		}
+
+		for i, r := range records {
+			if int(numberOfWritten) >= _limit {
+				return
+			}
+
+			if reverse {
+				queried += uint64(_leftOff - int64(r.index))
+				_leftOff = int64(r.index)
+			} else {
+				queried += uint64(int64(r.index) + 1 - _leftOff)
+				_leftOff = int64(r.index) + 1
+			}
+
+			// Evaluate the current record against the given query.
+			truth, record, err := basenine.Eval(expr, string(r.data))
+			if err != nil {
+				log.Printf("Eval error: %v\n", err)
+				continue
+			}
+
+			metadata, _ := json.Marshal(basenine.Metadata{
+				NumberOfWritten:    numberOfWritten,
+				Current:            uint64(queried),
+				Total:              totalNumberOfRecords,
+				LeftOff:            basenine.IndexToID(int(_leftOff)),
+				TruncatedTimestamp: truncatedTimestamp,
+				NoMoreData:         len(records) < boltStorageReadBatchSize && i == len(records)-1,
+			})
+
+			_, err = conn.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_METADATA, string(metadata))))
+			if err != nil {
+				log.Printf("Write error: %v\n", err)
+				break
+			}
+
+			// Write the record into TCP connection if it passes the query.
+			if truth {
+				_, err := conn.Write([]byte(fmt.Sprintf("%s\n", record)))
+				if err != nil {
+					log.Printf("Write error: %v\n", err)
+					break
+				}
+				numberOfWritten++
+			}
+		}
+
+		if len(records) < boltStorageReadBatchSize {
+			break
+		}
+	}
+
+	basenine.SendClose(conn)
+	return
+}
+
+// ApplyMacro defines a macro that will be expanded for each individual query.
+// The macro is committed into the database file.
+func (storage *boltStorage) ApplyMacro(conn net.Conn, data []byte) (err error) {
+	str := string(data)
+
+	s := strings.Split(str, "~")
+
+	if len(s) != 2 {
+		conn.Write([]byte("Error: Provide only two expressions!\n"))
+		return
+	}
+
+	macro := strings.TrimSpace(s[0])
+	expanded := strings.TrimSpace(s[1])
+
+	storage.Lock()
+	err = storage.update(func(w *boltWrite) error {
+		// The macros are copied since the queries read them without a lock.
+		macros := make(map[string]string, len(w.meta.Macros)+1)
+		for k, v := range w.meta.Macros {
+			macros[k] = v
+		}
+		w.meta.Macros = basenine.AddMacro(macros, macro, expanded)
+		return nil
+	})
+	storage.Unlock()
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: %s\n", err.Error())))
+		return
+	}
+
+	basenine.SendOK(conn)
+	return
+}
+
+// SetLimit sets a limit for the maximum total size of the records.
+// The oldest records are removed immediately if the database exceeds it.
+func (storage *boltStorage) SetLimit(conn net.Conn, data []byte) (err error) {
+	value, err := strconv.Atoi(string(data))
+
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While converting the limit to integer: %s\n", err.Error())))
+		return
+	}
+
+	storage.Lock()
+	err = storage.update(func(w *boltWrite) error {
+		w.meta.Limit = int64(value)
+		return w.enforceLimit()
+	})
+	storage.Unlock()
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: %s\n", err.Error())))
+		return
+	}
+
+	basenine.SendOK(conn)
+	return
+}
+
+// SetRetention sets the duration like "24h" that the records are kept in the database.
+// "0" disables the time-based retention.
+func (storage *boltStorage) SetRetention(conn net.Conn, data []byte) (err error) {
+	value, err := time.ParseDuration(string(data))
+
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While parsing the retention: %s\n", err.Error())))
+		return
+	}
+
+	if value < 0 {
+		err = fmt.Errorf("Retention must not be negative: %s", value)
+		conn.Write([]byte(fmt.Sprintf("Error: %s\n", err.Error())))
+		return
+	}
+
+	storage.Lock()
+	err = storage.update(func(w *boltWrite) error {
+		w.meta.Retention = value
+		return nil
+	})
+	storage.Unlock()
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: %s\n", err.Error())))
+		return
+	}
+
+	basenine.SendOK(conn)
+	return
+}
+
+// CreateIndex validates the field path given in data like `request.path` and acknowledges it.
+// The bolt storage evaluates every record, so there are no secondary indexes.
+func (storage *boltStorage) CreateIndex(conn net.Conn, data []byte) (err error) {
+	_, _, err = basenine.ParseIndexPath(string(data))
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While parsing the index path: %s\n", err.Error())))
+		return
+	}
+
+	basenine.SendOK(conn)
+	return
+}
+
+// Snapshot writes a consistent snapshot of the database into a tar archive at the path given in data.
+// The database file is copied through a read-only transaction, so the inserts are not paused at all.
+// It replies `OK` once the archive is written, otherwise the error is returned to be sent by the caller.
+func (storage *boltStorage) Snapshot(conn net.Conn, data []byte) (err error) {
+	path := strings.TrimSpace(string(data))
+	if path == "" {
+		err = errors.New("Provide a path for the snapshot!")
+		return
+	}
+
+	err = storage.db.View(func(tx *bolt.Tx) error {
+		records := tx.Bucket(boltStorageRecordsBucket)
+		first, err := boltFirstIndex(records)
+		if err != nil {
+			return err
+		}
+
+		return writeSnapshot(path, snapshotManifest{
+			Format:    SNAPSHOT_FORMAT,
+			Version:   basenine.VERSION,
+			Driver:    BOLT_STORAGE_DRIVER,
+			CreatedAt: time.Now().UnixMilli(),
+			FirstID:   basenine.IndexToID(int(first)),
+			Records:   records.Sequence() - first,
+			Files: []snapshotFile{{
+				Name: BOLT_STORAGE_DB_FILE,
+				Size: tx.Size(),
+				content: func(w io.Writer) (err error) {
+					_, err = tx.WriteTo(w)
+					return
+				},
+			}},
+		}, storage.syncMode != NATIVE_STORAGE_SYNC_NONE)
+	})
+	if err != nil {
+		err = fmt.Errorf("While taking the snapshot: %w", err)
+		return
+	}
+
+	log.Printf("Took a snapshot into: %s\n", path)
+	basenine.SendOK(conn)
+	return
+}
+
+// Export writes the records in the given ID range that pass the query into an NDJSON file at the given path,
+// which is gzip-compressed if compress is true. The records are written as the query transforms them.
+// The progress is reported through the Metadata messages, it replies `OK` once the file is written.
+// Otherwise the error is returned to be sent by the caller.
+func (storage *boltStorage) Export(conn net.Conn, path string, compress bool, from string, to string, query string) (err error) {
+	storage.RLock()
+	first := storage.removedOffsetsCounter
+	next := storage.nextIndex
+	truncatedTimestamp := storage.meta.TruncatedTimestamp
+	storage.RUnlock()
+
+	var expr *basenine.Expression
+	var w *exportWriter
+	expr, w, err = startExport(conn, storage, path, compress, from, to, query, first, next, truncatedTimestamp)
+	if err != nil {
+		return
+	}
+
+	// The records are read in batches of short read-only transactions.
+	leftOff := w.start
+	for leftOff < w.end && err == nil {
+		var records []boltRecord
+		records, err = storage.readRecords(leftOff, boltStorageReadBatchSize, false)
+		if err != nil {
+			break
+		}
+
+		for _, r := range records {
+			if r.index >= w.end {
+				leftOff = w.end
+				break
+			}
+			leftOff = r.index + 1
+
+			err = w.progress(leftOff)
+			if err != nil {
+				break
+			}
+
+			// Evaluate the current record against the given query.
+			truth, record, evalErr := basenine.Eval(expr, string(r.data))
+			if evalErr != nil {
+				log.Printf("Eval error: %v\n", evalErr)
+				continue
+			}
+
+			if truth {
+				err = w.write(record)
+				if err != nil {
+					break
+				}
+			}
+		}
+
+		if len(records) < boltStorageReadBatchSize {
+			break
+		}
+	}
+
+	if err == nil {
+		err = w.close(storage.syncMode != NATIVE_STORAGE_SYNC_NONE)
+	} else {
+		w.abort()
+	}
+	if err != nil {
+		err = fmt.Errorf("While exporting: %w", err)
+		return
+	}
+
+	log.Printf("Exported %d records into: %s\n", w.metadata.NumberOfWritten, w.path)
+	basenine.SendOK(conn)
+	return
+}
+
+// restoreBoltSnapshot validates the database file of a bolt snapshot that's extracted
+// into the staging directory against the manifest. The file is restored as is.
+func restoreBoltSnapshot(staging string, dataDir string, manifest snapshotManifest) (err error) {
+	var db *bolt.DB
+	db, err = bolt.Open(filepath.Join(staging, BOLT_STORAGE_DB_FILE), 0644, &bolt.Options{Timeout: boltStorageOpenTimeout, ReadOnly: true})
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		return
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) (err error) {
+		records := tx.Bucket(boltStorageRecordsBucket)
+		meta := tx.Bucket(boltStorageMetaBucket)
+		if records == nil || meta == nil {
+			return fmt.Errorf("%w: the buckets of the database file are missing", ErrInvalidSnapshot)
+		}
+
+		if b := meta.Get(boltStorageMetaKey); b != nil {
+			err = json.Unmarshal(b, &boltStorageMeta{})
+			if err != nil {
+				return fmt.Errorf("%w: %v: %v", ErrInvalidSnapshot, ErrCorruptedBoltMeta, err)
+			}
+		}
+
+		first, err := boltFirstIndex(records)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		if records.Sequence()-first != manifest.Records || basenine.IndexToID(int(first)) != manifest.FirstID {
+			return fmt.Errorf("%w: the manifest declares %d records starting from %s, the database file has %d records starting from %s", ErrInvalidSnapshot, manifest.Records, manifest.FirstID, records.Sequence()-first, basenine.IndexToID(int(first)))
+		}
+		return
+	})
+}
+
+// SetInsertionFilter tries to set the given query as an insertion filter.
+// The insertion filter is committed into the database file.
+func (storage *boltStorage) SetInsertionFilter(conn net.Conn, data []byte) (err error) {
+	query := string(data)
+
+	macros, err := storage.GetMacros()
+	if err != nil {
+		return
+	}
+
+	insertionFilterExpr, _, err := storage.PrepareQuery(query, macros)
+	if err != nil {
+		return
+	}
+
+	storage.Lock()
+	err = storage.update(func(w *boltWrite) error {
+		w.meta.InsertionFilter = query
+		return nil
+	})
+	if err == nil {
+		storage.insertionFilterExpr = insertionFilterExpr
+	}
+	storage.Unlock()
+
+	if err == nil {
+		basenine.SendOK(conn)
+	}
+	return
+}
+
+// Flush removes all the records in the database.
+func (storage *boltStorage) Flush() (err error) {
+	storage.Lock()
+	err = storage.update(func(w *boltWrite) error {
+		return w.clear(storage.options)
+	})
+	storage.Unlock()
+	return
+}
+
+// Reset removes all the records in the database and
+// resets the storage's state into its initial form.
+func (storage *boltStorage) Reset() (err error) {
+	storage.Lock()
+	err = storage.update(func(w *boltWrite) error {
+		w.meta.Macros = make(map[string]string)
+		w.meta.InsertionFilter = ""
+		return w.clear(storage.options)
+	})
+	if err == nil {
+		storage.insertionFilterExpr = nil
+	}
+	storage.Unlock()
+	return
+}
+
+// clear empties the records bucket and restores the limit and the retention
+// that are given through the options.
+func (w *boltWrite) clear(options BoltStorageOptions) (err error) {
+	err = w.tx.DeleteBucket(boltStorageRecordsBucket)
+	if err != nil {
+		return
+	}
+	w.records, err = w.tx.CreateBucket(boltStorageRecordsBucket)
+	if err != nil {
+		return
+	}
+
+	w.first = 0
+	w.next = 0
+	w.meta.Size = 0
+	w.meta.Limit = 0
+	w.meta.Retention = options.Retention
+	w.meta.TruncatedTimestamp = 0
+	return
+}
+
+// HandleExit gracefully exists the server accordingly. The database file is closed,
+// which commits nothing new since every change is committed as it happens.
+// The database file is removed if "-persistent" is not enabled.
+func (storage *boltStorage) HandleExit(sig syscall.Signal, persistent bool) (err error) {
+	// 128: killed by a signal and dumped core
+	// + the signal value.
+	exitCode := int(128 + sig)
+
+	err = storage.close()
+	if err != nil {
+		log.Printf("Error while closing the database file: %v\n", err)
+	}
+	if !persistent {
+		os.Remove(storage.path)
+	}
+
+	os.Exit(exitCode)
+	return
+}
+
+// close closes the database file and stops the periodic jobs of the storage.
+func (storage *boltStorage) close() (err error) {
+	storage.Lock()
+	storage.closed = true
+	err = storage.db.Close()
+	storage.Unlock()
+	return
+}
+
+// handleSpecialLeftOff handles negative leftOff value.
+func (storage *boltStorage) handleSpecialLeftOff(_leftOff string, increment int64) (leftOff int64, err error) {
+	// If leftOff value is -1 then set it to the last record
+	if _leftOff == basenine.LATEST {
+		storage.RLock()
+		last := int(storage.nextIndex) - 1
+		storage.RUnlock()
+		leftOff = int64(last)
+		if leftOff < 0 {
+			leftOff = 0
+		}
+	} else if _leftOff != "" {
+		var leftOffInt int
+		leftOffInt, err = strconv.Atoi(_leftOff)
+		leftOff = int64(leftOffInt)
+		leftOff += increment
+	}
+
+	return
+}
@@ -0,0 +1,300 @@
+package storages
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+func newTestBoltStorage(t *testing.T, persistent bool, options BoltStorageOptions) *boltStorage {
+	if options.DataDir == "" {
+		options.DataDir = t.TempDir()
+	}
+	storage, err := NewBoltStorage(persistent, options)
+	assert.Nil(t, err)
+	return storage.(*boltStorage)
+}
+
+func TestBoltStorageInsertAndRetrieveSingle(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := newTestBoltStorage(t, false, BoltStorageOptions{Sync: "none"})
+	defer storage.close()
+
+	for index := 0; index < 3000; index++ {
+		insertedId, err := storage.InsertData([]byte(payload))
+		assert.Nil(t, err)
+		assert.Equal(t, basenine.IndexToID(index), insertedId)
+	}
+
+	insertedIds, err := storage.InsertBatch([][]byte{[]byte(payload), []byte(`hello world`)})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{basenine.IndexToID(3000), nil}, insertedIds)
+
+	storage.RLock()
+	assert.Equal(t, uint64(3001), storage.nextIndex)
+	storage.RUnlock()
+
+	server, client := net.Pipe()
+	go func() {
+		storage.RetrieveSingle(server, basenine.IndexToID(2048), "redact(\"year\")", false)
+		server.Close()
+	}()
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":"[REDACTED]"}`, basenine.IndexToID(2048)), string(bytes))
+}
+
+func TestBoltStoragePersistence(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+	dataDir := t.TempDir()
+
+	storage := newTestBoltStorage(t, true, BoltStorageOptions{DataDir: dataDir})
+
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	server, client := net.Pipe()
+	go func() {
+		storage.ApplyMacro(server, []byte("chevy~brand.name == \"Chevrolet\""))
+		storage.SetInsertionFilter(server, []byte("chevy"))
+		storage.SetLimit(server, []byte("1000000"))
+		storage.SetRetention(server, []byte("24h"))
+		server.Close()
+	}()
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "OK\nOK\nOK\nOK\n", string(bytes))
+
+	// The database file is closed without a core dump, like a crash would.
+	assert.Nil(t, storage.close())
+
+	storage = newTestBoltStorage(t, true, BoltStorageOptions{DataDir: dataDir})
+	defer storage.close()
+
+	storage.RLock()
+	assert.Equal(t, uint64(10), storage.nextIndex)
+	assert.Equal(t, map[string]string{"chevy": "(brand.name == \"Chevrolet\")"}, storage.meta.Macros)
+	assert.Equal(t, "chevy", storage.meta.InsertionFilter)
+	assert.NotNil(t, storage.insertionFilterExpr)
+	assert.Equal(t, int64(1000000), storage.meta.Limit)
+	assert.Equal(t, 24*time.Hour, storage.meta.Retention)
+	storage.RUnlock()
+
+	// The IDs continue from where they left off and the insertion filter is in effect.
+	insertedIds, err := storage.InsertBatch([][]byte{[]byte(payload), []byte(`{"brand":{"name":"Ford"}}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{basenine.IndexToID(10), nil}, insertedIds)
+
+	// The records are removed on initialization if the persistent mode is not enabled.
+	assert.Nil(t, storage.close())
+
+	storage = newTestBoltStorage(t, false, BoltStorageOptions{DataDir: dataDir})
+	defer storage.close()
+
+	storage.RLock()
+	assert.Equal(t, uint64(0), storage.nextIndex)
+	assert.Empty(t, storage.meta.Macros)
+	storage.RUnlock()
+}
+
+func TestBoltStorageLimit(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := newTestBoltStorage(t, false, BoltStorageOptions{Sync: "none"})
+	defer storage.close()
+
+	for index := 0; index < 250; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	records, err := storage.readRecords(0, 1, false)
+	assert.Nil(t, err)
+	recordSize := int64(len(records[0].data))
+
+	server, client := net.Pipe()
+	go func() {
+		storage.SetLimit(server, []byte(fmt.Sprintf("%d", 10*recordSize)))
+		storage.RetrieveSingle(server, basenine.IndexToID(239), "", false)
+		server.Close()
+	}()
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "OK\nRecord does not exist!\n", string(bytes))
+
+	storage.RLock()
+	assert.Equal(t, uint64(240), storage.removedOffsetsCounter)
+	assert.Equal(t, 10*recordSize, storage.meta.Size)
+	storage.RUnlock()
+
+	// Flush restores the options.
+	assert.Nil(t, storage.Flush())
+
+	storage.RLock()
+	assert.Equal(t, uint64(0), storage.removedOffsetsCounter)
+	assert.Equal(t, uint64(0), storage.nextIndex)
+	assert.Equal(t, int64(0), storage.meta.Limit)
+	storage.RUnlock()
+}
+
+func TestBoltStorageRetention(t *testing.T) {
+	storage := newTestBoltStorage(t, false, BoltStorageOptions{Retention: time.Hour, Sync: "none"})
+	defer storage.close()
+
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(fmt.Sprintf(`{"model":"Camaro","timestamp":%d}`, old+int64(index))))
+	}
+
+	recent := time.Now().UnixMilli()
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(fmt.Sprintf(`{"model":"Camaro","timestamp":%d}`, recent+int64(index))))
+	}
+
+	assert.Nil(t, storage.enforceRetention())
+
+	storage.RLock()
+	assert.Equal(t, uint64(10), storage.removedOffsetsCounter)
+	assert.Equal(t, old+9, storage.meta.TruncatedTimestamp)
+	storage.RUnlock()
+}
+
+func TestBoltStorageStreamRecords(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := newTestBoltStorage(t, false, BoltStorageOptions{Sync: "none"})
+	defer storage.close()
+
+	storage.InsertData([]byte(payload))
+
+	server, client := net.Pipe()
+	go storage.StreamRecords(server, "", `model == "Camaro"`)
+
+	scanner := bufio.NewScanner(client)
+	var records []string
+	read := func(n int) {
+		for len(records) < n && scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), basenine.CMD_METADATA) {
+				continue
+			}
+			records = append(records, scanner.Text())
+		}
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	read(1)
+
+	// The records that are inserted afterwards are streamed live.
+	storage.InsertData([]byte(`{"model":"Corvette"}`))
+	storage.InsertData([]byte(payload))
+	read(2)
+
+	assert.Len(t, records, 2)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(2)), records[1])
+
+	client.Close()
+}
+
+func TestBoltStorageFetch(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := newTestBoltStorage(t, false, BoltStorageOptions{Sync: "none"})
+	defer storage.close()
+
+	for index := 0; index < 100; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	server, client := net.Pipe()
+	go func() {
+		storage.Fetch(server, basenine.IndexToID(42), "-1", "", "20", false)
+		server.Close()
+	}()
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	lines := strings.Split(string(bytes), "\n")
+	assert.Len(t, lines, 41)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(41)), lines[1])
+}
+
+func TestBoltStorageSnapshot(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := newTestBoltStorage(t, false, BoltStorageOptions{Sync: "none"})
+	defer storage.close()
+
+	for index := 0; index < 100; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	// The error is returned without being written into the connection.
+	server, client := net.Pipe()
+	err := storage.Snapshot(server, []byte(""))
+	assert.EqualError(t, err, "Provide a path for the snapshot!")
+	server.Close()
+	client.Close()
+
+	path := filepath.Join(t.TempDir(), "snapshot.tar")
+	server, client = net.Pipe()
+	go func() {
+		storage.Snapshot(server, []byte(path))
+		server.Close()
+	}()
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "OK\n", string(bytes))
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	manifest, err := readSnapshotManifest(tar.NewReader(f))
+	assert.Nil(t, err)
+	assert.Equal(t, BOLT_STORAGE_DRIVER, manifest.Driver)
+	assert.Equal(t, uint64(100), manifest.Records)
+	assert.Equal(t, BOLT_STORAGE_DB_FILE, manifest.Files[0].Name)
+
+	dataDir := t.TempDir()
+	err = RestoreSnapshot(path, BOLT_STORAGE_DRIVER, dataDir)
+	assert.Nil(t, err)
+
+	restored := newTestBoltStorage(t, true, BoltStorageOptions{DataDir: dataDir})
+	defer restored.close()
+
+	restored.RLock()
+	assert.Equal(t, uint64(100), restored.nextIndex)
+	restored.RUnlock()
+}
+
+func TestBoltStorageRegistry(t *testing.T) {
+	assert.Contains(t, basenine.StorageDrivers(), BOLT_STORAGE_DRIVER)
+
+	args, err := basenine.ParseStorageArgs(BOLT_STORAGE_DRIVER, fmt.Sprintf("data-dir=%s,sync=interval", t.TempDir()))
+	assert.Nil(t, err)
+
+	storage, err := basenine.NewStorage(BOLT_STORAGE_DRIVER, false, args)
+	assert.Nil(t, err)
+	defer storage.(*boltStorage).close()
+	assert.Equal(t, NATIVE_STORAGE_SYNC_INTERVAL, storage.(*boltStorage).syncMode)
+
+	for _, text := range []string{"sync=sometimes", "retention=-1h", "max-records=10"} {
+		_, err = basenine.ParseStorageArgs(BOLT_STORAGE_DRIVER, text)
+		assert.NotNil(t, err, text)
+	}
+}
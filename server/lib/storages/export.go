@@ -0,0 +1,253 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// The number of queried records between the progress reports of the /export command.
+const exportProgressInterval uint64 = 1000
+
+var ErrExportPathOutsideDirectory = errors.New("The path is outside of the export directory")
+
+// exportWriter writes the records that are exported by the /export command into an NDJSON file,
+// which is optionally gzip-compressed, and reports the progress into the connection through
+// the Metadata messages. The records are written into a temporary file that's renamed once
+// the export is completed, such that a failed export doesn't leave a partial file behind.
+//
+// start and end are the indexes of the exported range of records, end is not included.
+//
+// metadata is the progress that's reported. Current is the number of records in the range
+// that are queried so far, Total is the number of records in the range and LeftOff is
+// the ID of the next record.
+//
+// reported is the value of metadata.Current at the last progress report.
+type exportWriter struct {
+	conn     net.Conn
+	path     string
+	f        *os.File
+	gz       *gzip.Writer
+	w        *bufio.Writer
+	start    uint64
+	end      uint64
+	metadata basenine.Metadata
+	reported uint64
+}
+
+// startExport validates the arguments of the /export command against the records in the [first, next) index range
+// of the storage, then creates the temporary file of the export. The range that's given by the from and to IDs
+// includes both ends, an empty ID leaves that end open. The records that are removed are not exported.
+func startExport(conn net.Conn, storage basenine.Storage, path string, compress bool, from string, to string, query string, first uint64, next uint64, truncatedTimestamp int64) (expr *basenine.Expression, w *exportWriter, err error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		err = errors.New("Provide a path for the export!")
+		return
+	}
+
+	start, end, err := parseExportRange(from, to, first, next)
+	if err != nil {
+		return
+	}
+
+	var macros map[string]string
+	macros, err = storage.GetMacros()
+	if err != nil {
+		return
+	}
+
+	expr, _, err = storage.PrepareQuery(query, macros)
+	if err != nil {
+		err = fmt.Errorf("While parsing the query: %w", err)
+		return
+	}
+
+	w = &exportWriter{
+		conn:  conn,
+		path:  path,
+		start: start,
+		end:   end,
+		metadata: basenine.Metadata{
+			Total:              end - start,
+			LeftOff:            basenine.IndexToID(int(start)),
+			TruncatedTimestamp: truncatedTimestamp,
+		},
+	}
+
+	w.f, err = os.Create(path + ".tmp")
+	if err != nil {
+		w = nil
+		return
+	}
+
+	var out io.Writer = w.f
+	if compress {
+		w.gz = gzip.NewWriter(w.f)
+		out = w.gz
+	}
+	w.w = bufio.NewWriter(out)
+	return
+}
+
+// ResolveExportPath resolves the path that's given to the /export or the /snapshot command against the export directory,
+// which is the current working directory if it's empty. A relative path is relative to the directory.
+// The paths that point outside of the directory, also through the symbolic links, are refused such that
+// a client cannot overwrite an arbitrary file on the server's filesystem. An empty path is returned as is.
+func ResolveExportPath(dir string, path string) (resolved string, err error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return
+	}
+
+	if dir == "" {
+		dir = "."
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+
+	var parent string
+	parent, err = filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+
+	resolved = filepath.Join(parent, filepath.Base(path))
+	rel, relErr := filepath.Rel(dir, resolved)
+	if relErr != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		resolved = ""
+		err = fmt.Errorf("%w: %s", ErrExportPathOutsideDirectory, path)
+	}
+	return
+}
+
+// parseExportRange parses the IDs of the /export command into the [start, end) index range,
+// which is narrowed down to the records in the [first, next) index range.
+func parseExportRange(from string, to string, first uint64, next uint64) (start uint64, end uint64, err error) {
+	start = first
+	end = next
+
+	var fromIndex, toIndex uint64
+	if from != "" {
+		fromIndex, err = strconv.ParseUint(from, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("Cannot parse the start of the range: %s", from)
+			return
+		}
+		if fromIndex > start {
+			start = fromIndex
+		}
+	}
+	if to != "" {
+		toIndex, err = strconv.ParseUint(to, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("Cannot parse the end of the range: %s", to)
+			return
+		}
+		if from != "" && fromIndex > toIndex {
+			err = fmt.Errorf("The range starts after it ends: %s > %s", from, to)
+			return
+		}
+		if toIndex+1 < end {
+			end = toIndex + 1
+		}
+	}
+
+	if start > next {
+		start = next
+	}
+	if end < start {
+		end = start
+	}
+	return
+}
+
+// write appends a record that passes the query into the file.
+func (w *exportWriter) write(record string) (err error) {
+	_, err = w.w.WriteString(record)
+	if err == nil {
+		err = w.w.WriteByte('\n')
+	}
+	if err == nil {
+		w.metadata.NumberOfWritten++
+	}
+	return
+}
+
+// progress marks the records before the given index as queried and reports the progress
+// once every exportProgressInterval records.
+func (w *exportWriter) progress(leftOff uint64) (err error) {
+	w.metadata.Current = leftOff - w.start
+	w.metadata.LeftOff = basenine.IndexToID(int(leftOff))
+	if w.metadata.Current-w.reported < exportProgressInterval {
+		return
+	}
+	return w.report()
+}
+
+// report sends the progress into the connection as a Metadata message.
+func (w *exportWriter) report() (err error) {
+	w.reported = w.metadata.Current
+	metadata, _ := json.Marshal(w.metadata)
+	_, err = w.conn.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_METADATA, string(metadata))))
+	return
+}
+
+// close completes the file, moves it to the path of the export and reports the final progress with NoMoreData.
+func (w *exportWriter) close(sync bool) (err error) {
+	err = w.w.Flush()
+	if err == nil && w.gz != nil {
+		err = w.gz.Close()
+	}
+	if err == nil && sync {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		w.abort()
+		return
+	}
+
+	err = w.f.Close()
+	if err == nil {
+		err = os.Rename(w.f.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.f.Name())
+		return
+	}
+
+	w.metadata.Current = w.metadata.Total
+	w.metadata.LeftOff = basenine.IndexToID(int(w.end))
+	w.metadata.NoMoreData = true
+	return w.report()
+}
+
+// abort removes the temporary file of a failed export.
+func (w *exportWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
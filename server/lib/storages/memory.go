@@ -0,0 +1,961 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// Error that's returned on an attempt to restore the core of the memory storage.
+var ErrMemoryStorageNotPersistent = errors.New("Memory storage is not persistent")
+
+// The interval that the memory storage enforces the retention.
+const memoryStorageRetentionInterval time.Duration = 1 * time.Second
+
+// MemoryStorageOptions is the set of options that alter the behavior of the memory storage driver.
+//
+// MaxRecords is the maximum number of records that are kept in the memory. 0 means unlimited number of records.
+//
+// MaxBytes is the maximum total size of the records in bytes. 0 means unlimited size.
+// The /limit command overrides it.
+//
+// Retention is the duration that the records are kept in the memory. 0 means unlimited time.
+type MemoryStorageOptions struct {
+	MaxRecords int
+	MaxBytes   int64
+	Retention  time.Duration
+}
+
+// Name of the memory storage driver in the storage driver registry.
+const MEMORY_STORAGE_DRIVER string = "memory"
+
+func init() {
+	basenine.RegisterStorage(MEMORY_STORAGE_DRIVER, newMemoryStorageFromArgs,
+		basenine.StorageOption{
+			Name:  "max-records",
+			Type:  basenine.STORAGE_ARG_INT,
+			Usage: "The maximum number of records that are kept in the memory. 0 means unlimited number of records.",
+			Validate: func(value interface{}) (err error) {
+				if value.(int64) < 0 {
+					err = fmt.Errorf("Maximum number of records must not be negative: %d", value)
+				}
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:  "max-bytes",
+			Type:  basenine.STORAGE_ARG_INT,
+			Usage: "The maximum total size of the records in bytes. 0 means unlimited size.",
+			Validate: func(value interface{}) (err error) {
+				if value.(int64) < 0 {
+					err = fmt.Errorf("Maximum size must not be negative: %d", value)
+				}
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:  "retention",
+			Type:  basenine.STORAGE_ARG_DURATION,
+			Usage: "The duration that the records are kept in the memory. 0 means unlimited time.",
+			Validate: func(value interface{}) (err error) {
+				if value.(time.Duration) < 0 {
+					err = fmt.Errorf("Retention must not be negative: %s", value)
+				}
+				return
+			},
+		},
+	)
+}
+
+// newMemoryStorageFromArgs is the factory of the memory storage driver in the storage driver registry.
+func newMemoryStorageFromArgs(persistent bool, args basenine.StorageArgs) (storage basenine.Storage, err error) {
+	storage = NewMemoryStorage(persistent, memoryStorageOptionsFromArgs(args))
+	return
+}
+
+// ParseMemoryStorageArgs parses the comma separated key=value pairs given through
+// the -storage-args flag into MemoryStorageOptions. Such as: max-records=100000,max-bytes=104857600,retention=1h
+func ParseMemoryStorageArgs(text string) (options MemoryStorageOptions, err error) {
+	args, err := basenine.ParseStorageArgs(MEMORY_STORAGE_DRIVER, text)
+	if err != nil {
+		return
+	}
+
+	options = memoryStorageOptionsFromArgs(args)
+	return
+}
+
+// memoryStorageOptionsFromArgs converts the parsed arguments of the memory storage driver into MemoryStorageOptions.
+func memoryStorageOptionsFromArgs(args basenine.StorageArgs) MemoryStorageOptions {
+	return MemoryStorageOptions{
+		MaxRecords: int(args.Int("max-records")),
+		MaxBytes:   args.Int("max-bytes"),
+		Retention:  args.Duration("retention"),
+	}
+}
+
+// memoryStorage is a mutually excluded struct that keeps the records in a ring buffer
+// instead of the database partitions. It never touches the filesystem. Therefore
+// the records are lost on exit and the core dumps are not supported.
+//
+// records is the ring buffer of the records. The oldest record is at the index head.
+//
+// head is the index of the oldest record in records.
+//
+// count is the number of records in the ring buffer.
+//
+// size is the total size of the records in the ring buffer in bytes.
+//
+// maxRecords is the maximum number of records that are kept. 0 means unlimited number of records.
+//
+// maxBytes is the maximum total size of the records in bytes. 0 means unlimited size.
+//
+// retention is the duration that the records are kept. 0 means unlimited time.
+//
+// truncatedTimestamp is the timestamp of the newest record that's dropped upon the limits or the retention.
+//
+// removedOffsetsCounter is the counter of how many records are dropped, which is also the index of the oldest record.
+//
+// macros is the map of strings where the key is the macro and value is the expanded form.
+//
+// insertionFilter is the filter that's applied just before the insertion of every individual record.
+//
+// insertionFilterExpr is the parsed version of insertionFilter
+//
+// notifier broadcasts the insertions to the streams in QUERY mode.
+//
+// options is the set of options that's given on initialization.
+type memoryStorage struct {
+	sync.RWMutex
+	records               []memoryRecord
+	head                  int
+	count                 int
+	size                  int64
+	maxRecords            int
+	maxBytes              int64
+	retention             time.Duration
+	truncatedTimestamp    int64
+	removedOffsetsCounter uint64
+	macros                map[string]string
+	insertionFilter       string
+	insertionFilterExpr   *basenine.Expression
+	notifier              *basenine.Notifier
+	options               MemoryStorageOptions
+}
+
+// memoryRecord is a single record in the ring buffer.
+//
+// data is the JSON of the record including its "id" field.
+//
+// timestamp is the value of the "timestamp" field of the record. hasTimestamp is false if it has none.
+type memoryRecord struct {
+	data         []byte
+	timestamp    int64
+	hasTimestamp bool
+}
+
+// NewMemoryStorage creates a memory storage with the given options.
+func NewMemoryStorage(persistent bool, options MemoryStorageOptions) (storage basenine.Storage) {
+	memory := &memoryStorage{
+		macros:     make(map[string]string),
+		notifier:   basenine.NewNotifier(),
+		options:    options,
+		maxRecords: options.MaxRecords,
+		maxBytes:   options.MaxBytes,
+		retention:  options.Retention,
+	}
+
+	storage = memory
+	storage.Init(persistent)
+
+	return
+}
+
+// Init initializes the storage
+func (storage *memoryStorage) Init(persistent bool) (err error) {
+	if persistent {
+		log.Printf("The records of the memory storage are lost on exit, ignoring the persistent mode.\n")
+	}
+
+	go storage.periodicRetention(time.NewTicker(memoryStorageRetentionInterval))
+	return
+}
+
+// DumpCore does nothing since the memory storage is not persistent.
+func (storage *memoryStorage) DumpCore(silent bool, dontLock bool) (err error) {
+	return
+}
+
+// RestoreCore always fails since the memory storage is not persistent.
+func (storage *memoryStorage) RestoreCore() (err error) {
+	err = ErrMemoryStorageNotPersistent
+	return
+}
+
+// InsertData inserts a record into the ring buffer.
+// It unmarshals the given bytes into a map[string]interface{}
+// Then inserts a key named "id" to that map. Which indicates the
+// index of that record. The oldest records are dropped if the
+// ring buffer exceeds the limits.
+func (storage *memoryStorage) InsertData(data []byte) (insertedId interface{}, err error) {
+	// Handle the insertion filter if it's not empty
+	storage.RLock()
+	insertionFilter := storage.insertionFilter
+	insertionFilterExpr := storage.insertionFilterExpr
+	storage.RUnlock()
+
+	d, err := decodeRecord(data, insertionFilter, insertionFilterExpr)
+	if d == nil || err != nil {
+		return
+	}
+
+	storage.Lock()
+	insertedId = storage.push(d)
+	storage.enforceLimits()
+	storage.Unlock()
+
+	// Wake up all of the streams that are waiting for new records.
+	storage.notifier.Publish()
+	return
+}
+
+// InsertBatch inserts the given records into the ring buffer at once.
+// insertedIds contains nil for the records that are filtered out or cannot be decoded.
+func (storage *memoryStorage) InsertBatch(batch [][]byte) (insertedIds []interface{}, err error) {
+	storage.RLock()
+	insertionFilter := storage.insertionFilter
+	insertionFilterExpr := storage.insertionFilterExpr
+	storage.RUnlock()
+
+	decoded := make([]map[string]interface{}, len(batch))
+	for i, data := range batch {
+		var decodeErr error
+		decoded[i], decodeErr = decodeRecord(data, insertionFilter, insertionFilterExpr)
+		if decodeErr != nil {
+			log.Printf("Skipping the record in the batch: %v\n", decodeErr)
+		}
+	}
+
+	insertedIds = make([]interface{}, len(batch))
+
+	storage.Lock()
+	for i, d := range decoded {
+		if d == nil {
+			continue
+		}
+		insertedIds[i] = storage.push(d)
+	}
+	storage.enforceLimits()
+	storage.Unlock()
+
+	// Wake up all of the streams that are waiting for new records.
+	storage.notifier.Publish()
+	return
+}
+
+// push sets the "id" field of the decoded record and appends it to the end of the ring buffer.
+// The ring buffer grows if it's full. It must be called while the storage is locked.
+func (storage *memoryStorage) push(d map[string]interface{}) (insertedId interface{}) {
+	// Set "id" field to the index of the record.
+	insertedId = basenine.IndexToID(int(storage.removedOffsetsCounter) + storage.count)
+	d["id"] = insertedId
+
+	// Marshal it back.
+	data, _ := json.Marshal(d)
+
+	record := memoryRecord{
+		data: data,
+	}
+	if timestamp, ok := d["timestamp"].(float64); ok {
+		record.timestamp = int64(timestamp)
+		record.hasTimestamp = true
+	}
+
+	if storage.count == len(storage.records) {
+		capacity := 2 * len(storage.records)
+		if capacity == 0 {
+			capacity = 1024
+		}
+		records := make([]memoryRecord, capacity)
+		for i := 0; i < storage.count; i++ {
+			records[i] = storage.at(i)
+		}
+		storage.records = records
+		storage.head = 0
+	}
+
+	storage.records[(storage.head+storage.count)%len(storage.records)] = record
+	storage.count++
+	storage.size += int64(len(data))
+	return
+}
+
+// at returns the i-th oldest record in the ring buffer.
+// It must be called while the storage is locked.
+func (storage *memoryStorage) at(i int) memoryRecord {
+	return storage.records[(storage.head+i)%len(storage.records)]
+}
+
+// drop removes the oldest record from the ring buffer.
+// It must be called while the storage is locked.
+func (storage *memoryStorage) drop() {
+	record := storage.records[storage.head]
+	storage.records[storage.head] = memoryRecord{}
+	storage.head = (storage.head + 1) % len(storage.records)
+	storage.count--
+	storage.size -= int64(len(record.data))
+	storage.removedOffsetsCounter++
+	if record.hasTimestamp {
+		storage.truncatedTimestamp = record.timestamp
+	}
+}
+
+// enforceLimits drops the oldest records until the ring buffer fits into the limits.
+// The newest record is always kept, even if it's bigger than the size limit.
+// It must be called while the storage is locked.
+func (storage *memoryStorage) enforceLimits() {
+	for storage.maxRecords > 0 && storage.count > storage.maxRecords {
+		storage.drop()
+	}
+	for storage.maxBytes > 0 && storage.size > storage.maxBytes && storage.count > 1 {
+		storage.drop()
+	}
+}
+
+// enforceRetention drops the oldest records that are older than the retention window.
+// The records are dropped in the order of insertion. Such that the dropping stops at
+// the first record that's in the window or doesn't have a timestamp.
+func (storage *memoryStorage) enforceRetention() {
+	storage.Lock()
+	defer storage.Unlock()
+
+	if storage.retention == 0 {
+		return
+	}
+
+	deadline := time.Now().Add(-storage.retention).UnixMilli()
+	for storage.count > 0 {
+		record := storage.at(0)
+		if !record.hasTimestamp || record.timestamp >= deadline {
+			return
+		}
+		storage.drop()
+	}
+}
+
+// periodicRetention is a Goroutine that enforces the retention that's set by /retention command.
+// Triggered every second.
+func (storage *memoryStorage) periodicRetention(ticker *time.Ticker) {
+	for {
+		<-ticker.C
+		storage.enforceRetention()
+	}
+}
+
+// snapshot returns the records in the [from, to) index range in ascending order.
+// The records are immutable, so they can be read after the lock is released.
+// It must be called while the storage is locked.
+func (storage *memoryStorage) snapshot(from uint64, to uint64) (records []memoryRecord) {
+	for id := from; id < to; id++ {
+		records = append(records, storage.at(int(id-storage.removedOffsetsCounter)))
+	}
+	return
+}
+
+// GetMacros returns registered macros in the form a map of strings.
+func (storage *memoryStorage) GetMacros() (macros map[string]string, err error) {
+	storage.RLock()
+	macros = storage.macros
+	storage.RUnlock()
+	return
+}
+
+// PrepareQuery get the query as an argument and handles expansion, parsing and compile-time evaluations.
+func (storage *memoryStorage) PrepareQuery(query string, macros map[string]string) (expr *basenine.Expression, prop basenine.Propagate, err error) {
+	// Expand all macros in the query, if there are any.
+	query, err = basenine.ExpandMacros(macros, query)
+	if err != nil {
+		log.Printf("Macro expand error: %v\n", err)
+		return
+	}
+
+	// Parse the query.
+	expr, err = basenine.Parse(query)
+	if err != nil {
+		log.Printf("Syntax error: %v\n", err)
+		return
+	}
+
+	prop, err = basenine.Precompute(expr)
+	if err != nil {
+		log.Printf("Precompute error: %v\n", err)
+		return
+	}
+
+	return
+}
+
+// StreamRecords is an infinite loop that only called in case of QUERY TCP connection mode.
+// It expands marcros, parses the given query, does compile-time evaluations with Precompute() call
+// and filters out the records according to query.
+// It starts from the oldest record in the ring buffer.
+func (storage *memoryStorage) StreamRecords(conn net.Conn, _leftOff string, query string) (err error) {
+	var macros map[string]string
+	macros, err = storage.GetMacros()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	var expr *basenine.Expression
+	var prop basenine.Propagate
+	expr, prop, err = storage.PrepareQuery(query, macros)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	limit := prop.Limit
+
+	leftOff, err := storage.handleSpecialLeftOff(_leftOff, 1)
+	if err != nil {
+		return
+	}
+
+	// Number of written records to the TCP connection.
+	var numberOfWritten uint64 = 0
+
+	// Number of queried records
+	var queried uint64 = 0
+
+	// Subscribe before reading the records such that a record inserted
+	// in between cannot be missed.
+	sub := storage.notifier.Subscribe()
+	defer sub.Close()
+
+	for {
+		err = basenine.ConnCheck(conn)
+		if err != nil {
+			return
+		}
+
+		// Safely access the next part of the ring buffer.
+		storage.RLock()
+		if leftOff < int64(storage.removedOffsetsCounter) {
+			// The records are dropped in the meantime, they're also counted as queried.
+			queried += uint64(int64(storage.removedOffsetsCounter) - leftOff)
+			leftOff = int64(storage.removedOffsetsCounter)
+		}
+		end := storage.removedOffsetsCounter + uint64(storage.count)
+		var records []memoryRecord
+		if uint64(leftOff) < end {
+			records = storage.snapshot(uint64(leftOff), end)
+		}
+		totalNumberOfRecords := storage.count
+		truncatedTimestamp := storage.truncatedTimestamp
+		storage.RUnlock()
+
+		for _, r := range records {
+			queried++
+			leftOff++
+
+			// Evaluate the current record against the given query.
+			truth, record, err := basenine.Eval(expr, string(r.data))
+			if err != nil {
+				log.Printf("Eval error: %v\n", err)
+				continue
+			}
+
+			// Write the record into TCP connection if it passes the query.
+			if truth {
+				_, err := conn.Write([]byte(fmt.Sprintf("%s\n", record)))
+				if err != nil {
+					log.Printf("Write error: %v\n", err)
+					break
+				}
+				numberOfWritten++
+			}
+
+			metadata := &basenine.Metadata{
+				NumberOfWritten:    numberOfWritten,
+				Current:            uint64(queried),
+				Total:              uint64(totalNumberOfRecords),
+				LeftOff:            basenine.IndexToID(int(leftOff)),
+				TruncatedTimestamp: truncatedTimestamp,
+			}
+			queried = 0
+
+			metadataMarshaled, _ := json.Marshal(metadata)
+			_, err = conn.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_METADATA, string(metadataMarshaled))))
+			if err != nil {
+				log.Printf("Write error: %v\n", err)
+				break
+			}
+
+			// If the number of written records is greater than or equal to the limit
+			// and if the limit is not zero then stop the stream.
+			if limit != 0 && numberOfWritten >= limit {
+				return nil
+			}
+		}
+
+		// Block until a record is inserted. Time out periodically
+		// to check whether the connection is closed by the peer or not.
+		sub.Wait(nativeStorageStreamCheckInterval)
+	}
+}
+
+// RetrieveSingle fetches a single record from the ring buffer.
+// There are no archived records in the memory, so archived has no effect.
+func (storage *memoryStorage) RetrieveSingle(conn net.Conn, index string, query string, archived bool) (err error) {
+	// Convert index value provided as string to integer
+	_index, err := strconv.Atoi(index)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While converting the index to integer: %s\n", err.Error())))
+		return
+	}
+
+	// Safely access the record.
+	storage.RLock()
+	l := storage.count + int(storage.removedOffsetsCounter)
+	_index -= int(storage.removedOffsetsCounter)
+	var r memoryRecord
+	exists := _index >= 0 && _index < storage.count
+	if exists {
+		r = storage.at(_index)
+	}
+	storage.RUnlock()
+
+	if _index > l {
+		conn.Write([]byte(fmt.Sprintf("Index out of range: %d\n", _index)))
+		return
+	}
+
+	// The record is either dropped or not inserted yet.
+	if !exists {
+		conn.Write([]byte(fmt.Sprintf("Record does not exist!\n")))
+		return
+	}
+
+	macros, err := storage.GetMacros()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	// Callling `Eval` for record altering helpers like `redact`
+	expr, _, err := storage.PrepareQuery(query, macros)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	_, record, err := basenine.Eval(expr, string(r.data))
+	if err != nil {
+		msg := fmt.Sprintf("Eval error: %v\n", err)
+		log.Println(msg)
+		conn.Write([]byte(msg))
+		return
+	}
+
+	conn.Write([]byte(fmt.Sprintf("%s\n", record)))
+	return
+}
+
+// ValidateQuery tries to parse the given query and checks if there are
+// any syntax errors or not.
+func (storage *memoryStorage) ValidateQuery(conn net.Conn, query string) (err error) {
+	// Expand all macros in the query, if there are any.
+	storage.RLock()
+	macros := storage.macros
+	storage.RUnlock()
+	query, err = basenine.ExpandMacros(macros, query)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("%s\n", err.Error())))
+	}
+	_, err = basenine.Parse(query)
+
+	if err == nil {
+		basenine.SendOK(conn)
+	} else {
+		conn.Write([]byte(fmt.Sprintf("%s\n", err.Error())))
+	}
+	return
+}
+
+// Fetch fetches records in prefered direction, starting from leftOff up to given limit
+// There are no archived records in the memory, so archived has no effect.
+func (storage *memoryStorage) Fetch(conn net.Conn, leftOff string, direction string, query string, limit string, archived bool) (err error) {
+	// Parse the arguments
+	var _leftOff int64
+	_leftOff, err = storage.handleSpecialLeftOff(leftOff, 0)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: Cannot parse leftOff value to int: %s\n", err.Error())))
+		return
+	}
+
+	var _direction int
+	_direction, err = strconv.Atoi(direction)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While converting the direction to integer: %s\n", err.Error())))
+		return
+	}
+
+	var _limit int
+	_limit, err = strconv.Atoi(limit)
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While converting the limit to integer: %s\n", err.Error())))
+		return
+	}
+
+	macros, err := storage.GetMacros()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	// `limit`, and `leftOff` helpers are not effective in `FETCH` connection mode
+	var expr *basenine.Expression
+	expr, _, err = storage.PrepareQuery(query, macros)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	err = basenine.ConnCheck(conn)
+	if err != nil {
+		return
+	}
+
+	// Safely access the part of the ring buffer in the direction.
+	storage.RLock()
+	removedOffsetsCounter := storage.removedOffsetsCounter
+	end := removedOffsetsCounter + uint64(storage.count)
+	totalNumberOfRecords := uint64(storage.count)
+	truncatedTimestamp := storage.truncatedTimestamp
+
+	// Check if the leftOff is in the ring buffer.
+	if uint64(_leftOff) > end {
+		storage.RUnlock()
+		conn.Write([]byte(fmt.Sprintf("Index out of range: %d\n", _leftOff)))
+		return
+	}
+
+	// The records before the dropped ones cannot be fetched.
+	if _leftOff < int64(removedOffsetsCounter) {
+		_leftOff = int64(removedOffsetsCounter)
+	}
+
+	var records []memoryRecord
+	if _direction < 0 {
+		records = storage.snapshot(removedOffsetsCounter, uint64(_leftOff))
+	} else {
+		records = storage.snapshot(uint64(_leftOff), end)
+	}
+	storage.RUnlock()
+
+	// Number of written records to the TCP connection.
+	var numberOfWritten uint64 = 0
+
+	// Number of queried records
+	var queried uint64 = 0
+
+	for i := 0; i < len(records); i++ {
+		if int(numberOfWritten) >= _limit {
+			return
+		}
+
+		r := records[i]
+		queried++
+		if _direction < 0 {
+			r = records[len(records)-1-i]
+			_leftOff--
+		} else {
+			_leftOff++
+		}
+
+		// Evaluate the current record against the given query.
+		truth, record, err := basenine.Eval(expr, string(r.data))
+		if err != nil {
+			log.Printf("Eval error: %v\n", err)
+			continue
+		}
+
+		metadata, _ := json.Marshal(basenine.Metadata{
+			NumberOfWritten:    numberOfWritten,
+			Current:            uint64(queried),
+			Total:              totalNumberOfRecords,
+			LeftOff:            basenine.IndexToID(int(_leftOff)),
+			TruncatedTimestamp: truncatedTimestamp,
+			NoMoreData:         i == len(records)-1,
+		})
+
+		_, err = conn.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_METADATA, string(metadata))))
+		if err != nil {
+			log.Printf("Write error: %v\n", err)
+			break
+		}
+
+		// Write the record into TCP connection if it passes the query.
+		if truth {
+			_, err := conn.Write([]byte(fmt.Sprintf("%s\n", record)))
+			if err != nil {
+				log.Printf("Write error: %v\n", err)
+				break
+			}
+			numberOfWritten++
+		}
+	}
+
+	basenine.SendClose(conn)
+	return
+}
+
+// ApplyMacro defines a macro that will be expanded for each individual query.
+func (storage *memoryStorage) ApplyMacro(conn net.Conn, data []byte) (err error) {
+	str := string(data)
+
+	s := strings.Split(str, "~")
+
+	if len(s) != 2 {
+		conn.Write([]byte("Error: Provide only two expressions!\n"))
+		return
+	}
+
+	macro := strings.TrimSpace(s[0])
+	expanded := strings.TrimSpace(s[1])
+
+	storage.Lock()
+	storage.macros = basenine.AddMacro(storage.macros, macro, expanded)
+	storage.Unlock()
+
+	basenine.SendOK(conn)
+	return
+}
+
+// SetLimit sets a limit for the maximum total size of the records.
+// The oldest records are dropped immediately if the ring buffer exceeds it.
+func (storage *memoryStorage) SetLimit(conn net.Conn, data []byte) (err error) {
+	value, err := strconv.Atoi(string(data))
+
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While converting the limit to integer: %s\n", err.Error())))
+		return
+	}
+
+	storage.Lock()
+	storage.maxBytes = int64(value)
+	storage.enforceLimits()
+	storage.Unlock()
+
+	basenine.SendOK(conn)
+	return
+}
+
+// SetRetention sets the duration like "24h" that the records are kept in the memory.
+// "0" disables the time-based retention.
+func (storage *memoryStorage) SetRetention(conn net.Conn, data []byte) (err error) {
+	value, err := time.ParseDuration(string(data))
+
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While parsing the retention: %s\n", err.Error())))
+		return
+	}
+
+	if value < 0 {
+		err = fmt.Errorf("Retention must not be negative: %s", value)
+		conn.Write([]byte(fmt.Sprintf("Error: %s\n", err.Error())))
+		return
+	}
+
+	storage.Lock()
+	storage.retention = value
+	storage.Unlock()
+
+	basenine.SendOK(conn)
+	return
+}
+
+// CreateIndex validates the field path given in data like `request.path` and acknowledges it.
+// The memory storage evaluates every record in the ring buffer, so there are no secondary indexes.
+func (storage *memoryStorage) CreateIndex(conn net.Conn, data []byte) (err error) {
+	_, _, err = basenine.ParseIndexPath(string(data))
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While parsing the index path: %s\n", err.Error())))
+		return
+	}
+
+	basenine.SendOK(conn)
+	return
+}
+
+// Snapshot is not supported since the records of the memory storage are lost on exit anyway.
+func (storage *memoryStorage) Snapshot(conn net.Conn, data []byte) (err error) {
+	err = fmt.Errorf("While taking the snapshot: %w", ErrMemoryStorageNotPersistent)
+	return
+}
+
+// Export writes the records in the given ID range that pass the query into an NDJSON file at the given path,
+// which is gzip-compressed if compress is true. The records are written as the query transforms them.
+// The progress is reported through the Metadata messages, it replies `OK` once the file is written.
+// Otherwise the error is returned to be sent by the caller.
+func (storage *memoryStorage) Export(conn net.Conn, path string, compress bool, from string, to string, query string) (err error) {
+	storage.RLock()
+	first := storage.removedOffsetsCounter
+	next := first + uint64(storage.count)
+	truncatedTimestamp := storage.truncatedTimestamp
+	storage.RUnlock()
+
+	var expr *basenine.Expression
+	var w *exportWriter
+	expr, w, err = startExport(conn, storage, path, compress, from, to, query, first, next, truncatedTimestamp)
+	if err != nil {
+		return
+	}
+
+	// The records that are dropped in the meantime are not exported.
+	storage.RLock()
+	start := w.start
+	if start < storage.removedOffsetsCounter {
+		start = storage.removedOffsetsCounter
+	}
+	if start > w.end {
+		start = w.end
+	}
+	records := storage.snapshot(start, w.end)
+	storage.RUnlock()
+
+	for i, r := range records {
+		err = w.progress(start + uint64(i) + 1)
+		if err != nil {
+			break
+		}
+
+		// Evaluate the current record against the given query.
+		truth, record, evalErr := basenine.Eval(expr, string(r.data))
+		if evalErr != nil {
+			log.Printf("Eval error: %v\n", evalErr)
+			continue
+		}
+
+		if truth {
+			err = w.write(record)
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err == nil {
+		err = w.close(false)
+	} else {
+		w.abort()
+	}
+	if err != nil {
+		err = fmt.Errorf("While exporting: %w", err)
+		return
+	}
+
+	log.Printf("Exported %d records into: %s\n", w.metadata.NumberOfWritten, w.path)
+	basenine.SendOK(conn)
+	return
+}
+
+// SetInsertionFilter tries to set the given query as an insertion filter
+func (storage *memoryStorage) SetInsertionFilter(conn net.Conn, data []byte) (err error) {
+	query := string(data)
+
+	macros, err := storage.GetMacros()
+	if err != nil {
+		return
+	}
+
+	insertionFilterExpr, _, err := storage.PrepareQuery(query, macros)
+
+	if err == nil {
+		storage.Lock()
+		storage.insertionFilter = query
+		storage.insertionFilterExpr = insertionFilterExpr
+		storage.Unlock()
+		basenine.SendOK(conn)
+	}
+	return
+}
+
+// Flush removes all the records in the memory.
+func (storage *memoryStorage) Flush() (err error) {
+	storage.Lock()
+	storage.clear()
+	storage.Unlock()
+	return
+}
+
+// Reset removes all the records in the memory and
+// resets the storage's state into its initial form.
+func (storage *memoryStorage) Reset() (err error) {
+	storage.Lock()
+	storage.clear()
+	storage.macros = make(map[string]string)
+	storage.insertionFilter = ""
+	storage.insertionFilterExpr = nil
+	storage.Unlock()
+	return
+}
+
+// clear empties the ring buffer and restores the limits that are given through the options.
+// It must be called while the storage is locked.
+func (storage *memoryStorage) clear() {
+	storage.records = nil
+	storage.head = 0
+	storage.count = 0
+	storage.size = 0
+	storage.maxRecords = storage.options.MaxRecords
+	storage.maxBytes = storage.options.MaxBytes
+	storage.retention = storage.options.Retention
+	storage.truncatedTimestamp = 0
+	storage.removedOffsetsCounter = 0
+}
+
+// HandleExit exits the server. The records are lost regardless of the persistent mode.
+func (storage *memoryStorage) HandleExit(sig syscall.Signal, persistent bool) (err error) {
+	// 128: killed by a signal and dumped core
+	// + the signal value.
+	exitCode := int(128 + sig)
+
+	os.Exit(exitCode)
+	return
+}
+
+// handleSpecialLeftOff handles negative leftOff value.
+func (storage *memoryStorage) handleSpecialLeftOff(_leftOff string, increment int64) (leftOff int64, err error) {
+	// If leftOff value is -1 then set it to the last record
+	if _leftOff == basenine.LATEST {
+		storage.RLock()
+		last := storage.count + int(storage.removedOffsetsCounter) - 1
+		storage.RUnlock()
+		leftOff = int64(last)
+		if leftOff < 0 {
+			leftOff = 0
+		}
+	} else if _leftOff != "" {
+		var leftOffInt int
+		leftOffInt, err = strconv.Atoi(_leftOff)
+		leftOff = int64(leftOffInt)
+		leftOff += increment
+	}
+
+	return
+}
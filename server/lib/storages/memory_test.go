@@ -0,0 +1,218 @@
+package storages
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+func TestMemoryStorageInsertAndRetrieveSingle(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewMemoryStorage(false, MemoryStorageOptions{}).(*memoryStorage)
+
+	for index := 0; index < 3000; index++ {
+		insertedId, err := storage.InsertData([]byte(payload))
+		assert.Nil(t, err)
+		assert.Equal(t, basenine.IndexToID(index), insertedId)
+	}
+
+	insertedIds, err := storage.InsertBatch([][]byte{[]byte(payload), []byte(`hello world`)})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{basenine.IndexToID(3000), nil}, insertedIds)
+
+	storage.RLock()
+	assert.Equal(t, 3001, storage.count)
+	storage.RUnlock()
+
+	server, client := net.Pipe()
+	go func() {
+		storage.RetrieveSingle(server, basenine.IndexToID(2048), "redact(\"year\")", false)
+		server.Close()
+	}()
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":"[REDACTED]"}`, basenine.IndexToID(2048)), string(bytes))
+
+	storage.Reset()
+}
+
+func TestMemoryStorageLimits(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewMemoryStorage(false, MemoryStorageOptions{MaxRecords: 100}).(*memoryStorage)
+
+	for index := 0; index < 250; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	storage.RLock()
+	assert.Equal(t, 100, storage.count)
+	assert.Equal(t, uint64(150), storage.removedOffsetsCounter)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(150)), string(storage.at(0).data))
+	recordSize := int64(len(storage.at(0).data))
+	storage.RUnlock()
+
+	// The dropped records do not exist anymore.
+	server, client := net.Pipe()
+	go func() {
+		storage.RetrieveSingle(server, basenine.IndexToID(149), "", false)
+		server.Close()
+	}()
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "Record does not exist!\n", string(bytes))
+
+	// The size limit drops the oldest records immediately.
+	server, client = net.Pipe()
+	go func() {
+		storage.SetLimit(server, []byte(fmt.Sprintf("%d", 10*recordSize)))
+		server.Close()
+	}()
+
+	bytes, err = ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "OK\n", string(bytes))
+
+	storage.RLock()
+	assert.Equal(t, 10, storage.count)
+	assert.Equal(t, uint64(240), storage.removedOffsetsCounter)
+	assert.LessOrEqual(t, storage.size, 10*recordSize)
+	storage.RUnlock()
+
+	// Flush restores the limits of the options.
+	storage.Flush()
+
+	storage.RLock()
+	assert.Equal(t, 0, storage.count)
+	assert.Equal(t, int64(0), storage.maxBytes)
+	assert.Equal(t, 100, storage.maxRecords)
+	storage.RUnlock()
+}
+
+func TestMemoryStorageRetention(t *testing.T) {
+	storage := NewMemoryStorage(false, MemoryStorageOptions{Retention: time.Hour}).(*memoryStorage)
+
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(fmt.Sprintf(`{"model":"Camaro","timestamp":%d}`, old+int64(index))))
+	}
+
+	recent := time.Now().UnixMilli()
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(fmt.Sprintf(`{"model":"Camaro","timestamp":%d}`, recent+int64(index))))
+	}
+
+	storage.enforceRetention()
+
+	storage.RLock()
+	assert.Equal(t, 10, storage.count)
+	assert.Equal(t, uint64(10), storage.removedOffsetsCounter)
+	assert.Equal(t, old+9, storage.truncatedTimestamp)
+	storage.RUnlock()
+
+	storage.Reset()
+}
+
+func TestMemoryStorageStreamRecords(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewMemoryStorage(false, MemoryStorageOptions{}).(*memoryStorage)
+
+	storage.InsertData([]byte(payload))
+
+	server, client := net.Pipe()
+	go storage.StreamRecords(server, "", `model == "Camaro"`)
+
+	scanner := bufio.NewScanner(client)
+	var records []string
+	read := func(n int) {
+		for len(records) < n && scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), basenine.CMD_METADATA) {
+				continue
+			}
+			records = append(records, scanner.Text())
+		}
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	read(1)
+
+	// The records that are inserted afterwards are streamed live.
+	storage.InsertData([]byte(`{"model":"Corvette"}`))
+	storage.InsertData([]byte(payload))
+	read(2)
+
+	assert.Len(t, records, 2)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(2)), records[1])
+
+	client.Close()
+
+	storage.Reset()
+}
+
+func TestMemoryStorageFetch(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewMemoryStorage(false, MemoryStorageOptions{}).(*memoryStorage)
+
+	for index := 0; index < 100; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	server, client := net.Pipe()
+	go func() {
+		storage.Fetch(server, basenine.IndexToID(42), "-1", "", "20", false)
+		server.Close()
+	}()
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	lines := strings.Split(string(bytes), "\n")
+	assert.Len(t, lines, 41)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(41)), lines[1])
+
+	storage.Reset()
+}
+
+func TestMemoryStorageRestoreCore(t *testing.T) {
+	storage := NewMemoryStorage(true, MemoryStorageOptions{})
+
+	assert.Nil(t, storage.DumpCore(false, false))
+	assert.Equal(t, ErrMemoryStorageNotPersistent, storage.RestoreCore())
+}
+
+func TestParseMemoryStorageArgs(t *testing.T) {
+	options, err := ParseMemoryStorageArgs("max-records=1000, max-bytes=1048576,retention=1h")
+	assert.Nil(t, err)
+	assert.Equal(t, MemoryStorageOptions{MaxRecords: 1000, MaxBytes: 1048576, Retention: time.Hour}, options)
+
+	options, err = ParseMemoryStorageArgs("")
+	assert.Nil(t, err)
+	assert.Equal(t, MemoryStorageOptions{}, options)
+
+	for _, args := range []string{"max-records=-1", "max-bytes=a lot", "retention=-1h", "data-dir=/tmp", "max-records"} {
+		_, err = ParseMemoryStorageArgs(args)
+		assert.NotNil(t, err, args)
+	}
+}
+
+func TestMemoryStorageRegistry(t *testing.T) {
+	assert.Contains(t, basenine.StorageDrivers(), MEMORY_STORAGE_DRIVER)
+
+	args, err := basenine.ParseStorageArgs(MEMORY_STORAGE_DRIVER, "max-records=10")
+	assert.Nil(t, err)
+
+	storage, err := basenine.NewStorage(MEMORY_STORAGE_DRIVER, false, args)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, storage.(*memoryStorage).maxRecords)
+}
@@ -6,10 +6,10 @@ package storages
 
 import (
 	"encoding/binary"
-	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"net"
@@ -19,15 +19,51 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
 	jp "github.com/ohler55/ojg/jp"
 	oj "github.com/ohler55/ojg/oj"
 	basenine "github.com/up9inc/basenine/server/lib"
 )
 
+// Record format versions. The version is stored in the most significant byte of the
+// 8-byte little-endian record header, the rest of the header is the length of the payload.
+//
+// NATIVE_STORAGE_RECORD_V0 is the legacy headerless format. The length is directly followed by the JSON.
+//
+// NATIVE_STORAGE_RECORD_V1 is followed by the 4-byte little-endian CRC32C checksum of the payload.
+//
+// NATIVE_STORAGE_RECORD_V2 has the same header with NATIVE_STORAGE_RECORD_V1 but its payload
+// is a compressed block of records. The first byte of the payload is the compression codec.
+//
+// NATIVE_STORAGE_RECORD_V3 has the same header with NATIVE_STORAGE_RECORD_V1 but its payload
+// is a dictionary encoded record that refers to the repeated strings in the dictionary of the partition.
+const (
+	NATIVE_STORAGE_RECORD_V0 byte = iota
+	NATIVE_STORAGE_RECORD_V1
+	NATIVE_STORAGE_RECORD_V2
+	NATIVE_STORAGE_RECORD_V3
+)
+
+// Lengths of the record headers in bytes for each record format version.
+const nativeStorageRecordHeaderLengthV0 int64 = 8
+const nativeStorageRecordHeaderLengthV1 int64 = 12
+
+// Records cannot be longer than the scanner buffer of a TCP connection.
+// A longer length can only be read from a corrupted header.
+const nativeStorageMaxRecordLength int64 = 209715200
+
+// Mask of the length bits in the record header.
+const nativeStorageRecordLengthMask uint64 = 1<<56 - 1
+
+var nativeStorageCRC32CTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Errors that indicates a corrupted record.
+var ErrChecksumMismatch = errors.New("Record checksum mismatch")
+var ErrCorruptedRecordHeader = errors.New("Corrupted record header")
+
 // Constants defines the database filename's prefix and file extension.
 const NATIVE_STORAGE_DB_FILE string = "data"
 const NATIVE_STORAGE_DB_FILE_LEGACY_EXT string = "bin"
@@ -35,6 +71,244 @@ const NATIVE_STORAGE_DB_FILE_EXT string = "db"
 
 var nativeStorageCoreDumpLock NativeStorageCoreDumpLock
 
+// NativeStorageOptions is the set of options that alter the behavior of the native storage driver.
+//
+// Recover forces the offset index to be rebuilt by scanning the database partitions on startup.
+//
+// Compression is the name of the codec (none, snappy or zstd) that's used for compressing
+// the records in blocks. Empty string or "none" disables the block compression.
+// The pending records are written once they fill a block or within a second, while in
+// sync=always mode they are written before the insertion returns.
+//
+// BlockSize is the size of a block in bytes, before the compression.
+//
+// DataDir is the directory that the partitions and the core dumps are stored in.
+// Defaults to the current working directory.
+//
+// Retention is the duration that the records are kept in the database. 0 means unlimited time.
+//
+// Partitions is the number of live partitions that the database size limit is divided into.
+// Defaults to NATIVE_STORAGE_DEFAULT_PARTITIONS.
+//
+// ArchiveDir enables the archive mode. The partitions that fall out of the size limit
+// or the retention are moved into this directory instead of being removed.
+//
+// ArchiveLimit is the maximum size of the archive directory in bytes. 0 means unlimited size.
+//
+// Sync is the name of the durability mode (none, interval or always) that decides
+// when the partitions and the core dumps are fsynced. Defaults to none.
+//
+// ZoneMaps are the paths of the numeric fields that have zone maps in addition to `timestamp`.
+//
+// BloomFilters are the paths of the fields that have Bloom filters. NATIVE_STORAGE_BLOOM_FILTER_ALL_LEAVES
+// adds all of the leaf values of the records into the Bloom filters.
+//
+// FullText are the paths of the fields that have full-text indexes for the `search` helper.
+//
+// Checksums are the paths of the fields whose values are hashed into a checksum that's stored
+// next to the offset of each record, to reject the records that cannot satisfy a `==` comparison.
+//
+// Dictionary enables the dictionary encoding of the records, which replaces the repeated strings
+// in a partition with references to the dictionary of that partition. It cannot be combined with
+// the block compression.
+type NativeStorageOptions struct {
+	Recover      bool
+	Compression  string
+	BlockSize    int
+	DataDir      string
+	Retention    time.Duration
+	Partitions   int
+	ArchiveDir   string
+	ArchiveLimit int64
+	Sync         string
+	ZoneMaps     []string
+	BloomFilters []string
+	FullText     []string
+	Checksums    []string
+	Dictionary   bool
+}
+
+// Default number of live partitions.
+const NATIVE_STORAGE_DEFAULT_PARTITIONS int = 2
+
+// Name of the native storage driver in the storage driver registry.
+const NATIVE_STORAGE_DRIVER string = "native"
+
+func init() {
+	basenine.RegisterStorage(NATIVE_STORAGE_DRIVER, newNativeStorageFromArgs,
+		basenine.StorageOption{
+			Name:    "compression",
+			Type:    basenine.STORAGE_ARG_STRING,
+			Default: "none",
+			Usage:   "The codec for compressing the records in blocks: none, snappy or zstd.",
+			Validate: func(value interface{}) (err error) {
+				_, err = parseCompression(value.(string))
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:    "block-size",
+			Type:    basenine.STORAGE_ARG_INT,
+			Default: strconv.Itoa(NATIVE_STORAGE_DEFAULT_BLOCK_SIZE),
+			Usage:   "The size of a compressed block in bytes, before the compression.",
+			Validate: func(value interface{}) (err error) {
+				if value.(int64) <= 0 {
+					err = fmt.Errorf("Block size must be positive: %d", value)
+				}
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:    "data-dir",
+			Type:    basenine.STORAGE_ARG_STRING,
+			Default: ".",
+			Usage:   "The directory for the database partitions and the core dumps.",
+		},
+		basenine.StorageOption{
+			Name:  "retention",
+			Type:  basenine.STORAGE_ARG_DURATION,
+			Usage: "The duration that the records are kept in the database. 0 means unlimited time.",
+			Validate: func(value interface{}) (err error) {
+				if value.(time.Duration) < 0 {
+					err = fmt.Errorf("Retention must not be negative: %s", value)
+				}
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:    "partitions",
+			Type:    basenine.STORAGE_ARG_INT,
+			Default: strconv.Itoa(NATIVE_STORAGE_DEFAULT_PARTITIONS),
+			Usage:   "The number of live partitions that the database size limit is divided into.",
+			Validate: func(value interface{}) (err error) {
+				if value.(int64) < 2 {
+					err = fmt.Errorf("Number of partitions must be at least 2: %d", value)
+				}
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:    "sync",
+			Type:    basenine.STORAGE_ARG_STRING,
+			Default: "none",
+			Usage:   "When to fsync the database partitions and the core dumps: none, interval or always.",
+			Validate: func(value interface{}) (err error) {
+				_, err = parseSyncMode(value.(string))
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:  "recover",
+			Type:  basenine.STORAGE_ARG_BOOL,
+			Usage: "Rebuild the offset index by scanning the database partitions on startup.",
+		},
+		basenine.StorageOption{
+			Name:  "archive-dir",
+			Type:  basenine.STORAGE_ARG_STRING,
+			Usage: "The directory that the removed partitions are archived into.",
+		},
+		basenine.StorageOption{
+			Name:  "archive-limit",
+			Type:  basenine.STORAGE_ARG_INT,
+			Usage: "The maximum size of the archive directory in bytes. 0 means unlimited size.",
+			Validate: func(value interface{}) (err error) {
+				if value.(int64) < 0 {
+					err = fmt.Errorf("Archive limit must not be negative: %d", value)
+				}
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:  "zone-maps",
+			Type:  basenine.STORAGE_ARG_LIST,
+			Usage: "The paths of the numeric fields that have zone maps in addition to timestamp.",
+			Validate: func(value interface{}) (err error) {
+				_, err = newZoneMaps(value.([]string))
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:  "bloom-filters",
+			Type:  basenine.STORAGE_ARG_LIST,
+			Usage: "The paths of the fields that have Bloom filters. * adds all of the values.",
+			Validate: func(value interface{}) (err error) {
+				_, err = newBloomIndex(value.([]string))
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:  "full-text",
+			Type:  basenine.STORAGE_ARG_LIST,
+			Usage: "The paths of the fields that have full-text indexes for the search helper.",
+			Validate: func(value interface{}) (err error) {
+				_, err = newFullTextIndexes(value.([]string))
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:  "checksums",
+			Type:  basenine.STORAGE_ARG_LIST,
+			Usage: "The paths of the fields whose values are hashed into the checksums of the records.",
+			Validate: func(value interface{}) (err error) {
+				_, err = newChecksumIndex(value.([]string), nil)
+				return
+			},
+		},
+		basenine.StorageOption{
+			Name:  "dictionary",
+			Type:  basenine.STORAGE_ARG_BOOL,
+			Usage: "Dictionary encode the repeated strings in the partitions. Cannot be combined with the compression.",
+		},
+	)
+}
+
+// newNativeStorageFromArgs is the factory of the native storage driver in the storage driver registry.
+func newNativeStorageFromArgs(persistent bool, args basenine.StorageArgs) (storage basenine.Storage, err error) {
+	options, err := nativeStorageOptionsFromArgs(args)
+	if err != nil {
+		return
+	}
+
+	storage = NewNativeStorageWithOptions(persistent, options)
+	return
+}
+
+// ParseNativeStorageArgs parses the comma separated key=value pairs given through
+// the -storage-args flag into NativeStorageOptions. Such as: compression=zstd,block-size=65536,data-dir=/var/lib/basenine,retention=24h,partitions=10,archive-dir=/var/lib/basenine/archive,sync=interval,zone-maps=response.status:elapsedTime,bloom-filters=*,full-text=response.body,checksums=request.path,dictionary=true
+func ParseNativeStorageArgs(text string) (options NativeStorageOptions, err error) {
+	args, err := basenine.ParseStorageArgs(NATIVE_STORAGE_DRIVER, text)
+	if err != nil {
+		return
+	}
+
+	return nativeStorageOptionsFromArgs(args)
+}
+
+// nativeStorageOptionsFromArgs converts the parsed arguments of the native storage driver into NativeStorageOptions.
+func nativeStorageOptionsFromArgs(args basenine.StorageArgs) (options NativeStorageOptions, err error) {
+	options = NativeStorageOptions{
+		Recover:      args.Bool("recover"),
+		Compression:  args.String("compression"),
+		BlockSize:    int(args.Int("block-size")),
+		DataDir:      args.String("data-dir"),
+		Retention:    args.Duration("retention"),
+		Partitions:   int(args.Int("partitions")),
+		ArchiveDir:   args.String("archive-dir"),
+		ArchiveLimit: args.Int("archive-limit"),
+		Sync:         args.String("sync"),
+		ZoneMaps:     args.List("zone-maps"),
+		BloomFilters: args.List("bloom-filters"),
+		FullText:     args.List("full-text"),
+		Checksums:    args.List("checksums"),
+		Dictionary:   args.Bool("dictionary"),
+	}
+
+	if options.Dictionary && options.Compression != "" && options.Compression != "none" {
+		err = ErrDictionaryWithCompression
+	}
+	return
+}
+
 // nativeStorage is a mutually excluded struct that contains a list of fields that
 // needs to be safely accessed data across multiple goroutines.
 //
@@ -42,9 +316,8 @@ var nativeStorageCoreDumpLock NativeStorageCoreDumpLock
 //
 // lastOffset contains the offset of the latest inserted record into the database.
 //
-// partitionRefs is a slice that contains the corresponding partition references of offsets.
-//
-// offsets is a slice that contains the offsets of each individual records inserted into the database.
+// offsets is the disk-backed index that contains the offsets of each individual records inserted
+// into the database along with the corresponding partition references.
 //
 // partitions is a slice of file descriptors that refers to the database partitions.
 //
@@ -52,74 +325,211 @@ var nativeStorageCoreDumpLock NativeStorageCoreDumpLock
 // is a reference to partitions slice's index and it's often times equal to len(partitions).
 // Initial value of partitionIndex should be -1. -1 means there are no partitions yet.
 //
-// partitionSizeLimit is the value of database partition size limit. 0 means unlimited size.
+// partitionSizeLimit is the value of database partition size limit, which is the database size limit
+// divided by the number of live partitions. 0 means unlimited size.
+//
+// retention is the duration that the records are kept in the database. 0 means unlimited time.
 //
-// truncatedTimestamp is the timestamp of database truncation event upon size limiting.
+// truncatedTimestamp is the timestamp of database truncation event upon size limiting or retention.
 //
-// removedOffsetsCounter is the counter of how many offsets are removed through size limiting.
+// removedOffsetsCounter is the counter of how many offsets are removed through size limiting or retention.
 //
 // macros is the map of strings where the key is the macro and value is the expanded form.
 //
 // insertionFilter is the filter that's applied just before the insertion of every individual record.
 //
 // insertionFilterExpr is the parsed version of insertionFilter
+//
+// corruptedRecordsCounter is the counter of how many corrupted records are skipped while reading.
+//
+// notifier broadcasts the insertions to the streams in QUERY mode.
+//
+// options is the set of options that's given on initialization.
+//
+// compression is the codec that's used for compressing the blocks.
+// NATIVE_STORAGE_COMPRESSION_NONE means the records are not written in blocks.
+//
+// pendingRecords are the records that are waiting to be compressed and written as a block.
+//
+// pendingDecoded are the decoded pendingRecords. The records are added to the secondary indexes,
+// the Bloom filters and the zone maps once their block is flushed into a partition.
+//
+// pendingSize is the total size of pendingRecords in bytes.
+//
+// blockCache keeps the recently decompressed blocks.
+//
+// archives is the list of archived partitions in ascending order.
+//
+// syncMode is the durability mode that decides when the writes are fsynced.
+//
+// hashIndexes are the secondary indexes on the fields that are declared through the INDEX mode.
+//
+// zoneMaps keep the ranges of the values of `timestamp` and the numeric fields given through
+// the options for each partition.
+//
+// bloomIndex keeps the Bloom filters of the partitions. nil means the Bloom filters are disabled.
+//
+// fullTextIndexes are the inverted indexes on the fields that are given through the options.
+//
+// checksums keeps the checksums of the values of the records. nil means the checksums are disabled.
+//
+// dictionaries keeps the dictionaries of the partitions in case of the dictionary encoding.
+//
+// writes is read locked by the inserts from the moment that they reserve their offsets until their
+// records are written into the partition. Such that a snapshot can wait for the in-flight writes.
+//
+// flushes serializes the flushes of the pending records.
 type nativeStorage struct {
 	sync.RWMutex
-	version               string
-	lastOffset            int64
-	partitionRefs         []int64
-	offsets               []int64
-	partitions            []*os.File
-	partitionIndex        int64
-	partitionSizeLimit    int64
-	truncatedTimestamp    int64
-	removedOffsetsCounter uint64
-	macros                map[string]string
-	insertionFilter       string
-	insertionFilterExpr   *basenine.Expression
-	watcher               *fsnotify.Watcher
+	version                 string
+	lastOffset              int64
+	offsets                 *offsetIndex
+	partitions              []*os.File
+	partitionIndex          int64
+	partitionSizeLimit      int64
+	retention               time.Duration
+	truncatedTimestamp      int64
+	removedOffsetsCounter   uint64
+	macros                  map[string]string
+	insertionFilter         string
+	insertionFilterExpr     *basenine.Expression
+	corruptedRecordsCounter uint64
+	notifier                *basenine.Notifier
+	options                 NativeStorageOptions
+	compression             byte
+	pendingRecords          [][]byte
+	pendingDecoded          []map[string]interface{}
+	pendingSize             int
+	blockCache              *blockCache
+	archives                []*nativeArchive
+	syncMode                byte
+	hashIndexes             []*hashIndex
+	zoneMaps                []*zoneMap
+	bloomIndex              *bloomIndex
+	fullTextIndexes         []*hashIndex
+	checksums               *checksumIndex
+	dictionaries            *dictionaryCache
+	writes                  sync.RWMutex
+	flushes                 sync.Mutex
 }
 
 // Unmutexed, file descriptor clean version of nativeStorage for achieving core dump.
+// PartitionRefs and Offsets are only read from the legacy cores that contain the whole
+// offset index. IndexSegments refers to the offset index files instead.
 type nativeStorageExport struct {
 	Version               string
 	LastOffset            int64
 	PartitionRefs         []int64
 	Offsets               []int64
+	IndexSegments         []nativeStorageIndexSegmentExport
 	PartitionPaths        []string
 	PartitionIndex        int64
 	PartitionSizeLimit    int64
+	Retention             time.Duration
 	TruncatedTimestamp    int64
 	RemovedOffsetsCounter uint64
 	Macros                map[string]string
 	InsertionFilter       string
+	IndexedPaths          []string
+	ZoneMaps              []nativeStorageZoneMapExport
+	ChecksumPaths         []string
+	ChecksumSegments      []nativeStorageIndexSegmentExport
 }
 
+// The interval that an idle QUERY stream checks whether its connection is still alive.
+const nativeStorageStreamCheckInterval time.Duration = 1 * time.Second
+
 // Core dump filename
 const nativeStorageCoreDumpFilename string = "basenine.gob"
 const nativeStorageCoreDumpFilenameTemp string = "basenine_tmp.gob"
 
+// Lock filename that prevents two servers from using the same data directory
+const nativeStorageLockFilename string = "basenine.lock"
+
+// Serves as the registry of the data directories that are locked by this process.
+// Multiple storages in the same process share the lock of a directory.
+var nativeStorageDirectoryLocks = struct {
+	sync.Mutex
+	files map[string]*os.File
+}{files: make(map[string]*os.File)}
+
 // Serves as a core dump lock
 type NativeStorageCoreDumpLock struct {
 	sync.Mutex
 }
 
+// NewNativeStorage creates a native storage with the default options.
 func NewNativeStorage(persistent bool) (storage basenine.Storage) {
-	// Initiate the watcher
-	watcher, err := fsnotify.NewWatcher()
+	return NewNativeStorageWithOptions(persistent, NativeStorageOptions{})
+}
+
+// NewNativeStorageWithOptions creates a native storage with the given options.
+func NewNativeStorageWithOptions(persistent bool, options NativeStorageOptions) (storage basenine.Storage) {
+	var compression byte
+	if options.Compression != "" {
+		var err error
+		compression, err = parseCompression(options.Compression)
+		basenine.Check(err)
+	}
+
+	var syncMode byte
+	if options.Sync != "" {
+		var err error
+		syncMode, err = parseSyncMode(options.Sync)
+		basenine.Check(err)
+	}
+
+	if options.Dictionary && compression != NATIVE_STORAGE_COMPRESSION_NONE {
+		basenine.Check(ErrDictionaryWithCompression)
+	}
+
+	if options.BlockSize <= 0 {
+		options.BlockSize = NATIVE_STORAGE_DEFAULT_BLOCK_SIZE
+	}
+
+	if options.DataDir == "" {
+		options.DataDir = "."
+	}
+
+	if options.Partitions < 2 {
+		options.Partitions = NATIVE_STORAGE_DEFAULT_PARTITIONS
+	}
+
+	// Create the data directory and lock it, before touching any of the files in it.
+	err := os.MkdirAll(options.DataDir, 0755)
 	basenine.Check(err)
+	err = lockDataDirectory(options.DataDir)
+	basenine.Check(err)
+
+	if options.ArchiveDir != "" {
+		err = os.MkdirAll(options.ArchiveDir, 0755)
+		basenine.Check(err)
+	}
 
 	// Initialize the native storage.
-	storage = &nativeStorage{
+	native := &nativeStorage{
 		version:        basenine.VERSION,
 		partitionIndex: -1,
 		macros:         make(map[string]string),
-		watcher:        watcher,
-	}
-
-	// Initialize the core dump lock.
-	nativeStorageCoreDumpLock = NativeStorageCoreDumpLock{}
+		notifier:       basenine.NewNotifier(),
+		options:        options,
+		retention:      options.Retention,
+		compression:    compression,
+		syncMode:       syncMode,
+		blockCache:     newBlockCache(),
+		dictionaries:   newDictionaryCache(),
+	}
+	native.offsets = newOffsetIndex(native.indexPath)
+	native.zoneMaps, err = newZoneMaps(options.ZoneMaps)
+	basenine.Check(err)
+	native.bloomIndex, err = newBloomIndex(options.BloomFilters)
+	basenine.Check(err)
+	native.fullTextIndexes, err = newFullTextIndexes(options.FullText)
+	basenine.Check(err)
+	native.checksums, err = newChecksumIndex(options.Checksums, native.checksumPath)
+	basenine.Check(err)
 
+	storage = native
 	storage.Init(persistent)
 
 	return
@@ -137,12 +547,93 @@ func (storage *nativeStorage) Init(persistent bool) (err error) {
 		if err == nil {
 			isRestored = true
 		}
+		// Recovering from the partitions would overwrite a core that's written by a newer version.
+		if errors.Is(err, ErrUnsupportedCoreFormat) {
+			basenine.Check(err)
+		}
+	}
+
+	// Rebuild the offset index from the partitions if it's explicitly requested
+	// or if the core is missing or older than the partitions in persistent mode.
+	if storage.options.Recover || (persistent && (!isRestored || storage.isCoreStale())) {
+		err := storage.RecoverCore()
+		if err == nil {
+			isRestored = true
+		} else {
+			log.Printf("Warning while recovering the core: %v\n", err)
+		}
+	}
+
+	// The retention that's given on initialization overrides the restored one.
+	if storage.options.Retention > 0 {
+		storage.Lock()
+		storage.retention = storage.options.Retention
+		storage.Unlock()
 	}
 
 	if !isRestored {
 		// Clean up the database files.
 		storage.removeDatabaseFiles()
+		storage.Lock()
+		storage.removeArchives()
+		storage.resetZoneMaps()
+		storage.resetBloomIndex()
+		storage.resetChecksums()
+		storage.Unlock()
 		storage.newPartition()
+	} else if storage.options.ArchiveDir != "" {
+		err := storage.loadArchives()
+		if err != nil {
+			log.Printf("Warning while loading the archive: %v\n", err)
+		}
+	}
+
+	// Rebuild the secondary indexes that are restored from the core and the full-text indexes.
+	storage.RLock()
+	hashIndexes := storage.invertedIndexes()
+	end := storage.offsets.Len() + storage.removedOffsetsCounter
+	storage.RUnlock()
+	for _, index := range hashIndexes {
+		storage.buildHashIndex(index, end)
+	}
+
+	// Compute the zone maps that are not restored from the core.
+	storage.RLock()
+	zoneMaps := storage.zoneMaps
+	storage.RUnlock()
+	for _, zoneMap := range zoneMaps {
+		storage.RLock()
+		ready := zoneMap.ready
+		storage.RUnlock()
+		if !ready {
+			storage.buildZoneMap(zoneMap, end)
+		}
+	}
+
+	// Compute the Bloom filters of the restored records.
+	storage.RLock()
+	bloomIndex := storage.bloomIndex
+	storage.RUnlock()
+	if bloomIndex != nil {
+		storage.RLock()
+		ready := bloomIndex.ready
+		storage.RUnlock()
+		if !ready {
+			storage.buildBloomIndex(bloomIndex, end)
+		}
+	}
+
+	// Compute the checksums that are not restored from the core.
+	storage.RLock()
+	checksums := storage.checksums
+	storage.RUnlock()
+	if checksums != nil {
+		storage.RLock()
+		ready := checksums.ready
+		storage.RUnlock()
+		if !ready {
+			storage.buildChecksums(checksums, end)
+		}
 	}
 
 	// Trigger partitioning check for every second.
@@ -151,26 +642,95 @@ func (storage *nativeStorage) Init(persistent bool) (err error) {
 	return
 }
 
-// DumpCore dumps the core into a file named "basenine.gob"
+// DumpCore dumps the core into a file named "basenine.gob" in the data directory.
+// The core is preceded by a header that declares its format, see writeNativeStorageCore.
 func (storage *nativeStorage) DumpCore(silent bool, dontLock bool) (err error) {
 	nativeStorageCoreDumpLock.Lock()
+	defer nativeStorageCoreDumpLock.Unlock()
+
 	var f *os.File
-	f, err = os.Create(nativeStorageCoreDumpFilenameTemp)
+	f, err = os.Create(storage.dataPath(nativeStorageCoreDumpFilenameTemp))
 	if err != nil {
 		return
 	}
 	defer f.Close()
-	encoder := gob.NewEncoder(f)
 
-	// nativeStorage has an embedded mutex. Therefore it cannot be dumped directly.
-	var csExport nativeStorageExport
 	if !dontLock {
 		storage.Lock()
 	}
+	var csExport nativeStorageExport
+	csExport, err = storage.exportCore(storage.syncMode != NATIVE_STORAGE_SYNC_NONE)
+	if err != nil {
+		if !dontLock {
+			storage.Unlock()
+		}
+		return
+	}
+
+	var current *os.File
+	if storage.partitionIndex >= 0 && int(storage.partitionIndex) < len(storage.partitions) {
+		current = storage.partitions[storage.partitionIndex]
+	}
+	if !dontLock {
+		storage.Unlock()
+	}
+
+	// The records that the core refers to must be on the disk before the core itself.
+	if storage.syncMode != NATIVE_STORAGE_SYNC_NONE && current != nil {
+		err = current.Sync()
+		if err == nil {
+			err = storage.dictionaries.sync(current.Name())
+		}
+		if err != nil {
+			log.Printf("Error while syncing the partition: %v\n", err.Error())
+			return
+		}
+	}
+
+	err = writeNativeStorageCore(f, csExport)
+	if err != nil {
+		log.Printf("Error while dumping the core: %v\n", err.Error())
+		return
+	}
+
+	if storage.syncMode != NATIVE_STORAGE_SYNC_NONE {
+		err = f.Sync()
+		if err != nil {
+			log.Printf("Error while syncing the core: %v\n", err.Error())
+			return
+		}
+	}
+
+	os.Rename(storage.dataPath(nativeStorageCoreDumpFilenameTemp), storage.dataPath(nativeStorageCoreDumpFilename))
+
+	if storage.syncMode != NATIVE_STORAGE_SYNC_NONE {
+		err = syncDirectory(storage.options.DataDir)
+		if err != nil {
+			log.Printf("Error while syncing the data directory: %v\n", err.Error())
+			return
+		}
+	}
+
+	if !silent {
+		log.Printf("Dumped the core to: %s\n", storage.dataPath(nativeStorageCoreDumpFilename))
+	}
+	return
+}
+
+// exportCore returns the core to be dumped. The entries of the offset index and the checksums
+// that are not written into their files yet are flushed, and synced if sync is true.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) exportCore(sync bool) (csExport nativeStorageExport, err error) {
+	// nativeStorage has an embedded mutex. Therefore it cannot be dumped directly.
 	csExport.Version = storage.version
 	csExport.LastOffset = storage.lastOffset
-	csExport.PartitionRefs = storage.partitionRefs
-	csExport.Offsets = storage.offsets
+	// Only the entries that are not written into the index files yet are flushed.
+	err = storage.offsets.Flush(sync)
+	if err != nil {
+		log.Printf("Error while flushing the offset index: %v\n", err.Error())
+		return
+	}
+	csExport.IndexSegments = storage.offsets.Export()
 	for _, partition := range storage.partitions {
 		partitionPath := ""
 		if partition != nil {
@@ -180,43 +740,41 @@ func (storage *nativeStorage) DumpCore(silent bool, dontLock bool) (err error) {
 	}
 	csExport.PartitionIndex = storage.partitionIndex
 	csExport.PartitionSizeLimit = storage.partitionSizeLimit
+	csExport.Retention = storage.retention
 	csExport.TruncatedTimestamp = storage.truncatedTimestamp
 	csExport.RemovedOffsetsCounter = storage.removedOffsetsCounter
 	csExport.Macros = storage.macros
 	csExport.InsertionFilter = storage.insertionFilter
-	if !dontLock {
-		storage.Unlock()
-	}
-
-	err = encoder.Encode(csExport)
-	if err != nil {
-		log.Printf("Error while dumping the core: %v\n", err.Error())
-		return
+	for _, index := range storage.hashIndexes {
+		csExport.IndexedPaths = append(csExport.IndexedPaths, index.path)
 	}
-
-	os.Rename(nativeStorageCoreDumpFilenameTemp, nativeStorageCoreDumpFilename)
-
-	if !silent {
-		log.Printf("Dumped the core to: %s\n", nativeStorageCoreDumpFilename)
+	csExport.ZoneMaps = storage.exportZoneMaps()
+	if storage.checksums != nil && storage.checksums.ready {
+		err = storage.checksums.entries.Flush(sync)
+		if err != nil {
+			log.Printf("Error while flushing the checksums: %v\n", err.Error())
+			return
+		}
+		csExport.ChecksumPaths = storage.checksums.paths
+		csExport.ChecksumSegments = storage.checksums.entries.Export()
 	}
-	nativeStorageCoreDumpLock.Unlock()
 	return
 }
 
 // RestoreCore restores the core from a file named "basenine.gob"
-// if it's present in current working directory
+// if it's present in the data directory. The cores of the older formats are migrated
+// and the newer formats are refused with ErrUnsupportedCoreFormat.
 func (storage *nativeStorage) RestoreCore() (err error) {
 	var f *os.File
-	f, err = os.Open(nativeStorageCoreDumpFilename)
+	f, err = os.Open(storage.dataPath(nativeStorageCoreDumpFilename))
 	if err != nil {
 		log.Printf("Warning while restoring the core: %v\n", err)
 		return
 	}
 	defer f.Close()
-	decoder := gob.NewDecoder(f)
 
-	var csExport nativeStorageExport
-	err = decoder.Decode(&csExport)
+	// The core is migrated to the current format, such that it's owned by this version from now on.
+	csExport, header, err := readNativeStorageCore(f)
 	if err != nil {
 		log.Printf("Error while restoring the core: %v\n", err.Error())
 		return
@@ -225,8 +783,26 @@ func (storage *nativeStorage) RestoreCore() (err error) {
 	storage.Lock()
 	storage.version = basenine.VERSION
 	storage.lastOffset = csExport.LastOffset
-	storage.partitionRefs = csExport.PartitionRefs
-	storage.offsets = csExport.Offsets
+	if csExport.IndexSegments != nil {
+		err = storage.offsets.Import(csExport.IndexSegments)
+	} else {
+		// Migrate the offset index of a legacy core into the index files.
+		storage.offsets.Reset()
+		for i, offset := range csExport.Offsets {
+			err = storage.offsets.Append(csExport.PartitionRefs[i], offset)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = storage.offsets.Flush(false)
+		}
+	}
+	if err != nil {
+		storage.Unlock()
+		log.Printf("Error while restoring the offset index: %v\n", err.Error())
+		return
+	}
 	for _, partitionPath := range csExport.PartitionPaths {
 		if partitionPath == "" {
 			storage.partitions = append(storage.partitions, nil)
@@ -238,22 +814,34 @@ func (storage *nativeStorage) RestoreCore() (err error) {
 			return
 		}
 		storage.partitions = append(storage.partitions, paritition)
-
-		err = storage.watcher.Add(paritition.Name())
-		if err != nil {
-			return
-		}
 	}
 	storage.partitionIndex = csExport.PartitionIndex
 	storage.partitionSizeLimit = csExport.PartitionSizeLimit
+	storage.retention = csExport.Retention
 	storage.truncatedTimestamp = csExport.TruncatedTimestamp
 	storage.removedOffsetsCounter = csExport.RemovedOffsetsCounter
 	storage.macros = csExport.Macros
 	storage.insertionFilter = csExport.InsertionFilter
 	storage.insertionFilterExpr, _, _ = storage.PrepareQuery(storage.insertionFilter, csExport.Macros)
+	storage.hashIndexes = nil
+	for _, path := range csExport.IndexedPaths {
+		var jsonPath jp.Expr
+		path, jsonPath, err = basenine.ParseIndexPath(path)
+		if err != nil {
+			storage.Unlock()
+			return
+		}
+		storage.hashIndexes = append(storage.hashIndexes, &hashIndex{
+			path:     path,
+			jsonPath: jsonPath,
+		})
+	}
+	storage.importZoneMaps(csExport.ZoneMaps)
+	storage.importChecksums(csExport.ChecksumPaths, csExport.ChecksumSegments)
+	storage.invalidateBloomIndex()
 	storage.Unlock()
 
-	log.Printf("Restored the core from: %s\n", nativeStorageCoreDumpFilename)
+	log.Printf("Restored the core from: %s (version: %s, format: %d)\n", storage.dataPath(nativeStorageCoreDumpFilename), header.Version, header.Format)
 	return
 }
 
@@ -278,58 +866,258 @@ func (storage *nativeStorage) InsertData(data []byte) (insertedId interface{}, e
 	insertionFilter := storage.insertionFilter
 	insertionFilterExpr := storage.insertionFilterExpr
 	storage.RUnlock()
-	if len(insertionFilter) > 0 {
-		var truth bool
-		var record string
-		truth, record, err = basenine.Eval(insertionFilterExpr, string(data))
-		if err != nil {
-			return
-		}
-		if !truth {
-			return
-		}
-		data = []byte(record)
-	}
 
-	var d map[string]interface{}
-	if err = json.Unmarshal(data, &d); err != nil {
+	d, err := decodeRecord(data, insertionFilter, insertionFilterExpr)
+	if d == nil || err != nil {
 		return
 	}
 
 	var lastOffset int64
 	// Safely access the last offset and current partition.
 	storage.Lock()
-	l := len(storage.offsets) + int(storage.removedOffsetsCounter)
+	l := int(storage.offsets.Len()) + int(storage.removedOffsetsCounter) + len(storage.pendingRecords)
 	lastOffset = storage.lastOffset
-	f := storage.partitions[storage.partitionIndex]
+	partitionIndex := storage.partitionIndex
+	f := storage.partitions[partitionIndex]
 
 	// Set "id" field to the index of the record.
-	insertedId = basenine.IndexToID(l)
-	d["id"] = insertedId
+	id := basenine.IndexToID(l)
+	d["id"] = id
 
 	// Marshal it back.
 	data, _ = json.Marshal(d)
 
-	// Calculate the length of bytes.
-	var length int64 = int64(len(data))
-	b := make([]byte, 8)
-	binary.LittleEndian.PutUint64(b, uint64(length))
+	// In case of block compression, the record is queued into the pending block.
+	if storage.compression != NATIVE_STORAGE_COMPRESSION_NONE {
+		insertedId = id
+		storage.pendingRecords = append(storage.pendingRecords, data)
+		storage.pendingDecoded = append(storage.pendingDecoded, d)
+		storage.pendingSize += len(data)
+		isFull := storage.pendingSize >= storage.options.BlockSize || len(storage.pendingRecords) >= nativeStorageMaxBlockRecords
+		storage.Unlock()
+
+		err = storage.flushPendingRecords(isFull)
+		return
+	}
+
+	// Prepend the record header that contains the length and the checksum into the data.
+	// In case of the dictionary encoding, the repeated strings are replaced beforehand.
+	var encoded []byte
+	if storage.options.Dictionary {
+		encoded, err = storage.encodeDictionaryRecord(f.Name(), data)
+		if err != nil {
+			storage.Unlock()
+			return
+		}
+	} else {
+		encoded = encodeRecord(data)
+	}
 
 	// Safely update the offsets and paritition references.
-	storage.offsets = append(storage.offsets, lastOffset)
-	storage.partitionRefs = append(storage.partitionRefs, storage.partitionIndex)
-	storage.lastOffset = lastOffset + 8 + length
+	err = storage.offsets.Append(partitionIndex, lastOffset)
+	if err != nil {
+		storage.Unlock()
+		return
+	}
+
+	// Add the record to the secondary indexes, the Bloom filters and the zone maps
+	// once its offset is reserved, such that a failed insertion doesn't leave its ID behind.
+	checksum := storage.indexRecord(uint64(l), partitionIndex, data)
+	storage.zoneRecord(partitionIndex, d)
+	storage.appendChecksum(partitionIndex, checksum)
+	insertedId = id
+	data = encoded
+	storage.lastOffset = lastOffset + int64(len(data))
 
 	// Release the lock
+	storage.writes.RLock()
 	storage.Unlock()
 
-	// Prepend the length into the data.
-	data = append(b, data...)
-
 	// Write the record into database immediately after the last record.
 	// The offset is tracked by lastOffset which is storage.lastOffset
 	// WriteAt() is important here! Write() races.
 	_, err = f.WriteAt(data, lastOffset)
+	storage.writes.RUnlock()
+	if err == nil {
+		err = storage.syncWrite(f)
+	} else {
+		storage.markLostRecords(uint64(l), uint64(l)+1)
+	}
+
+	// Wake up all of the streams that are waiting for new records.
+	storage.notifier.Publish()
+	return
+}
+
+// InsertBatch inserts the given records into database at once.
+// The insertion filter is applied to all of the records first. Then the IDs and
+// the offsets are reserved under a single lock and the records are written into the
+// current database partition through a single write call.
+// insertedIds contains nil for the records that are filtered out or cannot be decoded,
+// and for the records that are not inserted since an error is returned.
+func (storage *nativeStorage) InsertBatch(batch [][]byte) (insertedIds []interface{}, err error) {
+	// partitionIndex -1 means there are not partitions created yet
+	// Safely access the current partition index
+	storage.RLock()
+	currentPartitionIndex := storage.partitionIndex
+	storage.RUnlock()
+	if currentPartitionIndex == -1 {
+		storage.newPartition()
+	}
+
+	storage.RLock()
+	insertionFilter := storage.insertionFilter
+	insertionFilterExpr := storage.insertionFilterExpr
+	storage.RUnlock()
+
+	decoded := make([]map[string]interface{}, len(batch))
+	for i, data := range batch {
+		var decodeErr error
+		decoded[i], decodeErr = decodeRecord(data, insertionFilter, insertionFilterExpr)
+		if decodeErr != nil {
+			log.Printf("Skipping the record in the batch: %v\n", decodeErr)
+		}
+	}
+
+	insertedIds = make([]interface{}, len(batch))
+
+	// Safely access the last offset and current partition.
+	storage.Lock()
+	l := int(storage.offsets.Len()) + int(storage.removedOffsetsCounter) + len(storage.pendingRecords)
+	lastOffset := storage.lastOffset
+	partitionIndex := storage.partitionIndex
+	f := storage.partitions[partitionIndex]
+
+	// The IDs of the records that are written through buf are in the [first, end) range.
+	first := storage.offsets.Len() + storage.removedOffsetsCounter
+
+	var buf []byte
+	for i, d := range decoded {
+		if d == nil {
+			continue
+		}
+
+		// Set "id" field to the index of the record.
+		insertedIds[i] = basenine.IndexToID(l)
+		d["id"] = insertedIds[i]
+		l++
+
+		// Marshal it back.
+		data, _ := json.Marshal(d)
+
+		// In case of block compression, the record is queued into the pending block.
+		if storage.compression != NATIVE_STORAGE_COMPRESSION_NONE {
+			storage.pendingRecords = append(storage.pendingRecords, data)
+			storage.pendingDecoded = append(storage.pendingDecoded, d)
+			storage.pendingSize += len(data)
+			continue
+		}
+
+		// In case of the dictionary encoding, the repeated strings are replaced.
+		var encoded []byte
+		if storage.options.Dictionary {
+			encoded, err = storage.encodeDictionaryRecord(f.Name(), data)
+		} else {
+			encoded = encodeRecord(data)
+		}
+
+		// Safely update the offsets and paritition references.
+		if err == nil {
+			err = storage.offsets.Append(partitionIndex, lastOffset+int64(len(buf)))
+		}
+		if err != nil {
+			// The records before it are still written. Neither this record nor the rest
+			// are indexed, such that their IDs are assigned to the next records.
+			insertedIds[i] = nil
+			break
+		}
+
+		// Add the record to the secondary indexes, the Bloom filters and the zone maps
+		// once its offset is reserved, such that a failed insertion doesn't leave its ID behind.
+		checksum := storage.indexRecord(uint64(l-1), partitionIndex, data)
+		storage.zoneRecord(partitionIndex, d)
+		storage.appendChecksum(partitionIndex, checksum)
+		buf = append(buf, encoded...)
+	}
+	storage.lastOffset = lastOffset + int64(len(buf))
+	end := storage.offsets.Len() + storage.removedOffsetsCounter
+	isFull := storage.pendingSize >= storage.options.BlockSize || len(storage.pendingRecords) >= nativeStorageMaxBlockRecords
+
+	// Release the lock
+	if len(buf) > 0 {
+		storage.writes.RLock()
+	}
+	storage.Unlock()
+
+	if storage.compression != NATIVE_STORAGE_COMPRESSION_NONE {
+		err = storage.flushPendingRecords(isFull)
+		return
+	}
+
+	if len(buf) == 0 {
+		return
+	}
+
+	// The records before the failed one are written even if the insertion failed.
+	indexErr := err
+
+	// Write all of the records immediately after the last record.
+	_, err = f.WriteAt(buf, lastOffset)
+	storage.writes.RUnlock()
+	if err == nil {
+		err = storage.syncWrite(f)
+	} else {
+		storage.markLostRecords(first, end)
+	}
+	if err == nil {
+		err = indexErr
+	}
+
+	// Wake up all of the streams that are waiting for new records.
+	storage.notifier.Publish()
+	return
+}
+
+// markLostRecords marks the records with the IDs in the [first, end) range as lost once their write fails.
+// Otherwise their offsets would stay reserved and the streams would wait for them to be written forever.
+func (storage *nativeStorage) markLostRecords(first uint64, end uint64) {
+	storage.Lock()
+	defer storage.Unlock()
+
+	// The records might be removed through the size limiting in the meantime.
+	if first < storage.removedOffsetsCounter {
+		first = storage.removedOffsetsCounter
+	}
+	if end <= first {
+		return
+	}
+
+	err := storage.offsets.MarkLost(first-storage.removedOffsetsCounter, end-storage.removedOffsetsCounter)
+	if err != nil {
+		log.Printf("Error while marking the records from %d to %d as lost: %v\n", first, end, err)
+	}
+}
+
+// decodeRecord applies the insertion filter, if it's not empty, to the record and unmarshals it
+// into a map[string]interface{}. d is nil if the record is filtered out.
+func decodeRecord(data []byte, insertionFilter string, insertionFilterExpr *basenine.Expression) (d map[string]interface{}, err error) {
+	if len(insertionFilter) > 0 {
+		var truth bool
+		var record string
+		truth, record, err = basenine.Eval(insertionFilterExpr, string(data))
+		if err != nil {
+			return
+		}
+		if !truth {
+			return
+		}
+		data = []byte(record)
+	}
+
+	err = json.Unmarshal(data, &d)
+	if err != nil {
+		d = nil
+	}
 	return
 }
 
@@ -389,6 +1177,9 @@ func (storage *nativeStorage) StreamRecords(conn net.Conn, _leftOff string, quer
 
 	limit := prop.Limit
 
+	// The plan narrows down the records through the secondary indexes and the zone maps.
+	plan := basenine.BuildPlan(expr)
+
 	leftOff, err := storage.handleSpecialLeftOff(_leftOff, 1)
 	if err != nil {
 		return
@@ -400,6 +1191,11 @@ func (storage *nativeStorage) StreamRecords(conn net.Conn, _leftOff string, quer
 	// Number of queried records
 	var queried uint64 = 0
 
+	// Subscribe before reading the offsets such that a record inserted
+	// in between cannot be missed.
+	sub := storage.notifier.Subscribe()
+	defer sub.Close()
+
 	for {
 		// f is the current partition we're reading the data from.
 		var f *os.File
@@ -420,30 +1216,53 @@ func (storage *nativeStorage) StreamRecords(conn net.Conn, _leftOff string, quer
 			leftOff = int64(storage.removedOffsetsCounter)
 			iLeftOff = 0
 		}
-		subOffsets := storage.offsets[iLeftOff:]
-		subPartitionRefs := storage.partitionRefs[iLeftOff:]
-		totalNumberOfRecords := len(storage.offsets)
+		totalNumberOfRecords := int(storage.offsets.Len())
+		subOffsets := &offsetCursor{
+			storage: storage,
+			first:   uint64(leftOff),
+			length:  uint64(totalNumberOfRecords) - uint64(iLeftOff),
+		}
+		subOffsets.ids = storage.lookupPlan(plan, subOffsets.first, subOffsets.first+subOffsets.length)
+		pruned := storage.prunePartitions(plan)
 		truncatedTimestamp := storage.truncatedTimestamp
 		storage.RUnlock()
 
 		var metadata *basenine.Metadata
 
 		// Iterate through the next part of the offsets
-		for i, offset := range subOffsets {
-			leftOff++
-			queried++
+		for i := 0; i < subOffsets.Len(); i++ {
+			// The offsets are read from the index through the cursor.
+			id, offset, partitionRef, cursorErr := subOffsets.At(i)
+
+			// The records that are skipped through the secondary indexes are also counted as queried.
+			queried += uint64(int64(id) + 1 - leftOff)
+			leftOff = int64(id) + 1
+
+			if cursorErr != nil {
+				continue
+			}
+
+			// The partitions that cannot contain a match according to the zone maps are skipped.
+			if pruned[partitionRef] {
+				continue
+			}
+
+			// The records whose checksums cannot satisfy the `==` comparisons are skipped without being read.
+			if checksum, ok := subOffsets.Checksum(i); ok && !storage.checksums.mayMatch(checksum, plan) {
+				continue
+			}
 
 			// Safely access the *os.File pointer that the current offset refers to.
-			var partitionRef int64
 			storage.RLock()
-			partitionRef = subPartitionRefs[i]
 			fRef := storage.partitions[partitionRef]
-			totalNumberOfRecords = len(storage.offsets)
+			currentPartitionIndex := storage.partitionIndex
+			totalNumberOfRecords = int(storage.offsets.Len())
 			truncatedTimestamp = storage.truncatedTimestamp
 			storage.RUnlock()
 
 			// File descriptor nil means; the partition is removed. So we pass this offset.
-			if fRef == nil {
+			// Negative offset means; the record is lost during a crash recovery.
+			if fRef == nil || offset < 0 {
 				continue
 			}
 
@@ -464,16 +1283,32 @@ func (storage *nativeStorage) StreamRecords(conn net.Conn, _leftOff string, quer
 				}
 			}
 
-			// Seek to the offset
-			f.Seek(offset, io.SeekStart)
-
 			// Read the record into b
 			var b []byte
-			b, _, err = storage.readRecord(f, offset)
+			b, _, err = storage.readMatchingRecord(f, offset, plan)
 
-			// Even if it's EOF, continue.
-			// Because a later offset might point to a previous region of the file.
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// The offset is reserved but the record is not completely written yet.
+				// Come back to it once the writer notifies.
+				if partitionRef == currentPartitionIndex {
+					leftOff--
+					queried--
+					break
+				}
+
+				// Otherwise, continue.
+				// Because a later offset might point to a previous region of the file.
+				continue
+			}
+
+			// Skip the corrupted record.
+			if isCorruptedRecord(err) {
+				storage.countCorruptedRecord(f, offset, err)
+				continue
+			}
+
+			// The dictionary encoded record cannot satisfy the query.
+			if b == nil {
 				continue
 			}
 
@@ -517,13 +1352,19 @@ func (storage *nativeStorage) StreamRecords(conn net.Conn, _leftOff string, quer
 			}
 		}
 
-		// Block until a partition is modified
-		storage.watchPartitions()
+		// Block until a partition is modified. Time out periodically
+		// to check whether the connection is closed by the peer or not.
+		sub.Wait(nativeStorageStreamCheckInterval)
+
+		if f != nil {
+			f.Close()
+		}
 	}
 }
 
 // RetrieveSingle fetches a single record from the database.
-func (storage *nativeStorage) RetrieveSingle(conn net.Conn, index string, query string) (err error) {
+// The archived records are also looked up if archived is true.
+func (storage *nativeStorage) RetrieveSingle(conn net.Conn, index string, query string, archived bool) (err error) {
 	// Convert index value provided as string to integer
 	_index, err := strconv.Atoi(index)
 	if err != nil {
@@ -533,25 +1374,36 @@ func (storage *nativeStorage) RetrieveSingle(conn net.Conn, index string, query
 
 	// Safely access the length of offsets slice.
 	storage.RLock()
-	l := len(storage.offsets) + int(storage.removedOffsetsCounter)
+	l := int(storage.offsets.Len()) + int(storage.removedOffsetsCounter)
 	removedOffsetsCounter := storage.removedOffsetsCounter
 	storage.RUnlock()
 
 	_index -= int(removedOffsetsCounter)
 
+	var n int64
+	var f *os.File
 	if _index < 0 {
-		conn.Write([]byte(fmt.Sprintf("Record does not exist!\n")))
-		return
-	}
+		if !archived {
+			conn.Write([]byte(fmt.Sprintf("Record does not exist!\n")))
+			return
+		}
 
-	// Check if the index is in the offsets slice.
-	if int(_index) > l {
-		conn.Write([]byte(fmt.Sprintf("Index out of range: %d\n", _index)))
-		return
-	}
+		// Safely access the archived offsets
+		var path string
+		n, path, err = storage.getArchivedOffset(uint64(_index + int(removedOffsetsCounter)))
+		if err == nil {
+			f, err = os.Open(path)
+		}
+	} else {
+		// Check if the index is in the offsets slice.
+		if int(_index) > l {
+			conn.Write([]byte(fmt.Sprintf("Index out of range: %d\n", _index)))
+			return
+		}
 
-	// Safely acces the offsets and partition references
-	n, f, err := storage.getOffsetAndPartition(uint64(_index))
+		// Safely acces the offsets and partition references
+		n, f, err = storage.getOffsetAndPartition(uint64(_index))
+	}
 
 	// Record can only be removed if the partition of the record
 	// that it belongs to is removed. Therefore a file open error
@@ -565,9 +1417,11 @@ func (storage *nativeStorage) RetrieveSingle(conn net.Conn, index string, query
 
 	// If we got to this point then it means the record is there
 	// Read it using its offset (which is n) and return it.
-	f.Seek(n, io.SeekStart)
 	var b []byte
 	b, _, err = storage.readRecord(f, n)
+	if isCorruptedRecord(err) {
+		storage.countCorruptedRecord(f, n, err)
+	}
 	f.Close()
 	if err != nil {
 		msg := fmt.Sprintf("Read error: %v\n", err)
@@ -622,7 +1476,8 @@ func (storage *nativeStorage) ValidateQuery(conn net.Conn, query string) (err er
 }
 
 // Fetch fetches records in prefered direction, starting from leftOff up to given limit
-func (storage *nativeStorage) Fetch(conn net.Conn, leftOff string, direction string, query string, limit string) (err error) {
+// The archived records are also fetched if archived is true.
+func (storage *nativeStorage) Fetch(conn net.Conn, leftOff string, direction string, query string, limit string, archived bool) (err error) {
 	// Parse the arguments
 	var _leftOff int64
 	_leftOff, err = storage.handleSpecialLeftOff(leftOff, 0)
@@ -647,7 +1502,7 @@ func (storage *nativeStorage) Fetch(conn net.Conn, leftOff string, direction str
 
 	// Safely access the length of offsets slice.
 	storage.RLock()
-	l := len(storage.offsets) + int(storage.removedOffsetsCounter)
+	l := int(storage.offsets.Len()) + int(storage.removedOffsetsCounter)
 	storage.RUnlock()
 
 	// Check if the leftOff is in the offsets slice.
@@ -685,27 +1540,67 @@ func (storage *nativeStorage) Fetch(conn net.Conn, leftOff string, direction str
 	}
 
 	// Safely access the next part of offsets and partition references.
-	var subOffsets []int64
-	var subPartitionRefs []int64
 	var totalNumberOfRecords uint64
 	var truncatedTimestamp int64
+	var removedOffsetsCounter uint64
 	storage.RLock()
-	totalNumberOfRecords = uint64(len(storage.offsets))
+	totalNumberOfRecords = storage.offsets.Len()
 	truncatedTimestamp = storage.truncatedTimestamp
-	iLeftOff := _leftOff - int64(storage.removedOffsetsCounter)
+	removedOffsetsCounter = storage.removedOffsetsCounter
+	iLeftOff := _leftOff - int64(removedOffsetsCounter)
 	if iLeftOff < 0 {
-		_leftOff = int64(storage.removedOffsetsCounter)
 		iLeftOff = 0
 	}
+	subOffsets := &offsetCursor{
+		storage: storage,
+		reverse: _direction < 0,
+	}
 	if _direction < 0 {
-		subOffsets = storage.offsets[:iLeftOff]
-		subPartitionRefs = storage.partitionRefs[:iLeftOff]
+		subOffsets.first = removedOffsetsCounter
+		subOffsets.length = uint64(iLeftOff)
 	} else {
-		subOffsets = storage.offsets[iLeftOff:]
-		subPartitionRefs = storage.partitionRefs[iLeftOff:]
+		subOffsets.first = removedOffsetsCounter + uint64(iLeftOff)
+		subOffsets.length = totalNumberOfRecords - uint64(iLeftOff)
 	}
+
+	// The plan narrows down the records through the secondary indexes and the zone maps.
+	plan := basenine.BuildPlan(expr)
+	subOffsets.ids = storage.lookupPlan(plan, subOffsets.first, subOffsets.first+subOffsets.length)
+	pruned := storage.prunePartitions(plan)
 	storage.RUnlock()
 
+	// Prepend the archived part of the offsets.
+	var archives []*nativeArchive
+	var archivedOffsets []int64
+	var archivedRefs []int64
+	var firstArchived uint64
+	if archived {
+		if _direction < 0 {
+			archives, archivedOffsets, archivedRefs, firstArchived = storage.getArchivedOffsets(0, uint64(_leftOff))
+		} else {
+			archives, archivedOffsets, archivedRefs, firstArchived = storage.getArchivedOffsets(uint64(_leftOff), removedOffsetsCounter)
+		}
+		for _, archive := range archives {
+			totalNumberOfRecords += uint64(len(archive.offsets))
+		}
+		subOffsets.archivedOffsets = archivedOffsets
+		subOffsets.archivedRefs = archivedRefs
+		subOffsets.archivedFirst = firstArchived
+	}
+
+	// The records before the removed ones can only be found in the archive.
+	if _leftOff < int64(removedOffsetsCounter) {
+		if !archived {
+			_leftOff = int64(removedOffsetsCounter)
+		} else if _direction >= 0 {
+			if len(archivedOffsets) > 0 {
+				_leftOff = int64(firstArchived)
+			} else {
+				_leftOff = int64(removedOffsetsCounter)
+			}
+		}
+	}
+
 	var metadata []byte
 
 	// Number of queried records
@@ -719,80 +1614,36 @@ func (storage *nativeStorage) Fetch(conn net.Conn, leftOff string, direction str
 		TruncatedTimestamp: truncatedTimestamp,
 	})
 
-	if _direction < 0 {
-		subOffsets = basenine.ReverseSlice(subOffsets)
-		subPartitionRefs = basenine.ReverseSlice(subPartitionRefs)
+	// A zero limit doesn't fetch anything.
+	if _limit <= 0 && subOffsets.Len() > 0 {
+		return
 	}
 
 	// Iterate through the next part of the offsets
-	for i, offset := range subOffsets {
-		if int(numberOfWritten) >= _limit {
-			return
-		}
-
+	var stopped bool
+	stopped, err = storage.readRecords(subOffsets, archives, plan, pruned, func(i int, id uint64, b []byte) (stop bool, err error) {
+		// The records that are skipped through the secondary indexes are also counted as queried.
 		if _direction < 0 {
-			_leftOff--
+			queried += uint64(_leftOff - int64(id))
+			_leftOff = int64(id)
 		} else {
-			_leftOff++
-		}
-
-		if _leftOff < 0 {
-			_leftOff = 0
-		}
-
-		queried++
-
-		// Safely access the *os.File pointer that the current offset refers to.
-		var partitionRef int64
-		storage.RLock()
-		partitionRef = subPartitionRefs[i]
-		fRef := storage.partitions[partitionRef]
-		storage.RUnlock()
-
-		// File descriptor nil means; the partition is removed. So we pass this offset.
-		if fRef == nil {
-			continue
-		}
-
-		// f == nil means we didn't open any partition yet.
-		// fRef.Name() != f.Name() means we're switching to the next partition.
-		if f == nil || fRef.Name() != f.Name() {
-			if f != nil && fRef.Name() != f.Name() {
-				// We're switching to the next partition, close the current partition.
-				f.Close()
-			}
-
-			// Open the partition that the current offset refers to.
-			f, err = os.Open(fRef.Name())
-
-			// If the file cannot be opened, pass.
-			if err != nil {
-				continue
-			}
+			queried += uint64(int64(id) + 1 - _leftOff)
+			_leftOff = int64(id) + 1
 		}
 
-		// Seek to the offset
-		f.Seek(offset, io.SeekStart)
-
-		// Read the record into b
-		var b []byte
-		b, _, err = storage.readRecord(f, offset)
-
-		// Even if it's EOF, continue.
-		// Because a later offset might point to a previous region of the file.
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			continue
+		if b == nil {
+			return
 		}
 
 		// Evaluate the current record against the given query.
-		truth, record, err := basenine.Eval(expr, string(b))
-		if err != nil {
-			log.Printf("Eval error: %v\n", err)
-			continue
+		truth, record, evalErr := basenine.Eval(expr, string(b))
+		if evalErr != nil {
+			log.Printf("Eval error: %v\n", evalErr)
+			return
 		}
 
 		var noMoreData bool
-		if i == len(subOffsets)-1 {
+		if i == subOffsets.Len()-1 {
 			noMoreData = true
 		}
 
@@ -808,24 +1659,139 @@ func (storage *nativeStorage) Fetch(conn net.Conn, leftOff string, direction str
 		_, err = conn.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_METADATA, string(metadata))))
 		if err != nil {
 			log.Printf("Write error: %v\n", err)
-			break
+			return
 		}
 
 		// Write the record into TCP connection if it passes the query.
 		if truth {
-			_, err := conn.Write([]byte(fmt.Sprintf("%s\n", record)))
+			_, err = conn.Write([]byte(fmt.Sprintf("%s\n", record)))
 			if err != nil {
 				log.Printf("Write error: %v\n", err)
-				break
+				return
 			}
 			numberOfWritten++
 		}
+
+		// Stop once the limit is reached, unless it's the last record.
+		stop = int(numberOfWritten) >= _limit && i < subOffsets.Len()-1
+		return
+	})
+	if stopped {
+		return
 	}
 
 	basenine.SendClose(conn)
 	return
 }
 
+// readRecords reads the records in the cursor one by one. The records are narrowed down through
+// the zone maps and the checksums according to the plan, in addition to the secondary indexes that
+// the cursor is built through. archives are the archived partitions that the cursor refers to.
+//
+// visit is called for every record in the cursor along with its position i in the cursor and its ID.
+// b is the record if it's read, otherwise it's nil since the record cannot match the plan, it's removed,
+// lost or corrupted. The reading stops once visit returns stop or an error.
+func (storage *nativeStorage) readRecords(cursor *offsetCursor, archives []*nativeArchive, plan *basenine.Plan, pruned map[int64]bool, visit func(i int, id uint64, b []byte) (stop bool, err error)) (stopped bool, err error) {
+	// f is the current partition we're reading the data from.
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	for i := 0; i < cursor.Len() && !stopped && err == nil; i++ {
+		// The offsets are read from the index through the cursor.
+		id, offset, partitionRef, cursorErr := cursor.At(i)
+
+		var b []byte
+		if cursorErr == nil {
+			b, f = storage.readCursorRecord(f, archives, plan, pruned, cursor, i, offset, partitionRef)
+		}
+
+		stopped, err = visit(i, id, b)
+	}
+	return
+}
+
+// readCursorRecord reads the record at the position i of the cursor through the partition f. opened is the partition
+// that's left open for the next record, which replaces f if the record is in another one. b is nil if the record is skipped.
+func (storage *nativeStorage) readCursorRecord(f *os.File, archives []*nativeArchive, plan *basenine.Plan, pruned map[int64]bool, cursor *offsetCursor, i int, offset int64, partitionRef int64) (b []byte, opened *os.File) {
+	opened = f
+
+	// The partitions that cannot contain a match according to the zone maps are skipped.
+	if partitionRef >= 0 && pruned[partitionRef] {
+		return
+	}
+
+	// The records whose checksums cannot satisfy the `==` comparisons are skipped without being read.
+	if checksum, ok := cursor.Checksum(i); ok && !storage.checksums.mayMatch(checksum, plan) {
+		return
+	}
+
+	// Safely access the path of the partition that the current offset refers to.
+	// Negative partition reference means; the offset refers to an archived partition.
+	var path string
+	if partitionRef < 0 {
+		path = archives[-partitionRef-1].path
+	} else {
+		storage.RLock()
+		fRef := storage.partitions[partitionRef]
+		if fRef != nil {
+			path = fRef.Name()
+		}
+		storage.RUnlock()
+	}
+
+	// Empty path means; the partition is removed. So we pass this offset.
+	// Negative offset means; the record is lost during a crash recovery or a failed write.
+	if path == "" || offset < 0 {
+		return
+	}
+
+	// opened == nil means we didn't open any partition yet.
+	// path != opened.Name() means we're switching to the next partition.
+	if opened == nil || path != opened.Name() {
+		if opened != nil {
+			// We're switching to the next partition, close the current partition.
+			opened.Close()
+		}
+
+		// Open the partition that the current offset refers to.
+		var err error
+		opened, err = os.Open(path)
+
+		// If the file cannot be opened, pass.
+		if err != nil {
+			opened = nil
+			return
+		}
+	}
+
+	// Read the record into b
+	b, _, err := storage.readMatchingRecord(opened, offset, plan)
+
+	// Even if it's EOF, continue.
+	// Because a later offset might point to a previous region of the file.
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		b = nil
+		return
+	}
+
+	// Skip the corrupted record.
+	if isCorruptedRecord(err) {
+		storage.countCorruptedRecord(opened, offset, err)
+		b = nil
+		return
+	}
+	if err != nil {
+		b = nil
+	}
+
+	// b is nil if the dictionary encoded record cannot satisfy the query.
+	return
+}
+
 // ApplyMacro defines a macro that will be expanded for each individual query.
 func (storage *nativeStorage) ApplyMacro(conn net.Conn, data []byte) (err error) {
 	str := string(data)
@@ -863,6 +1829,30 @@ func (storage *nativeStorage) SetLimit(conn net.Conn, data []byte) (err error) {
 	return
 }
 
+// SetRetention sets the duration like "24h" that the records are kept in the database.
+// "0" disables the time-based retention.
+func (storage *nativeStorage) SetRetention(conn net.Conn, data []byte) (err error) {
+	value, err := time.ParseDuration(string(data))
+
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While parsing the retention: %s\n", err.Error())))
+		return
+	}
+
+	if value < 0 {
+		err = fmt.Errorf("Retention must not be negative: %s", value)
+		conn.Write([]byte(fmt.Sprintf("Error: %s\n", err.Error())))
+		return
+	}
+
+	storage.Lock()
+	storage.retention = value
+	storage.Unlock()
+
+	basenine.SendOK(conn)
+	return
+}
+
 // SetInsertionFilter tries to set the given query as an insertion filter
 func (storage *nativeStorage) SetInsertionFilter(conn net.Conn, data []byte) (err error) {
 	query := string(data)
@@ -887,16 +1877,27 @@ func (storage *nativeStorage) SetInsertionFilter(conn net.Conn, data []byte) (er
 // Flush removes all the records in the database.
 func (storage *nativeStorage) Flush() (err error) {
 	storage.Lock()
-	storage.removeAllWatchers()
 	storage.lastOffset = 0
-	storage.partitionRefs = []int64{}
-	storage.offsets = []int64{}
+	storage.offsets.Reset()
 	storage.partitions = []*os.File{}
 	storage.partitionIndex = -1
 	storage.partitionSizeLimit = 0
+	storage.retention = storage.options.Retention
 	storage.truncatedTimestamp = 0
 	storage.removedOffsetsCounter = 0
+	storage.pendingRecords = nil
+	storage.pendingDecoded = nil
+	storage.pendingSize = 0
+	for _, index := range storage.invertedIndexes() {
+		index.buckets = nil
+	}
+	storage.resetZoneMaps()
+	storage.resetBloomIndex()
+	storage.resetChecksums()
 	storage.removeDatabaseFiles()
+	storage.removeArchives()
+	storage.blockCache.clear()
+	storage.dictionaries.clear()
 	storage.DumpCore(true, true)
 	storage.Unlock()
 	storage.newPartition()
@@ -907,20 +1908,32 @@ func (storage *nativeStorage) Flush() (err error) {
 // resets the core's state into its initial form.
 func (storage *nativeStorage) Reset() (err error) {
 	storage.Lock()
-	storage.removeAllWatchers()
 	storage.version = basenine.VERSION
 	storage.macros = make(map[string]string)
 	storage.insertionFilter = ""
 	storage.insertionFilterExpr = nil
 	storage.lastOffset = 0
-	storage.partitionRefs = []int64{}
-	storage.offsets = []int64{}
+	storage.offsets.Reset()
 	storage.partitions = []*os.File{}
 	storage.partitionIndex = -1
 	storage.partitionSizeLimit = 0
+	storage.retention = storage.options.Retention
 	storage.truncatedTimestamp = 0
 	storage.removedOffsetsCounter = 0
+	storage.pendingRecords = nil
+	storage.pendingDecoded = nil
+	storage.pendingSize = 0
+	storage.hashIndexes = nil
+	for _, index := range storage.fullTextIndexes {
+		index.buckets = nil
+	}
+	storage.resetZoneMaps()
+	storage.resetBloomIndex()
+	storage.resetChecksums()
 	storage.removeDatabaseFiles()
+	storage.removeArchives()
+	storage.blockCache.clear()
+	storage.dictionaries.clear()
 	storage.DumpCore(true, true)
 	storage.Unlock()
 	storage.newPartition()
@@ -929,8 +1942,6 @@ func (storage *nativeStorage) Reset() (err error) {
 
 // HandleExit gracefully exists the server accordingly. Dumps core if "-persistent" enabled.
 func (storage *nativeStorage) HandleExit(sig syscall.Signal, persistent bool) (err error) {
-	storage.watcher.Close()
-
 	// 128: killed by a signal and dumped core
 	// + the signal value.
 	exitCode := int(128 + sig)
@@ -940,6 +1951,8 @@ func (storage *nativeStorage) HandleExit(sig syscall.Signal, persistent bool) (e
 		os.Exit(exitCode)
 	}
 
+	// Write the pending records before dumping the core.
+	storage.flushBlock()
 	storage.DumpCore(false, false)
 
 	os.Exit(exitCode)
@@ -950,31 +1963,91 @@ func (storage *nativeStorage) HandleExit(sig syscall.Signal, persistent bool) (e
 // Such that the filename increments according to the partition index.
 func (storage *nativeStorage) newPartition() *os.File {
 	storage.Lock()
+	// Sync the tail of the previous partition before leaving it behind.
+	if storage.syncMode != NATIVE_STORAGE_SYNC_NONE && storage.partitionIndex >= 0 {
+		if previous := storage.partitions[storage.partitionIndex]; previous != nil {
+			previous.Sync()
+			storage.dictionaries.sync(previous.Name())
+		}
+	}
+	if storage.partitionIndex >= 0 {
+		if previous := storage.partitions[storage.partitionIndex]; previous != nil {
+			storage.dictionaries.seal(previous.Name())
+		}
+	}
 	storage.partitionIndex++
-	f, err := os.OpenFile(fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, storage.partitionIndex, NATIVE_STORAGE_DB_FILE_EXT), os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(storage.partitionPath(storage.partitionIndex), os.O_CREATE|os.O_WRONLY, 0644)
 	basenine.Check(err)
 	storage.partitions = append(storage.partitions, f)
 	storage.lastOffset = 0
 	storage.Unlock()
 
-	err = storage.watcher.Add(f.Name())
-	basenine.Check(err)
-
 	return f
 }
 
+// dataPath returns the path of the given filename in the data directory.
+func (storage *nativeStorage) dataPath(filename string) string {
+	return filepath.Join(storage.options.DataDir, filename)
+}
+
+// partitionPath returns the path of the database partition with the given index.
+func (storage *nativeStorage) partitionPath(index int64) string {
+	return storage.dataPath(fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, index, NATIVE_STORAGE_DB_FILE_EXT))
+}
+
+// lockDataDirectory takes an exclusive lock on the lock file in the given directory
+// such that two servers cannot clobber the same data directory. The lock is
+// released by the operating system once the process exits.
+func lockDataDirectory(dir string) (err error) {
+	var abs string
+	abs, err = filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+
+	nativeStorageDirectoryLocks.Lock()
+	defer nativeStorageDirectoryLocks.Unlock()
+
+	// Already locked by this process.
+	if _, ok := nativeStorageDirectoryLocks.files[abs]; ok {
+		return
+	}
+
+	var f *os.File
+	f, err = os.OpenFile(filepath.Join(abs, nativeStorageLockFilename), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("The data directory %s is being used by another process: %v", abs, err)
+		return
+	}
+
+	// Write the PID for the operators to know which process holds the lock.
+	f.Truncate(0)
+	f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+
+	nativeStorageDirectoryLocks.files[abs] = f
+	return
+}
+
 // removeDatabaseFiles cleans up all of the database files.
 func (storage *nativeStorage) removeDatabaseFiles() {
-	files, err := filepath.Glob(fmt.Sprintf("./data_*.%s", NATIVE_STORAGE_DB_FILE_EXT))
-	basenine.Check(err)
-	for _, f := range files {
-		os.Remove(f)
+	for _, ext := range []string{NATIVE_STORAGE_DB_FILE_EXT, NATIVE_STORAGE_INDEX_FILE_EXT, NATIVE_STORAGE_CHECKSUM_FILE_EXT, NATIVE_STORAGE_DICTIONARY_FILE_EXT} {
+		files, err := filepath.Glob(storage.dataPath(fmt.Sprintf("%s_*.%s", NATIVE_STORAGE_DB_FILE, ext)))
+		basenine.Check(err)
+		for _, f := range files {
+			os.Remove(f)
+		}
 	}
 }
 
 // renameLegacyDatabaseFiles cleans up all of the database files.
 func (storage *nativeStorage) renameLegacyDatabaseFiles() {
-	files, err := filepath.Glob(fmt.Sprintf("./data_*.%s", NATIVE_STORAGE_DB_FILE_LEGACY_EXT))
+	files, err := filepath.Glob(storage.dataPath(fmt.Sprintf("%s_*.%s", NATIVE_STORAGE_DB_FILE, NATIVE_STORAGE_DB_FILE_LEGACY_EXT)))
 	basenine.Check(err)
 	for _, infile := range files {
 		ext := path.Ext(infile)
@@ -984,26 +2057,20 @@ func (storage *nativeStorage) renameLegacyDatabaseFiles() {
 }
 
 func (storage *nativeStorage) getLastTimestampOfPartition(discardedPartitionIndex int64) (timestamp int64, err error) {
-	storage.RLock()
-	offsets := storage.offsets
-	partitionRefs := storage.partitionRefs
-	storage.RUnlock()
-
-	var removedOffsetsCounter uint64
-
-	for i := range offsets {
-		if partitionRefs[i] > discardedPartitionIndex {
-			break
-		}
-		removedOffsetsCounter++
-	}
-
 	storage.Lock()
-	storage.offsets = storage.offsets[removedOffsetsCounter:]
-	storage.partitionRefs = storage.partitionRefs[removedOffsetsCounter:]
-	storage.removedOffsetsCounter += removedOffsetsCounter
+	storage.removedOffsetsCounter += storage.offsets.DropThrough(discardedPartitionIndex)
+	storage.dropHashIndexPostings()
+	storage.dropZones(discardedPartitionIndex)
+	storage.dropBloomFilters(discardedPartitionIndex)
+	storage.dropChecksums(discardedPartitionIndex)
+	remaining := storage.offsets.Len()
 	storage.Unlock()
 
+	if remaining == 0 {
+		err = errors.New("No records left after the partition!")
+		return
+	}
+
 	var n int64
 	var f *os.File
 	n, f, err = storage.getOffsetAndPartition(0)
@@ -1012,7 +2079,6 @@ func (storage *nativeStorage) getLastTimestampOfPartition(discardedPartitionInde
 		return
 	}
 
-	f.Seek(n, io.SeekStart)
 	var b []byte
 	b, _, err = storage.readRecord(f, n)
 	f.Close()
@@ -1044,18 +2110,35 @@ func (storage *nativeStorage) getLastTimestampOfPartition(discardedPartitionInde
 }
 
 // periodicPartitioner is a Goroutine that handles database parititioning according
-// to the database size limit that's set by /limit command.
+// to the database size limit that's set by /limit command and the retention
+// that's set by /retention command.
 // Triggered every second.
 func (storage *nativeStorage) periodicPartitioner(persistent bool, ticker *time.Ticker) {
 	var f *os.File
 	for {
 		<-ticker.C
 
+		// Write the pending records such that they become visible
+		// within a second even if the block is not full.
+		err := storage.flushBlock()
+		if err != nil {
+			log.Printf("Block flush error: %v\n", err)
+		}
+
+		// Sync the current partition periodically in interval mode.
+		err = storage.syncCurrentPartition()
+		if err != nil {
+			log.Printf("Sync error: %v\n", err)
+		}
+
 		if persistent {
 			// Dump the core periodically
 			storage.DumpCore(true, false)
 		}
 
+		// Drop the partitions that are out of the retention window.
+		storage.enforceRetention(persistent)
+
 		var partitionSizeLimit int64
 
 		// Safely access the partition size limit, current partition index and get the current partition
@@ -1068,6 +2151,7 @@ func (storage *nativeStorage) periodicPartitioner(persistent bool, ticker *time.
 		f = storage.partitions[storage.partitionIndex]
 		storage.RUnlock()
 
+		// The size on the disk, which is the compressed size in case of block compression.
 		info, err := f.Stat()
 		basenine.Check(err)
 		currentSize := info.Size()
@@ -1075,91 +2159,164 @@ func (storage *nativeStorage) periodicPartitioner(persistent bool, ticker *time.
 			// If we exceeded the half of the database size limit, create a new partition
 			f = storage.newPartition()
 
-			// Safely access the partitions slice and partitionIndex
-			if storage.partitionIndex > 1 {
-				// Populate the truncatedTimestamp field, which symbolizes the new
-				// recording start time
-				var truncatedTimestamp int64
-				truncatedTimestamp, err = storage.getLastTimestampOfPartition(storage.partitionIndex - 2)
-				if err == nil {
-					storage.truncatedTimestamp = truncatedTimestamp + 1
-				}
+			// There can be only a certain number of living partitions any given time.
+			// Discard the oldest ones such that the disk usage stays under the limit.
+			storage.discardOldPartitions(persistent)
+		}
+	}
+}
 
-				storage.Lock()
-				// There can be only two living partition any given time.
-				// We've created the third partition, so discard the first one.
-				discarded := storage.partitions[storage.partitionIndex-2]
-				discarded.Close()
-				err = storage.watcher.Remove(discarded.Name())
-				if err != nil {
-					log.Printf("Watch removal error: %v\n", err.Error())
-				}
-				os.Remove(discarded.Name())
-				storage.partitions[storage.partitionIndex-2] = nil
+// discardOldPartitions discards the oldest partitions until
+// the number of living partitions fits into options.Partitions.
+func (storage *nativeStorage) discardOldPartitions(persistent bool) {
+	storage.RLock()
+	last := storage.partitionIndex - int64(storage.options.Partitions)
+	storage.RUnlock()
 
-				if persistent {
-					// Dump the core in case of a partition removal
-					storage.DumpCore(true, true)
-				}
-				storage.Unlock()
-			}
+	for index := int64(0); index <= last; index++ {
+		storage.discardPartition(index, persistent)
+	}
+}
+
+// discardPartition closes and removes the partition with the given index along with
+// the offsets of its records. The partition is archived beforehand in archive mode. It populates the truncatedTimestamp field, which symbolizes
+// the new recording start time. The returned error is non-nil if the truncatedTimestamp
+// couldn't be populated.
+func (storage *nativeStorage) discardPartition(index int64, persistent bool) (err error) {
+	var discarded *os.File
+	storage.RLock()
+	if index >= 0 && int(index) < len(storage.partitions) {
+		discarded = storage.partitions[index]
+	}
+	storage.RUnlock()
+	if discarded == nil {
+		return
+	}
+
+	// Archive the partition before its offsets are removed.
+	if storage.options.ArchiveDir != "" {
+		archiveErr := storage.archivePartition(index, discarded.Name())
+		if archiveErr != nil {
+			log.Printf("Error while archiving the partition %s: %v\n", discarded.Name(), archiveErr)
 		}
 	}
+
+	var truncatedTimestamp int64
+	truncatedTimestamp, err = storage.getLastTimestampOfPartition(index)
+
+	storage.Lock()
+	if err == nil {
+		storage.truncatedTimestamp = truncatedTimestamp + 1
+	}
+
+	discarded.Close()
+	os.Remove(discarded.Name())
+	storage.dictionaries.remove(discarded.Name())
+	storage.partitions[index] = nil
+
+	if persistent {
+		// Dump the core in case of a partition removal
+		storage.DumpCore(true, true)
+	}
+	storage.Unlock()
+	return
 }
 
 // readRecord reads the record from the database paritition provided by argument f
-// and the reads the record by seeking to the offset provided by seek argument.
+// at the offset provided by seek argument. The offset of a record in a compressed block
+// also contains the slot of the record in that block. The checksum of the record is
+// verified if the record has one. n is the offset right after the record or the block.
+// A dictionary encoded record is rehydrated into its JSON form.
 func (storage *nativeStorage) readRecord(f *os.File, seek int64) (b []byte, n int64, err error) {
-	n = seek
-	l := make([]byte, 8)
-	_, err = io.ReadAtLeast(f, l, 8)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
+	return storage.readMatchingRecord(f, seek, nil)
+}
+
+// readMatchingRecord is the same with readRecord, except that a dictionary encoded record that
+// cannot satisfy the plan according to its strings is not rehydrated. b is nil in that case.
+func (storage *nativeStorage) readMatchingRecord(f *os.File, seek int64, plan *basenine.Plan) (b []byte, n int64, err error) {
+	offset, slot := unpackOffset(seek)
+	n = offset
+
+	l := make([]byte, nativeStorageRecordHeaderLengthV1)
+	_, err = f.ReadAt(l[:nativeStorageRecordHeaderLengthV0], offset)
+	if err != nil {
 		return
 	}
-	n += 8
+
+	var version byte
+	var length int64
+	version, length, err = decodeRecordHeader(l)
 	if err != nil {
 		return
 	}
-	length := int(binary.LittleEndian.Uint64(l))
+
+	headerLength := recordHeaderLength(version)
+	if version != NATIVE_STORAGE_RECORD_V0 {
+		_, err = f.ReadAt(l[nativeStorageRecordHeaderLengthV0:], offset+nativeStorageRecordHeaderLengthV0)
+		if err != nil {
+			return
+		}
+	}
+
+	// Serve the block from the cache if it's already decompressed.
+	var key string
+	if version == NATIVE_STORAGE_RECORD_V2 {
+		key = blockCacheKey(f.Name(), offset)
+		if records, ok := storage.blockCache.get(key); ok {
+			b, err = pickFromBlock(records, slot)
+			n += headerLength + length
+			return
+		}
+	}
 
 	b = make([]byte, length)
-	_, err = io.ReadAtLeast(f, b, length)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		n -= 8
+	_, err = f.ReadAt(b, offset+headerLength)
+	if err != nil {
 		return
 	}
-	n += int64(length)
-	if err != nil {
+
+	if version != NATIVE_STORAGE_RECORD_V0 && crc32.Checksum(b, nativeStorageCRC32CTable) != binary.LittleEndian.Uint32(l[nativeStorageRecordHeaderLengthV0:]) {
+		err = ErrChecksumMismatch
 		return
 	}
-	return
-}
 
-// Blocks until a partition is modified
-func (storage *nativeStorage) watchPartitions() (err error) {
-	select {
-	case event, ok := <-storage.watcher.Events:
-		if !ok {
+	if version == NATIVE_STORAGE_RECORD_V2 {
+		var records [][]byte
+		records, err = decodeBlock(b)
+		if err != nil {
 			return
 		}
-		if event.Op&fsnotify.Write != fsnotify.Write {
+		storage.blockCache.put(key, records)
+
+		b, err = pickFromBlock(records, slot)
+		if err != nil {
 			return
 		}
-	case errW, ok := <-storage.watcher.Errors:
-		if !ok {
-			err = errW
+	}
+
+	if version == NATIVE_STORAGE_RECORD_V3 {
+		b, err = storage.decodeDictionaryRecord(f.Name(), b, plan)
+		if err != nil {
 			return
 		}
 	}
+
+	n += headerLength + length
 	return
 }
 
+// countCorruptedRecord increments the counter of the corrupted records and logs it.
+func (storage *nativeStorage) countCorruptedRecord(f *os.File, offset int64, err error) {
+	counter := atomic.AddUint64(&storage.corruptedRecordsCounter, 1)
+	log.Printf("Skipping the corrupted record at offset %d in %s: %v (%d corrupted records so far)\n", offset, f.Name(), err, counter)
+}
+
 // handleSpecialLeftOff handles negative leftOff value.
 func (storage *nativeStorage) handleSpecialLeftOff(_leftOff string, increment int64) (leftOff int64, err error) {
 	// If leftOff value is -1 then set it to last offset
 	if _leftOff == basenine.LATEST {
 		storage.RLock()
-		lastOffset := len(storage.offsets) + int(storage.removedOffsetsCounter) - 1
+		lastOffset := int(storage.offsets.Len()) + int(storage.removedOffsetsCounter) - 1
 		storage.RUnlock()
 		leftOff = int64(lastOffset)
 		if leftOff < 0 {
@@ -1178,34 +2335,78 @@ func (storage *nativeStorage) handleSpecialLeftOff(_leftOff string, increment in
 // Safely access the offsets and partition references
 func (storage *nativeStorage) getOffsetAndPartition(index uint64) (offset int64, f *os.File, err error) {
 	storage.RLock()
-	offset = storage.offsets[index]
-	i := storage.partitionRefs[index]
+	defer storage.RUnlock()
+
+	var i int64
+	offset, i, err = storage.offsets.Get(index)
+	if err != nil {
+		return
+	}
+
 	fRef := storage.partitions[i]
 	if fRef == nil {
 		err = errors.New("Read on not opened partition")
+	} else if offset < 0 {
+		err = errors.New("Read on a lost record")
 	} else {
 		f, err = os.Open(fRef.Name())
 	}
-	storage.RUnlock()
 	return
 }
 
-// removeAllWatchers removes all the watchers that are watching the database files.
-func (storage *nativeStorage) removeAllWatchers() {
-	for _, partition := range storage.partitions {
-		if partition == nil {
-			continue
-		}
-		err := storage.watcher.Remove(partition.Name())
-		if err != nil {
-			log.Printf("Watch removal error: %v\n", err.Error())
-		}
-	}
-}
-
-// setPartitionSizeLimit sets the partition size limit to the half of the given value.
+// setPartitionSizeLimit divides the given value by the number of
+// live partitions and sets it as the partition size limit.
 func (storage *nativeStorage) setPartitionSizeLimit(value int) {
 	storage.Lock()
-	storage.partitionSizeLimit = int64(value) / 2
+	storage.partitionSizeLimit = int64(value) / int64(storage.options.Partitions)
 	storage.Unlock()
 }
+
+// encodeRecord prepends the record header with the NATIVE_STORAGE_RECORD_V1 format into the data.
+func encodeRecord(data []byte) (b []byte) {
+	return encodeRecordVersion(NATIVE_STORAGE_RECORD_V1, data)
+}
+
+// encodeRecordVersion prepends the record header with the given record format version into the data.
+func encodeRecordVersion(version byte, data []byte) (b []byte) {
+	b = make([]byte, nativeStorageRecordHeaderLengthV1+int64(len(data)))
+	binary.LittleEndian.PutUint64(b, uint64(len(data))|uint64(version)<<56)
+	binary.LittleEndian.PutUint32(b[nativeStorageRecordHeaderLengthV0:], crc32.Checksum(data, nativeStorageCRC32CTable))
+	copy(b[nativeStorageRecordHeaderLengthV1:], data)
+	return
+}
+
+// decodeRecordHeader decodes the version and the payload length from the first 8 bytes of a record.
+func decodeRecordHeader(l []byte) (version byte, length int64, err error) {
+	header := binary.LittleEndian.Uint64(l)
+	version = byte(header >> 56)
+	length = int64(header & nativeStorageRecordLengthMask)
+
+	if version > NATIVE_STORAGE_RECORD_V3 || length > nativeStorageMaxRecordLength {
+		err = ErrCorruptedRecordHeader
+	}
+	return
+}
+
+// recordHeaderLength returns the length of the record header for the given record format version.
+func recordHeaderLength(version byte) int64 {
+	if version == NATIVE_STORAGE_RECORD_V0 {
+		return nativeStorageRecordHeaderLengthV0
+	}
+	return nativeStorageRecordHeaderLengthV1
+}
+
+// isCorruptedRecord checks whether the error returned by readRecord indicates a corrupted record.
+func isCorruptedRecord(err error) bool {
+	return err == ErrChecksumMismatch || err == ErrCorruptedRecordHeader || err == ErrBlockSlotOutOfRange || err == ErrCorruptedDictionaryRecord || errors.Is(err, ErrUnknownCompression)
+}
+
+// pickFromBlock returns the record in the given slot of a decompressed block.
+func pickFromBlock(records [][]byte, slot int) (b []byte, err error) {
+	if slot >= len(records) {
+		err = ErrBlockSlotOutOfRange
+		return
+	}
+	b = records[slot]
+	return
+}
@@ -0,0 +1,383 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// File extension of the offset sidecar of an archived partition.
+const nativeStorageArchiveIndexExt string = "idx"
+
+// nativeArchive is a partition that's moved into the archive directory instead of being
+// removed upon size limiting or retention. Its records are recompressed into zstd blocks.
+//
+// index is the index of the partition that's archived.
+//
+// path is the path of the archived partition.
+//
+// firstID is the index of the first record in the archived partition.
+//
+// offsets contains the offsets of the records in the archived partition.
+// Negative offset means the record is lost.
+//
+// size is the total size of the archived partition and its offset sidecar in bytes.
+type nativeArchive struct {
+	index   int64
+	path    string
+	firstID uint64
+	offsets []int64
+	size    int64
+}
+
+// archivePath returns the path of the archived partition with the given index.
+func (storage *nativeStorage) archivePath(index int64) string {
+	return filepath.Join(storage.options.ArchiveDir, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, index, NATIVE_STORAGE_DB_FILE_EXT))
+}
+
+// archiveIndexPath returns the path of the offset sidecar of the archived partition with the given index.
+func (storage *nativeStorage) archiveIndexPath(index int64) string {
+	return filepath.Join(storage.options.ArchiveDir, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, index, nativeStorageArchiveIndexExt))
+}
+
+// archivePartition copies the records of the partition with the given index into
+// the archive directory as zstd compressed blocks and writes the offset sidecar.
+// The partition itself is not removed.
+func (storage *nativeStorage) archivePartition(index int64, path string) (err error) {
+	storage.RLock()
+	start, end := storage.offsets.PartitionRange(index)
+	firstID := storage.removedOffsetsCounter + start
+	offsets, _, err := storage.offsets.Range(start, end)
+	blockSize := storage.options.BlockSize
+	storage.RUnlock()
+
+	if err != nil {
+		return
+	}
+
+	if len(offsets) == 0 {
+		return
+	}
+
+	var f *os.File
+	f, err = os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var out *os.File
+	out, err = os.Create(storage.archivePath(index))
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	archived := make([]int64, len(offsets))
+	var lastOffset int64
+	var pending [][]byte
+	var pendingSlots []int
+	var pendingSize int
+
+	flush := func() (err error) {
+		if len(pending) == 0 {
+			return
+		}
+
+		var data []byte
+		data, err = encodeBlock(NATIVE_STORAGE_COMPRESSION_ZSTD, pending)
+		if err != nil {
+			return
+		}
+
+		_, err = out.WriteAt(data, lastOffset)
+		if err != nil {
+			return
+		}
+
+		for slot, i := range pendingSlots {
+			archived[i] = packOffset(lastOffset, slot)
+		}
+		lastOffset += int64(len(data))
+		pending = nil
+		pendingSlots = nil
+		pendingSize = 0
+		return
+	}
+
+	for i, offset := range offsets {
+		archived[i] = -1
+		if offset < 0 {
+			continue
+		}
+
+		var b []byte
+		b, _, err = storage.readRecord(f, offset)
+		if err != nil {
+			// The record is lost, keep archiving the rest.
+			log.Printf("Skipping the record %d while archiving %s: %v\n", firstID+uint64(i), path, err)
+			err = nil
+			continue
+		}
+
+		pending = append(pending, b)
+		pendingSlots = append(pendingSlots, i)
+		pendingSize += len(b)
+
+		if pendingSize >= blockSize || len(pending) >= nativeStorageMaxBlockRecords {
+			err = flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	err = flush()
+	if err != nil {
+		return
+	}
+
+	if storage.syncMode != NATIVE_STORAGE_SYNC_NONE {
+		err = out.Sync()
+		if err != nil {
+			return
+		}
+	}
+
+	// The sidecar is written last. An archived partition without a sidecar is incomplete.
+	sidecar := make([]byte, 8*(len(archived)+1))
+	binary.LittleEndian.PutUint64(sidecar, firstID)
+	for i, offset := range archived {
+		binary.LittleEndian.PutUint64(sidecar[8*(i+1):], uint64(offset))
+	}
+
+	tmp := storage.archiveIndexPath(index) + ".tmp"
+	err = writeFile(tmp, sidecar, storage.syncMode != NATIVE_STORAGE_SYNC_NONE)
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, storage.archiveIndexPath(index))
+	if err != nil {
+		return
+	}
+
+	if storage.syncMode != NATIVE_STORAGE_SYNC_NONE {
+		err = syncDirectory(storage.options.ArchiveDir)
+		if err != nil {
+			return
+		}
+	}
+
+	storage.Lock()
+	storage.archives = append(storage.archives, &nativeArchive{
+		index:   index,
+		path:    storage.archivePath(index),
+		firstID: firstID,
+		offsets: archived,
+		size:    lastOffset + int64(len(sidecar)),
+	})
+	storage.Unlock()
+
+	storage.enforceArchiveLimit()
+	return
+}
+
+// enforceArchiveLimit removes the oldest archived partitions until
+// the total size of the archive fits into the archive size limit.
+func (storage *nativeStorage) enforceArchiveLimit() {
+	storage.Lock()
+	defer storage.Unlock()
+
+	if storage.options.ArchiveLimit <= 0 {
+		return
+	}
+
+	var total int64
+	for _, archive := range storage.archives {
+		total += archive.size
+	}
+
+	for len(storage.archives) > 0 && total > storage.options.ArchiveLimit {
+		oldest := storage.archives[0]
+		os.Remove(oldest.path)
+		os.Remove(storage.archiveIndexPath(oldest.index))
+		total -= oldest.size
+		storage.archives = storage.archives[1:]
+	}
+}
+
+// loadArchives reads the offset sidecars in the archive directory.
+// Incomplete archived partitions are removed.
+func (storage *nativeStorage) loadArchives() (err error) {
+	var files []string
+	files, err = filepath.Glob(filepath.Join(storage.options.ArchiveDir, fmt.Sprintf("%s_*.%s", NATIVE_STORAGE_DB_FILE, NATIVE_STORAGE_DB_FILE_EXT)))
+	if err != nil {
+		return
+	}
+
+	var archives []*nativeArchive
+	for _, file := range files {
+		var index int64
+		_, err = fmt.Sscanf(filepath.Base(file), NATIVE_STORAGE_DB_FILE+"_%d."+NATIVE_STORAGE_DB_FILE_EXT, &index)
+		if err != nil {
+			log.Printf("Skipping the archived file %s: %v\n", file, err)
+			err = nil
+			continue
+		}
+
+		var archive *nativeArchive
+		archive, err = storage.readArchive(index)
+		if err != nil {
+			log.Printf("Removing the incomplete archived partition %s: %v\n", file, err)
+			os.Remove(file)
+			os.Remove(storage.archiveIndexPath(index))
+			err = nil
+			continue
+		}
+		archives = append(archives, archive)
+	}
+
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].firstID < archives[j].firstID
+	})
+
+	storage.Lock()
+	storage.archives = archives
+	storage.Unlock()
+	return
+}
+
+// readArchive reads the offset sidecar of the archived partition with the given index.
+func (storage *nativeStorage) readArchive(index int64) (archive *nativeArchive, err error) {
+	var sidecar []byte
+	sidecar, err = ioutil.ReadFile(storage.archiveIndexPath(index))
+	if err != nil {
+		return
+	}
+
+	if len(sidecar) < 8 || len(sidecar)%8 != 0 {
+		err = errors.New("Corrupted offset sidecar")
+		return
+	}
+
+	var info os.FileInfo
+	info, err = os.Stat(storage.archivePath(index))
+	if err != nil {
+		return
+	}
+
+	archive = &nativeArchive{
+		index:   index,
+		path:    storage.archivePath(index),
+		firstID: binary.LittleEndian.Uint64(sidecar),
+		offsets: make([]int64, len(sidecar)/8-1),
+		size:    info.Size() + int64(len(sidecar)),
+	}
+	for i := range archive.offsets {
+		archive.offsets[i] = int64(binary.LittleEndian.Uint64(sidecar[8*(i+1):]))
+	}
+	return
+}
+
+// removeArchives removes all of the archived partitions.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) removeArchives() {
+	if storage.options.ArchiveDir == "" {
+		return
+	}
+
+	for _, pattern := range []string{NATIVE_STORAGE_DB_FILE_EXT, nativeStorageArchiveIndexExt} {
+		files, err := filepath.Glob(filepath.Join(storage.options.ArchiveDir, fmt.Sprintf("%s_*.%s", NATIVE_STORAGE_DB_FILE, pattern)))
+		basenine.Check(err)
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}
+	storage.archives = nil
+}
+
+// getArchivedOffsets collects the offsets of the archived records in the [from, to) range
+// of record indexes. The references are negative and -(ref+1) points to the archives slice
+// that's returned, such that they can be told apart from the partition references.
+// The collected offsets are contiguous and start from the index first. The records that
+// couldn't be archived are padded with negative offsets.
+func (storage *nativeStorage) getArchivedOffsets(from uint64, to uint64) (archives []*nativeArchive, offsets []int64, refs []int64, first uint64) {
+	storage.RLock()
+	archives = storage.archives
+	if to > storage.removedOffsetsCounter {
+		to = storage.removedOffsetsCounter
+	}
+	storage.RUnlock()
+
+	if len(archives) == 0 {
+		return
+	}
+
+	first = from
+	if first < archives[0].firstID {
+		first = archives[0].firstID
+	}
+
+	id := first
+	for i, archive := range archives {
+		for j, offset := range archive.offsets {
+			if id >= to {
+				return
+			}
+			if archive.firstID+uint64(j) != id {
+				continue
+			}
+			offsets = append(offsets, offset)
+			refs = append(refs, -int64(i)-1)
+			id++
+		}
+
+		// Pad the gap between the archived partitions.
+		next := to
+		if i+1 < len(archives) && archives[i+1].firstID < next {
+			next = archives[i+1].firstID
+		}
+		for ; id < next; id++ {
+			offsets = append(offsets, -1)
+			refs = append(refs, -1)
+		}
+	}
+	return
+}
+
+// getArchivedOffset returns the offset and the path of the archived record with the given index.
+func (storage *nativeStorage) getArchivedOffset(index uint64) (offset int64, path string, err error) {
+	storage.RLock()
+	defer storage.RUnlock()
+
+	if index >= storage.removedOffsetsCounter {
+		err = errors.New("Record is not archived")
+		return
+	}
+
+	i := sort.Search(len(storage.archives), func(i int) bool {
+		return storage.archives[i].firstID+uint64(len(storage.archives[i].offsets)) > index
+	})
+	if i == len(storage.archives) || storage.archives[i].firstID > index {
+		err = errors.New("Record is not archived")
+		return
+	}
+
+	offset = storage.archives[i].offsets[index-storage.archives[i].firstID]
+	path = storage.archives[i].path
+	if offset < 0 {
+		err = errors.New("Read on a lost record")
+	}
+	return
+}
@@ -0,0 +1,292 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"hash/fnv"
+	"log"
+
+	jp "github.com/ohler55/ojg/jp"
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// The path that enables the Bloom filter of all of the leaf values in the records.
+const NATIVE_STORAGE_BLOOM_FILTER_ALL_LEAVES string = "*"
+
+// Number of keys in the first stage of a Bloom filter. Each stage can hold
+// twice the number of keys of the previous one.
+const nativeStorageBloomFilterCapacity int = 4096
+
+// Number of bits per key and the number of hash functions of a stage,
+// which yields a false positive rate of about 1%.
+const nativeStorageBloomFilterBitsPerKey int = 10
+const nativeStorageBloomFilterHashes int = 7
+
+// bloomIndex keeps a Bloom filter for each partition that tells whether a value can be in that
+// partition. The partitions that cannot contain the literal of a `==` comparison are skipped
+// by the queries without reading their records.
+//
+// paths are the paths of the fields whose values are added to the filters along with the path.
+//
+// jsonPaths are the compiled versions of paths.
+//
+// leaves is true if all of the leaf values of the records are added to the filters regardless of their paths.
+//
+// ready is false until the filters of the records that are not inserted through this process,
+// like the ones that are restored or recovered, are computed. The filters are not dumped into
+// the core since they can be large, they're computed on initialization instead.
+//
+// filters maps the indexes of the partitions to their Bloom filters. A partition that
+// has no filter is never skipped.
+type bloomIndex struct {
+	paths     []string
+	jsonPaths []jp.Expr
+	leaves    bool
+	ready     bool
+	filters   map[int64]*bloomFilter
+}
+
+// bloomFilter is a scalable Bloom filter that consists of stages with growing capacities.
+// Such that the number of keys in a partition doesn't have to be known beforehand.
+type bloomFilter struct {
+	stages []*bloomFilterStage
+}
+
+// bloomFilterStage is a Bloom filter with a fixed capacity.
+type bloomFilterStage struct {
+	bits     []uint64
+	count    int
+	capacity int
+}
+
+// newBloomIndex creates the Bloom filters of the given paths. NATIVE_STORAGE_BLOOM_FILTER_ALL_LEAVES
+// enables the filter of all of the leaf values. nil means the Bloom filters are disabled.
+func newBloomIndex(paths []string) (index *bloomIndex, err error) {
+	if len(paths) == 0 {
+		return
+	}
+
+	index = &bloomIndex{
+		ready:   true,
+		filters: make(map[int64]*bloomFilter),
+	}
+	for _, text := range paths {
+		if text == NATIVE_STORAGE_BLOOM_FILTER_ALL_LEAVES {
+			index.leaves = true
+			continue
+		}
+
+		var path string
+		var jsonPath jp.Expr
+		path, jsonPath, err = basenine.ParseIndexPath(text)
+		if err != nil {
+			index = nil
+			return
+		}
+		index.paths = append(index.paths, path)
+		index.jsonPaths = append(index.jsonPaths, jsonPath)
+	}
+	return
+}
+
+// bloomKey returns the key of the value of a field in the Bloom filters.
+// The keys of the leaf values have no path.
+func bloomKey(path string, value string) string {
+	if path == "" {
+		return value
+	}
+	return path + "\x00" + value
+}
+
+// bloomHashes returns the two hashes that the positions of the key in a stage are derived from.
+func bloomHashes(key string) (h1 uint32, h2 uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+// newBloomFilterStage creates an empty stage that can hold the given number of keys.
+func newBloomFilterStage(capacity int) *bloomFilterStage {
+	bits := capacity * nativeStorageBloomFilterBitsPerKey
+	return &bloomFilterStage{
+		bits:     make([]uint64, (bits+63)/64),
+		capacity: capacity,
+	}
+}
+
+// test tells whether the key might be in the stage.
+func (stage *bloomFilterStage) test(h1 uint32, h2 uint32) bool {
+	m := uint32(len(stage.bits) * 64)
+	for i := 0; i < nativeStorageBloomFilterHashes; i++ {
+		bit := (h1 + uint32(i)*h2) % m
+		if stage.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// add sets the bits of the key in the stage.
+func (stage *bloomFilterStage) add(h1 uint32, h2 uint32) {
+	m := uint32(len(stage.bits) * 64)
+	for i := 0; i < nativeStorageBloomFilterHashes; i++ {
+		bit := (h1 + uint32(i)*h2) % m
+		stage.bits[bit/64] |= 1 << (bit % 64)
+	}
+	stage.count++
+}
+
+// Test tells whether the key might be in the filter. false means the key is definitely not in it.
+func (filter *bloomFilter) Test(key string) bool {
+	h1, h2 := bloomHashes(key)
+	for _, stage := range filter.stages {
+		if stage.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds the key into the last stage of the filter. A new stage is created once it's full.
+func (filter *bloomFilter) Add(key string) {
+	h1, h2 := bloomHashes(key)
+	for _, stage := range filter.stages {
+		// The repeated keys don't fill up the stages.
+		if stage.test(h1, h2) {
+			return
+		}
+	}
+
+	if len(filter.stages) == 0 || filter.stages[len(filter.stages)-1].count >= filter.stages[len(filter.stages)-1].capacity {
+		capacity := nativeStorageBloomFilterCapacity
+		if len(filter.stages) > 0 {
+			capacity = filter.stages[len(filter.stages)-1].capacity * 2
+		}
+		filter.stages = append(filter.stages, newBloomFilterStage(capacity))
+	}
+	filter.stages[len(filter.stages)-1].add(h1, h2)
+}
+
+// add adds the values of the given record into the filter of the partition.
+func (index *bloomIndex) add(filters map[int64]*bloomFilter, partition int64, obj interface{}) {
+	filter, ok := filters[partition]
+	if !ok {
+		filter = &bloomFilter{}
+		filters[partition] = filter
+	}
+
+	for i, jsonPath := range index.jsonPaths {
+		keys, _ := basenine.IndexKeys(obj, jsonPath)
+		for _, key := range keys {
+			filter.Add(bloomKey(index.paths[i], key))
+		}
+	}
+
+	if index.leaves {
+		for _, key := range basenine.LeafKeys(obj) {
+			filter.Add(bloomKey("", key))
+		}
+	}
+}
+
+// mayContain tells whether a record in the filter might satisfy the `==` predicate.
+func (index *bloomIndex) mayContain(filter *bloomFilter, predicate *basenine.Predicate) bool {
+	for _, path := range index.paths {
+		if path == predicate.Path {
+			return filter.Test(bloomKey(path, predicate.Value))
+		}
+	}
+
+	// Objects and arrays are equal to the empty string, while they have no keys.
+	if index.leaves && predicate.Value != "" {
+		return filter.Test(bloomKey("", predicate.Value))
+	}
+	return true
+}
+
+// bloomRecord adds the parsed record to the Bloom filter of the partition.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) bloomRecord(partition int64, obj interface{}) {
+	if storage.bloomIndex == nil {
+		return
+	}
+	storage.bloomIndex.add(storage.bloomIndex.filters, partition, obj)
+}
+
+// buildBloomIndex computes the Bloom filters of the records up to the index end.
+// The filters become ready to be used by the queries afterwards.
+func (storage *nativeStorage) buildBloomIndex(index *bloomIndex, end uint64) {
+	filters := make(map[int64]*bloomFilter)
+	storage.scanRecords(end, func(id uint64, partition int64, obj interface{}) {
+		index.add(filters, partition, obj)
+	})
+
+	// The records that are inserted in the meantime are in the other filters.
+	storage.Lock()
+	for partition, filter := range filters {
+		if current, ok := index.filters[partition]; ok {
+			filter.stages = append(filter.stages, current.stages...)
+		}
+		index.filters[partition] = filter
+	}
+	index.ready = true
+	storage.Unlock()
+
+	log.Printf("Computed the Bloom filters.\n")
+}
+
+// pruneBloomIndex returns the partitions that cannot contain a record that satisfies
+// the `==` predicate according to the Bloom filters. nil means none of the partitions can be skipped.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) pruneBloomIndex(predicate *basenine.Predicate) (pruned map[int64]bool) {
+	index := storage.bloomIndex
+	if index == nil || !index.ready || predicate.Op != "==" {
+		return
+	}
+
+	for partition, filter := range index.filters {
+		if !index.mayContain(filter, predicate) {
+			if pruned == nil {
+				pruned = make(map[int64]bool)
+			}
+			pruned[partition] = true
+		}
+	}
+	return
+}
+
+// invalidateBloomIndex discards the Bloom filters such that they're computed again.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) invalidateBloomIndex() {
+	if storage.bloomIndex == nil {
+		return
+	}
+	storage.bloomIndex.filters = make(map[int64]*bloomFilter)
+	storage.bloomIndex.ready = false
+}
+
+// resetBloomIndex empties the Bloom filters of a database that has no records.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) resetBloomIndex() {
+	if storage.bloomIndex == nil {
+		return
+	}
+	storage.bloomIndex.filters = make(map[int64]*bloomFilter)
+	storage.bloomIndex.ready = true
+}
+
+// dropBloomFilters removes the Bloom filters of the partitions up to and including the given partition.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) dropBloomFilters(partition int64) {
+	if storage.bloomIndex == nil {
+		return
+	}
+	for index := range storage.bloomIndex.filters {
+		if index <= partition {
+			delete(storage.bloomIndex.filters, index)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"os"
+	"strings"
+
+	jp "github.com/ohler55/ojg/jp"
+	oj "github.com/ohler55/ojg/oj"
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// File extension of the checksum files of the partitions.
+const NATIVE_STORAGE_CHECKSUM_FILE_EXT string = "sum"
+
+// The checksum of a record whose values are unknown, like a record that cannot be parsed.
+// It has all of the bits set, such that it satisfies any `==` comparison.
+const nativeStorageChecksumUnknown uint64 = math.MaxUint64
+
+// checksumIndex keeps a 64-bit checksum of the values at the given paths for each record.
+// Each value sets two bits of the checksum that are derived from its hash, such that a record
+// whose checksum lacks any of the bits of the literal of a `==` comparison is skipped without
+// reading and parsing its JSON. The checksums are stored in per-partition files next to the
+// offset index files, in the same layout.
+//
+// paths are the paths of the fields whose values are added into the checksums.
+//
+// jsonPaths are the compiled versions of paths.
+//
+// ready is false until the checksums of the records that are not inserted through
+// this process, like the ones that are recovered, are computed.
+//
+// entries are the checksums of the records in the order of the offset index.
+type checksumIndex struct {
+	paths     []string
+	jsonPaths []jp.Expr
+	ready     bool
+	entries   *offsetIndex
+}
+
+// newChecksumIndex creates the checksum index of the given paths. nil means the checksums are disabled.
+func newChecksumIndex(paths []string, path func(partition int64) string) (index *checksumIndex, err error) {
+	if len(paths) == 0 {
+		return
+	}
+
+	index = &checksumIndex{
+		ready:   true,
+		entries: newOffsetIndex(path),
+	}
+	for _, text := range paths {
+		var path string
+		var jsonPath jp.Expr
+		path, jsonPath, err = basenine.ParseIndexPath(text)
+		if err != nil {
+			index = nil
+			return
+		}
+		index.paths = append(index.paths, path)
+		index.jsonPaths = append(index.jsonPaths, jsonPath)
+	}
+	return
+}
+
+// checksumPath returns the path of the checksum file of the partition with the given index.
+func (storage *nativeStorage) checksumPath(index int64) string {
+	return storage.dataPath(fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, index, NATIVE_STORAGE_CHECKSUM_FILE_EXT))
+}
+
+// checksumBits returns the bits that the value of the field with the given path sets in a checksum.
+func checksumBits(path string, value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(path + "\x00" + value))
+	sum := h.Sum64()
+	return 1<<(sum%64) | 1<<((sum>>6)%64)
+}
+
+// compute returns the checksum of the values of the given record.
+func (index *checksumIndex) compute(obj interface{}) (checksum uint64) {
+	for i, jsonPath := range index.jsonPaths {
+		keys, _ := basenine.IndexKeys(obj, jsonPath)
+		for _, key := range keys {
+			checksum |= checksumBits(index.paths[i], key)
+		}
+	}
+	return
+}
+
+// mayMatch tells whether a record with the given checksum might satisfy the plan.
+func (index *checksumIndex) mayMatch(checksum uint64, plan *basenine.Plan) bool {
+	if index == nil || plan == nil {
+		return true
+	}
+
+	if plan.Predicate != nil {
+		if plan.Predicate.Op != "==" {
+			return true
+		}
+		for _, path := range index.paths {
+			if path == plan.Predicate.Path {
+				bits := checksumBits(path, plan.Predicate.Value)
+				return checksum&bits == bits
+			}
+		}
+		return true
+	}
+
+	switch plan.Op {
+	case "and":
+		return index.mayMatch(checksum, plan.Left) && index.mayMatch(checksum, plan.Right)
+	case "or":
+		return index.mayMatch(checksum, plan.Left) || index.mayMatch(checksum, plan.Right)
+	}
+	return true
+}
+
+// appendChecksum adds the checksum of a record to the end of the checksum index, right after
+// its offset is added into the offset index. The checksums are disabled until they're computed
+// again if they cannot be written, such that they never go out of line with the offsets.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) appendChecksum(partition int64, checksum uint64) {
+	index := storage.checksums
+	if index == nil || !index.ready {
+		return
+	}
+
+	err := index.entries.Append(partition, int64(checksum))
+	if err != nil {
+		log.Printf("Disabling the checksums due to: %v\n", err)
+		index.entries.Reset()
+		index.ready = false
+	}
+}
+
+// buildChecksums computes the checksums of the records up to the index end. The checksums
+// become ready to be used by the queries afterwards. It's called on initialization before
+// any record is inserted, since the checksums are appended in the order of the offsets.
+func (storage *nativeStorage) buildChecksums(index *checksumIndex, end uint64) {
+	storage.Lock()
+	index.entries.Reset()
+	cursor := &offsetCursor{
+		storage: storage,
+		first:   storage.removedOffsetsCounter,
+	}
+	if end > cursor.first {
+		cursor.length = end - cursor.first
+	}
+	storage.Unlock()
+
+	var f *os.File
+	for i := 0; i < cursor.Len(); i++ {
+		_, offset, partitionRef, err := cursor.At(i)
+		if err != nil {
+			log.Printf("Error while computing the checksums: %v\n", err)
+			if f != nil {
+				f.Close()
+			}
+			return
+		}
+
+		checksum := nativeStorageChecksumUnknown
+		var path string
+		storage.RLock()
+		if fRef := storage.partitions[partitionRef]; fRef != nil {
+			path = fRef.Name()
+		}
+		storage.RUnlock()
+
+		if path != "" && offset >= 0 {
+			if f == nil || f.Name() != path {
+				if f != nil {
+					f.Close()
+				}
+				f, err = os.Open(path)
+				if err != nil {
+					f = nil
+				}
+			}
+
+			if f != nil {
+				var b []byte
+				b, _, err = storage.readRecord(f, offset)
+				if err == nil {
+					var obj interface{}
+					obj, err = oj.Parse(b)
+					if err == nil {
+						checksum = index.compute(obj)
+					}
+				}
+			}
+		}
+
+		storage.Lock()
+		err = index.entries.Append(partitionRef, int64(checksum))
+		storage.Unlock()
+		if err != nil {
+			log.Printf("Error while computing the checksums: %v\n", err)
+			if f != nil {
+				f.Close()
+			}
+			return
+		}
+	}
+	if f != nil {
+		f.Close()
+	}
+
+	storage.Lock()
+	index.ready = true
+	storage.Unlock()
+
+	log.Printf("Computed the checksums.\n")
+}
+
+// importChecksums opens the checksum files that are dumped into the core. The checksums
+// are computed on initialization if they're not in the core or they're out of line with the offsets.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) importChecksums(paths []string, segments []nativeStorageIndexSegmentExport) {
+	index := storage.checksums
+	if index == nil {
+		return
+	}
+
+	index.ready = false
+	if strings.Join(paths, "\x00") != strings.Join(index.paths, "\x00") {
+		return
+	}
+
+	err := index.entries.Import(segments)
+	if err != nil {
+		log.Printf("Warning while restoring the checksums: %v\n", err)
+		return
+	}
+	index.ready = index.entries.Len() == storage.offsets.Len()
+}
+
+// invalidateChecksums discards the checksums such that they're computed again.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) invalidateChecksums() {
+	if storage.checksums == nil {
+		return
+	}
+	storage.checksums.entries.Reset()
+	storage.checksums.ready = false
+}
+
+// resetChecksums empties the checksums of a database that has no records.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) resetChecksums() {
+	if storage.checksums == nil {
+		return
+	}
+	storage.checksums.entries.Reset()
+	storage.checksums.ready = true
+}
+
+// dropChecksums removes the checksums of the partitions up to and including the given partition.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) dropChecksums(partition int64) {
+	if storage.checksums == nil {
+		return
+	}
+	storage.checksums.entries.DropThrough(partition)
+}
@@ -0,0 +1,311 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Block compression codecs. The codec is stored in the first byte of a block's payload.
+const (
+	NATIVE_STORAGE_COMPRESSION_NONE byte = iota
+	NATIVE_STORAGE_COMPRESSION_SNAPPY
+	NATIVE_STORAGE_COMPRESSION_ZSTD
+)
+
+// Names of the block compression codecs that can be given through the storage arguments.
+var nativeStorageCompressionCodecs = map[string]byte{
+	"none":   NATIVE_STORAGE_COMPRESSION_NONE,
+	"snappy": NATIVE_STORAGE_COMPRESSION_SNAPPY,
+	"zstd":   NATIVE_STORAGE_COMPRESSION_ZSTD,
+}
+
+// Default size of a block in bytes, before the compression.
+const NATIVE_STORAGE_DEFAULT_BLOCK_SIZE int = 64 * 1024
+
+// A record in a compressed block is addressed by packing its slot number in the block
+// into the upper bits of the block's offset. Offsets of the uncompressed records have the slot 0.
+const nativeStorageBlockSlotShift = 48
+const nativeStorageBlockOffsetMask int64 = 1<<nativeStorageBlockSlotShift - 1
+
+// Maximum number of records in a block, limited by the bits that are left for the slot in an offset.
+const nativeStorageMaxBlockRecords int = 1<<(63-nativeStorageBlockSlotShift) - 1
+
+// Maximum number of decompressed blocks that are kept in memory.
+const nativeStorageBlockCacheCapacity int = 64
+
+var ErrUnknownCompression = errors.New("Unknown compression codec")
+var ErrBlockSlotOutOfRange = errors.New("Block slot out of range")
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// packOffset packs the offset of a block and the slot of a record inside that block into an offset.
+func packOffset(offset int64, slot int) int64 {
+	return offset | int64(slot)<<nativeStorageBlockSlotShift
+}
+
+// unpackOffset is the reverse of packOffset.
+func unpackOffset(packed int64) (offset int64, slot int) {
+	offset = packed & nativeStorageBlockOffsetMask
+	slot = int(packed >> nativeStorageBlockSlotShift)
+	return
+}
+
+// parseCompression converts the name of a compression codec into its identifier.
+func parseCompression(name string) (codec byte, err error) {
+	codec, ok := nativeStorageCompressionCodecs[name]
+	if !ok {
+		err = fmt.Errorf("%w: %s", ErrUnknownCompression, name)
+	}
+	return
+}
+
+// encodeBlock concatenates the records by prefixing each of them with their length as
+// an unsigned varint, compresses them with the given codec and returns them as a
+// record with a NATIVE_STORAGE_RECORD_V2 header.
+func encodeBlock(codec byte, records [][]byte) (b []byte, err error) {
+	var raw []byte
+	l := make([]byte, binary.MaxVarintLen64)
+	for _, record := range records {
+		n := binary.PutUvarint(l, uint64(len(record)))
+		raw = append(raw, l[:n]...)
+		raw = append(raw, record...)
+	}
+
+	var compressed []byte
+	switch codec {
+	case NATIVE_STORAGE_COMPRESSION_NONE:
+		compressed = raw
+	case NATIVE_STORAGE_COMPRESSION_SNAPPY:
+		compressed = snappy.Encode(nil, raw)
+	case NATIVE_STORAGE_COMPRESSION_ZSTD:
+		compressed = zstdEncoder.EncodeAll(raw, nil)
+	default:
+		err = ErrUnknownCompression
+		return
+	}
+
+	b = encodeRecordVersion(NATIVE_STORAGE_RECORD_V2, append([]byte{codec}, compressed...))
+	return
+}
+
+// decodeBlock decompresses the payload of a NATIVE_STORAGE_RECORD_V2 record and splits it into records.
+func decodeBlock(payload []byte) (records [][]byte, err error) {
+	if len(payload) < 1 {
+		err = ErrCorruptedRecordHeader
+		return
+	}
+
+	var raw []byte
+	switch payload[0] {
+	case NATIVE_STORAGE_COMPRESSION_NONE:
+		raw = payload[1:]
+	case NATIVE_STORAGE_COMPRESSION_SNAPPY:
+		raw, err = snappy.Decode(nil, payload[1:])
+	case NATIVE_STORAGE_COMPRESSION_ZSTD:
+		raw, err = zstdDecoder.DecodeAll(payload[1:], nil)
+	default:
+		err = ErrUnknownCompression
+	}
+	if err != nil {
+		return
+	}
+
+	for len(raw) > 0 {
+		length, n := binary.Uvarint(raw)
+		if n <= 0 || uint64(len(raw)-n) < length {
+			err = ErrCorruptedRecordHeader
+			return
+		}
+		records = append(records, raw[n:n+int(length)])
+		raw = raw[n+int(length):]
+	}
+	return
+}
+
+// blockCache keeps the recently decompressed blocks such that the consecutive reads
+// of the records in the same block don't decompress the block again and again.
+type blockCache struct {
+	sync.Mutex
+	keys   []string
+	blocks map[string][][]byte
+}
+
+func newBlockCache() *blockCache {
+	return &blockCache{
+		blocks: make(map[string][][]byte),
+	}
+}
+
+func blockCacheKey(path string, offset int64) string {
+	return fmt.Sprintf("%s:%d", path, offset)
+}
+
+func (cache *blockCache) get(key string) (records [][]byte, ok bool) {
+	cache.Lock()
+	records, ok = cache.blocks[key]
+	cache.Unlock()
+	return
+}
+
+// put stores the block by evicting the oldest block if the cache is full.
+func (cache *blockCache) put(key string, records [][]byte) {
+	cache.Lock()
+	if _, ok := cache.blocks[key]; !ok {
+		if len(cache.keys) >= nativeStorageBlockCacheCapacity {
+			delete(cache.blocks, cache.keys[0])
+			cache.keys = cache.keys[1:]
+		}
+		cache.keys = append(cache.keys, key)
+	}
+	cache.blocks[key] = records
+	cache.Unlock()
+}
+
+// clear empties the cache. It must be called whenever a partition file is removed
+// since the partition filenames are reused after a flush or a reset.
+func (cache *blockCache) clear() {
+	cache.Lock()
+	cache.keys = nil
+	cache.blocks = make(map[string][][]byte)
+	cache.Unlock()
+}
+
+// flushBlock compresses all of the pending records into blocks and writes them into the current partition.
+// The records become visible to the readers only after their block is flushed.
+func (storage *nativeStorage) flushBlock() (err error) {
+	return storage.writeBlocks(false)
+}
+
+// flushFullBlocks writes the pending records that fill a block, the rest of them wait for the next flush.
+func (storage *nativeStorage) flushFullBlocks() (err error) {
+	return storage.writeBlocks(true)
+}
+
+// flushPendingRecords writes the pending records after an insertion. All of them are written in
+// NATIVE_STORAGE_SYNC_ALWAYS mode, such that the insertion returns once they're durable. Otherwise
+// only the full blocks are written and the rest of the records are written by the periodic flush.
+func (storage *nativeStorage) flushPendingRecords(isFull bool) (err error) {
+	if storage.syncMode == NATIVE_STORAGE_SYNC_ALWAYS {
+		return storage.flushBlock()
+	}
+	if isFull {
+		return storage.flushFullBlocks()
+	}
+	return
+}
+
+// writeBlocks cuts the pending records into blocks and writes them into the current partition.
+// A block is cut once it reaches the block size or the maximum number of records. If onlyFull
+// is true, the records that don't fill a block are left pending.
+//
+// The records are added to the secondary indexes, the Bloom filters and the zone maps of
+// the partition that they're written into, under the same lock that reserves their offsets.
+//
+// The flushes are serialized, such that a flush that finds the pending records taken by
+// a concurrent flush returns only after those records are written.
+func (storage *nativeStorage) writeBlocks(onlyFull bool) (err error) {
+	storage.flushes.Lock()
+	defer storage.flushes.Unlock()
+
+	for {
+		storage.Lock()
+		if len(storage.pendingRecords) == 0 || storage.partitionIndex == -1 {
+			storage.Unlock()
+			return
+		}
+
+		// Cut the next block from the pending records.
+		var n, size int
+		for n < len(storage.pendingRecords) && n < nativeStorageMaxBlockRecords && size < storage.options.BlockSize {
+			size += len(storage.pendingRecords[n])
+			n++
+		}
+		if onlyFull && n < nativeStorageMaxBlockRecords && size < storage.options.BlockSize {
+			storage.Unlock()
+			return
+		}
+		records := storage.pendingRecords[:n]
+
+		var data []byte
+		data, err = encodeBlock(storage.compression, records)
+		if err != nil {
+			storage.Unlock()
+			return
+		}
+
+		// The ID of the first pending record.
+		l := storage.offsets.Len() + storage.removedOffsetsCounter
+		lastOffset := storage.lastOffset
+		partitionIndex := storage.partitionIndex
+		f := storage.partitions[partitionIndex]
+
+		// Safely update the offsets and paritition references.
+		var appendErr error
+		for slot := range records {
+			appendErr = storage.offsets.Append(partitionIndex, packOffset(lastOffset, slot))
+			if appendErr != nil {
+				// Only the records that have their offsets are written.
+				n = slot
+				break
+			}
+
+			checksum := storage.indexRecord(l+uint64(slot), partitionIndex, records[slot])
+			storage.zoneRecord(partitionIndex, storage.pendingDecoded[slot])
+			storage.appendChecksum(partitionIndex, checksum)
+		}
+		if n == 0 {
+			storage.Unlock()
+			return appendErr
+		}
+		if n < len(records) {
+			records = records[:n]
+			data, err = encodeBlock(storage.compression, records)
+			if err != nil {
+				storage.Unlock()
+				return
+			}
+			size = 0
+			for _, record := range records {
+				size += len(record)
+			}
+		}
+
+		storage.lastOffset = lastOffset + int64(len(data))
+		storage.pendingRecords = storage.pendingRecords[n:]
+		storage.pendingDecoded = storage.pendingDecoded[n:]
+		storage.pendingSize -= size
+		if len(storage.pendingRecords) == 0 {
+			storage.pendingRecords = nil
+			storage.pendingDecoded = nil
+		}
+		storage.writes.RLock()
+		storage.Unlock()
+
+		_, err = f.WriteAt(data, lastOffset)
+		storage.writes.RUnlock()
+		if err == nil {
+			err = storage.syncWrite(f)
+		} else {
+			storage.markLostRecords(l, l+uint64(n))
+		}
+		if err == nil {
+			err = appendErr
+		}
+
+		// Wake up all of the streams that are waiting for new records.
+		storage.notifier.Publish()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// The format of the core dumps that are written by this version.
+// It must be incremented, along with a migration that's appended to nativeStorageCoreMigrations,
+// whenever a field of nativeStorageExport is renamed or changes its meaning.
+// Adding a field doesn't require a new format since gob leaves the missing fields zero.
+const NATIVE_STORAGE_CORE_FORMAT uint32 = 1
+
+// The format of the legacy core dumps that are bare gob streams without a header.
+const NATIVE_STORAGE_CORE_FORMAT_LEGACY uint32 = 0
+
+// The magic bytes that the header of a versioned core dump starts with.
+var nativeStorageCoreMagic = []byte("BN9-CORE")
+
+// The maximum length of the version string in the header of a core dump.
+const nativeStorageCoreMaxVersionLength uint64 = 256
+
+// Error that's returned if the core dump is written in a format that's newer than NATIVE_STORAGE_CORE_FORMAT.
+var ErrUnsupportedCoreFormat = errors.New("Unsupported core dump format")
+
+// nativeStorageCoreMigrations migrates a decoded core dump from one format to the next.
+// The migration at index i migrates the format i into the format i+1.
+var nativeStorageCoreMigrations = []func(csExport *nativeStorageExport) error{
+	migrateNativeStorageCoreFromLegacy,
+}
+
+// nativeStorageCoreHeader is the header that precedes the gob-encoded nativeStorageExport
+// in a core dump. Its layout is fixed across the formats such that a server can tell
+// which version has written a core dump that it cannot read:
+//
+//	magic bytes | format (uint32) | length of the version (uvarint) | version
+//
+// Format is the format of the gob-encoded nativeStorageExport that follows the header.
+//
+// Version is the version of the server that's written the core dump.
+type nativeStorageCoreHeader struct {
+	Format  uint32
+	Version string
+}
+
+// writeNativeStorageCore writes the header of the current format and the gob-encoded core into w.
+func writeNativeStorageCore(w io.Writer, csExport nativeStorageExport) (err error) {
+	header := make([]byte, len(nativeStorageCoreMagic)+4+binary.MaxVarintLen64)
+	n := copy(header, nativeStorageCoreMagic)
+	binary.LittleEndian.PutUint32(header[n:], NATIVE_STORAGE_CORE_FORMAT)
+	n += 4
+	n += binary.PutUvarint(header[n:], uint64(len(csExport.Version)))
+
+	_, err = w.Write(header[:n])
+	if err != nil {
+		return
+	}
+	_, err = io.WriteString(w, csExport.Version)
+	if err != nil {
+		return
+	}
+
+	return gob.NewEncoder(w).Encode(csExport)
+}
+
+// readNativeStorageCoreHeader reads the header of a core dump.
+// The legacy core dumps that don't have a header are reported as NATIVE_STORAGE_CORE_FORMAT_LEGACY.
+func readNativeStorageCoreHeader(r *bufio.Reader) (header nativeStorageCoreHeader, err error) {
+	magic, err := r.Peek(len(nativeStorageCoreMagic))
+	if err == io.EOF || (err == nil && !bytes.Equal(magic, nativeStorageCoreMagic)) {
+		// The gob stream starts right away.
+		err = nil
+		header.Format = NATIVE_STORAGE_CORE_FORMAT_LEGACY
+		return
+	}
+	if err != nil {
+		return
+	}
+	r.Discard(len(nativeStorageCoreMagic))
+
+	var format [4]byte
+	_, err = io.ReadFull(r, format[:])
+	if err != nil {
+		return
+	}
+	header.Format = binary.LittleEndian.Uint32(format[:])
+
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return
+	}
+	if length > nativeStorageCoreMaxVersionLength {
+		err = fmt.Errorf("Invalid length of the version in the core dump header: %d", length)
+		return
+	}
+
+	version := make([]byte, length)
+	_, err = io.ReadFull(r, version)
+	header.Version = string(version)
+	return
+}
+
+// readNativeStorageCore reads a core dump of any known format and migrates it to NATIVE_STORAGE_CORE_FORMAT.
+// It refuses the formats that are newer than NATIVE_STORAGE_CORE_FORMAT with ErrUnsupportedCoreFormat,
+// instead of decoding the fields that may have a different meaning.
+func readNativeStorageCore(r io.Reader) (csExport nativeStorageExport, header nativeStorageCoreHeader, err error) {
+	br := bufio.NewReader(r)
+	header, err = readNativeStorageCoreHeader(br)
+	if err != nil {
+		err = fmt.Errorf("Corrupted core dump header: %w", err)
+		return
+	}
+
+	if header.Format > NATIVE_STORAGE_CORE_FORMAT {
+		err = fmt.Errorf("%w %d that's written by version %s, this version supports up to the format %d. Upgrade the server or remove the core dump to recover from the partitions.", ErrUnsupportedCoreFormat, header.Format, header.Version, NATIVE_STORAGE_CORE_FORMAT)
+		return
+	}
+
+	err = gob.NewDecoder(br).Decode(&csExport)
+	if err != nil {
+		return
+	}
+
+	// The legacy core dumps only have the version in the payload.
+	if header.Format == NATIVE_STORAGE_CORE_FORMAT_LEGACY {
+		header.Version = csExport.Version
+	}
+
+	for format := header.Format; format < NATIVE_STORAGE_CORE_FORMAT; format++ {
+		err = nativeStorageCoreMigrations[format](&csExport)
+		if err != nil {
+			err = fmt.Errorf("While migrating the core dump from the format %d to %d: %w", format, format+1, err)
+			return
+		}
+		log.Printf("Migrated the core dump from the format %d to %d.\n", format, format+1)
+	}
+
+	return
+}
+
+// migrateNativeStorageCoreFromLegacy migrates the legacy core dumps into the format 1.
+// The legacy core dumps keep the whole offset index in PartitionRefs and Offsets,
+// which are written into the offset index files by RestoreCore. Such that
+// the two must be of the same length.
+func migrateNativeStorageCoreFromLegacy(csExport *nativeStorageExport) (err error) {
+	if csExport.IndexSegments == nil && len(csExport.Offsets) != len(csExport.PartitionRefs) {
+		err = fmt.Errorf("Mismatched number of offsets and partition references: %d != %d", len(csExport.Offsets), len(csExport.PartitionRefs))
+	}
+	return
+}
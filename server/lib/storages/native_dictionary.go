@@ -0,0 +1,626 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// File extension of the dictionary of a partition.
+const NATIVE_STORAGE_DICTIONARY_FILE_EXT string = "dict"
+
+// Strings longer than this many bytes are never added into a dictionary.
+const nativeStorageDictionaryMaxStringLength int = 256
+
+// Maximum number of strings in a dictionary. The strings are written inline once it's full.
+const nativeStorageDictionaryMaxEntries int = 1 << 20
+
+// Maximum number of strings that are seen only once and waiting for their second
+// occurrence to be added into a dictionary. They're forgotten once the limit is reached.
+const nativeStorageDictionaryMaxCandidates int = 1 << 16
+
+// Tags of the values in a dictionary encoded record. A number is kept in its textual form.
+// A string is either inline or a reference to the dictionary. An array is followed by
+// the number of its elements and an object is followed by the number of its key-value pairs.
+const (
+	dictionaryTagNull byte = iota
+	dictionaryTagFalse
+	dictionaryTagTrue
+	dictionaryTagNumber
+	dictionaryTagString
+	dictionaryTagRef
+	dictionaryTagArray
+	dictionaryTagObject
+)
+
+var ErrCorruptedDictionaryRecord = errors.New("Corrupted dictionary encoded record")
+var ErrDictionaryWithCompression = errors.New("Dictionary encoding cannot be combined with the block compression")
+
+// dictionary is the list of the repeated strings in a partition. The records of the partition
+// refer to the strings in the dictionary by their indexes instead of repeating them. The dictionary
+// is stored next to the partition as a file of length prefixed strings that's only appended to.
+//
+// path is the path of the dictionary file.
+//
+// file is the dictionary file that's opened for writing. It's nil for the partitions that are not written into.
+//
+// strings are the strings in the order of their references.
+//
+// ids maps the strings to their references. It's only kept for the partition that's written into.
+//
+// candidates are the strings that are seen only once so far in the partition that's written into.
+//
+// size is the size of the valid part of the dictionary file in bytes.
+//
+// pending are the entries that are added into strings but not written into the file yet.
+type dictionary struct {
+	sync.RWMutex
+	path       string
+	file       *os.File
+	strings    []string
+	ids        map[string]uint64
+	candidates map[string]bool
+	size       int64
+	pending    []byte
+}
+
+// dictionaryCache keeps the dictionaries of the partitions that are read or written
+// by the paths of the partitions.
+type dictionaryCache struct {
+	sync.Mutex
+	dictionaries map[string]*dictionary
+}
+
+// dictionaryPath returns the path of the dictionary of the partition with the given path.
+func dictionaryPath(partitionPath string) string {
+	return strings.TrimSuffix(partitionPath, "."+NATIVE_STORAGE_DB_FILE_EXT) + "." + NATIVE_STORAGE_DICTIONARY_FILE_EXT
+}
+
+// loadDictionary reads the dictionary file with the given path. A missing file is an empty
+// dictionary. An entry that's torn by a crash at the end of the file is ignored.
+func loadDictionary(path string) (dict *dictionary, err error) {
+	dict = &dictionary{path: path}
+
+	var data []byte
+	data, err = ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	for int(dict.size) < len(data) {
+		length, n := binary.Uvarint(data[dict.size:])
+		if n <= 0 || uint64(len(data)-int(dict.size)-n) < length {
+			break
+		}
+		start := int(dict.size) + n
+		dict.strings = append(dict.strings, string(data[start:start+int(length)]))
+		dict.size = int64(start) + int64(length)
+	}
+	return
+}
+
+// appendUvarint appends the unsigned varint form of v into b.
+func appendUvarint(b []byte, v uint64) []byte {
+	l := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(l, v)
+	return append(b, l[:n]...)
+}
+
+// intern returns the reference of a string if it's repeated. A string is added into the
+// dictionary upon its second occurrence, as long as it's short and the dictionary is not full.
+// It must be called while the dictionary is locked.
+func (dict *dictionary) intern(s string) (id uint64, ok bool) {
+	if dict.ids == nil {
+		dict.ids = make(map[string]uint64, len(dict.strings))
+		for i, entry := range dict.strings {
+			dict.ids[entry] = uint64(i)
+		}
+		dict.candidates = make(map[string]bool)
+	}
+
+	id, ok = dict.ids[s]
+	if ok || len(s) > nativeStorageDictionaryMaxStringLength || len(dict.strings) >= nativeStorageDictionaryMaxEntries {
+		return
+	}
+
+	if !dict.candidates[s] {
+		if len(dict.candidates) >= nativeStorageDictionaryMaxCandidates {
+			dict.candidates = make(map[string]bool)
+		}
+		dict.candidates[s] = true
+		return
+	}
+
+	delete(dict.candidates, s)
+	id = uint64(len(dict.strings))
+	dict.strings = append(dict.strings, s)
+	dict.ids[s] = id
+	dict.pending = appendUvarint(dict.pending, uint64(len(s)))
+	dict.pending = append(dict.pending, s...)
+	ok = true
+	return
+}
+
+// encode converts a JSON document into the dictionary encoded form. The order of
+// the keys and the textual form of the numbers are preserved.
+func (dict *dictionary) encode(data []byte) (b []byte, err error) {
+	dict.Lock()
+	defer dict.Unlock()
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return dict.encodeValue(decoder, nil)
+}
+
+// encodeValue encodes the next value of the decoder into b.
+// It must be called while the dictionary is locked.
+func (dict *dictionary) encodeValue(decoder *json.Decoder, b []byte) ([]byte, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return b, err
+	}
+
+	switch value := token.(type) {
+	case json.Delim:
+		var items []byte
+		var count uint64
+		for decoder.More() {
+			if value == '{' {
+				var key json.Token
+				key, err = decoder.Token()
+				if err != nil {
+					return b, err
+				}
+				items = dict.encodeString(items, key.(string))
+			}
+			items, err = dict.encodeValue(decoder, items)
+			if err != nil {
+				return b, err
+			}
+			count++
+		}
+		// Consume the closing delimiter.
+		_, err = decoder.Token()
+		if err != nil {
+			return b, err
+		}
+
+		tag := dictionaryTagArray
+		if value == '{' {
+			tag = dictionaryTagObject
+		}
+		b = append(b, tag)
+		b = appendUvarint(b, count)
+		b = append(b, items...)
+	case string:
+		b = dict.encodeString(b, value)
+	case json.Number:
+		b = append(b, dictionaryTagNumber)
+		b = appendUvarint(b, uint64(len(value)))
+		b = append(b, value...)
+	case bool:
+		if value {
+			b = append(b, dictionaryTagTrue)
+		} else {
+			b = append(b, dictionaryTagFalse)
+		}
+	case nil:
+		b = append(b, dictionaryTagNull)
+	}
+	return b, nil
+}
+
+// encodeString encodes a string into b either as a reference or inline.
+// It must be called while the dictionary is locked.
+func (dict *dictionary) encodeString(b []byte, s string) []byte {
+	if id, ok := dict.intern(s); ok {
+		b = append(b, dictionaryTagRef)
+		return appendUvarint(b, id)
+	}
+	b = append(b, dictionaryTagString)
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// persist appends the pending entries into the dictionary file. The entries must be
+// written before the records that refer to them.
+func (dict *dictionary) persist(sync bool) (err error) {
+	dict.Lock()
+	defer dict.Unlock()
+
+	if len(dict.pending) == 0 {
+		return
+	}
+
+	if dict.file == nil {
+		dict.file, err = os.OpenFile(dict.path, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = dict.file.WriteAt(dict.pending, dict.size)
+	if err != nil {
+		return
+	}
+	dict.size += int64(len(dict.pending))
+	dict.pending = nil
+
+	if sync {
+		err = dict.file.Sync()
+	}
+	return
+}
+
+// seal releases the resources that are only needed for writing into the partition.
+func (dict *dictionary) seal() {
+	dict.Lock()
+	defer dict.Unlock()
+
+	if dict.file != nil {
+		dict.file.Close()
+		dict.file = nil
+	}
+	dict.ids = nil
+	dict.candidates = nil
+}
+
+// dictionaryReader reads the values of a dictionary encoded record one by one.
+type dictionaryReader struct {
+	b       []byte
+	strings []string
+}
+
+// uvarint reads an unsigned varint.
+func (r *dictionaryReader) uvarint() (v uint64, err error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		err = ErrCorruptedDictionaryRecord
+		return
+	}
+	r.b = r.b[n:]
+	return
+}
+
+// bytes reads the bytes that are prefixed with their length.
+func (r *dictionaryReader) bytes() (v []byte, err error) {
+	var length uint64
+	length, err = r.uvarint()
+	if err != nil {
+		return
+	}
+	if uint64(len(r.b)) < length {
+		err = ErrCorruptedDictionaryRecord
+		return
+	}
+	v = r.b[:length]
+	r.b = r.b[length:]
+	return
+}
+
+// tag reads the tag of the next value.
+func (r *dictionaryReader) tag() (tag byte, err error) {
+	if len(r.b) == 0 {
+		err = ErrCorruptedDictionaryRecord
+		return
+	}
+	tag = r.b[0]
+	r.b = r.b[1:]
+	return
+}
+
+// string reads a string that's either inline or a reference, according to its tag.
+func (r *dictionaryReader) string(tag byte) (s string, err error) {
+	switch tag {
+	case dictionaryTagString:
+		var v []byte
+		v, err = r.bytes()
+		s = string(v)
+	case dictionaryTagRef:
+		var id uint64
+		id, err = r.uvarint()
+		if err == nil && id >= uint64(len(r.strings)) {
+			err = ErrCorruptedDictionaryRecord
+		}
+		if err == nil {
+			s = r.strings[id]
+		}
+	default:
+		err = ErrCorruptedDictionaryRecord
+	}
+	return
+}
+
+// decodeValue rehydrates the next value into its JSON form by appending it into out.
+func (r *dictionaryReader) decodeValue(out []byte) ([]byte, error) {
+	tag, err := r.tag()
+	if err != nil {
+		return out, err
+	}
+
+	switch tag {
+	case dictionaryTagNull:
+		out = append(out, "null"...)
+	case dictionaryTagFalse:
+		out = append(out, "false"...)
+	case dictionaryTagTrue:
+		out = append(out, "true"...)
+	case dictionaryTagNumber:
+		var v []byte
+		v, err = r.bytes()
+		out = append(out, v...)
+	case dictionaryTagString, dictionaryTagRef:
+		var s string
+		s, err = r.string(tag)
+		if err == nil {
+			// Escaped the same way as json.Marshal() does on insertion.
+			v, _ := json.Marshal(s)
+			out = append(out, v...)
+		}
+	case dictionaryTagArray, dictionaryTagObject:
+		var count uint64
+		count, err = r.uvarint()
+		opening, closing := byte('['), byte(']')
+		if tag == dictionaryTagObject {
+			opening, closing = '{', '}'
+		}
+		out = append(out, opening)
+		for i := uint64(0); err == nil && i < count; i++ {
+			if i > 0 {
+				out = append(out, ',')
+			}
+			if tag == dictionaryTagObject {
+				var keyTag byte
+				keyTag, err = r.tag()
+				if err != nil {
+					break
+				}
+				var key string
+				key, err = r.string(keyTag)
+				if err != nil {
+					break
+				}
+				v, _ := json.Marshal(key)
+				out = append(out, v...)
+				out = append(out, ':')
+			}
+			out, err = r.decodeValue(out)
+		}
+		out = append(out, closing)
+	default:
+		err = ErrCorruptedDictionaryRecord
+	}
+	return out, err
+}
+
+// containsString tells whether the next value has a string, including the keys, that's equal to s.
+func (r *dictionaryReader) containsString(s string) (found bool, err error) {
+	var tag byte
+	tag, err = r.tag()
+	if err != nil {
+		return
+	}
+
+	switch tag {
+	case dictionaryTagNumber:
+		_, err = r.bytes()
+	case dictionaryTagString, dictionaryTagRef:
+		var v string
+		v, err = r.string(tag)
+		found = v == s
+	case dictionaryTagArray, dictionaryTagObject:
+		var count uint64
+		count, err = r.uvarint()
+		if tag == dictionaryTagObject {
+			count *= 2
+		}
+		for i := uint64(0); err == nil && i < count; i++ {
+			var ok bool
+			ok, err = r.containsString(s)
+			found = found || ok
+		}
+	case dictionaryTagNull, dictionaryTagFalse, dictionaryTagTrue:
+	default:
+		err = ErrCorruptedDictionaryRecord
+	}
+	return
+}
+
+// decode rehydrates a dictionary encoded record into its JSON form.
+func (dict *dictionary) decode(b []byte) (data []byte, err error) {
+	dict.RLock()
+	r := &dictionaryReader{b: b, strings: dict.strings}
+	dict.RUnlock()
+
+	data, err = r.decodeValue(make([]byte, 0, len(b)*2))
+	if err == nil && len(r.b) > 0 {
+		err = ErrCorruptedDictionaryRecord
+	}
+	return
+}
+
+// mayMatch tells whether a dictionary encoded record might satisfy the plan by looking for
+// the string literals of the `==` predicates in the record without rehydrating it.
+func (dict *dictionary) mayMatch(b []byte, plan *basenine.Plan) bool {
+	if plan == nil {
+		return true
+	}
+
+	if plan.Predicate != nil {
+		s, ok := dictionaryLiteral(plan.Predicate)
+		if !ok {
+			return true
+		}
+
+		dict.RLock()
+		r := &dictionaryReader{b: b, strings: dict.strings}
+		dict.RUnlock()
+
+		found, err := r.containsString(s)
+		// A corrupted record is left to the decoding.
+		return found || err != nil
+	}
+
+	switch plan.Op {
+	case "and":
+		return dict.mayMatch(b, plan.Left) && dict.mayMatch(b, plan.Right)
+	case "or":
+		return dict.mayMatch(b, plan.Left) || dict.mayMatch(b, plan.Right)
+	}
+	return true
+}
+
+// dictionaryLiteral returns the literal of a `==` predicate that can only be equal to a string.
+// The literals like "42" or "true" are not returned since the `==` operator converts
+// the numbers and the booleans into strings. Likewise, the objects and the arrays are equal to "".
+func dictionaryLiteral(predicate *basenine.Predicate) (s string, ok bool) {
+	if predicate.Op != "==" {
+		return
+	}
+
+	s = predicate.Value
+	switch s {
+	case "", "true", "false", "null":
+		return
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// newDictionaryCache creates an empty cache of dictionaries.
+func newDictionaryCache() *dictionaryCache {
+	return &dictionaryCache{
+		dictionaries: make(map[string]*dictionary),
+	}
+}
+
+// get returns the dictionary of the partition with the given path. It's loaded from the disk if it's not cached.
+func (cache *dictionaryCache) get(partitionPath string) (dict *dictionary, err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	dict, ok := cache.dictionaries[partitionPath]
+	if ok {
+		return
+	}
+
+	dict, err = loadDictionary(dictionaryPath(partitionPath))
+	if err != nil {
+		return
+	}
+	cache.dictionaries[partitionPath] = dict
+	return
+}
+
+// seal releases the resources that are only needed for writing into the partition with the given path.
+func (cache *dictionaryCache) seal(partitionPath string) {
+	cache.Lock()
+	dict, ok := cache.dictionaries[partitionPath]
+	cache.Unlock()
+
+	if ok {
+		dict.seal()
+	}
+}
+
+// sync syncs the dictionary file of the partition with the given path if it's opened for writing.
+func (cache *dictionaryCache) sync(partitionPath string) (err error) {
+	cache.Lock()
+	dict, ok := cache.dictionaries[partitionPath]
+	cache.Unlock()
+
+	if !ok {
+		return
+	}
+
+	dict.RLock()
+	defer dict.RUnlock()
+	if dict.file != nil {
+		err = dict.file.Sync()
+	}
+	return
+}
+
+// remove evicts the dictionary of the partition with the given path and removes its file.
+func (cache *dictionaryCache) remove(partitionPath string) {
+	cache.Lock()
+	dict, ok := cache.dictionaries[partitionPath]
+	delete(cache.dictionaries, partitionPath)
+	cache.Unlock()
+
+	if ok {
+		dict.seal()
+	}
+	os.Remove(dictionaryPath(partitionPath))
+}
+
+// clear evicts all of the dictionaries. The files are removed along with the partitions.
+func (cache *dictionaryCache) clear() {
+	cache.Lock()
+	dictionaries := cache.dictionaries
+	cache.dictionaries = make(map[string]*dictionary)
+	cache.Unlock()
+
+	for _, dict := range dictionaries {
+		dict.seal()
+	}
+}
+
+// encodeDictionaryRecord encodes the record through the dictionary of the partition with the given path
+// and prepends the record header with the NATIVE_STORAGE_RECORD_V3 format into it. The strings that are
+// added into the dictionary are written into the dictionary file beforehand.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) encodeDictionaryRecord(partitionPath string, data []byte) (b []byte, err error) {
+	var dict *dictionary
+	dict, err = storage.dictionaries.get(partitionPath)
+	if err != nil {
+		return
+	}
+
+	b, err = dict.encode(data)
+	if err != nil {
+		return
+	}
+
+	err = dict.persist(storage.syncMode == NATIVE_STORAGE_SYNC_ALWAYS)
+	if err != nil {
+		return
+	}
+
+	b = encodeRecordVersion(NATIVE_STORAGE_RECORD_V3, b)
+	return
+}
+
+// decodeDictionaryRecord rehydrates the payload of a NATIVE_STORAGE_RECORD_V3 record through
+// the dictionary of the partition with the given path. b is nil if the record cannot satisfy the plan.
+func (storage *nativeStorage) decodeDictionaryRecord(partitionPath string, payload []byte, plan *basenine.Plan) (b []byte, err error) {
+	var dict *dictionary
+	dict, err = storage.dictionaries.get(partitionPath)
+	if err != nil {
+		return
+	}
+
+	if !dict.mayMatch(payload, plan) {
+		return
+	}
+	return dict.decode(payload)
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// Export writes the records in the given ID range that pass the query into an NDJSON file at the given path,
+// which is gzip-compressed if compress is true. The records are written as the query transforms them,
+// such that the fields that are removed by `redact` are not exported. The progress is reported through
+// the Metadata messages, it replies `OK` once the file is written. Otherwise the error is returned
+// to be sent by the caller. The archived records are not exported.
+func (storage *nativeStorage) Export(conn net.Conn, path string, compress bool, from string, to string, query string) (err error) {
+	storage.RLock()
+	first := storage.removedOffsetsCounter
+	next := first + storage.offsets.Len()
+	truncatedTimestamp := storage.truncatedTimestamp
+	storage.RUnlock()
+
+	var expr *basenine.Expression
+	var w *exportWriter
+	expr, w, err = startExport(conn, storage, path, compress, from, to, query, first, next, truncatedTimestamp)
+	if err != nil {
+		return
+	}
+
+	err = storage.exportRecords(expr, w)
+	if err == nil {
+		err = w.close(storage.syncMode != NATIVE_STORAGE_SYNC_NONE)
+	} else {
+		w.abort()
+	}
+	if err != nil {
+		err = fmt.Errorf("While exporting: %w", err)
+		return
+	}
+
+	log.Printf("Exported %d records into: %s\n", w.metadata.NumberOfWritten, w.path)
+	basenine.SendOK(conn)
+	return
+}
+
+// exportRecords writes the records in the range of the export that pass the query through w.
+// The records are read through the same loop as FETCH.
+func (storage *nativeStorage) exportRecords(expr *basenine.Expression, w *exportWriter) (err error) {
+	plan := basenine.BuildPlan(expr)
+
+	storage.RLock()
+	start := w.start
+	if start < storage.removedOffsetsCounter {
+		start = storage.removedOffsetsCounter
+	}
+	if start > w.end {
+		start = w.end
+	}
+	cursor := &offsetCursor{
+		storage: storage,
+		first:   start,
+		length:  w.end - start,
+	}
+	cursor.ids = storage.lookupPlan(plan, cursor.first, cursor.first+cursor.length)
+	pruned := storage.prunePartitions(plan)
+	storage.RUnlock()
+
+	_, err = storage.readRecords(cursor, nil, plan, pruned, func(i int, id uint64, b []byte) (stop bool, err error) {
+		// The records that are skipped through the secondary indexes are also counted as queried.
+		err = w.progress(id + 1)
+		if err != nil || b == nil {
+			return
+		}
+
+		// Evaluate the current record against the given query.
+		truth, record, evalErr := basenine.Eval(expr, string(b))
+		if evalErr != nil {
+			log.Printf("Eval error: %v\n", evalErr)
+			return
+		}
+
+		if truth {
+			err = w.write(record)
+		}
+		return
+	})
+	return
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	jp "github.com/ohler55/ojg/jp"
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// newFullTextIndexes creates the full-text indexes of the given paths. A full-text index is
+// an inverted index that maps the tokens of the values to the indexes of the records.
+// The indexes are not dumped into the core, they're built on initialization.
+func newFullTextIndexes(paths []string) (indexes []*hashIndex, err error) {
+	for _, text := range paths {
+		var path string
+		var jsonPath jp.Expr
+		path, jsonPath, err = basenine.ParseIndexPath(text)
+		if err != nil {
+			return
+		}
+
+		indexes = append(indexes, &hashIndex{
+			path:     path,
+			jsonPath: jsonPath,
+			fullText: true,
+		})
+	}
+	return
+}
+
+// getFullTextIndex returns the full-text index on the given path or nil if there is none.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) getFullTextIndex(path string) *hashIndex {
+	for _, index := range storage.fullTextIndexes {
+		if index.path == path {
+			return index
+		}
+	}
+	return nil
+}
+
+// lookupTerms returns the indexes of the records in the [from, to) range that contain all of the terms.
+// No records contain an empty list of terms, the same way that the `search` helper evaluates it.
+func (index *hashIndex) lookupTerms(terms []string, from uint64, to uint64) (ids []uint64) {
+	ids = []uint64{}
+	if len(terms) == 0 {
+		return
+	}
+
+	for _, bucket := range index.buckets {
+		if bucket.lastID < from {
+			continue
+		}
+
+		matches := rangeIDs(bucket.values[terms[0]], from, to)
+		for _, term := range terms[1:] {
+			matches = intersectIDs(matches, rangeIDs(bucket.values[term], from, to))
+		}
+		ids = append(ids, matches...)
+	}
+	return
+}
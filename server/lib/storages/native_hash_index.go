@@ -0,0 +1,399 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+
+	jp "github.com/ohler55/ojg/jp"
+	oj "github.com/ohler55/ojg/oj"
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// hashIndex is a secondary index that maps the values of a field to the indexes of the records.
+// It answers the `==` and `!=` predicates of the queries without evaluating every record.
+//
+// path is the path of the field as it's written in the queries, like `dst.name`.
+//
+// jsonPath is the compiled version of path.
+//
+// ready is false until the records that are inserted before the index is created are indexed.
+//
+// buckets are the postings of the partitions in ascending order.
+//
+// fullText is true if the keys are the tokens of the values instead of the values themselves.
+// Such an index answers the calls of the `search` helper.
+type hashIndex struct {
+	path     string
+	jsonPath jp.Expr
+	ready    bool
+	buckets  []*hashIndexBucket
+	fullText bool
+}
+
+// hashIndexBucket contains the postings of the records in a single partition.
+//
+// partition is the index of the partition.
+//
+// lastID is the greatest index of the records in the bucket.
+//
+// values maps the keys of the values to the indexes of the records in ascending order.
+//
+// present contains the indexes of all of the records that have the field, in ascending order.
+type hashIndexBucket struct {
+	partition int64
+	lastID    uint64
+	values    map[string][]uint64
+	present   []uint64
+}
+
+// CreateIndex declares a secondary index on the field path given in data like `request.path`.
+// The records that are already in the database are indexed before it's acknowledged.
+func (storage *nativeStorage) CreateIndex(conn net.Conn, data []byte) (err error) {
+	path, jsonPath, err := basenine.ParseIndexPath(string(data))
+	if err != nil {
+		conn.Write([]byte(fmt.Sprintf("Error: While parsing the index path: %s\n", err.Error())))
+		return
+	}
+
+	storage.Lock()
+	if storage.getHashIndex(path) != nil {
+		storage.Unlock()
+		basenine.SendOK(conn)
+		return
+	}
+	index := &hashIndex{
+		path:     path,
+		jsonPath: jsonPath,
+	}
+	storage.hashIndexes = append(storage.hashIndexes, index)
+	// The pending records are indexed once their block is flushed.
+	end := storage.offsets.Len() + storage.removedOffsetsCounter
+	storage.Unlock()
+
+	storage.buildHashIndex(index, end)
+
+	basenine.SendOK(conn)
+	return
+}
+
+// getHashIndex returns the secondary index on the given path or nil if there is none.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) getHashIndex(path string) *hashIndex {
+	for _, index := range storage.hashIndexes {
+		if index.path == path {
+			return index
+		}
+	}
+	return nil
+}
+
+// indexRecord adds the record with the given index to the secondary indexes and the Bloom filters.
+// It returns the checksum of the record that's stored next to its offset.
+// It must be called while the storage is locked, in the order of the indexes of the records.
+func (storage *nativeStorage) indexRecord(id uint64, partition int64, data []byte) (checksum uint64) {
+	checksum = nativeStorageChecksumUnknown
+	if len(storage.hashIndexes) == 0 && len(storage.fullTextIndexes) == 0 && storage.bloomIndex == nil && storage.checksums == nil {
+		return
+	}
+
+	obj, err := oj.Parse(data)
+	if err != nil {
+		return
+	}
+
+	if storage.checksums != nil {
+		checksum = storage.checksums.compute(obj)
+	}
+
+	for _, index := range storage.hashIndexes {
+		index.buckets = index.add(index.buckets, id, partition, obj)
+	}
+	for _, index := range storage.fullTextIndexes {
+		index.buckets = index.add(index.buckets, id, partition, obj)
+	}
+	storage.bloomRecord(partition, obj)
+	return
+}
+
+// add adds the keys of the record into the last bucket of the given buckets.
+// A new bucket is appended if the record belongs to another partition.
+func (index *hashIndex) add(buckets []*hashIndexBucket, id uint64, partition int64, obj interface{}) []*hashIndexBucket {
+	keys, ok := index.keys(obj)
+	if !ok {
+		return buckets
+	}
+
+	if len(buckets) == 0 || buckets[len(buckets)-1].partition != partition {
+		buckets = append(buckets, &hashIndexBucket{
+			partition: partition,
+			values:    make(map[string][]uint64),
+		})
+	}
+
+	bucket := buckets[len(buckets)-1]
+	bucket.lastID = id
+	bucket.present = append(bucket.present, id)
+	for _, key := range keys {
+		ids := bucket.values[key]
+		// The same key can be repeated in an array.
+		if len(ids) > 0 && ids[len(ids)-1] == id {
+			continue
+		}
+		bucket.values[key] = append(ids, id)
+	}
+	return buckets
+}
+
+// keys returns the keys of the given record in the index.
+func (index *hashIndex) keys(obj interface{}) ([]string, bool) {
+	if index.fullText {
+		return basenine.SearchKeys(obj, index.jsonPath)
+	}
+	return basenine.IndexKeys(obj, index.jsonPath)
+}
+
+// buildHashIndex indexes the records up to the index end that are inserted before the
+// secondary index is created. The index becomes ready to be used by the queries afterwards.
+func (storage *nativeStorage) buildHashIndex(index *hashIndex, end uint64) {
+	var buckets []*hashIndexBucket
+	storage.scanRecords(end, func(id uint64, partition int64, obj interface{}) {
+		buckets = index.add(buckets, id, partition, obj)
+	})
+
+	// The records that are inserted in the meantime are already indexed and they come after.
+	storage.Lock()
+	if len(buckets) > 0 && len(index.buckets) > 0 && buckets[len(buckets)-1].partition == index.buckets[0].partition {
+		last := buckets[len(buckets)-1]
+		first := index.buckets[0]
+		for key, ids := range first.values {
+			last.values[key] = append(last.values[key], ids...)
+		}
+		last.present = append(last.present, first.present...)
+		last.lastID = first.lastID
+		index.buckets = index.buckets[1:]
+	}
+	index.buckets = append(buckets, index.buckets...)
+	index.ready = true
+	storage.dropHashIndexPostings()
+	storage.Unlock()
+
+	log.Printf("Indexed the records on the path: %s\n", index.path)
+}
+
+// scanRecords calls fn with the parsed version of each live record up to the index end,
+// in ascending order. The records that cannot be read are skipped.
+func (storage *nativeStorage) scanRecords(end uint64, fn func(id uint64, partition int64, obj interface{})) {
+	storage.RLock()
+	cursor := &offsetCursor{
+		storage: storage,
+		first:   storage.removedOffsetsCounter,
+	}
+	if end > cursor.first {
+		cursor.length = end - cursor.first
+	}
+	storage.RUnlock()
+
+	var f *os.File
+	for i := 0; i < cursor.Len(); i++ {
+		id, offset, partitionRef, err := cursor.At(i)
+		if err != nil || offset < 0 {
+			continue
+		}
+
+		var path string
+		storage.RLock()
+		if fRef := storage.partitions[partitionRef]; fRef != nil {
+			path = fRef.Name()
+		}
+		storage.RUnlock()
+		if path == "" {
+			continue
+		}
+
+		if f == nil || f.Name() != path {
+			if f != nil {
+				f.Close()
+			}
+			f, err = os.Open(path)
+			if err != nil {
+				f = nil
+				continue
+			}
+		}
+
+		var b []byte
+		b, _, err = storage.readRecord(f, offset)
+		if err != nil {
+			continue
+		}
+
+		var obj interface{}
+		obj, err = oj.Parse(b)
+		if err != nil {
+			continue
+		}
+
+		fn(id, partitionRef, obj)
+	}
+	if f != nil {
+		f.Close()
+	}
+}
+
+// invertedIndexes returns the secondary indexes along with the full-text indexes.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) invertedIndexes() (indexes []*hashIndex) {
+	indexes = append(indexes, storage.hashIndexes...)
+	return append(indexes, storage.fullTextIndexes...)
+}
+
+// dropHashIndexPostings drops the buckets of the secondary indexes that only contain removed records.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) dropHashIndexPostings() {
+	for _, index := range storage.invertedIndexes() {
+		n := 0
+		for n < len(index.buckets) && index.buckets[n].lastID < storage.removedOffsetsCounter {
+			n++
+		}
+		index.buckets = index.buckets[n:]
+	}
+}
+
+// lookupPlan returns the indexes of the records in the [from, to) range that might satisfy the plan,
+// in ascending order. nil means the plan cannot be answered through the secondary indexes and all of
+// the records have to be evaluated. It must be called while the storage is locked.
+func (storage *nativeStorage) lookupPlan(plan *basenine.Plan, from uint64, to uint64) (ids []uint64) {
+	if plan == nil {
+		return
+	}
+
+	if plan.Predicate != nil {
+		switch plan.Predicate.Op {
+		case "==", "!=":
+			index := storage.getHashIndex(plan.Predicate.Path)
+			if index == nil || !index.ready {
+				return
+			}
+			return index.lookup(plan.Predicate, from, to)
+		case "search":
+			index := storage.getFullTextIndex(plan.Predicate.Path)
+			if index == nil || !index.ready {
+				return
+			}
+			return index.lookupTerms(basenine.Tokenize(plan.Predicate.Value), from, to)
+		}
+		return
+	}
+
+	left := storage.lookupPlan(plan.Left, from, to)
+	right := storage.lookupPlan(plan.Right, from, to)
+	switch plan.Op {
+	case "and":
+		if left == nil {
+			return right
+		}
+		if right == nil {
+			return left
+		}
+		return intersectIDs(left, right)
+	case "or":
+		if left == nil || right == nil {
+			return
+		}
+		return unionIDs(left, right)
+	}
+	return
+}
+
+// lookup returns the indexes of the records in the [from, to) range that satisfy the predicate.
+func (index *hashIndex) lookup(predicate *basenine.Predicate, from uint64, to uint64) (ids []uint64) {
+	ids = []uint64{}
+	for _, bucket := range index.buckets {
+		if bucket.lastID < from {
+			continue
+		}
+
+		matches := rangeIDs(bucket.values[predicate.Value], from, to)
+		if predicate.Op == "!=" {
+			// A record that doesn't have the field is not a match for `!=` either.
+			matches = differenceIDs(rangeIDs(bucket.present, from, to), matches)
+		}
+		ids = append(ids, matches...)
+	}
+	return
+}
+
+// rangeIDs returns the part of the sorted indexes that are in the [from, to) range.
+func rangeIDs(ids []uint64, from uint64, to uint64) []uint64 {
+	start := sort.Search(len(ids), func(i int) bool {
+		return ids[i] >= from
+	})
+	end := sort.Search(len(ids), func(i int) bool {
+		return ids[i] >= to
+	})
+	return ids[start:end]
+}
+
+// intersectIDs returns the indexes that are in both of the sorted slices.
+func intersectIDs(a []uint64, b []uint64) (ids []uint64) {
+	ids = []uint64{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			ids = append(ids, a[i])
+			i++
+			j++
+		}
+	}
+	return
+}
+
+// unionIDs returns the indexes that are in either of the sorted slices.
+func unionIDs(a []uint64, b []uint64) (ids []uint64) {
+	ids = make([]uint64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			ids = append(ids, a[i])
+			i++
+		case a[i] > b[j]:
+			ids = append(ids, b[j])
+			j++
+		default:
+			ids = append(ids, a[i])
+			i++
+			j++
+		}
+	}
+	ids = append(ids, a[i:]...)
+	ids = append(ids, b[j:]...)
+	return
+}
+
+// differenceIDs returns the indexes in the sorted slice a that are not in the sorted slice b.
+func differenceIDs(a []uint64, b []uint64) (ids []uint64) {
+	ids = []uint64{}
+	j := 0
+	for _, id := range a {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+		if j < len(b) && b[j] == id {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return
+}
@@ -0,0 +1,615 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// File extension of the offset index files of the partitions.
+const NATIVE_STORAGE_INDEX_FILE_EXT string = "idx"
+
+// An entry of an offset index file is the offset of a record as a little-endian int64.
+const nativeStorageIndexEntrySize int64 = 8
+
+// Number of entries in a page of an offset index file. The entries are written into
+// the index files and read back into the memory page by page.
+const nativeStorageIndexPageEntries int = 4096
+
+// Maximum number of offset index pages that are kept in memory.
+const nativeStorageIndexCacheCapacity int = 256
+
+var ErrIndexOutOfRange = errors.New("Index out of range")
+var ErrIndexFileTooShort = errors.New("Offset index file is shorter than expected")
+var ErrRecordRemoved = errors.New("Record is removed")
+
+// offsetIndex maps the positions of the records to their offsets and partitions.
+// The position of a record is its index minus the removedOffsetsCounter.
+// The offsets are stored in per-partition index files that consist of fixed-width
+// entries. Only the entries that are not written into the files yet and a limited
+// number of recently read pages are kept in memory. Such that the number of
+// records is not bounded by the RAM.
+//
+// offsetIndex is protected by the lock of nativeStorage. Only the page cache has its
+// own lock since it's shared by the readers that hold the read lock.
+//
+// segments are the per-partition parts of the index in ascending order.
+//
+// length is the total number of entries in the index.
+//
+// path returns the path of the index file of the partition with the given index.
+//
+// cache keeps the recently read pages.
+type offsetIndex struct {
+	segments []*indexSegment
+	length   uint64
+	path     func(partition int64) string
+	cache    *indexPageCache
+}
+
+// indexSegment is the part of the offset index that belongs to a single partition.
+//
+// partition is the index of the partition.
+//
+// start is the position of the first entry of the segment.
+//
+// count is the number of entries in the segment.
+//
+// file is the offset index file of the partition.
+//
+// flushed is the number of entries that are written into the file.
+//
+// tail contains the entries that are not written into the file yet.
+//
+// dirty is true if the file is written into since it's last synced.
+type indexSegment struct {
+	partition int64
+	start     uint64
+	count     uint64
+	file      *os.File
+	flushed   uint64
+	tail      []int64
+	dirty     bool
+}
+
+// Unmutexed, file descriptor clean version of indexSegment for achieving core dump.
+type nativeStorageIndexSegmentExport struct {
+	Partition int64
+	Count     uint64
+}
+
+// indexPageCache is a FIFO cache of the pages read from the offset index files.
+type indexPageCache struct {
+	sync.Mutex
+	keys  []string
+	pages map[string][]int64
+}
+
+func newOffsetIndex(path func(partition int64) string) *offsetIndex {
+	return &offsetIndex{
+		path: path,
+		cache: &indexPageCache{
+			pages: make(map[string][]int64),
+		},
+	}
+}
+
+// indexPath returns the path of the offset index file of the partition with the given index.
+func (storage *nativeStorage) indexPath(index int64) string {
+	return storage.dataPath(fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, index, NATIVE_STORAGE_INDEX_FILE_EXT))
+}
+
+// Len returns the number of entries in the index.
+func (index *offsetIndex) Len() uint64 {
+	return index.length
+}
+
+// Append adds the offset of a record in the given partition to the end of the index.
+// The tail of the segment is written into the index file once it fills a page.
+// Nothing is appended if an error is returned.
+func (index *offsetIndex) Append(partition int64, offset int64) (err error) {
+	var segment *indexSegment
+	if n := len(index.segments); n > 0 && index.segments[n-1].partition == partition {
+		segment = index.segments[n-1]
+	} else {
+		var f *os.File
+		f, err = os.OpenFile(index.path(partition), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+		if err != nil {
+			return
+		}
+		segment = &indexSegment{
+			partition: partition,
+			start:     index.length,
+			file:      f,
+		}
+		index.segments = append(index.segments, segment)
+	}
+
+	segment.tail = append(segment.tail, offset)
+	segment.count++
+	index.length++
+
+	if len(segment.tail) >= nativeStorageIndexPageEntries {
+		err = segment.flush()
+		if err != nil {
+			// The entry is taken back such that a failed append doesn't reserve the index.
+			segment.tail = segment.tail[:len(segment.tail)-1]
+			segment.count--
+			index.length--
+		}
+	}
+	return
+}
+
+// flush writes the tail of the segment into its index file.
+func (segment *indexSegment) flush() (err error) {
+	if len(segment.tail) == 0 {
+		return
+	}
+
+	b := make([]byte, int64(len(segment.tail))*nativeStorageIndexEntrySize)
+	for i, offset := range segment.tail {
+		binary.LittleEndian.PutUint64(b[int64(i)*nativeStorageIndexEntrySize:], uint64(offset))
+	}
+
+	_, err = segment.file.WriteAt(b, int64(segment.flushed)*nativeStorageIndexEntrySize)
+	if err != nil {
+		return
+	}
+
+	segment.flushed += uint64(len(segment.tail))
+	segment.tail = nil
+	segment.dirty = true
+	return
+}
+
+// Flush writes the entries that are not written yet into the index files.
+// The index files that are written into are synced if sync is true.
+func (index *offsetIndex) Flush(sync bool) (err error) {
+	for _, segment := range index.segments {
+		err = segment.flush()
+		if err != nil {
+			return
+		}
+
+		if sync && segment.dirty {
+			err = segment.file.Sync()
+			if err != nil {
+				return
+			}
+			segment.dirty = false
+		}
+	}
+	return
+}
+
+// segmentOf returns the segment that contains the entry at the given position.
+func (index *offsetIndex) segmentOf(position uint64) *indexSegment {
+	i := sort.Search(len(index.segments), func(i int) bool {
+		return index.segments[i].start+index.segments[i].count > position
+	})
+	return index.segments[i]
+}
+
+// Get returns the offset and the partition of the record at the given position.
+func (index *offsetIndex) Get(position uint64) (offset int64, partition int64, err error) {
+	var offsets, partitions []int64
+	offsets, partitions, err = index.Range(position, position+1)
+	if err != nil {
+		return
+	}
+	if len(offsets) == 0 {
+		err = ErrIndexOutOfRange
+		return
+	}
+
+	offset = offsets[0]
+	partition = partitions[0]
+	return
+}
+
+// Range returns the offsets and the partitions of the records in the [from, to) range of positions.
+// The range is clamped to the length of the index.
+func (index *offsetIndex) Range(from uint64, to uint64) (offsets []int64, partitions []int64, err error) {
+	if to > index.length {
+		to = index.length
+	}
+
+	for position := from; position < to; {
+		segment := index.segmentOf(position)
+		i := position - segment.start
+
+		var entries []int64
+		if i >= segment.flushed {
+			entries = segment.tail[i-segment.flushed:]
+		} else {
+			var page []int64
+			page, err = index.page(segment, i/uint64(nativeStorageIndexPageEntries))
+			if err != nil {
+				return
+			}
+			entries = page[i%uint64(nativeStorageIndexPageEntries):]
+		}
+
+		n := uint64(len(entries))
+		if n > to-position {
+			n = to - position
+		}
+
+		offsets = append(offsets, entries[:n]...)
+		for j := uint64(0); j < n; j++ {
+			partitions = append(partitions, segment.partition)
+		}
+		position += n
+	}
+	return
+}
+
+// page reads the page with the given number from the index file of the segment.
+// The last page of a segment might be partially written, such a page is read again
+// if it's cached before the rest of its entries are written.
+func (index *offsetIndex) page(segment *indexSegment, number uint64) (page []int64, err error) {
+	first := number * uint64(nativeStorageIndexPageEntries)
+	entries := segment.flushed - first
+	if entries > uint64(nativeStorageIndexPageEntries) {
+		entries = uint64(nativeStorageIndexPageEntries)
+	}
+
+	key := fmt.Sprintf("%s:%d", segment.file.Name(), number)
+	page, ok := index.cache.get(key)
+	if ok && uint64(len(page)) >= entries {
+		return
+	}
+
+	b := make([]byte, int64(entries)*nativeStorageIndexEntrySize)
+	_, err = segment.file.ReadAt(b, int64(first)*nativeStorageIndexEntrySize)
+	if err != nil {
+		return
+	}
+
+	page = make([]int64, entries)
+	for i := range page {
+		page[i] = int64(binary.LittleEndian.Uint64(b[int64(i)*nativeStorageIndexEntrySize:]))
+	}
+
+	index.cache.put(key, page)
+	return
+}
+
+// MarkLost marks the entries in the [from, to) range of positions as lost with a negative offset,
+// the same way as the records that couldn't be recovered after a crash. The range is clamped to
+// the length of the index.
+func (index *offsetIndex) MarkLost(from uint64, to uint64) (err error) {
+	if to > index.length {
+		to = index.length
+	}
+
+	for position := from; position < to; position++ {
+		segment := index.segmentOf(position)
+		i := position - segment.start
+
+		if i >= segment.flushed {
+			segment.tail[i-segment.flushed] = -1
+			continue
+		}
+
+		b := make([]byte, nativeStorageIndexEntrySize)
+		lost := int64(-1)
+		binary.LittleEndian.PutUint64(b, uint64(lost))
+		_, err = segment.file.WriteAt(b, int64(i)*nativeStorageIndexEntrySize)
+		if err != nil {
+			return
+		}
+		segment.dirty = true
+
+		// The cached page is replaced since the readers might still hold it.
+		number := i / uint64(nativeStorageIndexPageEntries)
+		key := fmt.Sprintf("%s:%d", segment.file.Name(), number)
+		if page, ok := index.cache.get(key); ok && uint64(len(page)) > i%uint64(nativeStorageIndexPageEntries) {
+			page = append([]int64(nil), page...)
+			page[i%uint64(nativeStorageIndexPageEntries)] = -1
+			index.cache.put(key, page)
+		}
+	}
+	return
+}
+
+// PartitionRange returns the [start, end) range of the positions of the records in the given partition.
+func (index *offsetIndex) PartitionRange(partition int64) (start uint64, end uint64) {
+	i := sort.Search(len(index.segments), func(i int) bool {
+		return index.segments[i].partition >= partition
+	})
+	if i == len(index.segments) {
+		start = index.length
+		end = index.length
+		return
+	}
+
+	start = index.segments[i].start
+	end = start
+	if index.segments[i].partition == partition {
+		end += index.segments[i].count
+	}
+	return
+}
+
+// FirstPartition returns the partition of the oldest record in the index.
+func (index *offsetIndex) FirstPartition() (partition int64, ok bool) {
+	if len(index.segments) == 0 {
+		return
+	}
+	return index.segments[0].partition, true
+}
+
+// DropThrough removes the entries of the partitions up to and including the given
+// partition along with their index files. removed is the number of removed entries.
+func (index *offsetIndex) DropThrough(partition int64) (removed uint64) {
+	n := 0
+	for ; n < len(index.segments) && index.segments[n].partition <= partition; n++ {
+		segment := index.segments[n]
+		removed += segment.count
+		segment.file.Close()
+		os.Remove(segment.file.Name())
+	}
+
+	index.segments = index.segments[n:]
+	for _, segment := range index.segments {
+		segment.start -= removed
+	}
+	index.length -= removed
+	index.cache.clear()
+	return
+}
+
+// Close closes the index files without removing them.
+func (index *offsetIndex) Close() {
+	for _, segment := range index.segments {
+		segment.file.Close()
+	}
+}
+
+// Reset removes all of the entries in the index along with the index files.
+func (index *offsetIndex) Reset() {
+	for _, segment := range index.segments {
+		segment.file.Close()
+		os.Remove(segment.file.Name())
+	}
+	index.segments = nil
+	index.length = 0
+	index.cache.clear()
+}
+
+// Export returns the metadata of the segments to be dumped into the core.
+// The entries themselves are expected to be flushed into the index files beforehand.
+func (index *offsetIndex) Export() (segments []nativeStorageIndexSegmentExport) {
+	for _, segment := range index.segments {
+		segments = append(segments, nativeStorageIndexSegmentExport{
+			Partition: segment.partition,
+			Count:     segment.count,
+		})
+	}
+	return
+}
+
+// Import opens the index files of the segments that are restored from the core.
+// An index file that has entries beyond the restored count is truncated, while an
+// index file that's shorter than expected results in an error.
+func (index *offsetIndex) Import(segments []nativeStorageIndexSegmentExport) (err error) {
+	index.Reset()
+
+	for _, export := range segments {
+		var f *os.File
+		f, err = os.OpenFile(index.path(export.Partition), os.O_RDWR, 0644)
+		if err != nil {
+			break
+		}
+
+		segment := &indexSegment{
+			partition: export.Partition,
+			start:     index.length,
+			count:     export.Count,
+			file:      f,
+			flushed:   export.Count,
+		}
+		index.segments = append(index.segments, segment)
+		index.length += export.Count
+
+		var info os.FileInfo
+		info, err = f.Stat()
+		if err != nil {
+			break
+		}
+
+		size := int64(export.Count) * nativeStorageIndexEntrySize
+		if info.Size() < size {
+			err = fmt.Errorf("%w: %s", ErrIndexFileTooShort, f.Name())
+			break
+		}
+		if info.Size() > size {
+			err = f.Truncate(size)
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		index.Close()
+		index.segments = nil
+		index.length = 0
+	}
+	return
+}
+
+func (cache *indexPageCache) get(key string) (page []int64, ok bool) {
+	cache.Lock()
+	page, ok = cache.pages[key]
+	cache.Unlock()
+	return
+}
+
+// put stores the page by evicting the oldest page if the cache is full.
+func (cache *indexPageCache) put(key string, page []int64) {
+	cache.Lock()
+	if _, ok := cache.pages[key]; !ok {
+		if len(cache.keys) >= nativeStorageIndexCacheCapacity {
+			delete(cache.pages, cache.keys[0])
+			cache.keys = cache.keys[1:]
+		}
+		cache.keys = append(cache.keys, key)
+	}
+	cache.pages[key] = page
+	cache.Unlock()
+}
+
+// clear empties the cache. It must be called whenever an index file is removed
+// since the index filenames are reused after a flush or a reset.
+func (cache *indexPageCache) clear() {
+	cache.Lock()
+	cache.keys = nil
+	cache.pages = make(map[string][]int64)
+	cache.Unlock()
+}
+
+// offsetCursor provides random access to a range of offsets through a window that's
+// loaded from the offset index on demand. Such that iterating through a large range of
+// records doesn't require loading all of their offsets into memory. The archived offsets
+// are placed before the live ones. The order of the whole range is reversed if reverse is true.
+//
+// archivedFirst is the index of the first archived record in the range.
+//
+// first is the index of the first live record in the range and length is the number of live records.
+//
+// ids narrows down the live records to the given indexes in ascending order, if it's not nil.
+//
+// windowChecksums are the checksums of the records in the window, if the checksums are enabled and ready.
+type offsetCursor struct {
+	storage         *nativeStorage
+	archivedOffsets []int64
+	archivedRefs    []int64
+	archivedFirst   uint64
+	first           uint64
+	length          uint64
+	ids             []uint64
+	reverse         bool
+	windowFirst     uint64
+	windowOffsets   []int64
+	windowRefs      []int64
+	windowChecksums []int64
+}
+
+// Len returns the number of records in the range.
+func (cursor *offsetCursor) Len() int {
+	if cursor.ids != nil {
+		return len(cursor.archivedOffsets) + len(cursor.ids)
+	}
+	return len(cursor.archivedOffsets) + int(cursor.length)
+}
+
+// At returns the index, the offset and the partition reference of the i-th record in the range.
+// ErrRecordRemoved is returned if the record is removed after the cursor is created.
+func (cursor *offsetCursor) At(i int) (id uint64, offset int64, ref int64, err error) {
+	if cursor.reverse {
+		i = cursor.Len() - 1 - i
+	}
+
+	if i < len(cursor.archivedOffsets) {
+		return cursor.archivedFirst + uint64(i), cursor.archivedOffsets[i], cursor.archivedRefs[i], nil
+	}
+
+	if cursor.ids != nil {
+		id = cursor.ids[i-len(cursor.archivedOffsets)]
+	} else {
+		id = cursor.first + uint64(i-len(cursor.archivedOffsets))
+	}
+	if id < cursor.windowFirst || id >= cursor.windowFirst+uint64(len(cursor.windowOffsets)) {
+		err = cursor.load(id)
+		if err != nil {
+			return
+		}
+	}
+
+	offset = cursor.windowOffsets[id-cursor.windowFirst]
+	ref = cursor.windowRefs[id-cursor.windowFirst]
+	return
+}
+
+// Checksum returns the checksum of the i-th record in the range, which is read along with its offset
+// by At(i). ok is false if the record has no checksum, like an archived record.
+func (cursor *offsetCursor) Checksum(i int) (checksum uint64, ok bool) {
+	if cursor.reverse {
+		i = cursor.Len() - 1 - i
+	}
+
+	if i < len(cursor.archivedOffsets) {
+		return
+	}
+
+	var id uint64
+	if cursor.ids != nil {
+		id = cursor.ids[i-len(cursor.archivedOffsets)]
+	} else {
+		id = cursor.first + uint64(i-len(cursor.archivedOffsets))
+	}
+	if id < cursor.windowFirst || id >= cursor.windowFirst+uint64(len(cursor.windowChecksums)) {
+		return
+	}
+
+	return uint64(cursor.windowChecksums[id-cursor.windowFirst]), true
+}
+
+// load reads a page of offsets that contains the record with the given index into the window.
+// The window extends towards the direction of the iteration.
+func (cursor *offsetCursor) load(id uint64) (err error) {
+	page := uint64(nativeStorageIndexPageEntries)
+	from := id
+	if cursor.reverse {
+		if id+1 >= page {
+			from = id + 1 - page
+		} else {
+			from = 0
+		}
+		if from < cursor.first {
+			from = cursor.first
+		}
+	}
+	to := from + page
+	if to > cursor.first+cursor.length {
+		to = cursor.first + cursor.length
+	}
+
+	cursor.storage.RLock()
+	defer cursor.storage.RUnlock()
+
+	removed := cursor.storage.removedOffsetsCounter
+	cursor.windowChecksums = nil
+	if id < removed {
+		cursor.windowOffsets = nil
+		cursor.windowRefs = nil
+		err = ErrRecordRemoved
+		return
+	}
+	if from < removed {
+		from = removed
+	}
+
+	cursor.windowFirst = from
+	cursor.windowOffsets, cursor.windowRefs, err = cursor.storage.offsets.Range(from-removed, to-removed)
+	if err == nil && id >= from+uint64(len(cursor.windowOffsets)) {
+		err = ErrIndexOutOfRange
+	}
+
+	// The checksums are loaded along with the offsets. The records are read without
+	// their checksums if the checksums cannot be loaded.
+	if checksums := cursor.storage.checksums; err == nil && checksums != nil && checksums.ready {
+		cursor.windowChecksums, _, _ = checksums.entries.Range(from-removed, to-removed)
+	}
+	return
+}
@@ -0,0 +1,447 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// recoveredPartition is the result of scanning a single database partition.
+type recoveredPartition struct {
+	index   int64
+	path    string
+	ids     []int64
+	offsets []int64
+	size    int64
+}
+
+// RecoverCore rebuilds the offset index by scanning the length-prefixed records
+// in the data_*.db partitions. It's the fallback of RestoreCore in case the core dump
+// is missing, corrupt or older than the partitions. Torn trailing records are truncated
+// while the corrupted records in the middle of a partition are skipped.
+//
+// Only the offsets, partitions, partitionIndex, lastOffset and removedOffsetsCounter
+// fields are rebuilt. The offset index files are rewritten. The rest of the core (macros, insertion filter,
+// limit) is left as is such that a successful RestoreCore call can be followed by RecoverCore.
+func (storage *nativeStorage) RecoverCore() (err error) {
+	files, err := filepath.Glob(storage.dataPath(fmt.Sprintf("%s_*.%s", NATIVE_STORAGE_DB_FILE, NATIVE_STORAGE_DB_FILE_EXT)))
+	if err != nil {
+		return
+	}
+
+	var scanned []*recoveredPartition
+	for _, file := range files {
+		var index int64
+		_, err = fmt.Sscanf(filepath.Base(file), NATIVE_STORAGE_DB_FILE+"_%d."+NATIVE_STORAGE_DB_FILE_EXT, &index)
+		if err != nil {
+			log.Printf("Skipping the file %s during recovery: %v\n", file, err)
+			err = nil
+			continue
+		}
+
+		var partition *recoveredPartition
+		partition, err = scanPartition(file, index)
+		if err != nil {
+			return
+		}
+		scanned = append(scanned, partition)
+	}
+
+	if len(scanned) == 0 {
+		err = errors.New("No partitions found to recover from!")
+		return
+	}
+
+	sort.Slice(scanned, func(i, j int) bool {
+		return scanned[i].index < scanned[j].index
+	})
+
+	// The first record that's found determines the number of records
+	// that were removed through size limiting.
+	var removedOffsetsCounter int64 = -1
+	var offsets []int64
+	var partitionRefs []int64
+	var lost int64
+	for _, partition := range scanned {
+		for i, id := range partition.ids {
+			if removedOffsetsCounter == -1 {
+				removedOffsetsCounter = id
+			}
+
+			expected := removedOffsetsCounter + int64(len(offsets))
+			if id < expected {
+				log.Printf("Skipping the duplicate record %d in %s during recovery.\n", id, partition.path)
+				continue
+			}
+
+			// Mark the records that couldn't be found as lost.
+			for ; expected < id; expected++ {
+				offsets = append(offsets, -1)
+				partitionRefs = append(partitionRefs, partition.index)
+				lost++
+			}
+
+			offsets = append(offsets, partition.offsets[i])
+			partitionRefs = append(partitionRefs, partition.index)
+		}
+	}
+
+	if removedOffsetsCounter == -1 {
+		removedOffsetsCounter = 0
+	}
+
+	if lost > 0 {
+		log.Printf("Warning: %d records are lost and couldn't be recovered.\n", lost)
+	}
+
+	last := scanned[len(scanned)-1]
+	partitions := make([]*os.File, last.index+1)
+	for _, partition := range scanned {
+		partitions[partition.index], err = os.OpenFile(partition.path, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return
+		}
+	}
+
+	storage.Lock()
+	for _, partition := range storage.partitions {
+		if partition != nil {
+			partition.Close()
+		}
+	}
+
+	// Rewrite the offset index files from scratch.
+	storage.offsets.Reset()
+	for i, offset := range offsets {
+		err = storage.offsets.Append(partitionRefs[i], offset)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = storage.offsets.Flush(storage.syncMode != NATIVE_STORAGE_SYNC_NONE)
+	}
+	if err != nil {
+		storage.offsets.Reset()
+		storage.Unlock()
+		return
+	}
+	storage.partitions = partitions
+	storage.partitionIndex = last.index
+	storage.lastOffset = last.size
+	storage.removedOffsetsCounter = uint64(removedOffsetsCounter)
+	// The zones are computed again from the recovered records.
+	storage.invalidateZoneMaps()
+	storage.invalidateBloomIndex()
+	storage.invalidateChecksums()
+	storage.Unlock()
+
+	// Populate the truncatedTimestamp field if it's not restored from the core.
+	if removedOffsetsCounter > 0 && storage.truncatedTimestamp == 0 {
+		var n int64
+		var f *os.File
+		n, f, err = storage.getOffsetAndPartition(0)
+		if err == nil {
+			var b []byte
+			b, _, err = storage.readRecord(f, n)
+			f.Close()
+			if err == nil {
+				var timestamp int64
+				timestamp, err = recordTimestamp(b)
+				if err == nil {
+					storage.truncatedTimestamp = timestamp
+				}
+			}
+		}
+		err = nil
+	}
+
+	log.Printf("Recovered %d records from %d partitions.\n", len(offsets), len(scanned))
+	return
+}
+
+// scanPartition reads the records in the partition one by one and collects
+// their offsets and IDs. A record that's corrupted in the middle of the partition
+// is skipped, either through the length in its header or by scanning for the next
+// valid record. The partition is truncated only if it ends with a torn record,
+// which is cut short by the end of the file.
+func scanPartition(path string, index int64) (partition *recoveredPartition, err error) {
+	partition = &recoveredPartition{
+		index: index,
+		path:  path,
+	}
+
+	var f *os.File
+	f, err = os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var info os.FileInfo
+	info, err = f.Stat()
+	if err != nil {
+		return
+	}
+	size := info.Size()
+
+	var offset int64
+	var corrupted int
+	var dict *dictionary
+	var dictErr error
+	for offset < size {
+		var version byte
+		var headerLength int64
+		var b []byte
+		version, headerLength, b, err = readRecordAt(f, offset, size)
+		next := offset + headerLength + int64(len(b))
+
+		if err == ErrChecksumMismatch && next < size {
+			// The length is intact since another record follows, skip only the corrupted record.
+			log.Printf("Skipping the corrupted record at offset %d in %s during recovery.\n", offset, path)
+			corrupted++
+			offset = next
+			continue
+		}
+
+		if err == ErrCorruptedRecordHeader || err == ErrChecksumMismatch || err == io.ErrUnexpectedEOF {
+			// Continue from the next valid record. There is none after a torn record at the end.
+			var found bool
+			next, found, err = nextValidRecord(f, offset+1, size)
+			if err != nil {
+				return
+			}
+			if !found {
+				break
+			}
+			log.Printf("Skipping the corrupted bytes between the offsets %d and %d in %s during recovery.\n", offset, next, path)
+			corrupted++
+			offset = next
+			continue
+		}
+		if err != nil {
+			return
+		}
+
+		// Collect all of the records in a compressed block.
+		if version == NATIVE_STORAGE_RECORD_V2 {
+			var records [][]byte
+			records, err = decodeBlock(b)
+			if err != nil {
+				log.Printf("Skipping the block at offset %d in %s during recovery: %v\n", offset, path, err)
+				corrupted++
+				offset = next
+				continue
+			}
+
+			for slot, record := range records {
+				var id int64
+				id, err = recordID(record)
+				if err != nil {
+					log.Printf("Skipping the record in slot %d of the block at offset %d in %s during recovery: %v\n", slot, offset, path, err)
+					corrupted++
+					continue
+				}
+				partition.ids = append(partition.ids, id)
+				partition.offsets = append(partition.offsets, packOffset(offset, slot))
+			}
+			offset = next
+			continue
+		}
+
+		// Rehydrate a dictionary encoded record through the dictionary of the partition.
+		if version == NATIVE_STORAGE_RECORD_V3 {
+			if dict == nil && dictErr == nil {
+				dict, dictErr = loadDictionary(dictionaryPath(path))
+			}
+			if dictErr == nil {
+				b, err = dict.decode(b)
+			} else {
+				err = dictErr
+			}
+			if err != nil {
+				// The strings that the record refers to are lost, skip only that record.
+				log.Printf("Skipping the record at offset %d in %s during recovery: %v\n", offset, path, err)
+				corrupted++
+				offset = next
+				continue
+			}
+		}
+
+		var id int64
+		id, err = recordID(b)
+		if err != nil && version == NATIVE_STORAGE_RECORD_V0 {
+			// The length of a record without a checksum cannot be trusted either.
+			var found bool
+			next, found, err = nextValidRecord(f, offset+1, size)
+			if err != nil {
+				return
+			}
+			if !found {
+				break
+			}
+			log.Printf("Skipping the corrupted bytes between the offsets %d and %d in %s during recovery.\n", offset, next, path)
+			corrupted++
+			offset = next
+			continue
+		}
+		if err != nil {
+			log.Printf("Skipping the record at offset %d in %s during recovery: %v\n", offset, path, err)
+			corrupted++
+			offset = next
+			continue
+		}
+
+		partition.ids = append(partition.ids, id)
+		partition.offsets = append(partition.offsets, offset)
+		offset = next
+	}
+
+	if corrupted > 0 {
+		log.Printf("Skipped %d corrupted records in %s during recovery.\n", corrupted, path)
+	}
+
+	if offset < size {
+		log.Printf("Truncating the torn record at offset %d in %s.\n", offset, path)
+		err = f.Truncate(offset)
+		if err != nil {
+			return
+		}
+	}
+	err = nil
+
+	partition.size = offset
+	return
+}
+
+// readRecordAt reads the header and the payload of the record at the given offset of a partition
+// of the given size, without decoding the payload. io.ErrUnexpectedEOF means the record is cut short
+// by the end of the file. b is returned along with ErrChecksumMismatch.
+func readRecordAt(f *os.File, offset int64, size int64) (version byte, headerLength int64, b []byte, err error) {
+	l := make([]byte, nativeStorageRecordHeaderLengthV1)
+	if offset+nativeStorageRecordHeaderLengthV0 > size {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	_, err = f.ReadAt(l[:nativeStorageRecordHeaderLengthV0], offset)
+	if err != nil {
+		return
+	}
+
+	var length int64
+	version, length, err = decodeRecordHeader(l)
+	if err != nil {
+		return
+	}
+	if length <= 0 {
+		err = ErrCorruptedRecordHeader
+		return
+	}
+
+	headerLength = recordHeaderLength(version)
+	if offset+headerLength+length > size {
+		headerLength = 0
+		err = io.ErrUnexpectedEOF
+		return
+	}
+
+	_, err = f.ReadAt(l[:headerLength], offset)
+	if err != nil {
+		return
+	}
+
+	b = make([]byte, length)
+	_, err = f.ReadAt(b, offset+headerLength)
+	if err != nil {
+		return
+	}
+
+	if version != NATIVE_STORAGE_RECORD_V0 && crc32.Checksum(b, nativeStorageCRC32CTable) != binary.LittleEndian.Uint32(l[nativeStorageRecordHeaderLengthV0:]) {
+		err = ErrChecksumMismatch
+	}
+	return
+}
+
+// nextValidRecord looks for the first offset starting from the given one, at which there is
+// a record with an intact checksum. The records without a checksum cannot be told apart from
+// the corrupted bytes, so they're not looked for.
+func nextValidRecord(f *os.File, from int64, size int64) (offset int64, found bool, err error) {
+	for offset = from; offset+nativeStorageRecordHeaderLengthV1 <= size; offset++ {
+		var version byte
+		version, _, _, err = readRecordAt(f, offset, size)
+		if err == nil && version != NATIVE_STORAGE_RECORD_V0 {
+			found = true
+			return
+		}
+		if err != nil && err != ErrCorruptedRecordHeader && err != ErrChecksumMismatch && err != io.ErrUnexpectedEOF {
+			return
+		}
+	}
+	err = nil
+	return
+}
+
+// recordID extracts the index from the "id" field of a JSON record.
+func recordID(b []byte) (id int64, err error) {
+	var record struct {
+		ID string `json:"id"`
+	}
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		return
+	}
+
+	id, err = strconv.ParseInt(record.ID, 10, 64)
+	return
+}
+
+// isCoreStale checks whether the restored core is older than the partitions.
+// It's the case if a partition has more bytes than the restored last offset,
+// a partition that the core refers to is missing or a newer partition exists.
+func (storage *nativeStorage) isCoreStale() bool {
+	storage.RLock()
+	defer storage.RUnlock()
+
+	if storage.partitionIndex < 0 || int(storage.partitionIndex) >= len(storage.partitions) {
+		return true
+	}
+
+	current := storage.partitions[storage.partitionIndex]
+	if current == nil {
+		return true
+	}
+
+	info, err := os.Stat(current.Name())
+	if err != nil || info.Size() != storage.lastOffset {
+		return true
+	}
+
+	for i, partition := range storage.partitions {
+		if partition == nil {
+			continue
+		}
+		if _, err := os.Stat(partition.Name()); err != nil {
+			log.Printf("Partition %d is missing: %v\n", i, err)
+			return true
+		}
+	}
+
+	next := storage.partitionPath(storage.partitionIndex + 1)
+	if _, err := os.Stat(next); err == nil {
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// enforceRetention drops the partitions whose newest record is older than the retention window.
+// Partitions are dropped as a whole, so the current partition is rotated once its oldest record
+// is older than the half of the window. Such that the records are kept for a duration that ranges
+// between the retention (soft-limit) and one and a half times the retention (hard-limit).
+func (storage *nativeStorage) enforceRetention(persistent bool) {
+	storage.RLock()
+	retention := storage.retention
+	partitionIndex := storage.partitionIndex
+	storage.RUnlock()
+
+	if retention == 0 || partitionIndex == -1 {
+		return
+	}
+
+	now := time.Now()
+
+	oldest, err := storage.getPartitionTimestamp(partitionIndex, false)
+	if err == nil && oldest < now.Add(-retention/2).UnixMilli() {
+		storage.newPartition()
+	}
+
+	deadline := now.Add(-retention).UnixMilli()
+	for {
+		var first int64
+		var ok bool
+		storage.RLock()
+		first, ok = storage.offsets.FirstPartition()
+		partitionIndex = storage.partitionIndex
+		storage.RUnlock()
+
+		if !ok {
+			return
+		}
+
+		// Never drop the current partition.
+		if first >= partitionIndex {
+			return
+		}
+
+		var newest int64
+		newest, err = storage.getPartitionTimestamp(first, true)
+		if err != nil || newest >= deadline {
+			return
+		}
+
+		err = storage.discardPartition(first, persistent)
+		if err != nil {
+			// There are no records left, the recording starts after the newest discarded record.
+			storage.Lock()
+			storage.truncatedTimestamp = newest + 1
+			storage.Unlock()
+		}
+	}
+}
+
+// getPartitionTimestamp returns the timestamp of the oldest or the newest
+// record in the partition with the given index.
+func (storage *nativeStorage) getPartitionTimestamp(index int64, newest bool) (timestamp int64, err error) {
+	var offset int64 = -1
+	var path string
+
+	storage.RLock()
+	start, end := storage.offsets.PartitionRange(index)
+
+	// Skip the lost records.
+	for i := start; i < end; i++ {
+		position := i
+		if newest {
+			position = start + end - 1 - i
+		}
+
+		var n int64
+		n, _, err = storage.offsets.Get(position)
+		if err != nil {
+			storage.RUnlock()
+			return
+		}
+		if n >= 0 {
+			offset = n
+			break
+		}
+	}
+
+	if index >= 0 && int(index) < len(storage.partitions) && storage.partitions[index] != nil {
+		path = storage.partitions[index].Name()
+	}
+	storage.RUnlock()
+
+	if offset < 0 || path == "" {
+		err = errors.New("No records found in the partition!")
+		return
+	}
+
+	var f *os.File
+	f, err = os.Open(path)
+	if err != nil {
+		return
+	}
+
+	var b []byte
+	b, _, err = storage.readRecord(f, offset)
+	f.Close()
+	if err != nil {
+		return
+	}
+
+	timestamp, err = recordTimestamp(b)
+	return
+}
+
+// recordTimestamp extracts the "timestamp" field of a JSON record.
+func recordTimestamp(b []byte) (timestamp int64, err error) {
+	var record struct {
+		Timestamp *int64 `json:"timestamp"`
+	}
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		return
+	}
+
+	if record.Timestamp == nil {
+		err = errors.New("The record has no timestamp!")
+		return
+	}
+
+	timestamp = *record.Timestamp
+	return
+}
@@ -0,0 +1,240 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// Snapshot writes a consistent snapshot of the database into a tar archive at the path given in data.
+// The archive starts with a manifest that's followed by the core dump and the database files.
+// The archived partitions are not included. It replies `OK` once the archive is written,
+// otherwise the error is returned to be sent by the caller.
+func (storage *nativeStorage) Snapshot(conn net.Conn, data []byte) (err error) {
+	path := strings.TrimSpace(string(data))
+	if path == "" {
+		err = errors.New("Provide a path for the snapshot!")
+		return
+	}
+
+	err = storage.snapshot(path)
+	if err != nil {
+		err = fmt.Errorf("While taking the snapshot: %w", err)
+		return
+	}
+
+	basenine.SendOK(conn)
+	return
+}
+
+// snapshot freezes the offset index and the sizes of the database files at a point in time,
+// then copies the files into a tar archive at the given path. The inserts are only paused
+// until the in-flight writes are completed and the files are opened. The files that are opened
+// stay readable even if the retention or a flush removes them before they're copied, and
+// the records that are appended into them in the meantime are not copied.
+func (storage *nativeStorage) snapshot(path string) (err error) {
+	// The pending records of the block compression are written beforehand to be included.
+	err = storage.flushBlock()
+	if err != nil {
+		return
+	}
+
+	storage.Lock()
+	storage.writes.Lock()
+	csExport, err := storage.exportCore(false)
+	var files []*os.File
+	var manifest snapshotManifest
+	if err == nil {
+		files, manifest.Files, err = storage.openSnapshotFiles(csExport)
+	}
+	manifest.Format = SNAPSHOT_FORMAT
+	manifest.Version = basenine.VERSION
+	manifest.Driver = NATIVE_STORAGE_DRIVER
+	manifest.CreatedAt = time.Now().UnixMilli()
+	manifest.FirstID = basenine.IndexToID(int(storage.removedOffsetsCounter))
+	manifest.Records = storage.offsets.Len()
+	storage.writes.Unlock()
+	storage.Unlock()
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if err != nil {
+		return
+	}
+
+	// The partitions are referred by their names relative to the data directory in the archive.
+	for i, partitionPath := range csExport.PartitionPaths {
+		if partitionPath != "" {
+			csExport.PartitionPaths[i] = filepath.Base(partitionPath)
+		}
+	}
+
+	var core bytes.Buffer
+	err = writeNativeStorageCore(&core, csExport)
+	if err != nil {
+		return
+	}
+
+	manifest.Files = append([]snapshotFile{{
+		Name:    nativeStorageCoreDumpFilename,
+		Size:    int64(core.Len()),
+		content: snapshotBytes(core.Bytes()),
+	}}, manifest.Files...)
+
+	err = writeSnapshot(path, manifest, storage.syncMode != NATIVE_STORAGE_SYNC_NONE)
+	if err != nil {
+		return
+	}
+
+	log.Printf("Took a snapshot of %d records into: %s\n", manifest.Records, path)
+	return
+}
+
+// openSnapshotFiles opens the partitions, the offset index files, the checksum files and
+// the dictionaries that the given core refers to, and returns them along with their sizes.
+// It must be called while the storage is locked and the in-flight writes are completed.
+func (storage *nativeStorage) openSnapshotFiles(csExport nativeStorageExport) (opened []*os.File, files []snapshotFile, err error) {
+	var paths []string
+	for _, partitionPath := range csExport.PartitionPaths {
+		if partitionPath == "" {
+			continue
+		}
+		paths = append(paths, partitionPath)
+		if storage.options.Dictionary {
+			paths = append(paths, dictionaryPath(partitionPath))
+		}
+	}
+	for _, segment := range csExport.IndexSegments {
+		paths = append(paths, storage.indexPath(segment.Partition))
+	}
+	for _, segment := range csExport.ChecksumSegments {
+		paths = append(paths, storage.checksumPath(segment.Partition))
+	}
+
+	for _, path := range paths {
+		var f *os.File
+		f, err = os.Open(path)
+		// A partition that's not written into doesn't have a dictionary.
+		if os.IsNotExist(err) && strings.HasSuffix(path, "."+NATIVE_STORAGE_DICTIONARY_FILE_EXT) {
+			err = nil
+			continue
+		}
+		if err != nil {
+			break
+		}
+		opened = append(opened, f)
+
+		var info os.FileInfo
+		info, err = f.Stat()
+		if err != nil {
+			break
+		}
+
+		files = append(files, snapshotFile{
+			Name:    filepath.Base(path),
+			Size:    info.Size(),
+			content: snapshotSection(f, info.Size()),
+		})
+	}
+
+	if err != nil {
+		for _, f := range opened {
+			f.Close()
+		}
+		opened = nil
+		files = nil
+	}
+	return
+}
+
+// restoreNativeSnapshot validates the core of a native snapshot that's extracted into the staging directory
+// against the manifest and the extracted files, then rewrites the partitions in the core to the data directory.
+func restoreNativeSnapshot(staging string, dataDir string, manifest snapshotManifest) (err error) {
+	corePath := filepath.Join(staging, nativeStorageCoreDumpFilename)
+	var f *os.File
+	f, err = os.Open(corePath)
+	if err != nil {
+		err = fmt.Errorf("%w: the core is missing: %v", ErrInvalidSnapshot, err)
+		return
+	}
+	csExport, _, err := readNativeStorageCore(f)
+	f.Close()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		return
+	}
+
+	sizes := make(map[string]int64)
+	for _, file := range manifest.Files {
+		sizes[file.Name] = file.Size
+	}
+
+	// The paths of the files in the staging directory are computed by a storage that's never initialized.
+	staged := &nativeStorage{options: NativeStorageOptions{DataDir: staging}}
+
+	var records uint64
+	for _, segment := range csExport.IndexSegments {
+		name := filepath.Base(staged.indexPath(segment.Partition))
+		if sizes[name] != int64(segment.Count)*nativeStorageIndexEntrySize {
+			err = fmt.Errorf("%w: the offset index %s doesn't match the core", ErrInvalidSnapshot, name)
+			return
+		}
+		records += segment.Count
+	}
+	for _, segment := range csExport.ChecksumSegments {
+		name := filepath.Base(staged.checksumPath(segment.Partition))
+		if _, ok := sizes[name]; !ok {
+			err = fmt.Errorf("%w: the checksums %s are missing", ErrInvalidSnapshot, name)
+			return
+		}
+	}
+	if records != manifest.Records || basenine.IndexToID(int(csExport.RemovedOffsetsCounter)) != manifest.FirstID {
+		err = fmt.Errorf("%w: the manifest declares %d records starting from %s, the core has %d records starting from %s", ErrInvalidSnapshot, manifest.Records, manifest.FirstID, records, basenine.IndexToID(int(csExport.RemovedOffsetsCounter)))
+		return
+	}
+
+	for i, partitionPath := range csExport.PartitionPaths {
+		if partitionPath == "" {
+			continue
+		}
+		size, ok := sizes[partitionPath]
+		if partitionPath != filepath.Base(partitionPath) || !ok {
+			err = fmt.Errorf("%w: the partition %s is missing", ErrInvalidSnapshot, partitionPath)
+			return
+		}
+		if int64(i) == csExport.PartitionIndex && size != csExport.LastOffset {
+			err = fmt.Errorf("%w: the partition %s is %d bytes, the core expects %d bytes", ErrInvalidSnapshot, partitionPath, size, csExport.LastOffset)
+			return
+		}
+		csExport.PartitionPaths[i] = filepath.Join(dataDir, partitionPath)
+	}
+
+	f, err = os.Create(corePath)
+	if err != nil {
+		return
+	}
+	err = writeNativeStorageCore(f, csExport)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+}
@@ -0,0 +1,105 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Durability modes that decide when the writes are flushed to the disk through fsync.
+//
+// NATIVE_STORAGE_SYNC_NONE never calls fsync and leaves it to the operating system.
+//
+// NATIVE_STORAGE_SYNC_INTERVAL syncs the current partition every second, right before the core is dumped.
+//
+// NATIVE_STORAGE_SYNC_ALWAYS syncs the partition after every write, before the insertion returns.
+// In case of the block compression, the pending records are written as blocks before the insertion returns.
+//
+// The core dump is synced before it's renamed in both NATIVE_STORAGE_SYNC_INTERVAL
+// and NATIVE_STORAGE_SYNC_ALWAYS modes.
+const (
+	NATIVE_STORAGE_SYNC_NONE byte = iota
+	NATIVE_STORAGE_SYNC_INTERVAL
+	NATIVE_STORAGE_SYNC_ALWAYS
+)
+
+// Names of the durability modes that can be given through the -sync flag or the storage arguments.
+var nativeStorageSyncModes = map[string]byte{
+	"none":     NATIVE_STORAGE_SYNC_NONE,
+	"interval": NATIVE_STORAGE_SYNC_INTERVAL,
+	"always":   NATIVE_STORAGE_SYNC_ALWAYS,
+}
+
+var ErrUnknownSyncMode = errors.New("Unknown sync mode")
+
+// parseSyncMode converts the name of a durability mode into its identifier.
+func parseSyncMode(name string) (mode byte, err error) {
+	mode, ok := nativeStorageSyncModes[name]
+	if !ok {
+		err = fmt.Errorf("%w: %s", ErrUnknownSyncMode, name)
+	}
+	return
+}
+
+// syncWrite syncs the partition after a write in NATIVE_STORAGE_SYNC_ALWAYS mode.
+func (storage *nativeStorage) syncWrite(f *os.File) (err error) {
+	if storage.syncMode != NATIVE_STORAGE_SYNC_ALWAYS {
+		return
+	}
+	return f.Sync()
+}
+
+// syncCurrentPartition syncs the current partition unless the mode is NATIVE_STORAGE_SYNC_NONE.
+func (storage *nativeStorage) syncCurrentPartition() (err error) {
+	if storage.syncMode == NATIVE_STORAGE_SYNC_NONE {
+		return
+	}
+
+	storage.RLock()
+	if storage.partitionIndex == -1 {
+		storage.RUnlock()
+		return
+	}
+	f := storage.partitions[storage.partitionIndex]
+	storage.RUnlock()
+
+	if f == nil {
+		return
+	}
+	err = f.Sync()
+	if err != nil {
+		return
+	}
+	return storage.dictionaries.sync(f.Name())
+}
+
+// syncDirectory syncs the given directory such that a rename in it is persisted.
+func syncDirectory(dir string) (err error) {
+	var d *os.File
+	d, err = os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeFile writes the data into the file at the given path and syncs it if sync is true.
+func writeFile(path string, data []byte, sync bool) (err error) {
+	var f *os.File
+	f, err = os.Create(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err != nil || !sync {
+		return
+	}
+	return f.Sync()
+}
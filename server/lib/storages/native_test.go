@@ -1,12 +1,23 @@
 package storages
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -15,159 +26,1927 @@ import (
 )
 
 func TestNativeStorageNewPartition(t *testing.T) {
-	storage := NewNativeStorage(false).(*nativeStorage)
+	dataDir := t.TempDir()
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
 
 	f := storage.newPartition()
 	assert.NotNil(t, f)
-	assert.FileExists(t, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, storage.partitionIndex, NATIVE_STORAGE_DB_FILE_EXT))
+	assert.FileExists(t, filepath.Join(dataDir, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, storage.partitionIndex, NATIVE_STORAGE_DB_FILE_EXT)))
+
+	storage.Reset()
+}
+
+func TestNativeStorageDataDir(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	dir, err := ioutil.TempDir("", "basenine")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dir}).(*nativeStorage)
+
+	storage.InsertData([]byte(payload))
+	err = storage.DumpCore(true, false)
+	assert.Nil(t, err)
+
+	assert.FileExists(t, filepath.Join(dir, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, 0, NATIVE_STORAGE_DB_FILE_EXT)))
+	assert.FileExists(t, filepath.Join(dir, nativeStorageCoreDumpFilename))
+	assert.FileExists(t, filepath.Join(dir, nativeStorageLockFilename))
+
+	storage.Reset()
+}
+
+func TestNativeStorageSyncModes(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	for _, compression := range []string{"none", "zstd"} {
+		for _, mode := range []string{"none", "interval", "always"} {
+			dir, err := ioutil.TempDir("", "basenine")
+			assert.Nil(t, err)
+
+			storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dir, Sync: mode, Compression: compression}).(*nativeStorage)
+			assert.Equal(t, nativeStorageSyncModes[mode], storage.syncMode)
+
+			for index := 0; index < 10; index++ {
+				_, err = storage.InsertData([]byte(payload))
+				assert.Nil(t, err)
+			}
+
+			// The records are written into the partition before the insertions return,
+			// except the pending records of the block compression in the other modes.
+			if compression != "none" && mode != "always" {
+				storage.RLock()
+				assert.Len(t, storage.pendingRecords, 10)
+				storage.RUnlock()
+
+				err = storage.flushBlock()
+				assert.Nil(t, err)
+			}
+
+			storage.RLock()
+			assert.Equal(t, uint64(10), storage.offsets.Len())
+			assert.Empty(t, storage.pendingRecords)
+			info, err := storage.partitions[storage.partitionIndex].Stat()
+			assert.Nil(t, err)
+			assert.Equal(t, storage.lastOffset, info.Size())
+			storage.RUnlock()
+
+			err = storage.syncCurrentPartition()
+			assert.Nil(t, err)
+			err = storage.DumpCore(true, false)
+			assert.Nil(t, err)
+			assert.FileExists(t, filepath.Join(dir, nativeStorageCoreDumpFilename))
+
+			storage.Reset()
+			os.RemoveAll(dir)
+		}
+	}
+
+	assert.Panics(t, func() {
+		NewNativeStorageWithOptions(false, NativeStorageOptions{Sync: "sometimes"})
+	})
+}
+
+func TestNativeStorageDataDirLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basenine")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Simulate another server that holds the lock.
+	f, err := os.OpenFile(filepath.Join(dir, nativeStorageLockFilename), os.O_CREATE|os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	assert.Nil(t, err)
+
+	assert.Panics(t, func() {
+		NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dir})
+	})
+
+	f.Close()
+}
+
+func TestNativeStorageDumpRestoreCore(t *testing.T) {
+	dataDir := t.TempDir()
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	err := storage.DumpCore(false, false)
+	assert.Nil(t, err)
+
+	err = storage.RestoreCore()
+	assert.Nil(t, err)
+
+	storage.removeDatabaseFiles()
+}
+
+func TestNativeStorageInsertAndReadData(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	for index := 0; index < 100; index++ {
+		expected := fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(index))
+
+		storage.InsertData([]byte(payload))
+
+		// Safely acces the offsets and partition references
+		n, rf, err := storage.getOffsetAndPartition(uint64(index))
+		assert.Nil(t, err)
+
+		rf.Seek(n, io.SeekStart)
+		b, n, err := storage.readRecord(rf, n)
+		assert.Nil(t, err)
+		assert.Greater(t, n, int64(0))
+		assert.JSONEq(t, expected, string(b))
+
+		rf.Close()
+	}
+
+	storage.Reset()
+}
+
+func TestNativeStorageInsertBatch(t *testing.T) {
+	dataDir := t.TempDir()
+	insertionFilter := `brand.name == "Chevrolet"`
+	batch := [][]byte{
+		[]byte(`{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`),
+		[]byte(`{"brand":{"name":"Ford"},"model":"Mustang","year":2021}`),
+		[]byte(`hello world`),
+		[]byte(`{"brand":{"name":"Chevrolet"},"model":"Corvette","year":2021}`),
+	}
+
+	for _, compression := range []string{"none", "zstd"} {
+		storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir, Compression: compression}).(*nativeStorage)
+
+		insertionFilterExpr, _, err := storage.PrepareQuery(insertionFilter, storage.macros)
+		assert.Nil(t, err)
+		storage.Lock()
+		storage.insertionFilter = insertionFilter
+		storage.insertionFilterExpr = insertionFilterExpr
+		storage.Unlock()
+
+		insertedIds, err := storage.InsertBatch(batch)
+		assert.Nil(t, err)
+		assert.Equal(t, []interface{}{basenine.IndexToID(0), nil, nil, basenine.IndexToID(1)}, insertedIds)
+
+		err = storage.flushBlock()
+		assert.Nil(t, err)
+
+		storage.RLock()
+		assert.Equal(t, uint64(2), storage.offsets.Len())
+		storage.RUnlock()
+
+		for index, model := range []string{"Camaro", "Corvette"} {
+			n, f, err := storage.getOffsetAndPartition(uint64(index))
+			assert.Nil(t, err)
+			b, _, err := storage.readRecord(f, n)
+			f.Close()
+			assert.Nil(t, err)
+			assert.Contains(t, string(b), model)
+			assert.Contains(t, string(b), basenine.IndexToID(index))
+		}
+
+		storage.Reset()
+	}
+}
+
+func TestNativeStorageRecoverCore(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	for index := 0; index < 100; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	storage.RLock()
+	f := storage.partitions[storage.partitionIndex]
+	lastOffset := storage.lastOffset
+	storage.RUnlock()
+
+	// Simulate a torn write at the end of the partition.
+	_, err := f.WriteAt([]byte{0xff, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, '{', '"'}, lastOffset)
+	assert.Nil(t, err)
+
+	recovered := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir, Recover: true}).(*nativeStorage)
+
+	recovered.RLock()
+	assert.Equal(t, uint64(100), recovered.offsets.Len())
+	_, partitionRefs, err := recovered.offsets.Range(0, 100)
+	assert.Nil(t, err)
+	assert.Len(t, partitionRefs, 100)
+	assert.Equal(t, lastOffset, recovered.lastOffset)
+	assert.Equal(t, uint64(0), recovered.removedOffsetsCounter)
+	recovered.RUnlock()
+
+	info, err := os.Stat(f.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, lastOffset, info.Size())
+
+	insertedId, err := recovered.InsertData([]byte(payload))
+	assert.Nil(t, err)
+	assert.Equal(t, basenine.IndexToID(100), insertedId)
+
+	n, rf, err := recovered.getOffsetAndPartition(42)
+	assert.Nil(t, err)
+	rf.Seek(n, io.SeekStart)
+	b, _, err := recovered.readRecord(rf, n)
+	assert.Nil(t, err)
+	rf.Close()
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(42)), string(b))
+
+	recovered.Reset()
+}
+
+func TestNativeStorageRecoverCorruptedRecords(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	for index := 0; index < 100; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	storage.RLock()
+	f := storage.partitions[storage.partitionIndex]
+	lastOffset := storage.lastOffset
+	storage.RUnlock()
+
+	// Corrupt the header of a record and the payload of another one in the middle of the partition.
+	n, rf, err := storage.getOffsetAndPartition(42)
+	assert.Nil(t, err)
+	rf.Close()
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, n)
+	assert.Nil(t, err)
+
+	n, rf, err = storage.getOffsetAndPartition(60)
+	assert.Nil(t, err)
+	rf.Close()
+	_, err = f.WriteAt([]byte("XX"), n+nativeStorageRecordHeaderLengthV1+2)
+	assert.Nil(t, err)
+
+	recovered := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir, Recover: true}).(*nativeStorage)
+
+	recovered.RLock()
+	assert.Equal(t, uint64(100), recovered.offsets.Len())
+	assert.Equal(t, lastOffset, recovered.lastOffset)
+	recovered.RUnlock()
+
+	info, err := os.Stat(recovered.partitions[0].Name())
+	assert.Nil(t, err)
+	assert.Equal(t, lastOffset, info.Size())
+
+	for _, index := range []uint64{42, 60} {
+		_, _, err = recovered.getOffsetAndPartition(index)
+		assert.NotNil(t, err)
+	}
+
+	for _, index := range []uint64{41, 43, 59, 61, 99} {
+		n, rf, err := recovered.getOffsetAndPartition(index)
+		assert.Nil(t, err)
+		b, _, err := recovered.readRecord(rf, n)
+		assert.Nil(t, err)
+		rf.Close()
+		assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(int(index))), string(b))
+	}
+
+	recovered.Reset()
+}
+
+func TestNativeStorageRecoverStaleCore(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	err := storage.DumpCore(true, false)
+	assert.Nil(t, err)
+
+	// These records are not in the core dump.
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	restored := NewNativeStorageWithOptions(true, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	restored.RLock()
+	assert.Equal(t, uint64(20), restored.offsets.Len())
+	restored.RUnlock()
+
+	restored.Reset()
+}
+
+func TestNativeStorageOffsetIndex(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	total := nativeStorageIndexPageEntries + 10
+	for index := 0; index < total; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	// Only the last entries that don't fill a page are kept in memory.
+	storage.RLock()
+	assert.Equal(t, uint64(total), storage.offsets.Len())
+	assert.Len(t, storage.offsets.segments, 1)
+	assert.Len(t, storage.offsets.segments[0].tail, 10)
+	storage.RUnlock()
+
+	info, err := os.Stat(storage.indexPath(0))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(nativeStorageIndexPageEntries)*nativeStorageIndexEntrySize, info.Size())
+
+	err = storage.DumpCore(true, false)
+	assert.Nil(t, err)
+
+	info, err = os.Stat(storage.indexPath(0))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(total)*nativeStorageIndexEntrySize, info.Size())
+
+	restored := NewNativeStorageWithOptions(true, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	restored.RLock()
+	assert.Equal(t, uint64(total), restored.offsets.Len())
+	assert.Empty(t, restored.offsets.segments[0].tail)
+	restored.RUnlock()
+
+	for _, index := range []int{0, nativeStorageIndexPageEntries - 1, total - 1} {
+		n, rf, err := restored.getOffsetAndPartition(uint64(index))
+		assert.Nil(t, err)
+		b, _, err := restored.readRecord(rf, n)
+		assert.Nil(t, err)
+		rf.Close()
+		assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(int(index))), string(b))
+	}
+
+	restored.Reset()
+}
+
+func TestNativeStorageRestoreLegacyCore(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	err := storage.DumpCore(true, false)
+	assert.Nil(t, err)
+
+	// Rewrite the core in the legacy format that contains the whole offset index.
+	f, err := os.Open(storage.dataPath(nativeStorageCoreDumpFilename))
+	assert.Nil(t, err)
+	csExport, _, err := readNativeStorageCore(f)
+	f.Close()
+	assert.Nil(t, err)
+
+	storage.RLock()
+	csExport.Offsets, csExport.PartitionRefs, err = storage.offsets.Range(0, storage.offsets.Len())
+	storage.RUnlock()
+	assert.Nil(t, err)
+	csExport.IndexSegments = nil
+
+	f, err = os.Create(storage.dataPath(nativeStorageCoreDumpFilename))
+	assert.Nil(t, err)
+	err = gob.NewEncoder(f).Encode(csExport)
+	f.Close()
+	assert.Nil(t, err)
+	os.Remove(storage.indexPath(0))
+
+	restored := NewNativeStorageWithOptions(true, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	restored.RLock()
+	assert.Equal(t, uint64(10), restored.offsets.Len())
+	restored.RUnlock()
+	assert.FileExists(t, restored.indexPath(0))
+
+	n, rf, err := restored.getOffsetAndPartition(9)
+	assert.Nil(t, err)
+	b, _, err := restored.readRecord(rf, n)
+	assert.Nil(t, err)
+	rf.Close()
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(9)), string(b))
+
+	restored.Reset()
+}
+
+func TestNativeStorageCoreFormat(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	// Every format except the current one has a migration.
+	assert.Len(t, nativeStorageCoreMigrations, int(NATIVE_STORAGE_CORE_FORMAT))
+
+	dir, err := ioutil.TempDir("", "basenine")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dir}).(*nativeStorage)
+	storage.InsertData([]byte(payload))
+	err = storage.DumpCore(true, false)
+	assert.Nil(t, err)
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, nativeStorageCoreDumpFilename))
+	assert.Nil(t, err)
+	csExport, header, err := readNativeStorageCore(bytes.NewReader(b))
+	assert.Nil(t, err)
+	assert.Equal(t, nativeStorageCoreHeader{Format: NATIVE_STORAGE_CORE_FORMAT, Version: basenine.VERSION}, header)
+	assert.Equal(t, basenine.VERSION, csExport.Version)
+
+	// A legacy core that's corrupted cannot be migrated.
+	csExport.IndexSegments = nil
+	csExport.Offsets = []int64{0, 42}
+	csExport.PartitionRefs = []int64{0}
+	var legacy bytes.Buffer
+	err = gob.NewEncoder(&legacy).Encode(csExport)
+	assert.Nil(t, err)
+	_, header, err = readNativeStorageCore(&legacy)
+	assert.NotNil(t, err)
+	assert.Equal(t, NATIVE_STORAGE_CORE_FORMAT_LEGACY, header.Format)
+
+	// A core of a future format is refused instead of being recovered from the partitions and overwritten.
+	binary.LittleEndian.PutUint32(b[len(nativeStorageCoreMagic):], NATIVE_STORAGE_CORE_FORMAT+1)
+	_, header, err = readNativeStorageCore(bytes.NewReader(b))
+	assert.ErrorIs(t, err, ErrUnsupportedCoreFormat)
+	assert.Contains(t, err.Error(), basenine.VERSION)
+
+	err = ioutil.WriteFile(filepath.Join(dir, nativeStorageCoreDumpFilename), b, 0644)
+	assert.Nil(t, err)
+	assert.Panics(t, func() {
+		NewNativeStorageWithOptions(true, NativeStorageOptions{DataDir: dir})
+	})
+	restored, err := ioutil.ReadFile(filepath.Join(dir, nativeStorageCoreDumpFilename))
+	assert.Nil(t, err)
+	assert.Equal(t, b, restored)
+}
+
+func TestNativeStorageSnapshot(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	dir, err := ioutil.TempDir("", "basenine")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dir, Checksums: []string{"model"}}).(*nativeStorage)
+
+	for index := 0; index < 1000; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	// The records that are inserted during the snapshot are either completely in it or not at all.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				storage.InsertData([]byte(payload))
+			}
+		}
+	}()
+
+	path := filepath.Join(dir, "snapshot.tar")
+	err = storage.snapshot(path)
+	close(stop)
+	wg.Wait()
+	assert.Nil(t, err)
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	tr := tar.NewReader(f)
+
+	header, err := tr.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, snapshotManifestName, header.Name)
+	var manifest snapshotManifest
+	err = json.NewDecoder(tr).Decode(&manifest)
+	assert.Nil(t, err)
+	assert.Equal(t, SNAPSHOT_FORMAT, manifest.Format)
+	assert.Equal(t, NATIVE_STORAGE_DRIVER, manifest.Driver)
+	assert.Equal(t, basenine.IndexToID(0), manifest.FirstID)
+	assert.GreaterOrEqual(t, manifest.Records, uint64(1000))
+
+	extracted := filepath.Join(dir, "extracted")
+	err = os.Mkdir(extracted, 0755)
+	assert.Nil(t, err)
+	for _, file := range manifest.Files {
+		header, err = tr.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, file.Name, header.Name)
+		assert.Equal(t, file.Size, header.Size)
+
+		b, err := ioutil.ReadAll(tr)
+		assert.Nil(t, err)
+		err = ioutil.WriteFile(filepath.Join(extracted, header.Name), b, 0644)
+		assert.Nil(t, err)
+	}
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+
+	core, err := os.Open(filepath.Join(extracted, nativeStorageCoreDumpFilename))
+	assert.Nil(t, err)
+	csExport, _, err := readNativeStorageCore(core)
+	core.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, 0, NATIVE_STORAGE_DB_FILE_EXT)}, csExport.PartitionPaths)
+	assert.Len(t, csExport.IndexSegments, 1)
+	assert.Equal(t, manifest.Records, csExport.IndexSegments[0].Count)
+	assert.Equal(t, csExport.IndexSegments, csExport.ChecksumSegments)
+
+	// The offset index and the partition in the snapshot agree on the last record.
+	b, err := ioutil.ReadFile(filepath.Join(extracted, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, 0, NATIVE_STORAGE_INDEX_FILE_EXT)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(manifest.Records)*nativeStorageIndexEntrySize, int64(len(b)))
+	offset := int64(binary.LittleEndian.Uint64(b[len(b)-int(nativeStorageIndexEntrySize):]))
+
+	rf, err := os.Open(filepath.Join(extracted, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, 0, NATIVE_STORAGE_DB_FILE_EXT)))
+	assert.Nil(t, err)
+	record, n, err := storage.readRecord(rf, offset)
+	rf.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, csExport.LastOffset, n)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(int(manifest.Records)-1)), string(record))
+
+	storage.Reset()
+}
+
+func TestNativeStorageRestoreSnapshot(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+	limit := 1000000 // 1MB
+
+	dir, err := ioutil.TempDir("", "basenine")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: filepath.Join(dir, "source"), Partitions: 3}).(*nativeStorage)
+	storage.setPartitionSizeLimit(limit)
+
+	for i := 0; i < 6; i++ {
+		for index := 0; index < 10; index++ {
+			storage.InsertData([]byte(payload))
+		}
+		storage.newPartition()
+	}
+	storage.discardOldPartitions(false)
+
+	storage.Lock()
+	storage.macros = map[string]string{"chevy": `brand.name == "Chevrolet"`}
+	storage.insertionFilter = "chevy"
+	storage.insertionFilterExpr, _, err = storage.PrepareQuery(storage.insertionFilter, storage.macros)
+	storage.Unlock()
+	assert.Nil(t, err)
+
+	path := filepath.Join(dir, "snapshot.tar")
+	err = storage.snapshot(path)
+	assert.Nil(t, err)
+	storage.Reset()
+
+	dataDir := filepath.Join(dir, "restored")
+	err = RestoreSnapshot(path, NATIVE_STORAGE_DRIVER, dataDir)
+	assert.Nil(t, err)
+
+	// The staging directory is cleaned up.
+	matches, err := filepath.Glob(filepath.Join(dataDir, ".restore-*"))
+	assert.Nil(t, err)
+	assert.Empty(t, matches)
+
+	restored := NewNativeStorageWithOptions(true, NativeStorageOptions{DataDir: dataDir, Partitions: 3}).(*nativeStorage)
+
+	restored.RLock()
+	assert.Equal(t, uint64(40), restored.removedOffsetsCounter)
+	assert.Equal(t, uint64(20), restored.offsets.Len())
+	assert.Equal(t, map[string]string{"chevy": `brand.name == "Chevrolet"`}, restored.macros)
+	assert.Equal(t, "chevy", restored.insertionFilter)
+	assert.NotNil(t, restored.insertionFilterExpr)
+	assert.Equal(t, int64(limit/3), restored.partitionSizeLimit)
+	restored.RUnlock()
+
+	// The records keep their IDs and the new records continue from them.
+	server, client := net.Pipe()
+	go func() {
+		restored.RetrieveSingle(server, basenine.IndexToID(45), "", false)
+		server.Close()
+	}()
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(45)), string(bytes))
+	client.Close()
+
+	insertedId, err := restored.InsertData([]byte(payload))
+	assert.Nil(t, err)
+	assert.Equal(t, basenine.IndexToID(60), insertedId)
+
+	// A database is never overwritten.
+	err = RestoreSnapshot(path, NATIVE_STORAGE_DRIVER, dataDir)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already contains a database")
+
+	// The snapshot is only restored into the storage driver that's taken it.
+	err = RestoreSnapshot(path, BOLT_STORAGE_DRIVER, filepath.Join(dir, "bolt"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "taken by the native storage driver")
+
+	// A truncated archive leaves the data directory empty.
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	truncated := filepath.Join(dir, "truncated.tar")
+	err = ioutil.WriteFile(truncated, b[:len(b)/2], 0644)
+	assert.Nil(t, err)
+	err = RestoreSnapshot(truncated, NATIVE_STORAGE_DRIVER, filepath.Join(dir, "truncated"))
+	assert.ErrorIs(t, err, ErrInvalidSnapshot)
+	err = checkSnapshotDataDirectory(filepath.Join(dir, "truncated"))
+	assert.Nil(t, err)
+
+	restored.Reset()
+}
+
+func TestNativeStorageExport(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	dir, err := ioutil.TempDir("", "basenine")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: filepath.Join(dir, "data")}).(*nativeStorage)
+
+	for index := 0; index < 100; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	export := func(path string, compress bool, from string, to string, query string) (string, error) {
+		server, client := net.Pipe()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- storage.Export(server, path, compress, from, to, query)
+			server.Close()
+		}()
+
+		bytes, err := ioutil.ReadAll(client)
+		assert.Nil(t, err)
+		client.Close()
+		return string(bytes), <-errs
+	}
+
+	// The range is open on the empty end.
+	path := filepath.Join(dir, "export.ndjson.gz")
+	response, err := export(path, true, basenine.IndexToID(90), "", `redact("year")`)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(response, "OK\n"))
+	assert.Contains(t, response, `"noMoreData":true`)
+
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	r, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	b, err := ioutil.ReadAll(r)
+	f.Close()
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	assert.Len(t, lines, 10)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":"[REDACTED]"}`, basenine.IndexToID(99)), lines[9])
+
+	// A failed export doesn't leave a file behind. The error is returned without being written into the connection.
+	path = filepath.Join(dir, "invalid.ndjson")
+	response, err = export(path, false, "", "", `=.=`)
+	assert.Empty(t, response)
+	assert.True(t, strings.HasPrefix(err.Error(), "While parsing the query:"))
+	_, err = export(path, false, basenine.IndexToID(10), basenine.IndexToID(5), "")
+	assert.EqualError(t, err, fmt.Sprintf("The range starts after it ends: %s > %s", basenine.IndexToID(10), basenine.IndexToID(5)))
+	_, err = export("", false, "", "", "")
+	assert.EqualError(t, err, "Provide a path for the export!")
+	assert.NoFileExists(t, path)
+	assert.NoFileExists(t, path+".tmp")
+
+	storage.Reset()
+}
+
+func TestParseExportRange(t *testing.T) {
+	for _, row := range []struct {
+		from  string
+		to    string
+		start uint64
+		end   uint64
+	}{
+		{"", "", 10, 20},
+		{"5", "", 10, 20},
+		{"12", "15", 12, 16},
+		{"", "100", 10, 20},
+		{"30", "40", 20, 20},
+		{"0", "5", 10, 10},
+	} {
+		start, end, err := parseExportRange(row.from, row.to, 10, 20)
+		assert.Nil(t, err)
+		assert.Equal(t, row.start, start, row)
+		assert.Equal(t, row.end, end, row)
+	}
+
+	_, _, err := parseExportRange("x", "", 10, 20)
+	assert.NotNil(t, err)
+	_, _, err = parseExportRange("15", "12", 10, 20)
+	assert.NotNil(t, err)
+}
+
+func TestResolveExportPath(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	assert.Nil(t, err)
+	err = os.Mkdir(filepath.Join(dir, "exports"), 0755)
+	assert.Nil(t, err)
+	err = os.Symlink(os.TempDir(), filepath.Join(dir, "outside"))
+	assert.Nil(t, err)
+
+	for _, row := range []struct {
+		path     string
+		resolved string
+	}{
+		{"export.ndjson", filepath.Join(dir, "export.ndjson")},
+		{"exports/../export.ndjson", filepath.Join(dir, "export.ndjson")},
+		{filepath.Join(dir, "exports", "export.ndjson"), filepath.Join(dir, "exports", "export.ndjson")},
+		{"", ""},
+	} {
+		resolved, err := ResolveExportPath(dir, row.path)
+		assert.Nil(t, err, row.path)
+		assert.Equal(t, row.resolved, resolved, row.path)
+	}
+
+	for _, path := range []string{
+		"../export.ndjson",
+		"exports/../../export.ndjson",
+		"/etc/passwd",
+		".",
+		"outside/export.ndjson",
+	} {
+		_, err := ResolveExportPath(dir, path)
+		assert.ErrorIs(t, err, ErrExportPathOutsideDirectory, path)
+	}
+}
+
+func TestNativeStorageChecksum(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	for index := 0; index < 3; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	// Flip a byte in the payload of the second record.
+	n, rf, err := storage.getOffsetAndPartition(1)
+	assert.Nil(t, err)
+	rf.Close()
+	storage.RLock()
+	f := storage.partitions[storage.partitionIndex]
+	storage.RUnlock()
+	_, err = f.WriteAt([]byte("X"), n+nativeStorageRecordHeaderLengthV1+2)
+	assert.Nil(t, err)
+
+	n, rf, err = storage.getOffsetAndPartition(1)
+	assert.Nil(t, err)
+	rf.Seek(n, io.SeekStart)
+	_, _, err = storage.readRecord(rf, n)
+	rf.Close()
+	assert.Equal(t, ErrChecksumMismatch, err)
+
+	// The corrupted record is skipped and counted, the rest is intact.
+	server, client := net.Pipe()
+	go func() {
+		storage.Fetch(server, basenine.IndexToID(0), "1", "", "3", false)
+		server.Close()
+	}()
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Contains(t, string(bytes), basenine.IndexToID(0))
+	assert.NotContains(t, string(bytes), fmt.Sprintf(`"id":"%s"`, basenine.IndexToID(1)))
+	assert.Contains(t, string(bytes), fmt.Sprintf(`"id":"%s"`, basenine.IndexToID(2)))
+	assert.Equal(t, uint64(1), storage.corruptedRecordsCounter)
+
+	client.Close()
+
+	storage.Reset()
+}
+
+func TestNativeStorageReadLegacyRecord(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"id":"000000000000000000000000","model":"Camaro","year":2021}`
+
+	f, err := ioutil.TempFile("", "legacy_*.db")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+
+	// Headerless format: 8-byte little-endian length followed by the JSON.
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(len(payload)))
+	_, err = f.Write(append(b, []byte(payload)...))
+	assert.Nil(t, err)
+
+	storage := &nativeStorage{}
+
+	f.Seek(0, io.SeekStart)
+	record, n, err := storage.readRecord(f, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8+len(payload)), n)
+	assert.JSONEq(t, payload, string(record))
+
+	f.Close()
+}
+
+func TestNativeStorageBlockCompression(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	for _, compression := range []string{"snappy", "zstd"} {
+		storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir, Compression: compression, BlockSize: 4096}).(*nativeStorage)
+
+		for index := 0; index < 1000; index++ {
+			insertedId, err := storage.InsertData([]byte(payload))
+			assert.Nil(t, err)
+			assert.Equal(t, basenine.IndexToID(index), insertedId)
+		}
+
+		// The records are written once they fill a block.
+		storage.RLock()
+		assert.NotEmpty(t, storage.pendingRecords)
+		assert.Less(t, storage.pendingSize, 4096)
+		storage.RUnlock()
+
+		err := storage.flushBlock()
+		assert.Nil(t, err)
+
+		storage.RLock()
+		assert.Equal(t, uint64(1000), storage.offsets.Len())
+		assert.Empty(t, storage.pendingRecords)
+		f := storage.partitions[storage.partitionIndex]
+		storage.RUnlock()
+
+		// Compressed blocks are much smaller than the raw records.
+		info, err := f.Stat()
+		assert.Nil(t, err)
+		assert.Less(t, info.Size(), int64(1000*len(payload)/4))
+
+		for _, index := range []int{0, 42, 999} {
+			server, client := net.Pipe()
+			go func() {
+				storage.RetrieveSingle(server, basenine.IndexToID(index), "", false)
+				server.Close()
+			}()
+
+			bytes, err := ioutil.ReadAll(client)
+			assert.Nil(t, err)
+			assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(index)), string(bytes))
+			client.Close()
+		}
+
+		server, client := net.Pipe()
+		go func() {
+			storage.Fetch(server, basenine.IndexToID(500), "-1", "", "20", false)
+			server.Close()
+		}()
+
+		bytes, err := ioutil.ReadAll(client)
+		assert.Nil(t, err)
+		assert.Len(t, strings.Split(string(bytes), "\n"), 41)
+		client.Close()
+
+		// Rebuild the offsets from the compressed blocks.
+		recovered := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir, Recover: true, Compression: compression}).(*nativeStorage)
+		storage.RLock()
+		offsets, partitionRefs, err := storage.offsets.Range(0, storage.offsets.Len())
+		storage.RUnlock()
+		assert.Nil(t, err)
+
+		recovered.RLock()
+		recoveredOffsets, recoveredPartitionRefs, err := recovered.offsets.Range(0, recovered.offsets.Len())
+		recovered.RUnlock()
+		assert.Nil(t, err)
+		assert.Equal(t, offsets, recoveredOffsets)
+		assert.Equal(t, partitionRefs, recoveredPartitionRefs)
+
+		recovered.Reset()
+	}
+}
+
+func TestNativeStorageBlockCompressionSyncAlways(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir, Compression: "zstd", Sync: "always"}).(*nativeStorage)
+
+	// The records are written before the insertions return in sync=always mode even if the block is not full.
+	insertedId, err := storage.InsertData([]byte(payload))
+	assert.Nil(t, err)
+
+	batch := make([][]byte, nativeStorageMaxBlockRecords+1)
+	for i := range batch {
+		batch[i] = []byte(payload)
+	}
+	insertedIds, err := storage.InsertBatch(batch)
+	assert.Nil(t, err)
+
+	storage.RLock()
+	assert.Equal(t, uint64(len(batch)+1), storage.offsets.Len())
+	assert.Empty(t, storage.pendingRecords)
+	storage.RUnlock()
+
+	for _, id := range []interface{}{insertedId, insertedIds[0], insertedIds[len(batch)-1]} {
+		server, client := net.Pipe()
+		go func() {
+			storage.RetrieveSingle(server, id.(string), "", false)
+			server.Close()
+		}()
+
+		bytes, err := ioutil.ReadAll(client)
+		assert.Nil(t, err)
+		assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, id), string(bytes))
+		client.Close()
+	}
+
+	storage.Reset()
+}
+
+func TestParseNativeStorageArgs(t *testing.T) {
+	options, err := ParseNativeStorageArgs("compression=zstd, block-size=1024,data-dir=/tmp/basenine,retention=24h")
+	assert.Nil(t, err)
+	assert.Equal(t, "zstd", options.Compression)
+	assert.Equal(t, 1024, options.BlockSize)
+	assert.Equal(t, "/tmp/basenine", options.DataDir)
+	assert.Equal(t, 24*time.Hour, options.Retention)
+
+	options, err = ParseNativeStorageArgs("")
+	assert.Nil(t, err)
+	assert.Equal(t, NativeStorageOptions{}, options)
+
+	_, err = ParseNativeStorageArgs("compression=lz4")
+	assert.ErrorIs(t, err, ErrUnknownCompression)
+
+	_, err = ParseNativeStorageArgs("foo=bar")
+	assert.NotNil(t, err)
+
+	_, err = ParseNativeStorageArgs("block-size")
+	assert.NotNil(t, err)
+
+	_, err = ParseNativeStorageArgs("retention=-1h")
+	assert.NotNil(t, err)
+
+	options, err = ParseNativeStorageArgs("partitions=10")
+	assert.Nil(t, err)
+	assert.Equal(t, 10, options.Partitions)
+
+	options, err = ParseNativeStorageArgs("sync=always")
+	assert.Nil(t, err)
+	assert.Equal(t, "always", options.Sync)
+
+	_, err = ParseNativeStorageArgs("sync=sometimes")
+	assert.ErrorIs(t, err, ErrUnknownSyncMode)
+
+	options, err = ParseNativeStorageArgs("archive-dir=/tmp/archive,archive-limit=1000000")
+	assert.Nil(t, err)
+	assert.Equal(t, "/tmp/archive", options.ArchiveDir)
+	assert.Equal(t, int64(1000000), options.ArchiveLimit)
+
+	_, err = ParseNativeStorageArgs("partitions=1")
+	assert.NotNil(t, err)
+
+	options, err = ParseNativeStorageArgs("zone-maps=response.status:elapsedTime")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"response.status", "elapsedTime"}, options.ZoneMaps)
+
+	_, err = ParseNativeStorageArgs("zone-maps=request.*")
+	assert.NotNil(t, err)
+
+	options, err = ParseNativeStorageArgs("full-text=request.body:response.body")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"request.body", "response.body"}, options.FullText)
+
+	options, err = ParseNativeStorageArgs(`bloom-filters=*:request.headers["x-request-id"]`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"*", `request.headers["x-request-id"]`}, options.BloomFilters)
+
+	options, err = ParseNativeStorageArgs("checksums=request.path:response.status")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"request.path", "response.status"}, options.Checksums)
+
+	_, err = ParseNativeStorageArgs("checksums=request.*")
+	assert.NotNil(t, err)
+
+	options, err = ParseNativeStorageArgs("dictionary=true")
+	assert.Nil(t, err)
+	assert.True(t, options.Dictionary)
+
+	_, err = ParseNativeStorageArgs("dictionary=true,compression=snappy")
+	assert.ErrorIs(t, err, ErrDictionaryWithCompression)
+
+	options, err = ParseNativeStorageArgs("recover=true")
+	assert.Nil(t, err)
+	assert.True(t, options.Recover)
+
+	_, err = ParseNativeStorageArgs("block-size=0")
+	assert.NotNil(t, err)
+}
+
+func TestNativeStorageMacros(t *testing.T) {
+	dataDir := t.TempDir()
+	key := `chevy`
+	value := `brand.name == "Chevrolet"`
+	macro := fmt.Sprintf(`%s~%s`, key, value)
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	server, client := net.Pipe()
+	go func() {
+		storage.ApplyMacro(server, []byte(macro))
+		macros, err := storage.GetMacros()
+		assert.Nil(t, err)
+		assert.Len(t, macros, 1)
+		assert.Equal(t, macros[key], fmt.Sprintf("(%s)", value))
+		server.Close()
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+
+	client.Close()
+
+	storage.removeDatabaseFiles()
+}
+
+func TestNativeStorageStreamRecords(t *testing.T) {
+	dataDir := t.TempDir()
+	query := ""
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	for index := 0; index < 100; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	server, client := net.Pipe()
+	go func() {
+		storage.StreamRecords(server, "", query)
+		server.Close()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client.Close()
+
+	storage.Reset()
+}
+
+func TestNativeStorageStreamRecordsMultipleStreams(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+	streams := 10
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	var wg sync.WaitGroup
+	var clients []net.Conn
+	for i := 0; i < streams; i++ {
+		server, client := net.Pipe()
+		clients = append(clients, client)
+		go storage.StreamRecords(server, "", "")
+
+		wg.Add(1)
+		go func(client net.Conn) {
+			defer wg.Done()
+			scanner := bufio.NewScanner(client)
+			for scanner.Scan() {
+				if strings.HasPrefix(scanner.Text(), basenine.CMD_METADATA) {
+					continue
+				}
+				// Every stream must receive the record.
+				return
+			}
+		}(client)
+	}
+
+	// Wait for all of the streams to subscribe.
+	for storage.notifier.Len() < streams {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A single write must wake up all of the streams.
+	storage.InsertData([]byte(payload))
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the streams")
+	}
+
+	for _, client := range clients {
+		client.Close()
+	}
+
+	storage.Reset()
+}
+
+func TestNativeStorageStreamRecordsFailedWrite(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	for index := 0; index < 5; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	// Make the write of the next record fail through a read-only file descriptor.
+	storage.Lock()
+	f := storage.partitions[storage.partitionIndex]
+	readOnly, err := os.Open(f.Name())
+	assert.Nil(t, err)
+	storage.partitions[storage.partitionIndex] = readOnly
+	storage.Unlock()
+
+	_, err = storage.InsertData([]byte(payload))
+	assert.NotNil(t, err)
+
+	storage.Lock()
+	storage.partitions[storage.partitionIndex] = f
+	storage.Unlock()
+	readOnly.Close()
+
+	// The offset of the failed record is not left reserved.
+	_, _, err = storage.getOffsetAndPartition(5)
+	assert.NotNil(t, err)
+
+	server, client := net.Pipe()
+	go storage.StreamRecords(server, "", "")
+
+	received := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), basenine.CMD_METADATA) {
+				continue
+			}
+			received <- scanner.Text()
+		}
+	}()
+
+	for index := 0; index < 5; index++ {
+		assert.Contains(t, <-received, basenine.IndexToID(index))
+	}
+
+	// The stream passes the failed record and receives the next one.
+	storage.InsertData([]byte(payload))
+
+	select {
+	case record := <-received:
+		assert.Contains(t, record, basenine.IndexToID(6))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the stream")
+	}
+
+	client.Close()
+
+	storage.Reset()
+}
+
+func TestNativeStorageRetrieveSingle(t *testing.T) {
+	dataDir := t.TempDir()
+	index := 42
+	query := ""
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	expected := fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(index))
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	for i := 0; i < 100; i++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	server, client := net.Pipe()
+	go func() {
+		storage.RetrieveSingle(server, basenine.IndexToID(index), query, false)
+		server.Close()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.JSONEq(t, expected, string(bytes))
+
+	client.Close()
+
+	storage.Reset()
+}
+
+func TestNativeStorageFetch(t *testing.T) {
+	dataDir := t.TempDir()
+	query := ""
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	for index := 0; index < 100; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	server, client := net.Pipe()
+	go func() {
+		storage.Fetch(server, basenine.IndexToID(42), "-1", query, "20", false)
+		server.Close()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Len(t, strings.Split(string(bytes), "\n"), 41)
+
+	client.Close()
+
+	storage.Reset()
+}
+
+func TestNativeStorageArchive(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	dir, err := ioutil.TempDir("", "basenine")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir, ArchiveDir: dir}).(*nativeStorage)
+
+	for i := 0; i < 2; i++ {
+		for index := 0; index < 10; index++ {
+			storage.InsertData([]byte(payload))
+		}
+		storage.newPartition()
+	}
+
+	// Archives the first partition.
+	storage.discardOldPartitions(false)
+
+	storage.RLock()
+	assert.Nil(t, storage.partitions[0])
+	assert.Equal(t, uint64(10), storage.removedOffsetsCounter)
+	assert.Len(t, storage.archives, 1)
+	storage.RUnlock()
+	assert.NoFileExists(t, storage.partitionPath(0))
+	assert.FileExists(t, storage.archivePath(0))
+	assert.FileExists(t, storage.archiveIndexPath(0))
+
+	expected := fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(3))
+
+	for _, archived := range []bool{false, true} {
+		server, client := net.Pipe()
+		go func() {
+			storage.RetrieveSingle(server, basenine.IndexToID(3), "", archived)
+			server.Close()
+		}()
+
+		bytes, err := ioutil.ReadAll(client)
+		assert.Nil(t, err)
+		if archived {
+			assert.JSONEq(t, expected, string(bytes))
+		} else {
+			assert.Equal(t, "Record does not exist!\n", string(bytes))
+		}
+		client.Close()
+	}
+
+	for _, archived := range []bool{false, true} {
+		server, client := net.Pipe()
+		go func() {
+			storage.Fetch(server, basenine.IndexToID(0), "1", "", "100", archived)
+			server.Close()
+		}()
+
+		var records []string
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, basenine.CMD_METADATA) || line == basenine.CloseConnection || line == "" {
+				continue
+			}
+			records = append(records, line)
+		}
+		if archived {
+			assert.Len(t, records, 20)
+			assert.Contains(t, records[0], basenine.IndexToID(0))
+		} else {
+			assert.Len(t, records, 10)
+			assert.Contains(t, records[0], basenine.IndexToID(10))
+		}
+		client.Close()
+	}
+
+	// The archive survives a reload.
+	err = storage.loadArchives()
+	assert.Nil(t, err)
+	storage.RLock()
+	assert.Len(t, storage.archives, 1)
+	assert.Equal(t, uint64(0), storage.archives[0].firstID)
+	assert.Len(t, storage.archives[0].offsets, 10)
+	storage.RUnlock()
+
+	// The archive size limit removes the oldest archived partitions.
+	storage.options.ArchiveLimit = 1
+	storage.enforceArchiveLimit()
+	storage.RLock()
+	assert.Empty(t, storage.archives)
+	storage.RUnlock()
+	assert.NoFileExists(t, storage.archivePath(0))
+
+	storage.Reset()
 }
 
-func TestNativeStorageDumpRestoreCore(t *testing.T) {
-	storage := NewNativeStorage(false).(*nativeStorage)
+func TestNativeStorageHashIndex(t *testing.T) {
+	dataDir := t.TempDir()
+	insert := func(storage *nativeStorage) {
+		for index := 0; index < 50; index++ {
+			brand := "Chevrolet"
+			if index%2 == 1 {
+				brand = "Ford"
+			}
+			storage.InsertData([]byte(fmt.Sprintf(`{"brand":{"name":"%s"},"model":"Camaro","year":2021}`, brand)))
+		}
+	}
+
+	lookup := func(storage *nativeStorage, query string) []uint64 {
+		expr, _, err := storage.PrepareQuery(query, nil)
+		assert.Nil(t, err)
+		storage.RLock()
+		defer storage.RUnlock()
+		return storage.lookupPlan(basenine.BuildPlan(expr), 0, storage.offsets.Len())
+	}
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	// The records before the index is created are also indexed.
+	insert(storage)
+
+	server, client := net.Pipe()
+	go func() {
+		storage.CreateIndex(server, []byte("brand.name"))
+		server.Close()
+	}()
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "OK\n", string(bytes))
+	client.Close()
 
-	err := storage.DumpCore(false, false)
+	insert(storage)
+
+	ids := lookup(storage, `brand.name == "Ford"`)
+	assert.Len(t, ids, 50)
+	for _, id := range ids {
+		assert.Equal(t, uint64(1), id%2)
+	}
+	assert.Len(t, lookup(storage, `brand.name != "Ford"`), 50)
+	assert.Len(t, lookup(storage, `"Ford" == brand.name and year == 2021`), 50)
+	assert.Len(t, lookup(storage, `brand.name == "Ford" or brand.name == "Chevrolet"`), 100)
+	assert.Empty(t, lookup(storage, `brand.name == "Ford" and brand.name == "Chevrolet"`))
+	assert.NotNil(t, lookup(storage, `brand.name == "Tesla"`))
+	assert.Nil(t, lookup(storage, `model == "Camaro"`))
+
+	server, client = net.Pipe()
+	go func() {
+		storage.Fetch(server, basenine.IndexToID(0), "1", `brand.name == "Ford"`, "100", false)
+		server.Close()
+	}()
+
+	bytes, err = ioutil.ReadAll(client)
 	assert.Nil(t, err)
+	assert.Len(t, strings.Split(string(bytes), "\n"), 102)
+	client.Close()
 
-	err = storage.RestoreCore()
+	// The index is not used when a helper changes the record before it's compared.
+	query := `redact("brand.name") and brand.name == "[REDACTED]"`
+	assert.Nil(t, lookup(storage, query))
+
+	server, client = net.Pipe()
+	go func() {
+		storage.Fetch(server, basenine.IndexToID(0), "1", query, "100", false)
+		server.Close()
+	}()
+
+	bytes, err = ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, strings.Count(string(bytes), `"[REDACTED]"`))
+	client.Close()
+
+	// The index is rebuilt upon restoring the core.
+	err = storage.DumpCore(true, false)
 	assert.Nil(t, err)
 
-	storage.removeDatabaseFiles()
+	restored := NewNativeStorageWithOptions(true, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+	assert.Len(t, lookup(restored, `brand.name == "Ford"`), 50)
+
+	restored.Reset()
+	assert.Nil(t, lookup(restored, `brand.name == "Ford"`))
 }
 
-func TestNativeStorageInsertAndReadData(t *testing.T) {
+func TestNativeStorageFailedInsertIndex(t *testing.T) {
 	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
 
-	storage := NewNativeStorage(false).(*nativeStorage)
+	dir, err := ioutil.TempDir("", "basenine")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
 
-	for index := 0; index < 100; index++ {
-		expected := fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(index))
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dir, FullText: []string{"model"}}).(*nativeStorage)
+
+	server, client := net.Pipe()
+	go func() {
+		storage.CreateIndex(server, []byte("brand.name"))
+		server.Close()
+	}()
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "OK\n", string(bytes))
+	client.Close()
 
+	for index := 0; index < 5; index++ {
 		storage.InsertData([]byte(payload))
+	}
 
-		// Safely acces the offsets and partition references
-		n, rf, err := storage.getOffsetAndPartition(uint64(index))
-		assert.Nil(t, err)
+	// The offset index file of the next partition cannot be created.
+	indexPath := storage.offsets.path
+	storage.offsets.path = func(partition int64) string {
+		return filepath.Join(dir, "missing", filepath.Base(indexPath(partition)))
+	}
+	storage.newPartition()
 
-		rf.Seek(n, io.SeekStart)
-		b, n, err := storage.readRecord(rf, n)
-		assert.Nil(t, err)
-		assert.Greater(t, n, int64(0))
-		assert.JSONEq(t, expected, string(b))
+	insertedId, err := storage.InsertData([]byte(payload))
+	assert.NotNil(t, err)
+	assert.Nil(t, insertedId)
 
-		rf.Close()
+	insertedIds, err := storage.InsertBatch([][]byte{[]byte(payload), []byte(payload)})
+	assert.NotNil(t, err)
+	assert.Equal(t, []interface{}{nil, nil}, insertedIds)
+
+	// The IDs of the failed insertions are assigned to the next records only once.
+	storage.offsets.path = indexPath
+	insertedId, err = storage.InsertData([]byte(payload))
+	assert.Nil(t, err)
+	assert.Equal(t, basenine.IndexToID(5), insertedId)
+
+	for _, query := range []string{`brand.name == "Chevrolet"`, `model.search("camaro")`} {
+		expr, _, err := storage.PrepareQuery(query, nil)
+		assert.Nil(t, err)
+		storage.RLock()
+		ids := storage.lookupPlan(basenine.BuildPlan(expr), 0, storage.offsets.Len())
+		storage.RUnlock()
+		assert.Equal(t, []uint64{0, 1, 2, 3, 4, 5}, ids, query)
 	}
 
 	storage.Reset()
 }
 
-func TestNativeStorageMacros(t *testing.T) {
-	key := `chevy`
-	value := `brand.name == "Chevrolet"`
-	macro := fmt.Sprintf(`%s~%s`, key, value)
+func TestNativeStorageZoneMaps(t *testing.T) {
+	options := NativeStorageOptions{DataDir: t.TempDir(), ZoneMaps: []string{"year"}}
+	storage := NewNativeStorageWithOptions(false, options).(*nativeStorage)
+
+	// Three partitions with the years 2019, 2020 and 2021 in ascending timestamps.
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			storage.newPartition()
+		}
+		for index := 0; index < 10; index++ {
+			storage.InsertData([]byte(fmt.Sprintf(`{"model":"Camaro","year":%d,"timestamp":%d}`, 2019+i, i*10+index)))
+		}
+	}
+
+	prune := func(storage *nativeStorage, query string) map[int64]bool {
+		expr, _, err := storage.PrepareQuery(query, nil)
+		assert.Nil(t, err)
+		storage.RLock()
+		defer storage.RUnlock()
+		return storage.prunePartitions(basenine.BuildPlan(expr))
+	}
 
-	storage := NewNativeStorage(false).(*nativeStorage)
+	assert.Nil(t, prune(storage, `year >= 2019`))
+	assert.Equal(t, map[int64]bool{0: true, 1: true}, prune(storage, `year > 2020`))
+	assert.Equal(t, map[int64]bool{1: true, 2: true}, prune(storage, `2020 > year`))
+	assert.Equal(t, map[int64]bool{0: true, 2: true}, prune(storage, `timestamp >= 10 and timestamp < 20`))
+	assert.Equal(t, map[int64]bool{1: true}, prune(storage, `timestamp < 10 or timestamp >= 20`))
+	assert.Equal(t, map[int64]bool{0: true, 1: true, 2: true}, prune(storage, `timestamp > now()`))
+	assert.Nil(t, prune(storage, `timestamp > now() or model == "Camaro"`))
+	assert.Nil(t, prune(storage, `model > 1`))
 
 	server, client := net.Pipe()
 	go func() {
-		storage.ApplyMacro(server, []byte(macro))
-		macros, err := storage.GetMacros()
-		assert.Nil(t, err)
-		assert.Len(t, macros, 1)
-		assert.Equal(t, macros[key], fmt.Sprintf("(%s)", value))
+		storage.Fetch(server, basenine.IndexToID(0), "1", `year > 2020`, "100", false)
 		server.Close()
 	}()
 
-	time.Sleep(500 * time.Millisecond)
-
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Len(t, strings.Split(string(bytes), "\n"), 22)
 	client.Close()
 
-	storage.removeDatabaseFiles()
+	// The zone maps are restored from the core.
+	err = storage.DumpCore(true, false)
+	assert.Nil(t, err)
+
+	restored := NewNativeStorageWithOptions(true, options).(*nativeStorage)
+	assert.Equal(t, map[int64]bool{0: true, 1: true}, prune(restored, `year > 2020`))
+
+	// The zone maps are computed again upon recovery.
+	options.Recover = true
+	recovered := NewNativeStorageWithOptions(true, options).(*nativeStorage)
+	assert.Equal(t, map[int64]bool{0: true, 1: true}, prune(recovered, `year > 2020`))
+
+	recovered.Reset()
+	assert.Nil(t, prune(recovered, `year > 2020`))
 }
 
-func TestNativeStorageStreamRecords(t *testing.T) {
-	query := ""
-	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+func TestNativeStorageBlockCompressionRotation(t *testing.T) {
+	options := NativeStorageOptions{DataDir: t.TempDir(), Compression: "zstd", ZoneMaps: []string{"year"}}
+	storage := NewNativeStorageWithOptions(false, options).(*nativeStorage)
+
+	server, client := net.Pipe()
+	go func() {
+		storage.CreateIndex(server, []byte("model"))
+		server.Close()
+	}()
+	_, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	client.Close()
 
-	storage := NewNativeStorage(false).(*nativeStorage)
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(`{"model":"Camaro","year":2021}`))
+	}
 
-	for index := 0; index < 100; index++ {
-		storage.InsertData([]byte(payload))
+	// The partition is rotated while the records are pending.
+	storage.newPartition()
+	err = storage.flushBlock()
+	assert.Nil(t, err)
+
+	storage.RLock()
+	_, partitionRefs, err := storage.offsets.Range(0, storage.offsets.Len())
+	assert.Nil(t, err)
+	for _, partition := range partitionRefs {
+		assert.Equal(t, int64(1), partition)
+	}
+	assert.Nil(t, storage.getZoneMap("year").zones[0])
+	assert.Equal(t, &zone{Min: 2021, Max: 2021}, storage.getZoneMap("year").zones[1])
+
+	expr, _, err := storage.PrepareQuery(`year > 2020`, nil)
+	assert.Nil(t, err)
+	assert.False(t, storage.prunePartitions(basenine.BuildPlan(expr))[1])
+
+	expr, _, err = storage.PrepareQuery(`model == "Camaro"`, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, storage.lookupPlan(basenine.BuildPlan(expr), 0, storage.offsets.Len()))
+	storage.RUnlock()
+
+	storage.Reset()
+}
+
+func TestNativeStorageBloomFilters(t *testing.T) {
+	options := NativeStorageOptions{DataDir: t.TempDir(), BloomFilters: []string{`request.headers["x-request-id"]`}}
+	storage := NewNativeStorageWithOptions(false, options).(*nativeStorage)
+
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			storage.newPartition()
+		}
+		for index := 0; index < 10; index++ {
+			storage.InsertData([]byte(fmt.Sprintf(`{"model":"Camaro","request":{"headers":{"x-request-id":"id-%d"}}}`, i*10+index)))
+		}
+	}
+
+	prune := func(storage *nativeStorage, query string) map[int64]bool {
+		expr, _, err := storage.PrepareQuery(query, nil)
+		assert.Nil(t, err)
+		storage.RLock()
+		defer storage.RUnlock()
+		return storage.prunePartitions(basenine.BuildPlan(expr))
 	}
 
+	assert.Equal(t, map[int64]bool{0: true, 2: true}, prune(storage, `request.headers["x-request-id"] == "id-15"`))
+	assert.Equal(t, map[int64]bool{1: true}, prune(storage, `"id-5" == request.headers["x-request-id"] or request.headers["x-request-id"] == "id-25"`))
+	assert.Nil(t, prune(storage, `request.headers["x-request-id"] != "id-15"`))
+	assert.Nil(t, prune(storage, `model == "Tesla"`))
+
 	server, client := net.Pipe()
 	go func() {
-		storage.StreamRecords(server, "", query)
+		storage.Fetch(server, basenine.IndexToID(0), "1", `request.headers["x-request-id"] == "id-15"`, "100", false)
 		server.Close()
 	}()
 
-	time.Sleep(100 * time.Millisecond)
-
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Contains(t, string(bytes), `"id-15"`)
+	assert.Len(t, strings.Split(string(bytes), "\n"), 13)
 	client.Close()
 
-	storage.Reset()
+	// All of the leaf values are added into the filters regardless of their paths.
+	err = storage.DumpCore(true, false)
+	assert.Nil(t, err)
+
+	options.BloomFilters = []string{NATIVE_STORAGE_BLOOM_FILTER_ALL_LEAVES}
+	restored := NewNativeStorageWithOptions(true, options).(*nativeStorage)
+	assert.Equal(t, map[int64]bool{0: true, 1: true, 2: true}, prune(restored, `model == "Tesla"`))
+	assert.Equal(t, map[int64]bool{0: true, 1: true}, prune(restored, `request.headers.x == "id-25"`))
+	assert.Nil(t, prune(restored, `model == "Camaro"`))
+
+	restored.Reset()
+	assert.Nil(t, prune(restored, `model == "Tesla"`))
 }
 
-func TestNativeStorageRetrieveSingle(t *testing.T) {
-	index := 42
-	query := ""
-	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+func TestBloomFilter(t *testing.T) {
+	filter := &bloomFilter{}
+	for i := 0; i < 10000; i++ {
+		filter.Add(fmt.Sprintf("key-%d", i))
+	}
+	assert.Greater(t, len(filter.stages), 1)
 
-	expected := fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(index))
+	for i := 0; i < 10000; i++ {
+		assert.True(t, filter.Test(fmt.Sprintf("key-%d", i)))
+	}
 
-	storage := NewNativeStorage(false).(*nativeStorage)
+	var falsePositives int
+	for i := 0; i < 10000; i++ {
+		if filter.Test(fmt.Sprintf("other-%d", i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 500)
+}
 
-	for i := 0; i < 100; i++ {
-		storage.InsertData([]byte(payload))
+func TestNativeStorageFullTextIndex(t *testing.T) {
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: t.TempDir(), FullText: []string{"response.body"}}).(*nativeStorage)
+
+	for i := 0; i < 2; i++ {
+		for index := 0; index < 10; index++ {
+			message := "OK"
+			if index%5 == 0 {
+				message = "Gateway Timeout"
+			}
+			body := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(`{"message":"%s"}`, message)))
+			storage.InsertData([]byte(fmt.Sprintf(`{"response":{"body":"%s"}}`, body)))
+		}
+		storage.newPartition()
+	}
+
+	lookup := func(query string) []uint64 {
+		expr, _, err := storage.PrepareQuery(query, nil)
+		assert.Nil(t, err)
+		storage.RLock()
+		defer storage.RUnlock()
+		return storage.lookupPlan(basenine.BuildPlan(expr), 0, storage.offsets.Len()+storage.removedOffsetsCounter)
 	}
 
+	assert.Equal(t, []uint64{0, 5, 10, 15}, lookup(`response.body.search("timeout")`))
+	assert.Equal(t, []uint64{0, 5, 10, 15}, lookup(`response.body.search("GATEWAY timeout")`))
+	assert.Empty(t, lookup(`response.body.search("gateway ok")`))
+	assert.Empty(t, lookup(`response.body.search("!")`))
+	assert.Nil(t, lookup(`request.body.search("timeout")`))
+
 	server, client := net.Pipe()
 	go func() {
-		storage.RetrieveSingle(server, basenine.IndexToID(index), query)
+		storage.Fetch(server, basenine.IndexToID(0), "1", `response.body.search("timeout", true)`, "100", false)
 		server.Close()
 	}()
 
-	time.Sleep(100 * time.Millisecond)
-
 	bytes, err := ioutil.ReadAll(client)
 	assert.Nil(t, err)
-	assert.JSONEq(t, expected, string(bytes))
-
+	assert.Equal(t, 4, strings.Count(string(bytes), `"_score":1`))
 	client.Close()
 
-	storage.Reset()
+	// The postings of the removed partitions are dropped.
+	storage.discardOldPartitions(false)
+	assert.Equal(t, []uint64{10, 15}, lookup(`response.body.search("timeout")`))
+
+	storage.Flush()
+	assert.Empty(t, lookup(`response.body.search("timeout")`))
 }
 
-func TestNativeStorageFetch(t *testing.T) {
-	query := ""
-	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+func TestNativeStorageFullTextIndexMissingPath(t *testing.T) {
+	records := []string{
+		`{"response":{"body":"false"}}`,
+		`{"response":{"body":"Gateway Timeout"}}`,
+		`{"response":{"status":204}}`,
+		`{"request":{"path":"/cars"}}`,
+		`{"response":{"body":"false positive"}}`,
+	}
+
+	// fetch returns the IDs of the records that match the query, with or without the full-text index.
+	fetch := func(fullText []string, query string) []string {
+		dir, err := ioutil.TempDir("", "basenine")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dir, FullText: fullText}).(*nativeStorage)
+		defer storage.Reset()
+		for _, record := range records {
+			storage.InsertData([]byte(record))
+		}
+
+		server, client := net.Pipe()
+		go func() {
+			storage.Fetch(server, basenine.IndexToID(0), "1", query, "100", false)
+			server.Close()
+		}()
+
+		bytes, err := ioutil.ReadAll(client)
+		assert.Nil(t, err)
+		client.Close()
 
-	storage := NewNativeStorage(false).(*nativeStorage)
+		var ids []string
+		for _, line := range strings.Split(string(bytes), "\n") {
+			var d map[string]interface{}
+			if json.Unmarshal([]byte(line), &d) == nil && d["id"] != nil {
+				ids = append(ids, d["id"].(string))
+			}
+		}
+		return ids
+	}
+
+	for _, query := range []string{
+		`response.body.search("false")`,
+		`response.body.search("timeout")`,
+		`response.body.search("false") or request.path == "/cars"`,
+	} {
+		assert.Equal(t, fetch(nil, query), fetch([]string{"response.body"}, query), query)
+	}
+	assert.Equal(t, []string{basenine.IndexToID(0), basenine.IndexToID(4)}, fetch(nil, `response.body.search("false")`))
+}
+
+func TestNativeStorageChecksums(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basenine")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	options := NativeStorageOptions{DataDir: dir, Checksums: []string{"request.path"}, Compression: "snappy"}
+	storage := NewNativeStorageWithOptions(false, options).(*nativeStorage)
 
 	for index := 0; index < 100; index++ {
-		storage.InsertData([]byte(payload))
+		storage.InsertData([]byte(fmt.Sprintf(`{"model":"Camaro","request":{"path":"/cars/%d"}}`, index)))
+	}
+	err = storage.flushBlock()
+	assert.Nil(t, err)
+
+	// skipped counts the records that are rejected through their checksums.
+	skipped := func(storage *nativeStorage, query string) (n int) {
+		expr, _, err := storage.PrepareQuery(query, nil)
+		assert.Nil(t, err)
+		plan := basenine.BuildPlan(expr)
+
+		storage.RLock()
+		cursor := &offsetCursor{storage: storage, first: 0, length: storage.offsets.Len()}
+		storage.RUnlock()
+		for i := 0; i < cursor.Len(); i++ {
+			_, _, _, err := cursor.At(i)
+			assert.Nil(t, err)
+			checksum, ok := cursor.Checksum(i)
+			assert.True(t, ok)
+			if !storage.checksums.mayMatch(checksum, plan) {
+				n++
+			}
+		}
+		return
 	}
 
+	assert.Greater(t, skipped(storage, `request.path == "/cars/42"`), 90)
+	assert.Equal(t, 100, skipped(storage, `request.path == "/bikes/42"`))
+	assert.Equal(t, 0, skipped(storage, `model == "Tesla"`))
+	assert.Equal(t, 0, skipped(storage, `request.path != "/cars/42"`))
+
 	server, client := net.Pipe()
 	go func() {
-		storage.Fetch(server, basenine.IndexToID(42), "-1", query, "20")
+		storage.Fetch(server, basenine.IndexToID(0), "1", `request.path == "/cars/42" or request.path == "/cars/43"`, "100", false)
 		server.Close()
 	}()
 
-	time.Sleep(100 * time.Millisecond)
-
 	bytes, err := ioutil.ReadAll(client)
 	assert.Nil(t, err)
-	assert.Len(t, strings.Split(string(bytes), "\n"), 41)
+	assert.Contains(t, string(bytes), `"/cars/42"`)
+	assert.Contains(t, string(bytes), `"/cars/43"`)
+	client.Close()
+
+	// The checksums are restored from the core and computed again upon recovery.
+	err = storage.DumpCore(true, false)
+	assert.Nil(t, err)
+	assert.FileExists(t, filepath.Join(dir, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, 0, NATIVE_STORAGE_CHECKSUM_FILE_EXT)))
+
+	restored := NewNativeStorageWithOptions(true, options).(*nativeStorage)
+	assert.True(t, restored.checksums.ready)
+	assert.Equal(t, 100, skipped(restored, `request.path == "/bikes/42"`))
+
+	options.Recover = true
+	recovered := NewNativeStorageWithOptions(false, options).(*nativeStorage)
+	assert.True(t, recovered.checksums.ready)
+	assert.Equal(t, 100, skipped(recovered, `request.path == "/bikes/42"`))
+
+	recovered.Reset()
+	assert.NoFileExists(t, filepath.Join(dir, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, 0, NATIVE_STORAGE_CHECKSUM_FILE_EXT)))
+}
+
+func TestNativeStorageDictionary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "basenine")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	options := NativeStorageOptions{DataDir: dir, Dictionary: true}
+	storage := NewNativeStorageWithOptions(false, options).(*nativeStorage)
+
+	for index := 0; index < 10; index++ {
+		model := "Camaro"
+		if index == 7 {
+			model = "Tesla <Model S>"
+		}
+		storage.InsertData([]byte(fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"model":"%s","year":%d.5,"tags":["a",null,true]}`, model, 2010+index)))
+	}
+	assert.FileExists(t, filepath.Join(dir, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, 0, NATIVE_STORAGE_DICTIONARY_FILE_EXT)))
+
+	// Only the repeated strings are in the dictionary.
+	dict, err := storage.dictionaries.get(storage.partitionPath(0))
+	assert.Nil(t, err)
+	assert.Contains(t, dict.strings, "Camaro")
+	assert.Contains(t, dict.strings, "brand")
+	assert.NotContains(t, dict.strings, "Tesla <Model S>")
+
+	read := func(storage *nativeStorage, index uint64, query string) []byte {
+		var plan *basenine.Plan
+		if query != "" {
+			expr, _, err := storage.PrepareQuery(query, nil)
+			assert.Nil(t, err)
+			plan = basenine.BuildPlan(expr)
+		}
+		n, f, err := storage.getOffsetAndPartition(index)
+		assert.Nil(t, err)
+		defer f.Close()
+		b, _, err := storage.readMatchingRecord(f, n, plan)
+		assert.Nil(t, err)
+		return b
+	}
+
+	// The records are rehydrated exactly as they're marshaled on insertion.
+	assert.Equal(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","tags":["a",null,true],"year":2013.5}`, basenine.IndexToID(3)), string(read(storage, 3, "")))
+	assert.Equal(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Tesla \u003cModel S\u003e","tags":["a",null,true],"year":2017.5}`, basenine.IndexToID(7)), string(read(storage, 7, "")))
+
+	// The records that don't contain the string literals are not rehydrated.
+	assert.Nil(t, read(storage, 3, `model == "Tesla <Model S>"`))
+	assert.NotNil(t, read(storage, 7, `model == "Tesla <Model S>"`))
+	assert.NotNil(t, read(storage, 3, `model == "Tesla <Model S>" or brand.name == "Chevrolet"`))
+	assert.Nil(t, read(storage, 3, `year > 2000 and model == "Ford"`))
+	assert.NotNil(t, read(storage, 3, `year == "2013.5"`))
+
+	server, client := net.Pipe()
+	go func() {
+		storage.Fetch(server, basenine.IndexToID(0), "1", `model == "Tesla <Model S>"`, "100", false)
+		server.Close()
+	}()
 
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, strings.Count(string(bytes), `"model":"Tesla <Model S>"`))
 	client.Close()
 
-	storage.Reset()
+	// The dictionary is loaded from the disk upon recovery.
+	recovered := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dir, Dictionary: true, Recover: true}).(*nativeStorage)
+	recovered.RLock()
+	assert.Equal(t, uint64(10), recovered.offsets.Len())
+	recovered.RUnlock()
+	assert.Contains(t, string(read(recovered, 9, "")), `"year":2019.5`)
+
+	insertedId, err := recovered.InsertData([]byte(`{"model":"Camaro"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf(`{"id":"%s","model":"Camaro"}`, insertedId), string(read(recovered, 10, "")))
+
+	recovered.Reset()
+	assert.NoFileExists(t, filepath.Join(dir, fmt.Sprintf("%s_%09d.%s", NATIVE_STORAGE_DB_FILE, 0, NATIVE_STORAGE_DICTIONARY_FILE_EXT)))
+
+	assert.Panics(t, func() {
+		NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dir, Dictionary: true, Compression: "zstd"})
+	})
 }
 
 func TestNativeStorageSetLimit(t *testing.T) {
+	dataDir := t.TempDir()
 	limit := 1000000 // 1MB
 
-	storage := NewNativeStorage(false).(*nativeStorage)
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
 
 	server, client := net.Pipe()
 	go func() {
@@ -188,10 +1967,77 @@ func TestNativeStorageSetLimit(t *testing.T) {
 	storage.Unlock()
 }
 
+func TestNativeStorageSetRetention(t *testing.T) {
+	dataDir := t.TempDir()
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	server, client := net.Pipe()
+	go func() {
+		storage.SetRetention(server, []byte("24h"))
+		server.Close()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	bytes, err := ioutil.ReadAll(client)
+	assert.Nil(t, err)
+	assert.Equal(t, "OK\n", string(bytes))
+
+	client.Close()
+
+	storage.Lock()
+	assert.Equal(t, 24*time.Hour, storage.retention)
+	storage.Unlock()
+}
+
+func TestNativeStorageRetention(t *testing.T) {
+	dataDir := t.TempDir()
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
+
+	storage.Lock()
+	storage.retention = time.Hour
+	storage.Unlock()
+
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(fmt.Sprintf(`{"model":"Camaro","timestamp":%d}`, old+int64(index))))
+	}
+
+	// Rotates the current partition since its oldest record is older than the half of the window.
+	// Then drops it since its newest record is older than the window.
+	storage.enforceRetention(false)
+
+	storage.RLock()
+	assert.Equal(t, int64(1), storage.partitionIndex)
+	assert.Nil(t, storage.partitions[0])
+	assert.Equal(t, uint64(0), storage.offsets.Len())
+	assert.Equal(t, uint64(10), storage.removedOffsetsCounter)
+	assert.Equal(t, old+10, storage.truncatedTimestamp)
+	storage.RUnlock()
+	assert.NoFileExists(t, storage.partitionPath(0))
+
+	recent := time.Now().UnixMilli()
+	for index := 0; index < 10; index++ {
+		storage.InsertData([]byte(fmt.Sprintf(`{"model":"Camaro","timestamp":%d}`, recent+int64(index))))
+	}
+
+	// The records in the window are kept.
+	storage.enforceRetention(false)
+
+	storage.RLock()
+	assert.Equal(t, int64(1), storage.partitionIndex)
+	assert.NotNil(t, storage.partitions[1])
+	assert.Equal(t, uint64(10), storage.offsets.Len())
+	storage.RUnlock()
+
+	storage.Reset()
+}
+
 func TestNativeStorageSetInsertionFilter(t *testing.T) {
+	dataDir := t.TempDir()
 	insertionFilter := `brand.name == "Chevrolet" and redact("year")`
 
-	storage := NewNativeStorage(false).(*nativeStorage)
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
 
 	server, client := net.Pipe()
 	go func() {
@@ -222,8 +2068,9 @@ var validateQueryData = []struct {
 }
 
 func TestNativeStorageValidateQuery(t *testing.T) {
+	dataDir := t.TempDir()
 	for _, row := range validateQueryData {
-		storage := NewNativeStorage(false).(*nativeStorage)
+		storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
 
 		server, client := net.Pipe()
 		go func() {
@@ -242,10 +2089,11 @@ func TestNativeStorageValidateQuery(t *testing.T) {
 }
 
 func TestNativeStorageSetPartitionSizeLimit(t *testing.T) {
+	dataDir := t.TempDir()
 	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
 	limit := 1000000 // 1MB
 
-	storage := NewNativeStorage(false).(*nativeStorage)
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
 
 	storage.setPartitionSizeLimit(limit)
 
@@ -272,8 +2120,46 @@ func TestNativeStorageSetPartitionSizeLimit(t *testing.T) {
 	storage.Reset()
 }
 
+func TestNativeStorageLivePartitions(t *testing.T) {
+	dataDir := t.TempDir()
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+	limit := 1000000 // 1MB
+
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir, Partitions: 3}).(*nativeStorage)
+
+	storage.setPartitionSizeLimit(limit)
+
+	storage.RLock()
+	assert.Equal(t, int64(limit/3), storage.partitionSizeLimit)
+	storage.RUnlock()
+
+	for i := 0; i < 6; i++ {
+		for index := 0; index < 10; index++ {
+			storage.InsertData([]byte(payload))
+		}
+		storage.newPartition()
+	}
+
+	storage.discardOldPartitions(false)
+
+	storage.RLock()
+	assert.Equal(t, int64(6), storage.partitionIndex)
+	for i := 0; i <= 3; i++ {
+		assert.Nil(t, storage.partitions[i])
+	}
+	for i := 4; i <= 6; i++ {
+		assert.NotNil(t, storage.partitions[i])
+	}
+	assert.Equal(t, uint64(20), storage.offsets.Len())
+	assert.Equal(t, uint64(40), storage.removedOffsetsCounter)
+	storage.RUnlock()
+
+	storage.Reset()
+}
+
 func TestNativeStorageFlush(t *testing.T) {
-	storage := NewNativeStorage(false).(*nativeStorage)
+	dataDir := t.TempDir()
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
 
 	insertionFilter := "model"
 	macros := map[string]string{"foo": "bar"}
@@ -296,8 +2182,8 @@ func TestNativeStorageFlush(t *testing.T) {
 	storage.RLock()
 	assert.Equal(t, storage.version, basenine.VERSION)
 	assert.Empty(t, storage.lastOffset)
-	assert.Empty(t, storage.partitionRefs)
-	assert.Empty(t, storage.offsets)
+	assert.Empty(t, storage.offsets.segments)
+	assert.Equal(t, uint64(0), storage.offsets.Len())
 	assert.Len(t, storage.partitions, 1)
 	assert.Empty(t, storage.partitionIndex)
 	assert.Empty(t, storage.partitionSizeLimit)
@@ -310,7 +2196,8 @@ func TestNativeStorageFlush(t *testing.T) {
 }
 
 func TestNativeStorageReset(t *testing.T) {
-	storage := NewNativeStorage(false).(*nativeStorage)
+	dataDir := t.TempDir()
+	storage := NewNativeStorageWithOptions(false, NativeStorageOptions{DataDir: dataDir}).(*nativeStorage)
 
 	insertionFilter := "model"
 	macros := map[string]string{"foo": "bar"}
@@ -333,8 +2220,8 @@ func TestNativeStorageReset(t *testing.T) {
 	storage.RLock()
 	assert.Equal(t, storage.version, basenine.VERSION)
 	assert.Empty(t, storage.lastOffset)
-	assert.Empty(t, storage.partitionRefs)
-	assert.Empty(t, storage.offsets)
+	assert.Empty(t, storage.offsets.segments)
+	assert.Equal(t, uint64(0), storage.offsets.Len())
 	assert.Len(t, storage.partitions, 1)
 	assert.Empty(t, storage.partitionIndex)
 	assert.Empty(t, storage.partitionSizeLimit)
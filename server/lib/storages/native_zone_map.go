@@ -0,0 +1,283 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"log"
+	"math"
+
+	jp "github.com/ohler55/ojg/jp"
+	basenine "github.com/up9inc/basenine/server/lib"
+)
+
+// Path of the field that always has a zone map. The records are expected
+// to have their timestamps in milliseconds in this field.
+const NATIVE_STORAGE_TIMESTAMP_ZONE_PATH string = "timestamp"
+
+// zoneMap keeps the range of the values of a numeric field for each partition.
+// The partitions whose ranges cannot satisfy the `>`, `>=`, `<` and `<=` comparisons
+// of the field are skipped by the queries without reading their records.
+//
+// path is the path of the field as it's written in the queries, like `timestamp`.
+//
+// jsonPath is the compiled version of path.
+//
+// ready is false until the zones of the records that are not inserted through
+// this process, like the ones that are recovered, are computed.
+//
+// zones maps the indexes of the partitions to the ranges of the values. A partition that
+// has no zone is never skipped.
+type zoneMap struct {
+	path     string
+	jsonPath jp.Expr
+	ready    bool
+	zones    map[int64]*zone
+}
+
+// zone is the range of the values of a field in a partition. A partition whose
+// records don't have the field has an empty range, in which Min is greater than Max.
+type zone struct {
+	Min float64
+	Max float64
+}
+
+// Unmutexed version of zoneMap for achieving core dump.
+type nativeStorageZoneMapExport struct {
+	Path  string
+	Zones map[int64]*zone
+}
+
+// newZoneMaps creates the zone maps of the `timestamp` field and the given paths.
+func newZoneMaps(paths []string) (zoneMaps []*zoneMap, err error) {
+	for _, text := range append([]string{NATIVE_STORAGE_TIMESTAMP_ZONE_PATH}, paths...) {
+		var path string
+		var jsonPath jp.Expr
+		path, jsonPath, err = basenine.ParseIndexPath(text)
+		if err != nil {
+			return
+		}
+
+		var exists bool
+		for _, zoneMap := range zoneMaps {
+			if zoneMap.path == path {
+				exists = true
+			}
+		}
+		if exists {
+			continue
+		}
+
+		zoneMaps = append(zoneMaps, &zoneMap{
+			path:     path,
+			jsonPath: jsonPath,
+			ready:    true,
+			zones:    make(map[int64]*zone),
+		})
+	}
+	return
+}
+
+// newZone returns an empty range.
+func newZone() *zone {
+	return &zone{
+		Min: math.Inf(1),
+		Max: math.Inf(-1),
+	}
+}
+
+// add extends the zone of the partition with the values of the field in the given record.
+func (zoneMap *zoneMap) add(zones map[int64]*zone, partition int64, obj interface{}) {
+	z, ok := zones[partition]
+	if !ok {
+		z = newZone()
+		zones[partition] = z
+	}
+
+	values, _ := basenine.ZoneValues(obj, zoneMap.jsonPath)
+	for _, value := range values {
+		// NaN never satisfies a comparison.
+		if math.IsNaN(value) {
+			continue
+		}
+		if value < z.Min {
+			z.Min = value
+		}
+		if value > z.Max {
+			z.Max = value
+		}
+	}
+}
+
+// merge extends the zone with the given range.
+func (z *zone) merge(other *zone) {
+	if other.Min < z.Min {
+		z.Min = other.Min
+	}
+	if other.Max > z.Max {
+		z.Max = other.Max
+	}
+}
+
+// zoneRecord adds the decoded record to the zone maps of the partition.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) zoneRecord(partition int64, d map[string]interface{}) {
+	for _, zoneMap := range storage.zoneMaps {
+		zoneMap.add(zoneMap.zones, partition, d)
+	}
+}
+
+// buildZoneMap computes the zones of the records up to the index end.
+// The zone map becomes ready to be used by the queries afterwards.
+func (storage *nativeStorage) buildZoneMap(zoneMap *zoneMap, end uint64) {
+	zones := make(map[int64]*zone)
+	storage.scanRecords(end, func(id uint64, partition int64, obj interface{}) {
+		zoneMap.add(zones, partition, obj)
+	})
+
+	// The records that are inserted in the meantime are already in the zones.
+	storage.Lock()
+	for partition, z := range zones {
+		if _, ok := zoneMap.zones[partition]; !ok {
+			zoneMap.zones[partition] = newZone()
+		}
+		zoneMap.zones[partition].merge(z)
+	}
+	zoneMap.ready = true
+	storage.Unlock()
+
+	log.Printf("Computed the zone map of the path: %s\n", zoneMap.path)
+}
+
+// invalidateZoneMaps discards the zones such that they're computed again.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) invalidateZoneMaps() {
+	for _, zoneMap := range storage.zoneMaps {
+		zoneMap.zones = make(map[int64]*zone)
+		zoneMap.ready = false
+	}
+}
+
+// dropZones removes the zones of the partitions up to and including the given partition.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) dropZones(partition int64) {
+	for _, zoneMap := range storage.zoneMaps {
+		for index := range zoneMap.zones {
+			if index <= partition {
+				delete(zoneMap.zones, index)
+			}
+		}
+	}
+}
+
+// getZoneMap returns the zone map of the given path or nil if there is none.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) getZoneMap(path string) *zoneMap {
+	for _, zoneMap := range storage.zoneMaps {
+		if zoneMap.path == path {
+			return zoneMap
+		}
+	}
+	return nil
+}
+
+// prunePartitions returns the partitions that cannot contain a record that satisfies the plan
+// according to the zone maps and the Bloom filters. nil means none of the partitions can be skipped.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) prunePartitions(plan *basenine.Plan) (pruned map[int64]bool) {
+	if plan == nil {
+		return
+	}
+
+	if plan.Predicate != nil && plan.Predicate.Op == "==" {
+		return storage.pruneBloomIndex(plan.Predicate)
+	}
+
+	if plan.Predicate != nil {
+		zoneMap := storage.getZoneMap(plan.Predicate.Path)
+		if zoneMap == nil || !zoneMap.ready {
+			return
+		}
+		for partition, z := range zoneMap.zones {
+			if !plan.Predicate.MayMatch(z.Min, z.Max) {
+				if pruned == nil {
+					pruned = make(map[int64]bool)
+				}
+				pruned[partition] = true
+			}
+		}
+		return
+	}
+
+	left := storage.prunePartitions(plan.Left)
+	right := storage.prunePartitions(plan.Right)
+	switch plan.Op {
+	case "and":
+		// A partition is skipped if either side cannot be satisfied.
+		if left == nil {
+			return right
+		}
+		for partition := range right {
+			left[partition] = true
+		}
+		return left
+	case "or":
+		// A partition is skipped only if both sides cannot be satisfied.
+		for partition := range left {
+			if right[partition] {
+				if pruned == nil {
+					pruned = make(map[int64]bool)
+				}
+				pruned[partition] = true
+			}
+		}
+	}
+	return
+}
+
+// exportZoneMaps returns the zone maps to be dumped into the core.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) exportZoneMaps() (zoneMaps []nativeStorageZoneMapExport) {
+	for _, zoneMap := range storage.zoneMaps {
+		if !zoneMap.ready {
+			continue
+		}
+		// The zones are copied since the core is encoded after the storage is unlocked.
+		zones := make(map[int64]*zone, len(zoneMap.zones))
+		for partition, z := range zoneMap.zones {
+			zones[partition] = &zone{Min: z.Min, Max: z.Max}
+		}
+		zoneMaps = append(zoneMaps, nativeStorageZoneMapExport{
+			Path:  zoneMap.path,
+			Zones: zones,
+		})
+	}
+	return
+}
+
+// importZoneMaps restores the zones that are dumped into the core. The zone maps
+// that are not in the core are computed on initialization.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) importZoneMaps(zoneMaps []nativeStorageZoneMapExport) {
+	storage.invalidateZoneMaps()
+	for _, export := range zoneMaps {
+		zoneMap := storage.getZoneMap(export.Path)
+		if zoneMap == nil {
+			continue
+		}
+		for partition, z := range export.Zones {
+			zoneMap.zones[partition] = z
+		}
+		zoneMap.ready = true
+	}
+}
+
+// resetZoneMaps empties the zone maps of a database that has no records.
+// It must be called while the storage is locked.
+func (storage *nativeStorage) resetZoneMaps() {
+	for _, zoneMap := range storage.zoneMaps {
+		zoneMap.zones = make(map[int64]*zone)
+		zoneMap.ready = true
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright 2022 UP9. All rights reserved.
+// Use of this source code is governed by Apache License 2.0
+// license that can be found in the LICENSE file.
+
+package storages
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The format of the snapshot archives that are written by this version.
+const SNAPSHOT_FORMAT uint32 = 1
+
+// The name of the manifest in a snapshot archive. It's always the first entry of the archive.
+const snapshotManifestName string = "manifest.json"
+
+// Error that's returned if a snapshot archive is corrupted or doesn't match its manifest.
+var ErrInvalidSnapshot = errors.New("Invalid snapshot")
+
+// snapshotRestorers validate the files of a snapshot that are extracted into a staging directory
+// and prepare them to be moved into the data directory, by the name of the storage driver.
+var snapshotRestorers = map[string]func(staging string, dataDir string, manifest snapshotManifest) error{
+	NATIVE_STORAGE_DRIVER: restoreNativeSnapshot,
+	BOLT_STORAGE_DRIVER:   restoreBoltSnapshot,
+}
+
+// snapshotManifest describes the content of a snapshot archive.
+//
+// Format is the format of the snapshot archive.
+//
+// Version is the version of the server that's taken the snapshot.
+//
+// Driver is the name of the storage driver that's taken the snapshot.
+//
+// CreatedAt is the time that the snapshot is taken at in Unix milliseconds.
+//
+// FirstID and Records are the index of the oldest record and the number of records in the snapshot.
+//
+// Files are the database files in the archive in the order of the entries.
+type snapshotManifest struct {
+	Format    uint32         `json:"format"`
+	Version   string         `json:"version"`
+	Driver    string         `json:"driver"`
+	CreatedAt int64          `json:"createdAt"`
+	FirstID   string         `json:"firstId"`
+	Records   uint64         `json:"records"`
+	Files     []snapshotFile `json:"files"`
+}
+
+// snapshotFile is a database file in a snapshot archive.
+//
+// Name is the name of the file in the archive and in the data directory.
+//
+// Size is the size of the file at the time of the snapshot in bytes.
+//
+// content writes exactly Size bytes of the file into the archive.
+type snapshotFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+
+	content func(w io.Writer) error
+}
+
+// snapshotBytes returns the content of a snapshotFile that's kept in memory.
+func snapshotBytes(b []byte) func(w io.Writer) error {
+	return func(w io.Writer) (err error) {
+		_, err = w.Write(b)
+		return
+	}
+}
+
+// snapshotSection returns the content of a snapshotFile that's the first size bytes of f.
+// The bytes that are appended into f after the snapshot is taken are not included.
+func snapshotSection(f *os.File, size int64) func(w io.Writer) error {
+	return func(w io.Writer) (err error) {
+		_, err = io.Copy(w, io.NewSectionReader(f, 0, size))
+		return
+	}
+}
+
+// writeSnapshot writes the manifest and the files of the manifest into a tar archive at the given path.
+// The archive is written into a temporary file that's renamed at the end, such that a snapshot
+// that's interrupted doesn't leave a partial archive behind.
+func writeSnapshot(path string, manifest snapshotManifest, sync bool) (err error) {
+	tmp := path + ".tmp"
+	var f *os.File
+	f, err = os.Create(tmp)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	modTime := time.UnixMilli(manifest.CreatedAt)
+	tw := tar.NewWriter(f)
+
+	var b []byte
+	b, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeSnapshotEntry(tw, snapshotFile{
+		Name:    snapshotManifestName,
+		Size:    int64(len(b)),
+		content: snapshotBytes(b),
+	}, modTime)
+	if err != nil {
+		return
+	}
+
+	for _, file := range manifest.Files {
+		err = writeSnapshotEntry(tw, file, modTime)
+		if err != nil {
+			return
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return
+	}
+
+	if sync {
+		err = f.Sync()
+		if err != nil {
+			return
+		}
+	}
+
+	err = f.Close()
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// writeSnapshotEntry writes the file as a regular file into the tar archive.
+func writeSnapshotEntry(tw *tar.Writer, file snapshotFile, modTime time.Time) (err error) {
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     file.Name,
+		Size:     file.Size,
+		Mode:     0644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return
+	}
+
+	// The tar writer refuses to write more than the size of the entry,
+	// while writing less than that fails on the next entry.
+	err = file.content(tw)
+	if err != nil {
+		err = fmt.Errorf("While writing %s into the snapshot: %w", file.Name, err)
+	}
+	return
+}
+
+// RestoreSnapshot restores a snapshot archive that's taken by the /snapshot command into the data directory
+// of the given storage driver, which then starts with the records, the macros, the insertion filter and
+// the limit of the snapshot. The records keep their IDs. The archive is validated and extracted into
+// a staging directory first, such that an invalid archive doesn't leave a partial database behind.
+// It refuses to overwrite a database that's already in the data directory.
+func RestoreSnapshot(archive string, driver string, dataDir string) (err error) {
+	if dataDir == "" {
+		dataDir = "."
+	}
+
+	var f *os.File
+	f, err = os.Open(archive)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	manifest, err := readSnapshotManifest(tr)
+	if err != nil {
+		return
+	}
+
+	if manifest.Driver != driver {
+		err = fmt.Errorf("The snapshot is taken by the %s storage driver, it cannot be restored into the %s storage driver", manifest.Driver, driver)
+		return
+	}
+	restore, ok := snapshotRestorers[driver]
+	if !ok {
+		err = fmt.Errorf("The %s storage driver doesn't support snapshots", driver)
+		return
+	}
+
+	// Lock the data directory such that a server cannot start on it while it's being restored.
+	err = os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return
+	}
+	err = lockDataDirectory(dataDir)
+	if err != nil {
+		return
+	}
+
+	err = checkSnapshotDataDirectory(dataDir)
+	if err != nil {
+		return
+	}
+
+	var staging string
+	staging, err = ioutil.TempDir(dataDir, ".restore-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(staging)
+
+	err = extractSnapshot(tr, manifest, staging)
+	if err != nil {
+		return
+	}
+
+	err = restore(staging, dataDir, manifest)
+	if err != nil {
+		return
+	}
+
+	// The files are moved in the reverse order, such that the first file, which is the core
+	// of the native storage, only appears once the files that it refers to are in place.
+	for i := len(manifest.Files) - 1; i >= 0; i-- {
+		name := manifest.Files[i].Name
+		err = os.Rename(filepath.Join(staging, name), filepath.Join(dataDir, name))
+		if err != nil {
+			return
+		}
+	}
+
+	err = syncDirectory(dataDir)
+	if err != nil {
+		return
+	}
+
+	log.Printf("Restored a snapshot of %d records starting from %s (version: %s, driver: %s) into: %s\n", manifest.Records, manifest.FirstID, manifest.Version, manifest.Driver, dataDir)
+	return
+}
+
+// readSnapshotManifest reads the manifest, which is the first entry of a snapshot archive.
+// It refuses the formats that are newer than SNAPSHOT_FORMAT.
+func readSnapshotManifest(tr *tar.Reader) (manifest snapshotManifest, err error) {
+	var header *tar.Header
+	header, err = tr.Next()
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		return
+	}
+	if header.Name != snapshotManifestName {
+		err = fmt.Errorf("%w: the archive starts with %s instead of the %s", ErrInvalidSnapshot, header.Name, snapshotManifestName)
+		return
+	}
+
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		err = fmt.Errorf("%w: corrupted manifest: %v", ErrInvalidSnapshot, err)
+		return
+	}
+
+	if manifest.Format > SNAPSHOT_FORMAT {
+		err = fmt.Errorf("Unsupported snapshot format %d that's written by version %s, this version supports up to the format %d", manifest.Format, manifest.Version, SNAPSHOT_FORMAT)
+	}
+	return
+}
+
+// checkSnapshotDataDirectory refuses a data directory that contains the database of any storage driver.
+func checkSnapshotDataDirectory(dataDir string) (err error) {
+	patterns := []string{
+		nativeStorageCoreDumpFilename,
+		fmt.Sprintf("%s_*.%s", NATIVE_STORAGE_DB_FILE, NATIVE_STORAGE_DB_FILE_EXT),
+		BOLT_STORAGE_DB_FILE,
+	}
+	for _, pattern := range patterns {
+		var matches []string
+		matches, err = filepath.Glob(filepath.Join(dataDir, pattern))
+		if err != nil {
+			return
+		}
+		if len(matches) > 0 {
+			err = fmt.Errorf("The data directory %s already contains a database (%s), restore the snapshot into an empty data directory", dataDir, filepath.Base(matches[0]))
+			return
+		}
+	}
+	return
+}
+
+// extractSnapshot extracts the files of the manifest from the rest of the archive into the given directory.
+// The entries must be exactly the files of the manifest in the same order and of the same sizes.
+func extractSnapshot(tr *tar.Reader, manifest snapshotManifest, dir string) (err error) {
+	names := make(map[string]bool)
+	for _, file := range manifest.Files {
+		// The names are relative to the data directory, which must not be escaped.
+		if file.Name != filepath.Base(file.Name) || file.Name == "." || file.Name == ".." || file.Name == snapshotManifestName || names[file.Name] {
+			err = fmt.Errorf("%w: invalid file name in the manifest: %q", ErrInvalidSnapshot, file.Name)
+			return
+		}
+		names[file.Name] = true
+
+		var header *tar.Header
+		header, err = tr.Next()
+		if err == io.EOF {
+			err = fmt.Errorf("%w: %s is missing", ErrInvalidSnapshot, file.Name)
+			return
+		}
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+			return
+		}
+		if header.Name != file.Name || header.Size != file.Size {
+			err = fmt.Errorf("%w: expected %s of %d bytes, found %s of %d bytes", ErrInvalidSnapshot, file.Name, file.Size, header.Name, header.Size)
+			return
+		}
+
+		err = extractSnapshotEntry(tr, filepath.Join(dir, file.Name))
+		if err != nil {
+			err = fmt.Errorf("%w: while extracting %s: %v", ErrInvalidSnapshot, file.Name, err)
+			return
+		}
+	}
+
+	var header *tar.Header
+	header, err = tr.Next()
+	if err == io.EOF {
+		err = nil
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("%w: %s is not in the manifest", ErrInvalidSnapshot, header.Name)
+	}
+	return
+}
+
+// extractSnapshotEntry writes the current entry of the archive into a file at the given path and fsyncs it.
+func extractSnapshotEntry(tr *tar.Reader, path string) (err error) {
+	var f *os.File
+	f, err = os.Create(path)
+	if err != nil {
+		return
+	}
+
+	// The tar reader fails if the archive ends before the size of the entry.
+	_, err = io.Copy(f, tr)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	return f.Close()
+}
@@ -18,6 +18,13 @@ type ConnectionMode int
 //
 // INSERT is a long lasting TCP connection mode for inserting data into database.
 //
+// INSERT_ACK is same as INSERT but the server replies each record with an Acknowledgement.
+//
+// INSERT_BATCH is a long lasting TCP connection mode for inserting records in batches.
+// Each batch starts with a line that contains the number of records in the batch
+// and the records follow it line by line. The server replies each record of the batch
+// with an Acknowledgement once the batch is inserted.
+//
 // INSERTION_FILTER is a short lasting TCP connection mode for setting the insertion filter.
 //
 // QUERY is a long lasting TCP connection mode for retrieving data from the database
@@ -36,6 +43,21 @@ type ConnectionMode int
 // LIMIT is a short lasting TCP connection mode for setting the maximum database size
 // to limit the disk usage.
 //
+// RETENTION is a short lasting TCP connection mode for setting the duration that
+// the records are kept in the database.
+//
+// INDEX is a short lasting TCP connection mode for declaring a secondary index on a field
+// to speed up the queries that compare that field against a literal.
+//
+// SNAPSHOT is a short lasting TCP connection mode for writing a consistent snapshot
+// of the database into a tar archive at a given path on the server. The path follows
+// the command on the same line, separated by a space.
+//
+// EXPORT is a short lasting TCP connection mode for writing the records that pass a query
+// in an ID range into an NDJSON file at a given path on the server. The path follows the command
+// on the same line, preceded by the FLAG_GZIP flag for a gzip-compressed file. The start ID,
+// the end ID and the query follow the command line by line.
+//
 // FLUSH is a short lasting TCP connection mode that removes all the records in the database.
 //
 // RESET is a short lasting TCP connection mode that removes all the records in the database
@@ -52,6 +74,12 @@ const (
 	LIMIT
 	FLUSH
 	RESET
+	RETENTION
+	INSERT_ACK
+	INSERT_BATCH
+	INDEX
+	SNAPSHOT
+	EXPORT
 )
 
 type Commands int
@@ -69,6 +97,26 @@ const (
 	CMD_METADATA         string = "/metadata"
 	CMD_FLUSH            string = "/flush"
 	CMD_RESET            string = "/reset"
+	CMD_RETENTION        string = "/retention"
+	CMD_INSERT_ACK       string = "/insert-ack"
+	CMD_INSERT_BATCH     string = "/insert-batch"
+	CMD_INDEX            string = "/index"
+	CMD_SNAPSHOT         string = "/snapshot"
+	CMD_EXPORT           string = "/export"
+)
+
+// The maximum number of records in a batch of INSERT_BATCH mode. The batch header comes from
+// the client, so the larger batches are refused instead of being buffered in the memory.
+const MAX_BATCH_SIZE int = 100000
+
+// Flags that can follow a command, separated by a space.
+//
+// FLAG_ARCHIVED makes the SINGLE and FETCH commands look up the archived records too.
+//
+// FLAG_GZIP makes the EXPORT command compress the file with gzip.
+const (
+	FLAG_ARCHIVED string = "archived"
+	FLAG_GZIP     string = "gzip"
 )
 
 // Metadata info that's streamed after each record
@@ -81,6 +129,16 @@ type Metadata struct {
 	NoMoreData         bool   `json:"noMoreData"`
 }
 
+// Acknowledgement is the reply of an inserted record in INSERT_ACK and INSERT_BATCH modes.
+// Only one of the fields is set. Id is the assigned ID of the record,
+// Filtered means the record is filtered out by the insertion filter and
+// Error is the reason of a failed insertion.
+type Acknowledgement struct {
+	Id       string `json:"id,omitempty"`
+	Filtered bool   `json:"filtered,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
 // Closing indicators
 const (
 	CloseConnection = "%quit%"
@@ -92,15 +150,20 @@ type Storage interface {
 	DumpCore(silent bool, dontLock bool) (err error)
 	RestoreCore() (err error)
 	InsertData(data []byte) (insertedId interface{}, err error)
+	InsertBatch(batch [][]byte) (insertedIds []interface{}, err error)
 	ValidateQuery(conn net.Conn, query string) (err error)
 	GetMacros() (macros map[string]string, err error)
 	PrepareQuery(query string, macros map[string]string) (expr *Expression, prop Propagate, err error)
 	StreamRecords(conn net.Conn, leftOff string, query string) (err error)
-	RetrieveSingle(conn net.Conn, index string, query string) (err error)
-	Fetch(conn net.Conn, leftOff string, direction string, query string, limit string) (err error)
+	RetrieveSingle(conn net.Conn, index string, query string, archived bool) (err error)
+	Fetch(conn net.Conn, leftOff string, direction string, query string, limit string, archived bool) (err error)
 	ApplyMacro(conn net.Conn, data []byte) (err error)
 	SetLimit(conn net.Conn, data []byte) (err error)
+	SetRetention(conn net.Conn, data []byte) (err error)
+	CreateIndex(conn net.Conn, data []byte) (err error)
 	SetInsertionFilter(conn net.Conn, data []byte) (err error)
+	Snapshot(conn net.Conn, data []byte) (err error)
+	Export(conn net.Conn, path string, compress bool, from string, to string, query string) (err error)
 	Flush() (err error)
 	Reset() (err error)
 	HandleExit(sig syscall.Signal, persistent bool) (err error)
@@ -16,6 +16,7 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -35,8 +36,14 @@ var port = flag.Int("port", 9099, "The port to listen on.")
 var debug = flag.Bool("debug", false, "Enable debug logs.")
 var version = flag.Bool("version", false, "Print version and exit.")
 var persistent = flag.Bool("persistent", false, "Enable persistent mode. Dumps core on exit.")
-var storageDriver = flag.String("storage", "native", "The storage driver for saving the records; default is \"native\" (.db files in pwd).")
-var storageArgs = flag.String("storage-args", "", "Arguments for the storage driver.")
+var storageDriver = flag.String("storage", "native", "The storage driver for saving the records: native (.db files in the data directory), memory (a ring buffer that is lost on exit) or bolt (a transactional key-value file in the data directory); default is \"native\". \"list\" prints the storage drivers along with their arguments.")
+var storageArgs = flag.String("storage-args", "", "Arguments for the storage driver. Comma separated key=value pairs like \"compression=zstd,block-size=65536\". See -storage list for the arguments of each driver.")
+var dataDir = flag.String("data-dir", "", "The directory for the database partitions and the core dumps; default is the current working directory.")
+var retention = flag.Duration("retention", 0, "The duration that the records are kept in the database like \"24h\"; default is 0 (no time-based retention).")
+var syncMode = flag.String("sync", "", "When to fsync the database partitions and the core dumps: none, interval (every second) or always (after every write); default is none.")
+var recoverDatabase = flag.Bool("recover", false, "Rebuild the offset index by scanning the database partitions on startup.")
+var restoreFrom = flag.String("restore-from", "", "Restore the database from a snapshot archive that's taken by the /snapshot command into an empty data directory, then start serving it. Implies -persistent. \"basenine restore [flags] <archive>\" restores it without serving.")
+var exportDir = flag.String("export-dir", "", "The directory that the /export and the /snapshot commands write the files into. The paths are relative to it and cannot point outside of it; default is the current working directory.")
 
 var storage basenine.Storage
 
@@ -44,8 +51,19 @@ var storage basenine.Storage
 var connections []net.Conn
 
 func main() {
-	// Parse the command-line arguments.
-	flag.Parse()
+	// Parse the command-line arguments. The restore subcommand takes the same flags
+	// followed by the path of the snapshot archive.
+	restore := len(os.Args) > 1 && os.Args[1] == "restore"
+	if restore {
+		flag.CommandLine.Parse(os.Args[2:])
+		if flag.NArg() != 1 {
+			fmt.Fprintf(os.Stderr, "Usage: %s restore [flags] <archive>\n", os.Args[0])
+			os.Exit(2)
+		}
+		*restoreFrom = flag.Arg(0)
+	} else {
+		flag.Parse()
+	}
 
 	// Print version and exit.
 	if *version {
@@ -54,15 +72,52 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Print the available storage drivers along with their arguments and exit.
+	if *storageDriver == "list" {
+		basenine.PrintStorageDrivers(os.Stdout)
+		os.Exit(0)
+	}
+
 	log.Printf("Basenine Community (Version: %s)\n", basenine.VERSION)
 
-	switch *storageDriver {
-	case "native":
-		storage = storages.NewNativeStorage(*persistent)
-		log.Printf("Using native storage driver.\n")
-	default:
+	args, err := basenine.ParseStorageArgs(*storageDriver, *storageArgs)
+	if errors.Is(err, basenine.ErrUnknownStorageDriver) {
 		log.Panicf("Unknown storage driver: %s", *storageDriver)
 	}
+	if err != nil {
+		log.Panicf("Invalid storage arguments: %v", err)
+	}
+
+	// The dedicated flags override the storage arguments.
+	overrideStorageArg(args, "data-dir", *dataDir)
+	if *retention != 0 {
+		overrideStorageArg(args, "retention", retention.String())
+	}
+	overrideStorageArg(args, "sync", *syncMode)
+	if *recoverDatabase {
+		overrideStorageArg(args, "recover", "true")
+	}
+
+	// Restore the snapshot into the data directory, which is then loaded like a core dump.
+	if *restoreFrom != "" {
+		if !args.Supports("data-dir") {
+			log.Panicf("The %s storage driver doesn't support snapshots.", *storageDriver)
+		}
+		err = storages.RestoreSnapshot(*restoreFrom, *storageDriver, args.String("data-dir"))
+		if err != nil {
+			log.Panicf("Error while restoring the snapshot: %v", err)
+		}
+		if restore {
+			os.Exit(0)
+		}
+		*persistent = true
+	}
+
+	storage, err = basenine.NewStorage(*storageDriver, *persistent, args)
+	if err != nil {
+		log.Panicf("Invalid storage arguments: %v", err)
+	}
+	log.Printf("Using %s storage driver.\n", *storageDriver)
 
 	// Start listenning to given address and port.
 	src := *addr + ":" + strconv.Itoa(*port)
@@ -96,6 +151,24 @@ func main() {
 	}
 }
 
+// overrideStorageArg sets the storage argument with the given key to the value of its dedicated flag.
+// Empty value means the flag is not given. The flags that the storage driver doesn't support are ignored.
+func overrideStorageArg(args basenine.StorageArgs, key string, value string) {
+	if value == "" {
+		return
+	}
+
+	if !args.Supports(key) {
+		log.Printf("Ignoring -%s since the %s storage driver doesn't support it.\n", key, *storageDriver)
+		return
+	}
+
+	err := args.Set(key, value)
+	if err != nil {
+		log.Panicf("Invalid storage arguments: %v", err)
+	}
+}
+
 // handleConnection handles a TCP connection
 func handleConnection(conn net.Conn) {
 	// Append connection into a global slice
@@ -126,6 +199,19 @@ func handleConnection(conn net.Conn) {
 	// Arguments for the FETCH command (leftOff, direction, query, limit)
 	var fetchArgs []string
 
+	// Whether the SINGLE and FETCH commands look up the archived records or not
+	var archived bool
+
+	// Path and compression of the EXPORT command and its arguments (from, to, query)
+	var exportPath string
+	var exportGzip bool
+	var exportArgs []string
+
+	// Records of the current batch and the number of records that's declared
+	// by the batch header in INSERT_BATCH mode. 0 means awaiting the batch header.
+	var batch [][]byte
+	var batchSize int
+
 	var err error
 	for {
 		// Scan the input
@@ -147,6 +233,8 @@ func handleConnection(conn net.Conn) {
 		case basenine.NONE:
 			mode = _mode
 			switch mode {
+			case basenine.SINGLE, basenine.FETCH:
+				archived = string(data) == basenine.FLAG_ARCHIVED
 			case basenine.FLUSH:
 				err = storage.Flush()
 				basenine.SendErr(conn, err)
@@ -159,9 +247,60 @@ func handleConnection(conn net.Conn) {
 				if err == nil {
 					basenine.SendOK(conn)
 				}
+			case basenine.SNAPSHOT:
+				var path string
+				path, err = storages.ResolveExportPath(*exportDir, string(data))
+				if err == nil {
+					err = storage.Snapshot(conn, []byte(path))
+				}
+				basenine.SendErr(conn, err)
+			case basenine.EXPORT:
+				exportPath = string(data)
+				exportGzip = strings.HasPrefix(exportPath, basenine.FLAG_GZIP+" ")
+				if exportGzip {
+					exportPath = strings.TrimSpace(strings.TrimPrefix(exportPath, basenine.FLAG_GZIP))
+				}
 			}
 		case basenine.INSERT:
 			_, err = storage.InsertData(data)
+		case basenine.INSERT_BATCH:
+			if batchSize == 0 {
+				batchSize, err = strconv.Atoi(string(data))
+				if err == nil && (batchSize <= 0 || batchSize > basenine.MAX_BATCH_SIZE) {
+					err = fmt.Errorf("Invalid batch size: %d (must be between 1 and %d)", batchSize, basenine.MAX_BATCH_SIZE)
+				}
+				if err != nil {
+					basenine.SendErr(conn, err)
+					break
+				}
+			} else {
+				batch = append(batch, data)
+				if len(batch) == batchSize {
+					// Each record of the batch is acknowledged in order. The records that are not inserted
+					// are acknowledged with the error instead of closing the connection.
+					insertedIds, insertErr := storage.InsertBatch(batch)
+					for i := range batch {
+						var insertedId interface{}
+						if i < len(insertedIds) {
+							insertedId = insertedIds[i]
+						}
+						var recordErr error
+						if insertedId == nil {
+							recordErr = insertErr
+						}
+						err = basenine.SendAck(conn, insertedId, recordErr)
+						if err != nil {
+							break
+						}
+					}
+					batch = nil
+					batchSize = 0
+				}
+			}
+		case basenine.INSERT_ACK:
+			// Errors of the individual records are acknowledged instead of closing the connection.
+			insertedId, insertErr := storage.InsertData(data)
+			err = basenine.SendAck(conn, insertedId, insertErr)
 		case basenine.INSERTION_FILTER:
 			err = storage.SetInsertionFilter(conn, data)
 			basenine.SendErr(conn, err)
@@ -177,14 +316,26 @@ func handleConnection(conn net.Conn) {
 				singleArgs = append(singleArgs, string(data))
 			}
 			if len(singleArgs) == 2 {
-				err = storage.RetrieveSingle(conn, singleArgs[0], singleArgs[1])
+				err = storage.RetrieveSingle(conn, singleArgs[0], singleArgs[1], archived)
 			}
 		case basenine.FETCH:
 			if len(fetchArgs) < 4 {
 				fetchArgs = append(fetchArgs, string(data))
 			}
 			if len(fetchArgs) == 4 {
-				err = storage.Fetch(conn, fetchArgs[0], fetchArgs[1], fetchArgs[2], fetchArgs[3])
+				err = storage.Fetch(conn, fetchArgs[0], fetchArgs[1], fetchArgs[2], fetchArgs[3], archived)
+			}
+		case basenine.EXPORT:
+			if len(exportArgs) < 3 {
+				exportArgs = append(exportArgs, string(data))
+			}
+			if len(exportArgs) == 3 {
+				var path string
+				path, err = storages.ResolveExportPath(*exportDir, exportPath)
+				if err == nil {
+					err = storage.Export(conn, path, exportGzip, exportArgs[0], exportArgs[1], exportArgs[2])
+				}
+				basenine.SendErr(conn, err)
 			}
 		case basenine.VALIDATE:
 			err = storage.ValidateQuery(conn, string(data))
@@ -194,6 +345,12 @@ func handleConnection(conn net.Conn) {
 		case basenine.LIMIT:
 			err = storage.SetLimit(conn, data)
 			basenine.SendErr(conn, err)
+		case basenine.RETENTION:
+			err = storage.SetRetention(conn, data)
+			basenine.SendErr(conn, err)
+		case basenine.INDEX:
+			err = storage.CreateIndex(conn, data)
+			basenine.SendErr(conn, err)
 		case basenine.FLUSH:
 			err = storage.Flush()
 			basenine.SendErr(conn, err)
@@ -242,17 +399,27 @@ func handleMessage(message string, conn net.Conn) (mode basenine.ConnectionMode,
 			mode = basenine.INSERT
 			return
 
+		case message == basenine.CMD_INSERT_ACK:
+			mode = basenine.INSERT_ACK
+			return
+
+		case message == basenine.CMD_INSERT_BATCH:
+			mode = basenine.INSERT_BATCH
+			return
+
 		case strings.HasPrefix(message, basenine.CMD_INSERTION_FILTER):
 			mode = basenine.INSERTION_FILTER
 
 		case strings.HasPrefix(message, basenine.CMD_QUERY):
 			mode = basenine.QUERY
 
-		case message == basenine.CMD_SINGLE:
+		case message == basenine.CMD_SINGLE, message == basenine.CMD_SINGLE+" "+basenine.FLAG_ARCHIVED:
 			mode = basenine.SINGLE
+			data = commandFlag(message, basenine.CMD_SINGLE)
 
-		case message == basenine.CMD_FETCH:
+		case message == basenine.CMD_FETCH, message == basenine.CMD_FETCH+" "+basenine.FLAG_ARCHIVED:
 			mode = basenine.FETCH
+			data = commandFlag(message, basenine.CMD_FETCH)
 
 		case strings.HasPrefix(message, basenine.CMD_VALIDATE):
 			mode = basenine.VALIDATE
@@ -263,6 +430,22 @@ func handleMessage(message string, conn net.Conn) (mode basenine.ConnectionMode,
 		case strings.HasPrefix(message, basenine.CMD_LIMIT):
 			mode = basenine.LIMIT
 
+		case strings.HasPrefix(message, basenine.CMD_RETENTION):
+			mode = basenine.RETENTION
+
+		case strings.HasPrefix(message, basenine.CMD_INDEX):
+			mode = basenine.INDEX
+
+		// The path follows the command on the same line since an absolute path starts with a slash.
+		case strings.HasPrefix(message, basenine.CMD_SNAPSHOT+" "):
+			mode = basenine.SNAPSHOT
+			data = commandFlag(message, basenine.CMD_SNAPSHOT)
+
+		// The path follows the command on the same line, like the SNAPSHOT command.
+		case strings.HasPrefix(message, basenine.CMD_EXPORT+" "):
+			mode = basenine.EXPORT
+			data = commandFlag(message, basenine.CMD_EXPORT)
+
 		case message == basenine.CMD_FLUSH:
 			mode = basenine.FLUSH
 
@@ -278,3 +461,8 @@ func handleMessage(message string, conn net.Conn) (mode basenine.ConnectionMode,
 
 	return
 }
+
+// commandFlag returns the flag that follows the command in the message, if there is any.
+func commandFlag(message string, command string) []byte {
+	return []byte(strings.TrimSpace(strings.TrimPrefix(message, command)))
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -16,8 +19,70 @@ import (
 	"github.com/up9inc/basenine/server/lib/storages"
 )
 
+// newNativeTestStorage creates a native storage in a temporary data directory of the test.
+func newNativeTestStorage(t *testing.T) basenine.Storage {
+	return storages.NewNativeStorageWithOptions(false, storages.NativeStorageOptions{DataDir: t.TempDir()})
+}
+
+// newTestStorage creates the storage that the protocol scenarios run against.
+var newTestStorage = newNativeTestStorage
+
+// The protocol scenarios that are run against each storage driver.
+var protocolScenarios = []struct {
+	name string
+	test func(t *testing.T)
+}{
+	{"InsertMode", TestServerProtocolInsertMode},
+	{"InsertAckMode", TestServerProtocolInsertAckMode},
+	{"InsertBatchMode", TestServerProtocolInsertBatchMode},
+	{"InsertionFilterMode", TestServerProtocolInsertionFilterMode},
+	{"QueryMode", TestServerProtocolQueryMode},
+	{"SingleMode", TestServerProtocolSingleMode},
+	{"ValidateMode", TestServerProtocolValidateMode},
+	{"MacroMode", TestServerProtocolMacroMode},
+	{"FetchMode", TestServerProtocolFetchMode},
+	{"LimitMode", TestServerProtocolLimitMode},
+	{"RetentionMode", TestServerProtocolRetentionMode},
+	{"IndexMode", TestServerProtocolIndexMode},
+	{"ExportMode", TestServerProtocolExportMode},
+	{"FlushMode", TestServerProtocolFlushMode},
+	{"ResetMode", TestServerProtocolResetMode},
+}
+
+func TestServerProtocolMemoryStorage(t *testing.T) {
+	newTestStorage = func(t *testing.T) basenine.Storage {
+		return storages.NewMemoryStorage(false, storages.MemoryStorageOptions{})
+	}
+	defer func() {
+		newTestStorage = newNativeTestStorage
+	}()
+
+	for _, scenario := range protocolScenarios {
+		t.Run(scenario.name, scenario.test)
+	}
+}
+
+func TestServerProtocolBoltStorage(t *testing.T) {
+	newTestStorage = func(t *testing.T) basenine.Storage {
+		// Each scenario gets its own database file since the previous ones are still open.
+		storage, err := storages.NewBoltStorage(false, storages.BoltStorageOptions{
+			DataDir: t.TempDir(),
+			Sync:    "none",
+		})
+		basenine.Check(err)
+		return storage
+	}
+	defer func() {
+		newTestStorage = newNativeTestStorage
+	}()
+
+	for _, scenario := range protocolScenarios {
+		t.Run(scenario.name, scenario.test)
+	}
+}
+
 func TestServerProtocolInsertMode(t *testing.T) {
-	storage = storages.NewNativeStorage(false)
+	storage = newTestStorage(t)
 
 	server, client := net.Pipe()
 	go handleConnection(server)
@@ -41,12 +106,124 @@ func TestServerProtocolInsertMode(t *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 }
 
+func TestServerProtocolInsertAckMode(t *testing.T) {
+	storage = newTestStorage(t)
+
+	server, client := net.Pipe()
+	go handleConnection(server)
+
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(fmt.Sprintf("%s\n", basenine.CMD_INSERT_ACK)))
+
+	scanner := bufio.NewScanner(client)
+
+	client.SetDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(`{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`))
+	client.Write([]byte("\n"))
+	assert.True(t, scanner.Scan())
+	assert.JSONEq(t, fmt.Sprintf(`{"id":"%s"}`, basenine.IndexToID(0)), scanner.Text())
+
+	// Case for non-JSON payload, the connection stays open
+	client.SetDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(`hello world`))
+	client.Write([]byte("\n"))
+	assert.True(t, scanner.Scan())
+	assert.Contains(t, scanner.Text(), `"error"`)
+
+	client.SetDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(`{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`))
+	client.Write([]byte("\n"))
+	assert.True(t, scanner.Scan())
+	assert.JSONEq(t, fmt.Sprintf(`{"id":"%s"}`, basenine.IndexToID(1)), scanner.Text())
+
+	client.Close()
+	server.Close()
+
+	storage.Reset()
+}
+
+func TestServerProtocolInsertBatchMode(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+
+	storage = newTestStorage(t)
+
+	server, client := net.Pipe()
+	go handleConnection(server)
+
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(fmt.Sprintf("%s\n", basenine.CMD_INSERT_BATCH)))
+
+	acks := bufio.NewScanner(client)
+	for i := 0; i < 3; i++ {
+		client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+		client.Write([]byte("10\n"))
+		for index := 0; index < 10; index++ {
+			client.Write([]byte(payload))
+			client.Write([]byte("\n"))
+		}
+
+		// Each record of the batch is acknowledged in order.
+		client.SetReadDeadline(time.Now().Add(1 * time.Second))
+		for index := 0; index < 10; index++ {
+			assert.True(t, acks.Scan())
+			assert.JSONEq(t, fmt.Sprintf(`{"id":"%s"}`, basenine.IndexToID(i*10+index)), acks.Text())
+		}
+	}
+
+	server, client2 := net.Pipe()
+	go handleConnection(server)
+
+	client2.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client2.Write([]byte(fmt.Sprintf("%s\n", basenine.CMD_SINGLE)))
+	client2.Write([]byte(fmt.Sprintf("%d\n", 29)))
+	client2.Write([]byte("\n"))
+
+	client2.SetReadDeadline(time.Now().Add(1 * time.Second))
+	scanner := bufio.NewScanner(client2)
+	assert.True(t, scanner.Scan())
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":2021}`, basenine.IndexToID(29)), scanner.Text())
+
+	client.Close()
+	client2.Close()
+	server.Close()
+
+	storage.Reset()
+}
+
+func TestServerProtocolInsertBatchModeInvalidSize(t *testing.T) {
+	storage = newTestStorage(t)
+
+	for _, size := range []string{"0", "-1", fmt.Sprintf("%d", basenine.MAX_BATCH_SIZE+1), "1000000000000"} {
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			handleConnection(server)
+			close(done)
+		}()
+
+		client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+		client.Write([]byte(fmt.Sprintf("%s\n", basenine.CMD_INSERT_BATCH)))
+		client.Write([]byte(size + "\n"))
+
+		// The connection is closed after the error.
+		client.SetReadDeadline(time.Now().Add(1 * time.Second))
+		b, err := ioutil.ReadAll(client)
+		assert.Nil(t, err)
+		assert.Contains(t, string(b), "batch size", size)
+
+		client.Close()
+		<-done
+	}
+
+	storage.Reset()
+}
+
 func TestServerProtocolInsertionFilterMode(t *testing.T) {
 	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
 	insertionFilter := `brand.name == "Chevrolet" and redact("year")`
 	query := `brand.name == "Chevrolet"`
 
-	storage = storages.NewNativeStorage(false)
+	storage = newTestStorage(t)
 
 	server, client := net.Pipe()
 	go handleConnection(server)
@@ -135,7 +312,7 @@ func TestServerProtocolQueryMode(t *testing.T) {
 	for _, row := range testServerProtocolQueryModeData {
 		payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
 
-		storage = storages.NewNativeStorage(false)
+		storage = newTestStorage(t)
 
 		server, client := net.Pipe()
 		go handleConnection(server)
@@ -209,7 +386,7 @@ func TestServerProtocolSingleMode(t *testing.T) {
 	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
 	id := 42
 
-	storage = storages.NewNativeStorage(false)
+	storage = newTestStorage(t)
 
 	server, client := net.Pipe()
 	go handleConnection(server)
@@ -275,7 +452,7 @@ var validateModeData = []struct {
 
 func TestServerProtocolValidateMode(t *testing.T) {
 	for _, row := range validateModeData {
-		storage = storages.NewNativeStorage(false)
+		storage = newTestStorage(t)
 
 		server, client := net.Pipe()
 		go handleConnection(server)
@@ -328,7 +505,7 @@ func TestServerProtocolMacroMode(t *testing.T) {
 	macro := `chevy~brand.name == "Chevrolet"`
 	query := `chevy`
 
-	storage = storages.NewNativeStorage(false)
+	storage = newTestStorage(t)
 
 	server, client := net.Pipe()
 	go handleConnection(server)
@@ -421,7 +598,7 @@ func TestServerProtocolFetchMode(t *testing.T) {
 	for _, row := range testServerProtocolFetchModeData {
 		payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
 
-		storage = storages.NewNativeStorage(false)
+		storage = newTestStorage(t)
 
 		server, client := net.Pipe()
 		go handleConnection(server)
@@ -509,7 +686,7 @@ func TestServerProtocolLimitMode(t *testing.T) {
 	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
 	limit := int64(1000000) // 1MB
 
-	storage = storages.NewNativeStorage(false)
+	storage = newTestStorage(t)
 
 	server, client := net.Pipe()
 	go handleConnection(server)
@@ -542,26 +719,235 @@ func TestServerProtocolLimitMode(t *testing.T) {
 	storage.Reset()
 }
 
-func TestServerProtocolFlushMode(t *testing.T) {
+func TestServerProtocolRetentionMode(t *testing.T) {
+	storage = newTestStorage(t)
+
+	server, client := net.Pipe()
+	go handleConnection(server)
+
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(fmt.Sprintf("%s\n", basenine.CMD_RETENTION)))
+
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte("24h\n"))
+
+	client.SetReadDeadline(time.Now().Add(1 * time.Second))
+	scanner := bufio.NewScanner(client)
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "OK", scanner.Text())
+
+	client.Close()
+	server.Close()
+
+	storage.Reset()
+}
+
+func TestServerProtocolIndexMode(t *testing.T) {
+	storage = newTestStorage(t)
+
 	server, client := net.Pipe()
 	go handleConnection(server)
 
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(fmt.Sprintf("%s\n", basenine.CMD_INDEX)))
+
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte("brand.name\n"))
+
+	client.SetReadDeadline(time.Now().Add(1 * time.Second))
+	scanner := bufio.NewScanner(client)
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "OK", scanner.Text())
+
+	client.Close()
+	server.Close()
+
+	storage.Reset()
+}
+
+func TestServerProtocolSnapshotMode(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+	*exportDir = t.TempDir()
+	path := filepath.Join(*exportDir, "snapshot.tar")
+
+	storage = newTestStorage(t)
+
+	for index := 0; index < 100; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	server, client := net.Pipe()
+	go handleConnection(server)
+
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_SNAPSHOT, "snapshot.tar")))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(client)
+	assert.True(t, scanner.Scan())
+	assert.Equal(t, "OK", scanner.Text())
+	assert.FileExists(t, path)
+
+	client.Close()
+	server.Close()
+
+	// The files outside of the export directory cannot be overwritten. The error is reported once.
+	server, client = net.Pipe()
+	go handleConnection(server)
+
+	outside := filepath.Join(t.TempDir(), "snapshot.tar")
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_SNAPSHOT, outside)))
+
+	client.SetReadDeadline(time.Now().Add(1 * time.Second))
+	scanner = bufio.NewScanner(client)
+	assert.True(t, scanner.Scan())
+	assert.True(t, strings.HasPrefix(scanner.Text(), storages.ErrExportPathOutsideDirectory.Error()))
+	assert.False(t, scanner.Scan())
+	assert.NoFileExists(t, outside)
+
+	client.Close()
+	server.Close()
+
+	storage.Reset()
+}
+
+func TestServerProtocolExportMode(t *testing.T) {
+	payload := `{"brand":{"name":"Chevrolet"},"model":"Camaro","year":2021}`
+	*exportDir = t.TempDir()
+	path := filepath.Join(*exportDir, "export.ndjson")
+
+	storage = newTestStorage(t)
+
+	for index := 0; index < 2000; index++ {
+		storage.InsertData([]byte(payload))
+	}
+
+	server, client := net.Pipe()
+	go handleConnection(server)
+
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_EXPORT, "export.ndjson")))
+	client.Write([]byte(fmt.Sprintf("%s\n", basenine.IndexToID(500))))
+	client.Write([]byte(fmt.Sprintf("%s\n", basenine.IndexToID(1999))))
+	client.Write([]byte(`brand.name == "Chevrolet" and redact("year")` + "\n"))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(client)
+
+	// The progress is reported once in the middle and once at the end.
+	var metadata []basenine.Metadata
+	for scanner.Scan() {
+		text := scanner.Text()
+		if !strings.HasPrefix(text, basenine.CMD_METADATA) {
+			assert.Equal(t, "OK", text)
+			break
+		}
+		var m basenine.Metadata
+		err := json.Unmarshal([]byte(strings.TrimPrefix(text, basenine.CMD_METADATA+" ")), &m)
+		assert.Nil(t, err)
+		metadata = append(metadata, m)
+	}
+	assert.Len(t, metadata, 2)
+	assert.Equal(t, uint64(1000), metadata[0].Current)
+	assert.False(t, metadata[0].NoMoreData)
+	assert.Equal(t, basenine.Metadata{
+		Current:         1500,
+		Total:           1500,
+		NumberOfWritten: 1500,
+		LeftOff:         basenine.IndexToID(2000),
+		NoMoreData:      true,
+	}, metadata[1])
+
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	assert.Len(t, lines, 1500)
+	assert.JSONEq(t, fmt.Sprintf(`{"brand":{"name":"Chevrolet"},"id":"%s","model":"Camaro","year":"[REDACTED]"}`, basenine.IndexToID(500)), lines[0])
+
+	client.Close()
+	server.Close()
+
+	// The error of a failed export is reported once.
+	server, client = net.Pipe()
+	go handleConnection(server)
+
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_EXPORT, path)))
+	client.Write([]byte("\n"))
+	client.Write([]byte("\n"))
+	client.Write([]byte("=.=\n"))
+
+	client.SetReadDeadline(time.Now().Add(1 * time.Second))
+	scanner = bufio.NewScanner(client)
+	assert.True(t, scanner.Scan())
+	assert.True(t, strings.HasPrefix(scanner.Text(), "While parsing the query:"))
+	assert.False(t, scanner.Scan())
+
+	client.Close()
+	server.Close()
+
+	// The files outside of the export directory cannot be overwritten.
+	server, client = net.Pipe()
+	go handleConnection(server)
+
+	outside := filepath.Join(t.TempDir(), "export.ndjson")
+	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
+	client.Write([]byte(fmt.Sprintf("%s %s\n", basenine.CMD_EXPORT, outside)))
+	client.Write([]byte("\n"))
+	client.Write([]byte("\n"))
+	client.Write([]byte("\n"))
+
+	client.SetReadDeadline(time.Now().Add(1 * time.Second))
+	scanner = bufio.NewScanner(client)
+	assert.True(t, scanner.Scan())
+	assert.True(t, strings.HasPrefix(scanner.Text(), storages.ErrExportPathOutsideDirectory.Error()))
+	assert.NoFileExists(t, outside)
+
+	client.Close()
+	server.Close()
+
+	storage.Reset()
+}
+
+func TestServerProtocolFlushMode(t *testing.T) {
+	storage = newTestStorage(t)
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server)
+		close(done)
+	}()
+
 	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
 	client.Write([]byte(fmt.Sprintf("%s\n", basenine.CMD_FLUSH)))
 
 	client.Close()
 	server.Close()
+
+	// The next test replaces the storage, so the command must be handled by then.
+	<-done
 }
 
 func TestServerProtocolResetMode(t *testing.T) {
+	storage = newTestStorage(t)
+
 	server, client := net.Pipe()
-	go handleConnection(server)
+	done := make(chan struct{})
+	go func() {
+		handleConnection(server)
+		close(done)
+	}()
 
 	client.SetWriteDeadline(time.Now().Add(1 * time.Second))
 	client.Write([]byte(fmt.Sprintf("%s\n", basenine.CMD_RESET)))
 
 	client.Close()
 	server.Close()
+
+	// The next test replaces the storage, so the command must be handled by then.
+	<-done
 }
 
 // handleCommands is used by readConnection to make the server's orders